@@ -0,0 +1,64 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"golang.zx2c4.com/wireguard/config"
+)
+
+/* Validates the configuration file named in args, decrypting it if
+ * necessary, without creating a device, printing one problem per line, or as JSON with --json.
+ * Returns the exit code: 0 if there are no errors, 1 otherwise.
+ */
+func checkConfig(args []string) int {
+	asJSON := false
+	if len(args) == 2 && args[0] == "--json" {
+		asJSON = true
+		args = args[1:]
+	}
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "usage: %s check [--json] CONFIG-FILE\n", os.Args[0])
+		return ExitSetupFailed
+	}
+	path := args[0]
+
+	data, err := readConfigFile(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitSetupFailed
+	}
+
+	problems, err := config.Check(bytes.NewReader(data))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+		return ExitSetupFailed
+	}
+
+	if asJSON {
+		if problems == nil {
+			problems = []config.Problem{}
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(problems)
+	} else {
+		for _, problem := range problems {
+			fmt.Printf("%s:%s\n", path, problem)
+		}
+	}
+
+	for _, problem := range problems {
+		if problem.Severity == config.SeverityError {
+			return ExitSetupFailed
+		}
+	}
+	return ExitSetupSuccess
+}
@@ -0,0 +1,357 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+/* Package config validates configuration files in the format of
+ * `wg setconf`, as extended by wg-quick, without creating a device,
+ * so that changes to configurations can be checked before they are
+ * deployed.
+ *
+ * Every problem found is reported with its line, section and key,
+ * rather than stopping at the first, so that all of them can be fixed
+ * in one round.
+ */
+package config
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.zx2c4.com/wireguard/device"
+)
+
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+)
+
+type Problem struct {
+	Line     int      `json:"line"`
+	Section  string   `json:"section,omitempty"`
+	Key      string   `json:"key,omitempty"`
+	Severity Severity `json:"severity"`
+	Message  string   `json:"message"`
+}
+
+func (problem Problem) String() string {
+	location := strconv.Itoa(problem.Line)
+	if problem.Key != "" {
+		location += ": " + problem.Section + "." + problem.Key
+	} else if problem.Section != "" {
+		location += ": " + problem.Section
+	}
+	return fmt.Sprintf("%s: %s: %s", location, problem.Severity, problem.Message)
+}
+
+const (
+	MinMTU     = 576  // of IPv4
+	MinMTUIPv6 = 1280 // of IPv6
+)
+
+type allowedIP struct {
+	network net.IPNet
+	peer    int
+	line    int
+}
+
+type checker struct {
+	problems   []Problem
+	section    string
+	line       int
+	peer       int // index of the current peer section
+	peerLine   int // of the current peer section header
+	peerKey    bool
+	privateKey []byte
+	publicKeys map[string]int // line of each peer public key
+	allowedIPs []allowedIP
+	mtu        int
+	mtuLine    int
+	ipv6       bool
+}
+
+func (c *checker) report(severity Severity, key, format string, args ...interface{}) {
+	c.problems = append(c.problems, Problem{
+		Line:     c.line,
+		Section:  c.section,
+		Key:      key,
+		Severity: severity,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+/* Checks the configuration read from reader and returns the problems
+ * found, ordered by line, or an error if reading failed
+ */
+func Check(reader io.Reader) ([]Problem, error) {
+	c := &checker{publicKeys: make(map[string]int)}
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		c.line++
+		line := scanner.Text()
+		if comment := strings.IndexByte(line, '#'); comment >= 0 {
+			line = line[:comment]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			c.beginSection(strings.TrimSpace(line[1 : len(line)-1]))
+			continue
+		}
+
+		equals := strings.IndexByte(line, '=')
+		if equals < 0 {
+			c.report(SeverityError, "", "expected key = value: %q", line)
+			continue
+		}
+		key := strings.TrimSpace(line[:equals])
+		value := strings.TrimSpace(line[equals+1:])
+
+		switch c.section {
+		case "Interface":
+			c.checkInterface(key, value)
+		case "Peer":
+			c.checkPeer(key, value)
+		default:
+			c.report(SeverityError, key, "key outside of a section")
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	c.endPeer()
+	c.finish()
+	sort.SliceStable(c.problems, func(i, j int) bool {
+		return c.problems[i].Line < c.problems[j].Line
+	})
+	return c.problems, nil
+}
+
+func (c *checker) beginSection(name string) {
+	c.endPeer()
+	switch strings.ToLower(name) {
+	case "interface":
+		c.section = "Interface"
+	case "peer":
+		c.section = "Peer"
+		c.peer++
+		c.peerLine = c.line
+		c.peerKey = false
+	default:
+		c.section = name
+		c.report(SeverityError, "", "unknown section")
+	}
+}
+
+func (c *checker) endPeer() {
+	if c.section == "Peer" && !c.peerKey {
+		line := c.line
+		c.line = c.peerLine
+		c.report(SeverityError, "", "peer without PublicKey")
+		c.line = line
+	}
+}
+
+func (c *checker) checkInterface(key, value string) {
+	switch strings.ToLower(key) {
+	case "privatekey":
+		c.privateKey = c.checkKey(key, value)
+	case "listenport":
+		if _, err := strconv.ParseUint(value, 10, 16); err != nil {
+			c.report(SeverityError, key, "invalid port %q", value)
+		}
+	case "fwmark":
+		if value != "off" {
+			if _, err := strconv.ParseUint(value, 0, 32); err != nil {
+				c.report(SeverityError, key, "invalid mark %q", value)
+			}
+		}
+	case "mtu":
+		mtu, err := strconv.Atoi(value)
+		if err != nil {
+			c.report(SeverityError, key, "invalid MTU %q", value)
+			break
+		}
+		if mtu < MinMTU || mtu > device.MaxContentSize {
+			c.report(SeverityError, key, "MTU %d outside of %d to %d", mtu, MinMTU, device.MaxContentSize)
+			break
+		}
+		c.mtu, c.mtuLine = mtu, c.line
+	case "address":
+		for _, address := range splitList(value) {
+			ip, _, err := net.ParseCIDR(address)
+			if err != nil {
+				ip = net.ParseIP(address)
+			}
+			if ip == nil {
+				c.report(SeverityError, key, "invalid address %q", address)
+				continue
+			}
+			if ip.To4() == nil {
+				c.ipv6 = true
+			}
+		}
+	case "dns":
+		for _, server := range splitList(value) {
+			if net.ParseIP(server) == nil && !validHostname(server) {
+				c.report(SeverityError, key, "invalid DNS server or search domain %q", server)
+			}
+		}
+	case "table":
+		if value != "off" && value != "auto" {
+			if _, err := strconv.ParseUint(value, 10, 32); err != nil {
+				c.report(SeverityError, key, "invalid table %q", value)
+			}
+		}
+	case "saveconfig":
+		if value != "true" && value != "false" {
+			c.report(SeverityError, key, "expected true or false")
+		}
+	case "preup", "postup", "predown", "postdown":
+	default:
+		c.report(SeverityError, key, "unknown key")
+	}
+}
+
+func (c *checker) checkPeer(key, value string) {
+	switch strings.ToLower(key) {
+	case "publickey":
+		if c.peerKey {
+			c.report(SeverityError, key, "duplicate PublicKey in peer")
+		}
+		c.peerKey = true
+		if k := c.checkKey(key, value); k != nil {
+			if line, ok := c.publicKeys[string(k)]; ok {
+				c.report(SeverityError, key, "peer already configured on line %d", line)
+			}
+			c.publicKeys[string(k)] = c.line
+		}
+	case "presharedkey":
+		c.checkKey(key, value)
+	case "endpoint":
+		host, port, err := net.SplitHostPort(value)
+		if err != nil {
+			c.report(SeverityError, key, "invalid endpoint %q: %v", value, err)
+			break
+		}
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			c.report(SeverityError, key, "invalid port %q", port)
+		}
+		if net.ParseIP(host) == nil && !validHostname(host) {
+			c.report(SeverityError, key, "invalid host %q", host)
+		}
+	case "allowedips":
+		for _, prefix := range splitList(value) {
+			ip, network, err := net.ParseCIDR(prefix)
+			if err != nil {
+				c.report(SeverityError, key, "invalid prefix %q", prefix)
+				continue
+			}
+			if !ip.Equal(network.IP) {
+				c.report(SeverityWarning, key, "%s has host bits set, taken as %s", prefix, network)
+			}
+			if ip.To4() == nil {
+				c.ipv6 = true
+			}
+			c.checkOverlap(key, *network)
+		}
+	case "persistentkeepalive":
+		if value != "off" {
+			if _, err := strconv.ParseUint(value, 10, 16); err != nil {
+				c.report(SeverityError, key, "invalid interval %q", value)
+			}
+		}
+	default:
+		c.report(SeverityError, key, "unknown key")
+	}
+}
+
+func (c *checker) checkKey(key, value string) []byte {
+	k, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(k) != device.NoisePublicKeySize {
+		c.report(SeverityError, key, "invalid key, expected %d bytes in base64", device.NoisePublicKeySize)
+		return nil
+	}
+	return k
+}
+
+/* Reports prefixes routed to more than one peer: identical ones as
+ * errors, as only the last peer gets them, nested ones as warnings
+ */
+func (c *checker) checkOverlap(key string, network net.IPNet) {
+	ones, bits := network.Mask.Size()
+	for _, other := range c.allowedIPs {
+		otherOnes, otherBits := other.network.Mask.Size()
+		if bits != otherBits || other.peer == c.peer {
+			continue
+		}
+		switch {
+		case ones == otherOnes && network.IP.Equal(other.network.IP):
+			c.report(SeverityError, key, "%s already allowed for the peer on line %d", &network, other.line)
+		case ones > otherOnes && other.network.Contains(network.IP):
+			c.report(SeverityWarning, key, "%s lies within %s of the peer on line %d", &network, &other.network, other.line)
+		case ones < otherOnes && network.Contains(other.network.IP):
+			c.report(SeverityWarning, key, "%s contains %s of the peer on line %d", &network, &other.network, other.line)
+		}
+	}
+	c.allowedIPs = append(c.allowedIPs, allowedIP{network: network, peer: c.peer, line: c.line})
+}
+
+func (c *checker) finish() {
+	c.section = "Interface"
+	if c.privateKey != nil {
+		var private, public [32]byte
+		copy(private[:], c.privateKey)
+		curve25519.ScalarBaseMult(&public, &private)
+		if line, ok := c.publicKeys[string(public[:])]; ok {
+			c.line = line
+			c.section = "Peer"
+			c.report(SeverityError, "PublicKey", "peer is the interface itself")
+		}
+	}
+	if c.mtu != 0 && c.ipv6 && c.mtu < MinMTUIPv6 {
+		c.line = c.mtuLine
+		c.section = "Interface"
+		c.report(SeverityError, "MTU", "MTU %d below the IPv6 minimum of %d", c.mtu, MinMTUIPv6)
+	}
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func validHostname(host string) bool {
+	if host == "" || len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
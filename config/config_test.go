@@ -0,0 +1,93 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+const (
+	testPrivateKey = "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=" // public key HIgo9xNzJMWLKASShiTqIybxZ0U3wGLiUeJ1PKf8ykw=
+	testPeerKey    = "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg="
+	testOtherKey   = "TrMvSoP4jYQlY6RIzBgbssQqY3vxI2Pi+y71lOWWXX0="
+)
+
+func TestCheckValid(t *testing.T) {
+	problems, err := Check(strings.NewReader(`
+[Interface]
+PrivateKey = ` + testPrivateKey + `
+ListenPort = 51820
+Address = 10.0.0.1/24, fd00::1/64
+MTU = 1420 # comment
+
+[Peer]
+PublicKey = ` + testPeerKey + `
+Endpoint = vpn.example.com:51820
+AllowedIPs = 10.0.0.2/32, 10.1.0.0/16
+
+[Peer]
+PublicKey = ` + testOtherKey + `
+Endpoint = [2001:db8::1]:51820
+AllowedIPs = 10.0.0.3/32
+PersistentKeepalive = 25
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("unexpected problems %v", problems)
+	}
+}
+
+func TestCheckProblems(t *testing.T) {
+	problems, err := Check(strings.NewReader(`[Interface]
+PrivateKey = ` + testPrivateKey + `
+ListenPort = 70000
+MTU = 1200
+Address = fd00::1/64
+Bogus = 1
+
+[Peer]
+PublicKey = ` + testPeerKey + `
+AllowedIPs = 10.0.0.0/24, 10.0.1.1/24
+
+[Peer]
+PublicKey = ` + testPeerKey + `
+Endpoint = 192.0.2.1
+AllowedIPs = 10.0.0.0/24, 10.0.0.5/32
+
+[Peer]
+PublicKey = HIgo9xNzJMWLKASShiTqIybxZ0U3wGLiUeJ1PKf8ykw=
+
+[Peer]
+AllowedIPs = 10.9.0.0/16
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"3: Interface.ListenPort: error: invalid port",
+		"4: Interface.MTU: error: MTU 1200 below the IPv6 minimum",
+		"6: Interface.Bogus: error: unknown key",
+		"10: Peer.AllowedIPs: warning: 10.0.1.1/24 has host bits set",
+		"13: Peer.PublicKey: error: peer already configured on line 9",
+		"14: Peer.Endpoint: error: invalid endpoint",
+		"15: Peer.AllowedIPs: error: 10.0.0.0/24 already allowed for the peer on line 10",
+		"15: Peer.AllowedIPs: warning: 10.0.0.5/32 lies within 10.0.0.0/24",
+		"18: Peer.PublicKey: error: peer is the interface itself",
+		"20: Peer: error: peer without PublicKey",
+	}
+	if len(problems) != len(expected) {
+		t.Fatalf("expected %d problems, got %v", len(expected), problems)
+	}
+	for i, problem := range problems {
+		if !strings.HasPrefix(problem.String(), expected[i]) {
+			t.Errorf("expected %q, got %q", expected[i], problem)
+		}
+	}
+}
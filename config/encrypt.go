@@ -0,0 +1,130 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package config
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+/* Encrypted configuration files
+ *
+ * So that private keys need not be stored in plaintext, a configuration
+ * file may be encrypted with a passphrase. The key is derived with
+ * scrypt and the file sealed with ChaCha20Poly1305, then armored:
+ *
+ *   -----BEGIN WIREGUARD ENCRYPTED CONFIG-----
+ *   <base64 of version, log2 of scrypt N, salt, nonce and ciphertext>
+ *   -----END WIREGUARD ENCRYPTED CONFIG-----
+ *
+ * The passphrase may itself be kept encrypted with age or a KMS key
+ * and fetched by a command at startup.
+ */
+
+const (
+	encryptedHeader  = "-----BEGIN WIREGUARD ENCRYPTED CONFIG-----"
+	encryptedFooter  = "-----END WIREGUARD ENCRYPTED CONFIG-----"
+	encryptedVersion = 1
+	encryptedLogN    = 15 // scrypt cost of new files
+	encryptedMaxLogN = 20
+	encryptedSalt    = 16
+	encryptedPrefix  = 2 + encryptedSalt + chacha20poly1305.NonceSize
+	armorLineLength  = 64
+)
+
+var ErrDecrypt = errors.New("wrong passphrase or corrupted file")
+
+/* Reports whether data is an encrypted configuration file
+ */
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte(encryptedHeader))
+}
+
+func encryptionKey(passphrase, salt []byte, logN uint) ([]byte, error) {
+	return scrypt.Key(passphrase, salt, 1<<logN, 8, 1, chacha20poly1305.KeySize)
+}
+
+/* Encrypts the configuration with the passphrase and returns the
+ * armored file
+ */
+func Encrypt(plaintext, passphrase []byte) ([]byte, error) {
+	prefix := make([]byte, encryptedPrefix)
+	prefix[0] = encryptedVersion
+	prefix[1] = encryptedLogN
+	if _, err := rand.Read(prefix[2:]); err != nil {
+		return nil, err
+	}
+	salt := prefix[2 : 2+encryptedSalt]
+	nonce := prefix[2+encryptedSalt:]
+
+	key, err := encryptionKey(passphrase, salt, encryptedLogN)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	sealed := aead.Seal(prefix, nonce, plaintext, prefix)
+
+	encoded := base64.StdEncoding.EncodeToString(sealed)
+	var out bytes.Buffer
+	out.WriteString(encryptedHeader + "\n")
+	for len(encoded) > armorLineLength {
+		out.WriteString(encoded[:armorLineLength] + "\n")
+		encoded = encoded[armorLineLength:]
+	}
+	out.WriteString(encoded + "\n")
+	out.WriteString(encryptedFooter + "\n")
+	return out.Bytes(), nil
+}
+
+/* Decrypts an armored file produced by Encrypt
+ */
+func Decrypt(data, passphrase []byte) ([]byte, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) < len(encryptedHeader)+len(encryptedFooter) || !bytes.HasPrefix(data, []byte(encryptedHeader)) || !bytes.HasSuffix(data, []byte(encryptedFooter)) {
+		return nil, errors.New("not an encrypted configuration file")
+	}
+	body := data[len(encryptedHeader) : len(data)-len(encryptedFooter)]
+	sealed, err := base64.StdEncoding.DecodeString(string(bytes.Join(bytes.Fields(body), nil)))
+	if err != nil {
+		return nil, errors.New("invalid encrypted configuration file: " + err.Error())
+	}
+	if len(sealed) < encryptedPrefix+poly1305.TagSize {
+		return nil, errors.New("encrypted configuration file truncated")
+	}
+	if sealed[0] != encryptedVersion {
+		return nil, errors.New("unsupported encrypted configuration version")
+	}
+	logN := uint(sealed[1])
+	if logN < 1 || logN > encryptedMaxLogN {
+		return nil, errors.New("invalid scrypt cost in encrypted configuration file")
+	}
+	prefix := sealed[:encryptedPrefix]
+	salt := prefix[2 : 2+encryptedSalt]
+	nonce := prefix[2+encryptedSalt:]
+
+	key, err := encryptionKey(passphrase, salt, logN)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, nonce, sealed[encryptedPrefix:], prefix)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plaintext, nil
+}
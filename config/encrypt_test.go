@@ -0,0 +1,79 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package config
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestEncryptRoundTrip(t *testing.T) {
+	plaintext := []byte("[Interface]\nPrivateKey = " + testPrivateKey + "\n")
+	passphrase := []byte("correct horse battery staple")
+
+	encrypted, err := Encrypt(plaintext, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncrypted(encrypted) || IsEncrypted(plaintext) {
+		t.Fatal("encrypted file not recognized")
+	}
+	if bytes.Contains(encrypted, []byte(testPrivateKey)) {
+		t.Fatal("private key left in plaintext")
+	}
+
+	decrypted, err := Decrypt(encrypted, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Fatalf("decrypted %q", decrypted)
+	}
+
+	if _, err := Decrypt(encrypted, []byte("wrong")); err != ErrDecrypt {
+		t.Fatalf("wrong passphrase gave %v", err)
+	}
+	tampered := bytes.Replace(encrypted, []byte("\n"), []byte("\nAAAA"), 2)
+	if _, err := Decrypt(tampered, passphrase); err == nil {
+		t.Fatal("tampered file decrypted")
+	}
+}
+
+func TestToUAPI(t *testing.T) {
+	set, err := ToUAPI(strings.NewReader(`
+[Interface]
+PrivateKey = ` + testPrivateKey + `
+ListenPort = 51820
+Address = 10.0.0.1/24
+
+[Peer]
+PublicKey = ` + testPeerKey + `
+Endpoint = [2001:db8::1]:51820
+AllowedIPs = 10.0.0.2/32, 10.1.0.0/16
+PersistentKeepalive = off
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `replace_peers=true
+private_key=c809f3e5317e9575c9b5ed78b638b7ce530dabe85ddab614220241801ddf0669
+listen_port=51820
+public_key=c53201039adba14be71f886da1d8dbe9eebded08cb111b75340078999aa9f038
+replace_allowed_ips=true
+endpoint=[2001:db8::1]:51820
+allowed_ip=10.0.0.2/32
+allowed_ip=10.1.0.0/16
+persistent_keepalive_interval=0
+`
+	if set != expected {
+		t.Fatalf("unexpected UAPI:\n%s", set)
+	}
+
+	if _, err := ToUAPI(strings.NewReader("[Peer]\nPublicKey = nope\n")); err == nil {
+		t.Fatal("invalid key translated")
+	}
+}
@@ -0,0 +1,119 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package config
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+/* Translates a configuration file into UAPI set operations replacing
+ * the whole configuration of a device, as `wg setconf` does. Endpoints
+ * are resolved, and keys only used by wg-quick are ignored. The file
+ * should have been checked first; remaining errors stop translation.
+ */
+func ToUAPI(reader io.Reader) (string, error) {
+	var out strings.Builder
+	out.WriteString("replace_peers=true\n")
+
+	section := ""
+	lineNumber := 0
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+		if comment := strings.IndexByte(line, '#'); comment >= 0 {
+			line = line[:comment]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			continue
+		}
+
+		equals := strings.IndexByte(line, '=')
+		if equals < 0 {
+			return "", fmt.Errorf("line %d: expected key = value", lineNumber)
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:equals]))
+		value := strings.TrimSpace(line[equals+1:])
+
+		lines, err := uapiLines(section, key, value)
+		if err != nil {
+			return "", fmt.Errorf("line %d: %v", lineNumber, err)
+		}
+		for _, line := range lines {
+			out.WriteString(line + "\n")
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+func uapiLines(section, key, value string) ([]string, error) {
+	switch section + "." + key {
+	case "interface.privatekey":
+		k, err := hexKey(value)
+		return []string{"private_key=" + k}, err
+	case "interface.listenport":
+		return []string{"listen_port=" + value}, nil
+	case "interface.fwmark":
+		if value == "off" {
+			value = "0"
+		}
+		return []string{"fwmark=" + value}, nil
+	case "peer.publickey":
+		k, err := hexKey(value)
+		return []string{"public_key=" + k, "replace_allowed_ips=true"}, err
+	case "peer.presharedkey":
+		k, err := hexKey(value)
+		return []string{"preshared_key=" + k}, err
+	case "peer.endpoint":
+		addr, err := net.ResolveUDPAddr("udp", value)
+		if err != nil {
+			return nil, err
+		}
+		return []string{"endpoint=" + addr.String()}, nil
+	case "peer.allowedips":
+		var lines []string
+		for _, prefix := range splitList(value) {
+			lines = append(lines, "allowed_ip="+prefix)
+		}
+		return lines, nil
+	case "peer.persistentkeepalive":
+		if value == "off" {
+			value = "0"
+		}
+		return []string{"persistent_keepalive_interval=" + value}, nil
+	case "interface.mtu", "interface.address", "interface.dns", "interface.table",
+		"interface.saveconfig", "interface.preup", "interface.postup",
+		"interface.predown", "interface.postdown":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown key %q in section %q", key, section)
+}
+
+func hexKey(value string) (string, error) {
+	k, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(k) != device.NoisePublicKeySize {
+		return "", errors.New("invalid key")
+	}
+	return hex.EncodeToString(k), nil
+}
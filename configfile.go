@@ -0,0 +1,167 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/config"
+	"golang.zx2c4.com/wireguard/device"
+)
+
+/* Configuration files
+ *
+ * The device may be configured at startup from the file named by
+ * WG_CONFIG_FILE, in the format of `wg setconf`. The file may be
+ * encrypted with `wireguard-go encrypt`, in which case the passphrase
+ * is read from the output of WG_CONFIG_KEY_COMMAND, run without a
+ * shell, or else prompted for on the terminal. The command can thus
+ * decrypt a passphrase kept with age, or fetch it from a KMS.
+ */
+
+const (
+	ENV_WG_CONFIG_FILE        = "WG_CONFIG_FILE"
+	ENV_WG_CONFIG_KEY_COMMAND = "WG_CONFIG_KEY_COMMAND"
+)
+
+/* Obtains the passphrase of the file at path, asking twice if confirm
+ */
+func configPassphrase(path string, confirm bool) ([]byte, error) {
+	if command := strings.Fields(os.Getenv(ENV_WG_CONFIG_KEY_COMMAND)); len(command) > 0 {
+		cmd := exec.Command(command[0], command[1:]...)
+		cmd.Stderr = os.Stderr
+		output, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("key command failed: %v", err)
+		}
+		passphrase := bytes.TrimRight(output, "\r\n")
+		if len(passphrase) == 0 {
+			return nil, errors.New("key command returned an empty passphrase")
+		}
+		return passphrase, nil
+	}
+
+	if !stdinIsTerminal() {
+		return nil, fmt.Errorf("no terminal to ask for the passphrase and %s unset", ENV_WG_CONFIG_KEY_COMMAND)
+	}
+	fmt.Fprintf(os.Stderr, "Passphrase for %s: ", path)
+	passphrase, err := readPassphrase()
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	if confirm {
+		fmt.Fprintf(os.Stderr, "Repeat passphrase: ")
+		repeated, err := readPassphrase()
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(passphrase, repeated) {
+			return nil, errors.New("passphrases do not match")
+		}
+	}
+	return passphrase, nil
+}
+
+/* Reads the configuration file at path, decrypting it if necessary
+ */
+func readConfigFile(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil || !config.IsEncrypted(data) {
+		return data, err
+	}
+	passphrase, err := configPassphrase(path, false)
+	if err != nil {
+		return nil, err
+	}
+	data, err = config.Decrypt(data, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return data, nil
+}
+
+/* Reads the configuration file named by WG_CONFIG_FILE and returns it
+ * as UAPI set operations, or nothing if that variable is unset
+ */
+func loadConfig() (string, error) {
+	path := os.Getenv(ENV_WG_CONFIG_FILE)
+	if path == "" {
+		return "", nil
+	}
+	data, err := readConfigFile(path)
+	if err != nil {
+		return "", err
+	}
+	problems, err := config.Check(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", path, err)
+	}
+	for _, problem := range problems {
+		if problem.Severity == config.SeverityError {
+			return "", fmt.Errorf("%s:%s", path, problem)
+		}
+	}
+	set, err := config.ToUAPI(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", path, err)
+	}
+	return set, nil
+}
+
+func applyConfig(dev *device.Device, set string) error {
+	if set == "" {
+		return nil
+	}
+	if err := dev.IpcSetOperation(bufio.NewReader(strings.NewReader(set))); err != nil {
+		return err
+	}
+	return nil
+}
+
+/* Encrypts the configuration file named in args, writing the result to
+ * standard output. Returns the exit code.
+ */
+func encryptConfig(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "usage: %s encrypt CONFIG-FILE\n", os.Args[0])
+		return ExitSetupFailed
+	}
+	path := args[0]
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitSetupFailed
+	}
+	if config.IsEncrypted(data) {
+		fmt.Fprintf(os.Stderr, "%s: already encrypted\n", path)
+		return ExitSetupFailed
+	}
+	passphrase, err := configPassphrase(path, true)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitSetupFailed
+	}
+	encrypted, err := config.Encrypt(data, passphrase)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitSetupFailed
+	}
+	os.Stdout.Write(encrypted)
+	return ExitSetupSuccess
+}
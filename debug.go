@@ -0,0 +1,87 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+const ENV_WG_DEBUG_LISTEN = "WG_DEBUG_LISTEN"
+
+/* Listens on the address given by WG_DEBUG_LISTEN, which is either
+ * a loopback "host:port" or "unix:/path/to/socket". Refusing other
+ * addresses keeps profiles from accidentally being served publicly.
+ */
+func debugListen(address string) (net.Listener, error) {
+	if strings.HasPrefix(address, "unix:") {
+		path := strings.TrimPrefix(address, "unix:")
+
+		// only replace a stale socket, never another file
+
+		info, err := os.Lstat(path)
+		if err == nil {
+			if info.Mode()&os.ModeSocket == 0 {
+				return nil, errors.New("debug listener path exists and is not a unix socket")
+			}
+			os.Remove(path)
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+		return net.Listen("unix", path)
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if host != "localhost" {
+		ip := net.ParseIP(host)
+		if ip == nil || !ip.IsLoopback() {
+			return nil, errors.New("debug listener must be on a loopback address or unix socket")
+		}
+	}
+	return net.Listen("tcp", address)
+}
+
+/* Serves net/http/pprof if requested by the environment,
+ * returning the listener so that it may be closed on shutdown.
+ */
+func startDebugListener(logger *device.Logger) net.Listener {
+	address := os.Getenv(ENV_WG_DEBUG_LISTEN)
+	if address == "" {
+		return nil
+	}
+
+	listener, err := debugListen(address)
+	if err != nil {
+		logger.Error.Println("Failed to start debug listener:", err)
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	go func() {
+		err := http.Serve(listener, mux)
+		if err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
+			logger.Error.Println("Debug listener stopped:", err)
+		}
+	}()
+
+	logger.Info.Println("Serving pprof on", listener.Addr())
+	return listener
+}
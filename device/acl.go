@@ -0,0 +1,62 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+)
+
+/* Source address ACL of the responder
+ *
+ * When any subnets are configured, handshake initiations from other
+ * source addresses are discarded as they arrive, before MACs are
+ * verified or any other cryptography is done. Initiations received
+ * through the relay carry no source address and are not restricted.
+ */
+
+func (device *Device) loadHandshakeSources() []net.IPNet {
+	sources, _ := device.acl.sources.Load().([]net.IPNet)
+	return sources
+}
+
+/* Returns the subnets which may initiate handshakes, empty if unrestricted
+ */
+func (device *Device) HandshakeSources() []net.IPNet {
+	return device.loadHandshakeSources()
+}
+
+/* Restricts the sources of handshake initiations to the subnets,
+ * or removes the restriction if there are none
+ */
+func (device *Device) SetHandshakeSources(sources []net.IPNet) {
+	device.acl.Lock()
+	defer device.acl.Unlock()
+	device.acl.sources.Store(append([]net.IPNet(nil), sources...))
+}
+
+func (device *Device) AddHandshakeSource(source net.IPNet) {
+	device.acl.Lock()
+	defer device.acl.Unlock()
+	sources := append([]net.IPNet(nil), device.loadHandshakeSources()...)
+	device.acl.sources.Store(append(sources, source))
+}
+
+func (device *Device) allowHandshakeSource(endpoint Endpoint) bool {
+	sources := device.loadHandshakeSources()
+	if len(sources) == 0 {
+		return true
+	}
+	ip := endpoint.DstIP()
+	if ip == nil {
+		return true
+	}
+	for _, source := range sources {
+		if source.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+)
+
+func TestHandshakeSources(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	allowed := func(address string) bool {
+		endpoint, err := CreateEndpoint(address)
+		assertNil(t, err)
+		return device.allowHandshakeSource(endpoint)
+	}
+
+	if !allowed("198.51.100.1:51820") {
+		t.Fatal("initiation refused without handshake sources")
+	}
+
+	if err := ipcSet(device, "handshake_source=192.0.2.0/24\nhandshake_source=2001:db8::/32\n"); err != nil {
+		t.Fatal(err)
+	}
+	for address, expected := range map[string]bool{
+		"192.0.2.7:51820":      true,
+		"[2001:db8::1]:51820":  true,
+		"198.51.100.1:51820":   false,
+		"[2001:db9::1]:51820":  false,
+		"[::ffff:192.0.2.7]:1": true,
+	} {
+		if allowed(address) != expected {
+			t.Errorf("initiation from %s allowed: %v, expected %v", address, !expected, expected)
+		}
+	}
+	if len(device.HandshakeSources()) != 2 {
+		t.Fatalf("unexpected handshake sources %v", device.HandshakeSources())
+	}
+
+	if err := ipcSet(device, "replace_handshake_sources=true\n"); err != nil {
+		t.Fatal(err)
+	}
+	if !allowed("198.51.100.1:51820") {
+		t.Fatal("initiation refused after removing handshake sources")
+	}
+}
@@ -0,0 +1,20 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"unsafe"
+)
+
+// 64-bit atomics require 64-bit alignment on 32-bit platforms,
+// run with GOARCH=386 to check
+func TestPeerAlignment(t *testing.T) {
+	var peer Peer
+	if offset := unsafe.Offsetof(peer.stats); offset%8 != 0 {
+		t.Fatalf("peer stats at offset %d, not 64-bit aligned", offset)
+	}
+}
@@ -97,10 +97,18 @@ func (node *trieEntry) choose(ip net.IP) byte {
 }
 
 func (node *trieEntry) insert(ip net.IP, cidr uint, peer *Peer) *trieEntry {
+	var created int
+	return node.insertCounting(ip, cidr, peer, &created)
+}
+
+/* Inserts like insert, adding the number of nodes allocated to created
+ */
+func (node *trieEntry) insertCounting(ip net.IP, cidr uint, peer *Peer, created *int) *trieEntry {
 
 	// at leaf
 
 	if node == nil {
+		*created++
 		return &trieEntry{
 			bits:         ip,
 			peer:         peer,
@@ -119,12 +127,13 @@ func (node *trieEntry) insert(ip net.IP, cidr uint, peer *Peer) *trieEntry {
 			return node
 		}
 		bit := node.choose(ip)
-		node.child[bit] = node.child[bit].insert(ip, cidr, peer)
+		node.child[bit] = node.child[bit].insertCounting(ip, cidr, peer, created)
 		return node
 	}
 
 	// split node
 
+	*created++
 	newNode := &trieEntry{
 		bits:         ip,
 		peer:         peer,
@@ -145,6 +154,7 @@ func (node *trieEntry) insert(ip net.IP, cidr uint, peer *Peer) *trieEntry {
 
 	// create new parent for node & newNode
 
+	*created++
 	parent := &trieEntry{
 		bits:         ip,
 		peer:         nil,
@@ -176,6 +186,57 @@ func (node *trieEntry) lookup(ip net.IP) *Peer {
 	return found
 }
 
+func (node *trieEntry) lookupExact(ip net.IP, cidr uint) *Peer {
+	for node != nil && node.cidr <= cidr && commonBits(node.bits, ip) >= node.cidr {
+		if node.cidr == cidr {
+			return node.peer
+		}
+		node = node.child[node.choose(ip)]
+	}
+	return nil
+}
+
+/* Adds the peers of all entries within the prefix to peers
+ */
+func (node *trieEntry) peersWithin(ip net.IP, cidr uint, peers map[*Peer]bool) {
+	for node != nil {
+		common := commonBits(node.bits, ip)
+		if node.cidr >= cidr && common >= cidr {
+			node.addPeers(peers)
+			return
+		}
+		if node.cidr >= cidr || common < node.cidr {
+			return
+		}
+		node = node.child[node.choose(ip)]
+	}
+}
+
+/* Adds the peers of all entries containing the prefix to peers
+ */
+func (node *trieEntry) peersContaining(ip net.IP, cidr uint, peers map[*Peer]bool) {
+	for node != nil && node.cidr <= cidr && commonBits(node.bits, ip) >= node.cidr {
+		if node.peer != nil {
+			peers[node.peer] = true
+		}
+		if node.cidr == cidr {
+			return
+		}
+		node = node.child[node.choose(ip)]
+	}
+}
+
+func (node *trieEntry) addPeers(peers map[*Peer]bool) {
+	if node == nil {
+		return
+	}
+	if node.peer != nil {
+		peers[node.peer] = true
+	}
+	node.child[0].addPeers(peers)
+	node.child[1].addPeers(peers)
+}
+
 func (node *trieEntry) entriesForPeer(p *Peer, results []net.IPNet) []net.IPNet {
 	if node == nil {
 		return results
@@ -195,9 +256,24 @@ func (node *trieEntry) entriesForPeer(p *Peer, results []net.IPNet) []net.IPNet
 type AllowedIPs struct {
 	IPv4  *trieEntry
 	IPv6  *trieEntry
+	nodes int // in both tries
 	mutex sync.RWMutex
 }
 
+func (node *trieEntry) nodeCount() int {
+	if node == nil {
+		return 0
+	}
+	return 1 + node.child[0].nodeCount() + node.child[1].nodeCount()
+}
+
+func (table *AllowedIPs) NodeCount() int {
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+
+	return table.nodes
+}
+
 func (table *AllowedIPs) EntriesForPeer(peer *Peer) []net.IPNet {
 	table.mutex.RLock()
 	defer table.mutex.RUnlock()
@@ -208,34 +284,122 @@ func (table *AllowedIPs) EntriesForPeer(peer *Peer) []net.IPNet {
 	return allowed
 }
 
+/* Returns the peers owning a prefix within prefix
+ */
+func (table *AllowedIPs) PeersWithin(prefix net.IPNet) []*Peer {
+	return table.peers(prefix, false)
+}
+
+/* Returns the peers owning a prefix within or containing prefix
+ */
+func (table *AllowedIPs) PeersOverlapping(prefix net.IPNet) []*Peer {
+	return table.peers(prefix, true)
+}
+
+func (table *AllowedIPs) peers(prefix net.IPNet, containing bool) []*Peer {
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+
+	ones, bits := prefix.Mask.Size()
+	peers := make(map[*Peer]bool)
+	var root *trieEntry
+	var ip net.IP
+	switch bits {
+	case net.IPv4len * 8:
+		root, ip = table.IPv4, prefix.IP.To4()
+	case net.IPv6len * 8:
+		root, ip = table.IPv6, prefix.IP.To16()
+	}
+	if ip != nil {
+		ip = ip.Mask(prefix.Mask)
+		root.peersWithin(ip, uint(ones), peers)
+		if containing {
+			root.peersContaining(ip, uint(ones), peers)
+		}
+	}
+
+	result := make([]*Peer, 0, len(peers))
+	for peer := range peers {
+		result = append(result, peer)
+	}
+	return result
+}
+
 func (table *AllowedIPs) Reset() {
 	table.mutex.Lock()
 	defer table.mutex.Unlock()
 
 	table.IPv4 = nil
 	table.IPv6 = nil
+	table.nodes = 0
 }
 
-func (table *AllowedIPs) RemoveByPeer(peer *Peer) {
+/* Removes all prefixes of the peer, returning the number of nodes freed
+ */
+func (table *AllowedIPs) RemoveByPeer(peer *Peer) int {
 	table.mutex.Lock()
 	defer table.mutex.Unlock()
 
 	table.IPv4 = table.IPv4.removeByPeer(peer)
 	table.IPv6 = table.IPv6.removeByPeer(peer)
+
+	nodes := table.IPv4.nodeCount() + table.IPv6.nodeCount()
+	removed := table.nodes - nodes
+	table.nodes = nodes
+	return removed
 }
 
-func (table *AllowedIPs) Insert(ip net.IP, cidr uint, peer *Peer) {
+/* Inserts the prefix, returning the number of nodes allocated
+ */
+func (table *AllowedIPs) Insert(ip net.IP, cidr uint, peer *Peer) int {
 	table.mutex.Lock()
 	defer table.mutex.Unlock()
 
+	var created int
 	switch len(ip) {
 	case net.IPv6len:
-		table.IPv6 = table.IPv6.insert(ip, cidr, peer)
+		table.IPv6 = table.IPv6.insertCounting(ip, cidr, peer, &created)
 	case net.IPv4len:
-		table.IPv4 = table.IPv4.insert(ip, cidr, peer)
+		table.IPv4 = table.IPv4.insertCounting(ip, cidr, peer, &created)
 	default:
 		panic(errors.New("inserting unknown address type"))
 	}
+	table.nodes += created
+	return created
+}
+
+/* Inserts all prefixes while holding the lock once,
+ * returning the number of nodes allocated
+ */
+func (table *AllowedIPs) InsertBatch(prefixes []net.IPNet, peer *Peer) int {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	var created int
+	for _, prefix := range prefixes {
+		ones, _ := prefix.Mask.Size()
+		switch len(prefix.IP) {
+		case net.IPv6len:
+			table.IPv6 = table.IPv6.insertCounting(prefix.IP, uint(ones), peer, &created)
+		case net.IPv4len:
+			table.IPv4 = table.IPv4.insertCounting(prefix.IP, uint(ones), peer, &created)
+		default:
+			panic(errors.New("inserting unknown address type"))
+		}
+	}
+	table.nodes += created
+	return created
+}
+
+/* Returns the peer owning exactly the prefix, if any
+ */
+func (table *AllowedIPs) LookupExact(ip net.IP, cidr uint) *Peer {
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+	if ip4 := ip.To4(); ip4 != nil {
+		return table.IPv4.lookupExact(ip4, cidr)
+	}
+	return table.IPv6.lookupExact(ip.To16(), cidr)
 }
 
 func (table *AllowedIPs) LookupIPv4(address []byte) *Peer {
@@ -0,0 +1,159 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/ipc"
+)
+
+/* Bulk import of allowed IPs
+ *
+ * Setting a full routing table of hundreds of thousands of prefixes
+ * line by line through the set operation takes the trie lock and
+ * checks the memory limit once per prefix. An import instead parses a
+ * stream of prefixes and inserts them AllowedIPsImportBatch at a time,
+ * reporting progress after each batch.
+ */
+
+const (
+	AllowedIPsImportBatch = 4096
+)
+
+/* Inserts the prefixes read from reader, one per line up to an empty
+ * line or the end of the stream, into the allowed IPs of the peer.
+ * Progress, if not nil, is called after every batch with the number of
+ * prefixes imported so far, which is also returned.
+ */
+func (device *Device) ImportAllowedIPs(peer *Peer, reader io.Reader, progress func(int)) (int, error) {
+	scanner := bufio.NewScanner(reader)
+	batch := make([]net.IPNet, 0, AllowedIPsImportBatch)
+	imported := 0
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		reserved := 2 * len(batch)
+		if err := device.reserveMemory(uint64(reserved) * memoryTrieNode); err != nil {
+			return err
+		}
+		created := device.allowedips.InsertBatch(batch, peer)
+		device.releaseMemory(uint64(reserved-created) * memoryTrieNode)
+		imported += len(batch)
+		batch = batch[:0]
+		if progress != nil {
+			progress(imported)
+		}
+		return nil
+	}
+
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			break
+		}
+		_, prefix, err := net.ParseCIDR(text)
+		if err != nil {
+			return imported, fmt.Errorf("line %d: %v", line, err)
+		}
+		batch = append(batch, *prefix)
+		if len(batch) == AllowedIPsImportBatch {
+			if err := flush(); err != nil {
+				return imported, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return imported, err
+	}
+	return imported, flush()
+}
+
+/* Imports allowed IPs into the peer given by public_key, after removing
+ * its current ones if replace_allowed_ips=true. The header is ended by
+ * an empty line and followed by the prefixes, again ended by an empty
+ * line. A progress line is written after every batch.
+ */
+func (device *Device) IpcImportAllowedIPsOperation(socket *bufio.ReadWriter) *IPCError {
+	var peer *Peer
+	replace := false
+
+	for {
+		line, err := socket.ReadString('\n')
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorIO, ipc.ReasonIO, "failed to read input: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			break
+		}
+		parts := strings.Split(line, "=")
+		if len(parts) != 2 {
+			return ipcErrorf(ipc.IpcErrorProtocol, ipc.ReasonProtocol, "failed to parse line %q", line)
+		}
+		key, value := parts[0], parts[1]
+
+		switch key {
+		case "public_key":
+			var publicKey NoisePublicKey
+			if err := publicKey.FromHex(value); err != nil {
+				return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidKey, "failed to get peer by public key: %v", err)
+			}
+			peer = device.LookupPeer(publicKey)
+			if peer == nil {
+				return ipcErrorf(ipc.IpcErrorNotFound, ipc.ReasonPeerNotFound, "no such peer: %v", value)
+			}
+
+		case "replace_allowed_ips":
+			if value != "true" {
+				return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to replace allowedips, invalid value: %v", value)
+			}
+			replace = true
+
+		default:
+			return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonUnknownKey, "invalid UAPI import key: %v", key)
+		}
+	}
+
+	if peer == nil {
+		return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonProtocol, "import requires public_key")
+	}
+
+	if replace {
+		device.log.Debug.Println(peer, "- UAPI: Removing all allowedips")
+		device.removeAllowedIPs(peer)
+	}
+
+	var writeErr error
+	imported, err := device.ImportAllowedIPs(peer, socket.Reader, func(imported int) {
+		if writeErr == nil {
+			_, writeErr = fmt.Fprintf(socket, "progress=%d\n", imported)
+		}
+		if writeErr == nil {
+			writeErr = socket.Flush()
+		}
+	})
+	device.log.Debug.Println(peer, "- UAPI: Imported", imported, "allowedips")
+
+	if err == ErrMemoryLimit {
+		return ipcErrorf(ipc.IpcErrorNoMemory, ipc.ReasonMemoryLimit, "failed to import allowed ips: %v", err)
+	} else if err != nil {
+		return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to import allowed ips: %v", err)
+	}
+	if writeErr == nil {
+		_, writeErr = fmt.Fprintf(socket, "imported=%d\n", imported)
+	}
+	if writeErr != nil {
+		return ipcErrorf(ipc.IpcErrorIO, ipc.ReasonIO, "failed to write output: %v", writeErr)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestImportAllowedIPs(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	sk, _ := newPrivateKey()
+	peer, err := device.NewPeer(sk.publicKey())
+	assertNil(t, err)
+
+	var input strings.Builder
+	fmt.Fprintf(&input, "public_key=%s\nreplace_allowed_ips=true\n\n", peer.handshake.remoteStatic.ToHex())
+	for i := 0; i < 10000; i++ {
+		fmt.Fprintf(&input, "10.%d.%d.0/24\n", i>>8, i&0xff)
+	}
+	input.WriteString("fd00::/64\n\n")
+
+	var output bytes.Buffer
+	socket := bufio.NewReadWriter(bufio.NewReader(strings.NewReader(input.String())), bufio.NewWriter(&output))
+	if err := device.IpcImportAllowedIPsOperation(socket); err != nil {
+		t.Fatal(err)
+	}
+	socket.Flush()
+
+	expected := "progress=4096\nprogress=8192\nprogress=10001\nimported=10001\n"
+	if output.String() != expected {
+		t.Fatalf("unexpected output %q", output.String())
+	}
+	if device.allowedips.LookupIPv4([]byte{10, 39, 15, 1}) != peer {
+		t.Fatal("imported prefix not routed to peer")
+	}
+	if device.allowedips.LookupIPv6(make([]byte, 16)) != nil {
+		t.Fatal("unexpected route for ::")
+	}
+	if len(device.allowedips.EntriesForPeer(peer)) != 10001 {
+		t.Fatal("wrong number of allowed ips")
+	}
+
+	// errors name the offending line
+
+	_, err = device.ImportAllowedIPs(peer, strings.NewReader("10.0.0.0/8\nbogus\n"), nil)
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
@@ -258,3 +258,77 @@ func TestTrieIPv6(t *testing.T) {
 	assertEQ(h, 0x24046800, 0x40040800, 0x10101010, 0x10101010)
 	assertEQ(a, 0x24046800, 0x40040800, 0xdeadbeef, 0xdeadbeef)
 }
+
+func TestPeersWithin(t *testing.T) {
+	a := &Peer{}
+	b := &Peer{}
+	c := &Peer{}
+	d := &Peer{}
+
+	var table AllowedIPs
+	insert := func(peer *Peer, prefix string) {
+		_, network, err := net.ParseCIDR(prefix)
+		assertNil(t, err)
+		ones, _ := network.Mask.Size()
+		ip := network.IP
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		table.Insert(ip, uint(ones), peer)
+	}
+	insert(a, "10.0.0.0/8")
+	insert(b, "10.1.0.0/16")
+	insert(b, "10.1.2.0/24")
+	insert(c, "10.1.3.4/32")
+	insert(c, "192.168.0.0/16")
+	insert(d, "fd00::/64")
+
+	within := func(prefix string) map[*Peer]bool {
+		_, network, err := net.ParseCIDR(prefix)
+		assertNil(t, err)
+		peers := make(map[*Peer]bool)
+		for _, peer := range table.PeersWithin(*network) {
+			peers[peer] = true
+		}
+		return peers
+	}
+
+	// only prefixes inside the given one count, not those covering it
+
+	if peers := within("10.1.0.0/16"); len(peers) != 2 || !peers[b] || !peers[c] {
+		t.Fatalf("unexpected peers within 10.1.0.0/16: %v", peers)
+	}
+	if peers := within("10.1.3.0/24"); len(peers) != 1 || !peers[c] {
+		t.Fatalf("unexpected peers within 10.1.3.0/24: %v", peers)
+	}
+	if peers := within("0.0.0.0/0"); len(peers) != 3 || peers[d] {
+		t.Fatalf("unexpected peers within 0.0.0.0/0: %v", peers)
+	}
+	if peers := within("10.2.0.0/16"); len(peers) != 0 {
+		t.Fatalf("unexpected peers within 10.2.0.0/16: %v", peers)
+	}
+	if peers := within("fd00::/16"); len(peers) != 1 || !peers[d] {
+		t.Fatalf("unexpected peers within fd00::/16: %v", peers)
+	}
+
+	// overlapping prefixes also include those covering the given one
+
+	overlapping := func(prefix string) map[*Peer]bool {
+		_, network, err := net.ParseCIDR(prefix)
+		assertNil(t, err)
+		peers := make(map[*Peer]bool)
+		for _, peer := range table.PeersOverlapping(*network) {
+			peers[peer] = true
+		}
+		return peers
+	}
+	if peers := overlapping("10.1.3.0/24"); len(peers) != 3 || !peers[a] || !peers[b] || !peers[c] {
+		t.Fatalf("unexpected peers overlapping 10.1.3.0/24: %v", peers)
+	}
+	if peers := overlapping("10.1.2.128/25"); len(peers) != 2 || !peers[a] || !peers[b] {
+		t.Fatalf("unexpected peers overlapping 10.1.2.128/25: %v", peers)
+	}
+	if peers := overlapping("172.16.0.0/12"); len(peers) != 0 {
+		t.Fatalf("unexpected peers overlapping 172.16.0.0/12: %v", peers)
+	}
+}
@@ -0,0 +1,98 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+/* Append-only audit log of completed handshakes, one JSON object
+ * per line, for accounting of remote access sessions:
+ *
+ *   {"time":"2019-10-01T12:00:00.123456789Z","peer":"<base64>",
+ *    "endpoint":"192.0.2.1:51820","role":"responder"}
+ *
+ * Register Record as event handler of the device. The first record
+ * failing to be written is logged, and its error kept for Err.
+ */
+
+type AuditLog struct {
+	sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+	log     *Logger
+	err     error
+}
+
+type auditRecord struct {
+	Time     string `json:"time"`
+	Peer     string `json:"peer"`
+	Endpoint string `json:"endpoint,omitempty"`
+	Role     string `json:"role"`
+}
+
+func OpenAuditLog(path string, logger *Logger) (*AuditLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{
+		file:    file,
+		encoder: json.NewEncoder(file),
+		log:     logger,
+	}, nil
+}
+
+/* Appends a record for completed handshakes, ignoring other events
+ */
+func (log *AuditLog) Record(event Event) {
+	if event.Type != EventHandshakeComplete {
+		return
+	}
+
+	record := auditRecord{
+		Time:     event.Time.UTC().Format(time.RFC3339Nano),
+		Peer:     base64.StdEncoding.EncodeToString(event.PublicKey[:]),
+		Endpoint: event.Endpoint,
+		Role:     "responder",
+	}
+	if event.Initiator {
+		record.Role = "initiator"
+	}
+
+	log.Lock()
+	defer log.Unlock()
+	if log.file == nil {
+		return
+	}
+	if err := log.encoder.Encode(record); err != nil && log.err == nil {
+		log.err = err
+		log.log.Error.Println("Failed to write audit record:", err)
+	}
+}
+
+/* Returns the error of the first record which failed to be written
+ */
+func (log *AuditLog) Err() error {
+	log.Lock()
+	defer log.Unlock()
+	return log.err
+}
+
+func (log *AuditLog) Close() error {
+	log.Lock()
+	defer log.Unlock()
+	if log.file == nil {
+		return nil
+	}
+	err := log.file.Close()
+	log.file = nil
+	return err
+}
@@ -0,0 +1,76 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wireguard-audit")
+	assertNil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	device := randDevice(t)
+	defer device.Close()
+
+	audit, err := OpenAuditLog(path, device.log)
+	assertNil(t, err)
+	device.AddEventHandler(audit.Record)
+
+	var events []Event
+	device.AddEventHandler(func(event Event) {
+		events = append(events, event)
+	})
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	peer, err := device.NewPeer(sk.publicKey())
+	assertNil(t, err)
+	peer.endpoint, err = CreateEndpoint("192.0.2.1:51820")
+	assertNil(t, err)
+
+	peer.eventHandshakeComplete(true)
+	peer.eventHandshakeComplete(false)
+	assertNil(t, audit.Close())
+
+	if len(events) != 2 || events[0].Type != EventHandshakeComplete || !events[0].Initiator || events[1].Initiator {
+		t.Fatalf("unexpected events %v", events)
+	}
+
+	content, err := ioutil.ReadFile(path)
+	assertNil(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 records, got %q", content)
+	}
+	for i, role := range []string{"initiator", "responder"} {
+		var record auditRecord
+		assertNil(t, json.Unmarshal([]byte(lines[i]), &record))
+		pk := sk.publicKey()
+		if record.Role != role || record.Endpoint != "192.0.2.1:51820" || record.Peer != base64.StdEncoding.EncodeToString(pk[:]) {
+			t.Errorf("unexpected record %q", lines[i])
+		}
+	}
+
+	// failures to write are kept
+
+	audit, err = OpenAuditLog(path, device.log)
+	assertNil(t, err)
+	assertNil(t, audit.Err())
+	audit.file.Close()
+	audit.Record(events[0])
+	if audit.Err() == nil {
+		t.Fatal("failed write not reported")
+	}
+}
@@ -6,6 +6,7 @@
 package device
 
 import (
+	"bytes"
 	"errors"
 	"net"
 	"strings"
@@ -42,6 +43,13 @@ type Endpoint interface {
 	SrcIP() net.IP
 }
 
+/* Reports whether two endpoints have the same destination, without
+ * formatting them: on Linux DstToBytes is a view of the socket address
+ */
+func sameDst(a, b Endpoint) bool {
+	return bytes.Equal(a.DstToBytes(), b.DstToBytes())
+}
+
 func parseEndpoint(s string) (*net.UDPAddr, error) {
 	// ensure that the host is an IP address
 
@@ -79,6 +87,20 @@ func unsafeCloseBind(device *Device) error {
 		err = netc.bind.Close()
 		netc.bind = nil
 	}
+	if netc.controlBind != nil {
+		if err2 := netc.controlBind.Close(); err == nil {
+			err = err2
+		}
+		netc.controlBind = nil
+	}
+	if netc.relayBind != nil {
+		netc.relayBind.Close()
+		netc.relayBind = nil
+	}
+	if netc.turnBind != nil {
+		netc.turnBind.Close()
+		netc.turnBind = nil
+	}
 	netc.stopping.Wait()
 	return err
 }
@@ -102,6 +124,11 @@ func (device *Device) BindSetMark(mark uint32) error {
 			return err
 		}
 	}
+	if device.isUp.Get() && device.net.controlBind != nil {
+		if err := device.net.controlBind.SetMark(mark); err != nil {
+			return err
+		}
+	}
 
 	// clear cached source addresses
 
@@ -137,13 +164,42 @@ func (device *Device) BindUpdate() error {
 
 		var err error
 		netc := &device.net
-		netc.bind, netc.port, err = CreateBind(netc.port, device)
+		if netc.shared != nil {
+			netc.bind, netc.port, err = netc.shared.attach(device)
+		} else {
+			netc.bind, netc.port, err = CreateBind(netc.port, device)
+		}
 		if err != nil {
 			netc.bind = nil
 			netc.port = 0
 			return err
 		}
 
+		// bind to control port
+
+		if netc.controlPort != 0 {
+			netc.controlBind, _, err = CreateBind(netc.controlPort, device)
+			if err != nil {
+				netc.controlBind = nil
+				netc.bind.Close()
+				netc.bind = nil
+				netc.port = 0
+				return err
+			}
+		}
+
+		// connect to relay in the background
+
+		if netc.relayAddress != "" {
+			netc.relayBind = newRelayBind(device, netc.relayAddress, netc.relaySecret)
+		}
+
+		// allocate on TURN server in the background
+
+		if netc.turnServer != "" {
+			netc.turnBind = newTURNBind(device, netc.turnServer, netc.turnUsername, netc.turnPassword)
+		}
+
 		// set fwmark
 
 		if netc.fwmark != 0 {
@@ -151,9 +207,15 @@ func (device *Device) BindUpdate() error {
 			if err != nil {
 				return err
 			}
+			if netc.controlBind != nil {
+				err = netc.controlBind.SetMark(netc.fwmark)
+				if err != nil {
+					return err
+				}
+			}
 		}
 
-		// clear cached source addresses
+		// clear cached source addresses, endpoints may now be our own
 
 		device.peers.RLock()
 		for _, peer := range device.peers.keyMap {
@@ -162,6 +224,7 @@ func (device *Device) BindUpdate() error {
 			if peer.endpoint != nil {
 				peer.endpoint.ClearSrc()
 			}
+			peer.unsafeUpdateHairpin(netc.port)
 		}
 		device.peers.RUnlock()
 
@@ -169,8 +232,26 @@ func (device *Device) BindUpdate() error {
 
 		device.net.starting.Add(ConnRoutineNumber)
 		device.net.stopping.Add(ConnRoutineNumber)
-		go device.RoutineReceiveIncoming(ipv4.Version, netc.bind)
-		go device.RoutineReceiveIncoming(ipv6.Version, netc.bind)
+		go device.RoutineReceiveIncoming(ipv4.Version, netc.bind, false)
+		go device.RoutineReceiveIncoming(ipv6.Version, netc.bind, false)
+		if netc.controlBind != nil {
+			device.net.starting.Add(ConnRoutineNumber)
+			device.net.stopping.Add(ConnRoutineNumber)
+			go device.RoutineReceiveIncoming(ipv4.Version, netc.controlBind, true)
+			go device.RoutineReceiveIncoming(ipv6.Version, netc.controlBind, true)
+		}
+		if netc.relayBind != nil {
+			device.net.starting.Add(ConnRoutineNumber)
+			device.net.stopping.Add(ConnRoutineNumber)
+			go device.RoutineReceiveIncoming(ipv4.Version, netc.relayBind, false)
+			go device.RoutineReceiveIncoming(ipv6.Version, netc.relayBind, false)
+		}
+		if netc.turnBind != nil {
+			device.net.starting.Add(ConnRoutineNumber)
+			device.net.stopping.Add(ConnRoutineNumber)
+			go device.RoutineReceiveIncoming(ipv4.Version, netc.turnBind, false)
+			go device.RoutineReceiveIncoming(ipv6.Version, netc.turnBind, false)
+		}
 		device.net.starting.Wait()
 
 		device.log.Debug.Println("UDP bind has been updated")
@@ -0,0 +1,271 @@
+// +build darwin freebsd
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ *
+ * This implements "sticky sockets" for darwin and freebsd, using the
+ * same approach as conn_linux.go: the local address on which a datagram
+ * arrived is obtained from ancillary data and used as the source address
+ * of datagrams sent in reply, so that multihomed hosts answer from the
+ * address the peer expects.
+ *
+ * Unlike on linux the sockets remain managed by the net package,
+ * the platform specific control messages are in conn_darwin.go
+ * and conn_freebsd.go
+ */
+
+package device
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+type nativeBind struct {
+	ipv4 *net.UDPConn
+	ipv6 *net.UDPConn
+}
+
+type NativeEndpoint struct {
+	dst     net.UDPAddr
+	src     net.IP // local address on which datagrams from dst arrived
+	ifindex uint32 // interface of the ipv6 source address
+}
+
+var _ Bind = (*nativeBind)(nil)
+var _ Endpoint = (*NativeEndpoint)(nil)
+
+func CreateEndpoint(s string) (Endpoint, error) {
+	addr, err := parseEndpoint(s)
+	if err != nil {
+		return nil, err
+	}
+	return &NativeEndpoint{dst: *addr}, nil
+}
+
+func (e *NativeEndpoint) ClearSrc() {
+	e.src = nil
+	e.ifindex = 0
+}
+
+func (e *NativeEndpoint) DstIP() net.IP {
+	return e.dst.IP
+}
+
+func (e *NativeEndpoint) SrcIP() net.IP {
+	return e.src
+}
+
+func (e *NativeEndpoint) DstToBytes() []byte {
+	out := e.dst.IP.To4()
+	if out == nil {
+		out = e.dst.IP
+	}
+	out = append(out, byte(e.dst.Port&0xff))
+	out = append(out, byte((e.dst.Port>>8)&0xff))
+	return out
+}
+
+func (e *NativeEndpoint) DstToString() string {
+	return e.dst.String()
+}
+
+func (e *NativeEndpoint) SrcToString() string {
+	if e.src == nil {
+		return ""
+	}
+	return e.src.String()
+}
+
+func listenNet(network string, port int) (*net.UDPConn, int, error) {
+
+	// listen
+
+	conn, err := net.ListenUDP(network, &net.UDPAddr{Port: port})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// request the destination address of received datagrams
+
+	level, opt := unix.IPPROTO_IP, sockoptRecvSrc4
+	if network == "udp6" {
+		level, opt = unix.IPPROTO_IPV6, sockoptRecvSrc6
+	}
+
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+	var operr error
+	err = rawConn.Control(func(fd uintptr) {
+		operr = unix.SetsockoptInt(int(fd), level, opt, 1)
+	})
+	if err == nil {
+		err = operr
+	}
+	if err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+
+	// retrieve port
+
+	return conn, conn.LocalAddr().(*net.UDPAddr).Port, nil
+}
+
+func extractErrno(err error) error {
+	opErr, ok := err.(*net.OpError)
+	if !ok {
+		return nil
+	}
+	syscallErr, ok := opErr.Err.(*os.SyscallError)
+	if !ok {
+		return nil
+	}
+	return syscallErr.Err
+}
+
+func CreateBind(uport uint16, device *Device) (Bind, uint16, error) {
+	var err error
+	var bind nativeBind
+
+	port := int(uport)
+
+	bind.ipv4, port, err = listenNet("udp4", port)
+	if err != nil && extractErrno(err) != syscall.EAFNOSUPPORT {
+		return nil, 0, err
+	}
+
+	bind.ipv6, port, err = listenNet("udp6", port)
+	if err != nil && extractErrno(err) != syscall.EAFNOSUPPORT {
+		bind.ipv4.Close()
+		bind.ipv4 = nil
+		return nil, 0, err
+	}
+
+	return &bind, uint16(port), nil
+}
+
+func (bind *nativeBind) Close() error {
+	var err1, err2 error
+	if bind.ipv4 != nil {
+		err1 = bind.ipv4.Close()
+	}
+	if bind.ipv6 != nil {
+		err2 = bind.ipv6.Close()
+	}
+	if err1 != nil {
+		return err1
+	}
+	return err2
+}
+
+func (bind *nativeBind) ReceiveIPv4(buff []byte) (int, Endpoint, error) {
+	if bind.ipv4 == nil {
+		return 0, nil, syscall.EAFNOSUPPORT
+	}
+	var oob [64]byte
+	n, oobn, _, addr, err := bind.ipv4.ReadMsgUDP(buff, oob[:])
+	if err != nil {
+		return 0, nil, err
+	}
+	end := &NativeEndpoint{dst: *addr}
+	end.dst.IP = end.dst.IP.To4()
+
+	// update source cache
+
+	msgs, _ := unix.ParseSocketControlMessage(oob[:oobn])
+	for _, msg := range msgs {
+		if msg.Header.Level == unix.IPPROTO_IP {
+			if src := parseSrc4(msg); src != nil {
+				end.src = src
+			}
+		}
+	}
+
+	return n, end, nil
+}
+
+func (bind *nativeBind) ReceiveIPv6(buff []byte) (int, Endpoint, error) {
+	if bind.ipv6 == nil {
+		return 0, nil, syscall.EAFNOSUPPORT
+	}
+	var oob [64]byte
+	n, oobn, _, addr, err := bind.ipv6.ReadMsgUDP(buff, oob[:])
+	if err != nil {
+		return 0, nil, err
+	}
+	end := &NativeEndpoint{dst: *addr}
+
+	// update source cache
+
+	msgs, _ := unix.ParseSocketControlMessage(oob[:oobn])
+	for _, msg := range msgs {
+		if msg.Header.Level == unix.IPPROTO_IPV6 &&
+			msg.Header.Type == cmsgSrc6 &&
+			len(msg.Data) >= unix.SizeofInet6Pktinfo {
+			pktinfo := (*unix.Inet6Pktinfo)(unsafe.Pointer(&msg.Data[0]))
+			end.src = append(net.IP(nil), pktinfo.Addr[:]...)
+			end.ifindex = pktinfo.Ifindex
+		}
+	}
+
+	return n, end, nil
+}
+
+func marshalCmsg(level, typ int32, data []byte) []byte {
+	oob := make([]byte, unix.CmsgSpace(len(data)))
+	cmsghdr := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	cmsghdr.Level = level
+	cmsghdr.Type = typ
+	cmsghdr.SetLen(unix.CmsgLen(len(data)))
+	copy(oob[unix.CmsgLen(0):], data)
+	return oob
+}
+
+func (bind *nativeBind) Send(buff []byte, endpoint Endpoint) error {
+	var oob []byte
+	var conn *net.UDPConn
+
+	nend := endpoint.(*NativeEndpoint)
+	if nend.dst.IP.To4() != nil {
+		conn = bind.ipv4
+		if nend.src != nil {
+			typ, data := marshalSrc4(nend.src)
+			oob = marshalCmsg(unix.IPPROTO_IP, typ, data)
+		}
+	} else {
+		conn = bind.ipv6
+		if nend.src != nil {
+			var pktinfo unix.Inet6Pktinfo
+			copy(pktinfo.Addr[:], nend.src)
+			pktinfo.Ifindex = nend.ifindex
+			data := (*[unix.SizeofInet6Pktinfo]byte)(unsafe.Pointer(&pktinfo))[:]
+			oob = marshalCmsg(unix.IPPROTO_IPV6, cmsgSrc6, data)
+		}
+	}
+	if conn == nil {
+		return syscall.EAFNOSUPPORT
+	}
+
+	_, _, err := conn.WriteMsgUDP(buff, oob, &nend.dst)
+	if err == nil || oob == nil {
+		return err
+	}
+
+	// clear src and retry
+
+	if errno := extractErrno(err); errno == unix.EADDRNOTAVAIL || errno == unix.EINVAL {
+		nend.ClearSrc()
+		_, _, err = conn.WriteMsgUDP(buff, nil, &nend.dst)
+	}
+
+	return err
+}
@@ -0,0 +1,117 @@
+// +build darwin freebsd
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestMarshalCmsg(t *testing.T) {
+	src := net.IPv4(192, 0, 2, 1)
+	typ, data := marshalSrc4(src)
+	msgs, err := unix.ParseSocketControlMessage(marshalCmsg(unix.IPPROTO_IP, typ, data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 control message, got %d", len(msgs))
+	}
+	if msgs[0].Header.Level != unix.IPPROTO_IP || msgs[0].Header.Type != typ {
+		t.Fatalf("unexpected header: %+v", msgs[0].Header)
+	}
+	if !bytes.Equal(msgs[0].Data[:len(data)], data) {
+		t.Fatal("control message data does not round trip")
+	}
+	if !bytes.Contains(msgs[0].Data, src.To4()) {
+		t.Fatal("source address missing from control message")
+	}
+}
+
+func TestParseSrc4Invalid(t *testing.T) {
+	var msg unix.SocketControlMessage
+	msg.Header.Level = unix.IPPROTO_IP
+	msg.Header.Type = unix.IP_TTL
+	msg.Data = make([]byte, 64)
+	if src := parseSrc4(msg); src != nil {
+		t.Fatalf("unrelated control message parsed as source %v", src)
+	}
+}
+
+func testStickySource(t *testing.T, bind *nativeBind, port uint16, loopback net.IP) {
+	recv := bind.ReceiveIPv4
+	if loopback.To4() == nil {
+		recv = bind.ReceiveIPv6
+	}
+
+	// deliver a datagram to ourselves over loopback
+
+	end := &NativeEndpoint{dst: net.UDPAddr{IP: loopback, Port: int(port)}}
+	if err := bind.Send([]byte("ping"), end); err != nil {
+		t.Fatal(err)
+	}
+	buff := make([]byte, 64)
+	n, got, err := recv(buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buff[:n]) != "ping" {
+		t.Fatalf("unexpected payload %q", buff[:n])
+	}
+
+	// the source must be the address the datagram arrived on
+
+	nend := got.(*NativeEndpoint)
+	if !nend.SrcIP().Equal(loopback) {
+		t.Fatalf("expected source %v, got %v", loopback, nend.SrcIP())
+	}
+
+	// replies carry the cached source
+
+	if err := bind.Send([]byte("pong"), nend); err != nil {
+		t.Fatal(err)
+	}
+	n, _, err = recv(buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buff[:n]) != "pong" {
+		t.Fatalf("unexpected payload %q", buff[:n])
+	}
+	if nend.SrcIP() == nil {
+		t.Fatal("source cleared after successful send")
+	}
+}
+
+func hasIPv6Loopback() bool {
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+func TestStickySource(t *testing.T) {
+	b, port, err := CreateBind(0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	bind := b.(*nativeBind)
+
+	if bind.ipv4 != nil {
+		testStickySource(t, bind, port, net.IPv4(127, 0, 0, 1).To4())
+	}
+	if bind.ipv6 != nil && hasIPv6Loopback() {
+		testStickySource(t, bind, port, net.IPv6loopback)
+	}
+}
@@ -0,0 +1,36 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	sockoptRecvSrc4 = unix.IP_RECVPKTINFO
+	sockoptRecvSrc6 = 0x3d // IPV6_RECVPKTINFO, hidden behind __APPLE_USE_RFC_3542
+	cmsgSrc6        = 0x2e // IPV6_PKTINFO, hidden behind __APPLE_USE_RFC_3542
+)
+
+func parseSrc4(msg unix.SocketControlMessage) net.IP {
+	if msg.Header.Type != unix.IP_PKTINFO || len(msg.Data) < unix.SizeofInet4Pktinfo {
+		return nil
+	}
+	pktinfo := (*unix.Inet4Pktinfo)(unsafe.Pointer(&msg.Data[0]))
+	return net.IPv4(pktinfo.Addr[0], pktinfo.Addr[1], pktinfo.Addr[2], pktinfo.Addr[3]).To4()
+}
+
+/* With a zero interface index the kernel
+ * uses ipi_spec_dst as the source address
+ */
+func marshalSrc4(src net.IP) (int32, []byte) {
+	var pktinfo unix.Inet4Pktinfo
+	copy(pktinfo.Spec_dst[:], src.To4())
+	return unix.IP_PKTINFO, (*[unix.SizeofInet4Pktinfo]byte)(unsafe.Pointer(&pktinfo))[:]
+}
@@ -1,4 +1,4 @@
-// +build !linux android
+// +build !linux,!darwin,!freebsd android
 
 /* SPDX-License-Identifier: MIT
  *
@@ -17,7 +17,8 @@ import (
  * on platforms for which the sticky socket / source caching behavior
  * has not yet been implemented.
  *
- * See conn_linux.go for an implementation on the linux platform.
+ * See conn_linux.go and conn_bsd.go for implementations on linux,
+ * darwin and freebsd.
  */
 
 type nativeBind struct {
@@ -0,0 +1,29 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	sockoptRecvSrc4 = unix.IP_RECVDSTADDR
+	sockoptRecvSrc6 = unix.IPV6_RECVPKTINFO
+	cmsgSrc6        = unix.IPV6_PKTINFO
+)
+
+func parseSrc4(msg unix.SocketControlMessage) net.IP {
+	if msg.Header.Type != unix.IP_RECVDSTADDR || len(msg.Data) < net.IPv4len {
+		return nil
+	}
+	return append(net.IP(nil), msg.Data[:net.IPv4len]...)
+}
+
+func marshalSrc4(src net.IP) (int32, []byte) {
+	return unix.IP_SENDSRCADDR, append([]byte(nil), src.To4()...)
+}
@@ -482,7 +482,12 @@ func send4(sock int, end *NativeEndpoint, buff []byte) error {
 		},
 	}
 
-	_, err := unix.SendmsgN(sock, buff, (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], end.dst4(), 0)
+	// SendmsgN encodes the address into it, so send to a copy,
+	// keeping concurrent sends to the endpoint apart
+
+	dst := *end.dst4()
+
+	_, err := unix.SendmsgN(sock, buff, (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], &dst, 0)
 
 	if err == nil {
 		return nil
@@ -493,7 +498,7 @@ func send4(sock int, end *NativeEndpoint, buff []byte) error {
 	if err == unix.EINVAL {
 		end.ClearSrc()
 		cmsg.pktinfo = unix.Inet4Pktinfo{}
-		_, err = unix.SendmsgN(sock, buff, (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], end.dst4(), 0)
+		_, err = unix.SendmsgN(sock, buff, (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], &dst, 0)
 	}
 
 	return err
@@ -522,7 +527,12 @@ func send6(sock int, end *NativeEndpoint, buff []byte) error {
 		cmsg.pktinfo.Ifindex = 0
 	}
 
-	_, err := unix.SendmsgN(sock, buff, (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], end.dst6(), 0)
+	// SendmsgN encodes the address into it, so send to a copy,
+	// keeping concurrent sends to the endpoint apart
+
+	dst := *end.dst6()
+
+	_, err := unix.SendmsgN(sock, buff, (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], &dst, 0)
 
 	if err == nil {
 		return nil
@@ -533,7 +543,7 @@ func send6(sock int, end *NativeEndpoint, buff []byte) error {
 	if err == unix.EINVAL {
 		end.ClearSrc()
 		cmsg.pktinfo = unix.Inet6Pktinfo{}
-		_, err = unix.SendmsgN(sock, buff, (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], end.dst6(), 0)
+		_, err = unix.SendmsgN(sock, buff, (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], &dst, 0)
 	}
 
 	return err
@@ -685,6 +695,9 @@ func (bind *nativeBind) routineRouteListener(device *Device) {
 				reqPeerLock.Lock()
 				reqPeer = make(map[uint32]peerEndpointPtr)
 				reqPeerLock.Unlock()
+				if device == nil {
+					break // shared by several devices, see sharedbind.go
+				}
 				go func() {
 					device.peers.RLock()
 					i := uint32(1)
@@ -30,6 +30,7 @@ const (
 	MinMessageSize = MessageKeepaliveSize                  // minimum size of transport message (keepalive)
 	MaxMessageSize = MaxSegmentSize                        // maximum size of transport message
 	MaxContentSize = MaxSegmentSize - MessageTransportSize // maximum size of transport message content
+	MaxMTU         = MaxContentSize                        // maximum MTU of the TUN device
 )
 
 /* Implementation constants */
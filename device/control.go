@@ -0,0 +1,73 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"strconv"
+)
+
+/* A device may listen on a second UDP port, the control port,
+ * which only accepts handshake messages. This allows firewalls
+ * to apply different policies to handshakes and to data.
+ *
+ * Handshake messages are sent to a peer from the local control port
+ * only when the peer has its own control port configured or has sent
+ * handshakes to the local control port, so peers unaware of control
+ * ports are unaffected. The control endpoint of a peer is learned from
+ * handshakes arriving on the control port and otherwise derived from
+ * the address of the peer endpoint.
+ *
+ * Handshakes received on the control port never update the peer
+ * endpoint, which only carries data.
+ */
+
+func controlEndpoint(endpoint Endpoint, port uint16) (Endpoint, error) {
+	host, _, err := net.SplitHostPort(endpoint.DstToString())
+	if err != nil {
+		return nil, err
+	}
+	return CreateEndpoint(net.JoinHostPort(host, strconv.Itoa(int(port))))
+}
+
+/* Returns the bind and endpoint used for sending handshake messages.
+ *
+ * Must hold device.net and peer read locks
+ */
+func (peer *Peer) handshakeDestination() (Bind, Endpoint) {
+	device := peer.device
+	if device.net.controlBind == nil {
+		return device.net.bind, peer.endpoint
+	}
+	if peer.control.endpoint != nil {
+		return device.net.controlBind, peer.control.endpoint
+	}
+	if peer.control.port == 0 || peer.endpoint == nil {
+		return device.net.bind, peer.endpoint
+	}
+	endpoint, err := controlEndpoint(peer.endpoint, peer.control.port)
+	if err != nil {
+		return device.net.bind, peer.endpoint
+	}
+	return device.net.controlBind, endpoint
+}
+
+func (peer *Peer) SetControlEndpointFromPacket(endpoint Endpoint) {
+	if RoamingDisabled {
+		return
+	}
+	peer.Lock()
+	peer.control.endpoint = endpoint
+	peer.Unlock()
+}
+
+/* Changes the control port of the device, takes effect on the next BindUpdate
+ */
+func (device *Device) SetControlPort(port uint16) {
+	device.net.Lock()
+	device.net.controlPort = port
+	device.net.Unlock()
+}
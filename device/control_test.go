@@ -0,0 +1,81 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestControlEndpoint(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		expected string
+	}{
+		{"192.0.2.1:51820", "192.0.2.1:51821"},
+		{"[2001:db8::1]:51820", "[2001:db8::1]:51821"},
+	}
+
+	for _, test := range tests {
+		endpoint, err := CreateEndpoint(test.endpoint)
+		assertNil(t, err)
+		control, err := controlEndpoint(endpoint, 51821)
+		assertNil(t, err)
+		if control.DstToString() != test.expected {
+			t.Errorf("control endpoint of %s: got %s, expected %s", test.endpoint, control.DstToString(), test.expected)
+		}
+	}
+}
+
+func TestControlPortConfig(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	config := "control_port=51821\npublic_key=" + strings.Repeat("ab", 32) + "\nendpoint=192.0.2.1:51820\ncontrol_port=51822\n"
+	if err := ipcSet(device, config); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	writer := bufio.NewWriter(&buf)
+	if err := device.IpcGetOperation(writer); err != nil {
+		t.Fatal(err)
+	}
+	writer.Flush()
+
+	for _, line := range []string{"control_port=51821\n", "endpoint=192.0.2.1:51820\ncontrol_port=51822\n"} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("missing %q in %q", line, buf.String())
+		}
+	}
+}
+
+func TestControlPortLegacyPeer(t *testing.T) {
+	device1, device2, peer1, _ := selftestPair(t)
+	defer device1.Close()
+	defer device2.Close()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	conn.Close()
+
+	// handshakes with a peer without control port go to its endpoint
+
+	if err := ipcSet(device1, fmt.Sprintf("control_port=%d\n", port)); err != nil {
+		t.Fatal(err)
+	}
+	if err := peer1.awaitSession(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,187 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* Resettable and per-interval peer counters
+ *
+ * Billing systems would rather not diff monotonic counters across
+ * restarts themselves. The counters of a peer may be reset, and with a
+ * statistics interval configured, the traffic of each completed interval
+ * is kept next to the lifetime totals, so that a poll at any point in
+ * the next interval returns the same figures.
+ *
+ * Over UAPI reset_stats=true resets a peer, stats_interval=<seconds>
+ * sets the interval, and get reports the last completed interval as
+ * interval_{tx,rx}_{bytes,packets} with interval_end_sec.
+ */
+
+/* Receives the traffic of every peer at the end of each interval,
+ * called with the peers locked, so it must return quickly and never
+ * call back into the device
+ */
+type MetricsSink func(publicKey NoisePublicKey, counters PeerCounters, end time.Time)
+
+type PeerCounters struct {
+	TxBytes   uint64
+	RxBytes   uint64
+	TxPackets uint64
+	RxPackets uint64
+}
+
+func (counters PeerCounters) sub(base PeerCounters) PeerCounters {
+	return PeerCounters{
+		TxBytes:   counters.TxBytes - base.TxBytes,
+		RxBytes:   counters.RxBytes - base.RxBytes,
+		TxPackets: counters.TxPackets - base.TxPackets,
+		RxPackets: counters.RxPackets - base.RxPackets,
+	}
+}
+
+type intervalCounters struct {
+	sync.Mutex
+	base  PeerCounters // totals at the start of the current interval
+	last  PeerCounters // traffic of the last completed interval
+	end   time.Time    // of the last completed interval, zero if none
+	reset bool         // counters were reset during the current interval
+}
+
+/* Returns the lifetime totals of the peer, since the last reset
+ */
+func (peer *Peer) Counters() PeerCounters {
+	return PeerCounters{
+		TxBytes:   atomic.LoadUint64(&peer.stats.txBytes),
+		RxBytes:   atomic.LoadUint64(&peer.stats.rxBytes),
+		TxPackets: atomic.LoadUint64(&peer.stats.txPackets),
+		RxPackets: atomic.LoadUint64(&peer.stats.rxPackets),
+	}
+}
+
+func (peer *Peer) ResetCounters() {
+	peer.interval.Lock()
+	defer peer.interval.Unlock()
+
+	atomic.StoreUint64(&peer.stats.txBytes, 0)
+	atomic.StoreUint64(&peer.stats.rxBytes, 0)
+	atomic.StoreUint64(&peer.stats.txPackets, 0)
+	atomic.StoreUint64(&peer.stats.rxPackets, 0)
+	atomic.StoreUint64(&peer.stats.txPaddingBytes, 0)
+
+	peer.interval.base = PeerCounters{}
+	peer.interval.last = PeerCounters{}
+	peer.interval.end = time.Time{}
+	peer.interval.reset = true
+}
+
+/* Returns the traffic of the last completed interval and its end,
+ * false if there is none
+ */
+func (peer *Peer) IntervalCounters() (PeerCounters, time.Time, bool) {
+	peer.interval.Lock()
+	defer peer.interval.Unlock()
+	return peer.interval.last, peer.interval.end, !peer.interval.end.IsZero()
+}
+
+func (peer *Peer) completeInterval(now time.Time) {
+	peer.interval.Lock()
+	defer peer.interval.Unlock()
+
+	counters := peer.Counters()
+	if peer.interval.reset {
+
+		// the interval was cut short by a reset
+
+		peer.interval.reset = false
+	} else {
+		peer.interval.last = counters.sub(peer.interval.base)
+		peer.interval.end = now
+	}
+	peer.interval.base = counters
+}
+
+/* Keeps per-interval counters every interval (0 = disabled)
+ */
+func (device *Device) SetStatsInterval(interval time.Duration) {
+	device.statsInterval.Lock()
+	defer device.statsInterval.Unlock()
+
+	if device.statsInterval.stop != nil {
+		close(device.statsInterval.stop)
+		device.statsInterval.stop = nil
+	}
+	device.statsInterval.interval = interval
+	if interval == 0 || device.isClosed.Get() {
+		return
+	}
+
+	// intervals start now for all peers
+
+	device.peers.RLock()
+	for _, peer := range device.peers.keyMap {
+		peer.interval.Lock()
+		peer.interval.base = peer.Counters()
+		peer.interval.last = PeerCounters{}
+		peer.interval.end = time.Time{}
+		peer.interval.reset = false
+		peer.interval.Unlock()
+	}
+	device.peers.RUnlock()
+
+	stop := make(chan struct{})
+	device.statsInterval.stop = stop
+	go device.RoutineStatsInterval(interval, stop)
+}
+
+/* Passes the traffic of each completed interval to sink (nil = none)
+ */
+func (device *Device) SetMetricsSink(sink MetricsSink) {
+	device.statsInterval.Lock()
+	defer device.statsInterval.Unlock()
+	device.statsInterval.sink = sink
+}
+
+func (device *Device) StatsInterval() time.Duration {
+	device.statsInterval.Lock()
+	defer device.statsInterval.Unlock()
+	return device.statsInterval.interval
+}
+
+func (device *Device) RoutineStatsInterval(interval time.Duration, stop chan struct{}) {
+	logDebug := device.log.Debug
+	logDebug.Println("Routine: stats interval - started")
+	defer logDebug.Println("Routine: stats interval - stopped")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			device.statsInterval.Lock()
+			sink := device.statsInterval.sink
+			device.statsInterval.Unlock()
+
+			device.peers.RLock()
+			for _, peer := range device.peers.keyMap {
+				peer.completeInterval(now)
+				if sink == nil {
+					continue
+				}
+				if counters, end, ok := peer.IntervalCounters(); ok && end.Equal(now) {
+					sink(peer.handshake.remoteStatic, counters, end)
+				}
+			}
+			device.peers.RUnlock()
+		}
+	}
+}
@@ -0,0 +1,76 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPeerCounters(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	peer, err := device.NewPeer(sk.publicKey())
+	assertNil(t, err)
+
+	atomic.AddUint64(&peer.stats.txBytes, 100)
+	atomic.AddUint64(&peer.stats.txPackets, 1)
+	device.SetStatsInterval(time.Hour)
+	defer device.SetStatsInterval(0)
+
+	// traffic before the interval started is not counted in it
+
+	atomic.AddUint64(&peer.stats.rxBytes, 200)
+	atomic.AddUint64(&peer.stats.rxPackets, 2)
+	if _, _, ok := peer.IntervalCounters(); ok {
+		t.Fatal("interval reported before completion")
+	}
+	peer.completeInterval(time.Now())
+	counters, _, ok := peer.IntervalCounters()
+	if !ok || counters != (PeerCounters{RxBytes: 200, RxPackets: 2}) {
+		t.Fatalf("unexpected interval counters %+v", counters)
+	}
+	if peer.Counters() != (PeerCounters{TxBytes: 100, RxBytes: 200, TxPackets: 1, RxPackets: 2}) {
+		t.Fatalf("unexpected totals %+v", peer.Counters())
+	}
+
+	// reset over uapi clears both, the interval cut short is dropped
+
+	if err := ipcSet(device, "public_key="+peer.handshake.remoteStatic.ToHex()+"\nreset_stats=true\n"); err != nil {
+		t.Fatal(err)
+	}
+	if peer.Counters() != (PeerCounters{}) {
+		t.Fatal("counters not reset")
+	}
+	atomic.AddUint64(&peer.stats.txBytes, 10)
+	peer.completeInterval(time.Now())
+	if _, _, ok := peer.IntervalCounters(); ok {
+		t.Fatal("interval cut short by reset reported")
+	}
+	atomic.AddUint64(&peer.stats.txBytes, 20)
+	peer.completeInterval(time.Now())
+	if counters, _, _ := peer.IntervalCounters(); counters.TxBytes != 20 {
+		t.Fatalf("unexpected interval counters %+v", counters)
+	}
+
+	var buf strings.Builder
+	writer := bufio.NewWriter(&buf)
+	if err := device.IpcGetOperation(writer); err != nil {
+		t.Fatal(err)
+	}
+	writer.Flush()
+	for _, line := range []string{"stats_interval=3600\n", "tx_bytes=30\n", "interval_tx_bytes=20\n"} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("get lacks %q", line)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+/* Basic resistance to flow-timing correlation, both strictly opt-in
+ * per peer because of the bandwidth and latency cost:
+ *
+ * Cover traffic sends keepalives at exponentially distributed
+ * intervals with the configured mean, so that an idle tunnel is not
+ * distinguishable by the absence of packets. Like persistent keepalives
+ * this keeps the session, and hence handshakes, alive.
+ *
+ * Transmission jitter delays every data packet by a uniformly
+ * distributed duration up to the configured maximum. The sequential
+ * sender keeps the deadline of the last delayed packet and sends none
+ * before it, so packets stay in order, as TCP in the tunnel expects,
+ * while no packet leaves later than the maximum after it was queued,
+ * so delays do not add up and throughput is kept.
+ */
+
+const (
+	MaxCoverTrafficInterval = 3600 * 1000 // milliseconds
+	MaxTransmitJitter       = 1000        // milliseconds
+)
+
+func (peer *Peer) coverTrafficDelay() time.Duration {
+	mean := float64(atomic.LoadUint32(&peer.cover.intervalMs))
+	delay := rand.ExpFloat64() * mean
+	if delay > 10*mean {
+		delay = 10 * mean
+	}
+	return time.Duration(delay * float64(time.Millisecond))
+}
+
+func expiredCoverTraffic(peer *Peer) {
+	if atomic.LoadUint32(&peer.cover.intervalMs) > 0 {
+		peer.SendKeepalive()
+		peer.timersCoverTraffic()
+	}
+}
+
+/* Should be called when the peer starts and when cover traffic is enabled */
+func (peer *Peer) timersCoverTraffic() {
+	if atomic.LoadUint32(&peer.cover.intervalMs) > 0 && peer.timersActive() {
+		peer.timers.coverTraffic.Mod(peer.coverTrafficDelay())
+	}
+}
+
+/* Returns the delay of the next data packet */
+func (peer *Peer) transmitJitter() time.Duration {
+	if jitter := atomic.LoadUint32(&peer.cover.jitterMs); jitter > 0 {
+		return time.Duration(rand.Int63n(int64(jitter) * int64(time.Millisecond)))
+	}
+	return 0
+}
@@ -0,0 +1,124 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCoverTrafficDelay(t *testing.T) {
+	peer := &Peer{}
+	peer.cover.intervalMs = 100
+
+	var total time.Duration
+	for i := 0; i < 1000; i++ {
+		delay := peer.coverTrafficDelay()
+		if delay < 0 || delay > time.Second {
+			t.Fatalf("delay out of range: %v", delay)
+		}
+		total += delay
+	}
+	if mean := total / 1000; mean < 50*time.Millisecond || mean > 150*time.Millisecond {
+		t.Errorf("unexpected mean delay: %v", mean)
+	}
+}
+
+func TestCoverTrafficConfig(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	peer := "public_key=" + strings.Repeat("ab", 32) + "\n"
+	if err := ipcSet(device, peer+"cover_traffic_interval_ms=500\ntransmit_jitter_ms=20\n"); err != nil {
+		t.Fatal(err)
+	}
+	for _, config := range []string{"cover_traffic_interval_ms=-1\n", "transmit_jitter_ms=5000\n"} {
+		if err := ipcSet(device, peer+config); err == nil {
+			t.Errorf("config %q: expected error", config)
+		}
+	}
+}
+
+func TestTransmitJitterThroughput(t *testing.T) {
+	device1, device2, peer1, _ := selftestPair(t)
+	defer device1.Close()
+	defer device2.Close()
+
+	// delays of 50ms on average would take 2.5s if added up
+
+	atomic.StoreUint32(&peer1.cover.jitterMs, 100)
+	result, err := peer1.SelfTest(SelfTestOptions{Packets: 50, Size: 500, Echo: true, Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Received != result.Sent {
+		t.Fatalf("%d of %d jittered packets arrived", result.Received, result.Sent)
+	}
+}
+
+/* Records the counters of the transport messages sent with data
+ */
+type counterBind struct {
+	Bind
+	sync.Mutex
+	counters []uint64
+}
+
+func (bind *counterBind) Send(buff []byte, end Endpoint) error {
+	if len(buff) > MessageKeepaliveSize && binary.LittleEndian.Uint32(buff) == MessageTransportType {
+		bind.Lock()
+		bind.counters = append(bind.counters, binary.LittleEndian.Uint64(buff[MessageTransportOffsetCounter:]))
+		bind.Unlock()
+	}
+	return bind.Bind.Send(buff, end)
+}
+
+func TestTransmitJitterOrder(t *testing.T) {
+	device1, device2, peer1, _ := selftestPair(t)
+	defer device1.Close()
+	defer device2.Close()
+
+	if err := peer1.awaitSession(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	bind := &counterBind{}
+	device1.net.Lock()
+	bind.Bind = device1.net.bind
+	device1.net.bind = bind
+	device1.net.Unlock()
+
+	atomic.StoreUint32(&peer1.cover.jitterMs, 20)
+	const packets = 50
+	msg := make([]byte, 100)
+	for i := 0; i < packets; i++ {
+		if !peer1.sendSelfTest(msg, time.Second) {
+			t.Fatal("outbound queue stalled")
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		bind.Lock()
+		counters := append([]uint64(nil), bind.counters...)
+		bind.Unlock()
+		for i := 1; i < len(counters); i++ {
+			if counters[i] < counters[i-1] {
+				t.Fatalf("jittered packets reordered: %v", counters)
+			}
+		}
+		if len(counters) >= packets {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d jittered packets sent", len(counters), packets)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
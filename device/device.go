@@ -6,24 +6,40 @@
 package device
 
 import (
+	"net"
+	"os"
 	"runtime"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"golang.org/x/crypto/blake2s"
 	"golang.zx2c4.com/wireguard/ratelimiter"
+	"golang.zx2c4.com/wireguard/relay"
 	"golang.zx2c4.com/wireguard/tun"
+	"golang.zx2c4.com/wireguard/turn"
 )
 
 const (
-	DeviceRoutineNumberPerCPU     = 3
+	DeviceRoutineNumberPerCPU     = 2 // plus the handshake workers, see DeviceOptions
 	DeviceRoutineNumberAdditional = 2
 )
 
 type Device struct {
+	// This must be 64-bit aligned, so it is kept as the first member
+	stats struct {
+		drops [queueCount][dropReasonCount]uint64 // packets dropped per queue and reason
+	}
+
+	memory struct {
+		sync.Mutex
+		committed uint64 // to peers and allowed IPs, see memory.go
+	}
+
 	isUp     AtomicBool // device is (going) up
 	isClosed AtomicBool // device is closed? (acting as guard)
 	log      *Logger
+	options  DeviceOptions // immutable after creation
 
 	// synchronized resources (locks acquired in order)
 
@@ -39,20 +55,179 @@ type Device struct {
 		starting sync.WaitGroup
 		stopping sync.WaitGroup
 		sync.RWMutex
-		bind   Bind   // bind interface
-		port   uint16 // listening port
-		fwmark uint32 // mark value (0 = disabled)
+		bind        Bind   // bind interface
+		port        uint16 // listening port
+		fwmark      uint32 // mark value (0 = disabled)
+		controlBind Bind   // bind interface for handshake messages
+		controlPort uint16 // listening port for handshake messages (0 = disabled)
+
+		relayBind    *relayBind // fallback for peers unreachable directly
+		relayAddress string     // address of relay server ("" = disabled)
+		relaySecret  relay.Key  // secret shared with relay server
+
+		turnBind     *turnBind // fallback through a TURN allocation
+		turnServer   string    // address of TURN server ("" = disabled)
+		turnUsername string
+		turnPassword string
+
+		shared *SharedBind // replaces the own socket if not nil, see sharedbind.go
+	}
+
+	gossip struct {
+		coordinator AtomicBool // announce peers to each other, see gossip.go
+	}
+
+	unreachable struct {
+		timeoutSec uint32 // flag peers not answering for this long (0 = disabled), see unreachable.go
+	}
+
+	rekeyJitterMs uint32 // maximum advance of rekeys, see rekeyjitter.go
+
+	pacing struct {
+		sync.Mutex
+		enabled     AtomicBool // handshake initiations are paced, see pacing.go
+		rate        uint32     // initiations per second
+		burst       float64
+		burstConfig uint32 // as configured, 0 = default
+		tokens      float64
+		last        time.Time
+	}
+
+	statsInterval struct {
+		sync.Mutex
+		interval time.Duration // per-interval peer counters (0 = disabled), see counters.go
+		stop     chan struct{}
+		sink     MetricsSink
+	}
+
+	roaming struct {
+		hook atomic.Value // RoamingHook, see roaming.go
+	}
+
+	sanitize struct {
+		policy int32 // IPOptionsPolicy for packets from peers, see sanitize.go
+	}
+
+	mss struct {
+		clamp int32 // MSS of TCP SYN segments clamped to, see mss.go
+	}
+
+	tunDown struct {
+		sync.Mutex
+		policy TunDownPolicy // when the TUN interface goes down, see tundown.go
+		grace  time.Duration
+		timer  *time.Timer // pending grace period
+	}
+
+	keyLog struct {
+		sync.Mutex
+		file       *os.File        // set by OpenKeyLog, see keylog.go
+		privateKey NoisePrivateKey // copy of the static private key while logging
+	}
+
+	events struct {
+		sync.Mutex              // held when adding handlers
+		handlers   atomic.Value // []func(Event), see events.go
+	}
+
+	acl struct {
+		sync.Mutex              // held when changing sources
+		sources    atomic.Value // []net.IPNet permitted to initiate, see acl.go
+	}
+
+	matches struct {
+		sync.Mutex              // held when changing rules
+		rules      atomic.Value // []*matchRule, see match.go
+	}
+
+	shaper struct {
+		sync.Mutex
+		enabled      AtomicBool // egress rate is limited, see shaper.go
+		rate         uint64     // bits per second
+		burst        float64    // bytes
+		pacing       time.Duration
+		burstConfig  uint32 // as configured, 0 = default
+		pacingConfig time.Duration
+		tokens       float64 // bytes available, negative while packets wait
+		last         time.Time
+	}
+
+	ipcJobs struct {
+		sync.Mutex
+		running sync.Mutex            // held while a configuration is applied
+		jobs    map[uint64]*IpcSetJob // see uapi_async.go
+		queue   []*IpcSetJob          // submitted, not yet applied
+		working bool                  // RoutineIpcJobs is draining the queue
+		lastID  uint64
+	}
+
+	flow struct {
+		sync.Mutex
+		collector string
+		version   int
+		exporter  atomic.Value // *flowExporter, nil if disabled, see flow.go
+	}
+
+	mirror struct {
+		sync.Mutex
+		config MirrorConfig
+		state  atomic.Value // *mirror, nil if disabled, see mirror.go
+	}
+
+	ha struct {
+		sync.Mutex
+		role        HARole
+		address     string
+		secret      HAKey
+		conn        *net.UDPConn // replication socket, see ha.go
+		standby     AtomicBool   // suppress handshake initiations
+		lastCounter uint64       // of the last message applied by the standby
+		lastSync    time.Time
+	}
+
+	nat64 struct {
+		sync.RWMutex
+		prefix        *net.IPNet // discovered NAT64 prefix, see nat64.go
+		lastDiscovery time.Time
+		discovering   bool
+	}
+
+	resolver struct {
+		sync.RWMutex
+		resolver Resolver // of host names, see resolver.go
+	}
+
+	maintenance struct {
+		sync.Mutex
+		active   AtomicBool // refusing new sessions, see maintenance.go
+		deadline time.Time
+		refusal  MaintenanceRefusal
+		stop     chan struct{}
+		running  sync.WaitGroup // maintenance routines, awaited on close
+	}
+
+	resumption struct {
+		sync.Mutex
+		tickets map[resumptionTicket]*Peer // accepted for resume initiations, see resumption.go
+	}
+
+	stun struct {
+		sync.Mutex
+		pending map[turn.TransactionID]chan *net.UDPAddr // outstanding binding requests
 	}
 
 	staticIdentity struct {
 		sync.RWMutex
-		privateKey NoisePrivateKey
-		publicKey  NoisePublicKey
+		privateKey  NoisePrivateKey
+		provider    KeyProvider // replaces privateKey if not nil, see keyprovider.go
+		publicKey   NoisePublicKey
+		initialHash [blake2s.Size]byte // initial hash mixed with public key, for responders
 	}
 
 	peers struct {
 		sync.RWMutex
 		keyMap map[NoisePublicKey]*Peer
+		empty  AtomicBool // mirrors len(keyMap) == 0 for lock-free readers
 	}
 
 	// unprotected / "self-synchronising resources"
@@ -77,7 +252,7 @@ type Device struct {
 
 	queue struct {
 		encryption chan *QueueOutboundElement
-		decryption chan *QueueInboundElement
+		decryption []chan *QueueInboundElement // one per worker, see decryptionQueue
 		handshake  chan QueueHandshakeElement
 	}
 
@@ -100,12 +275,16 @@ func unsafeRemovePeer(device *Device, peer *Peer, key NoisePublicKey) {
 
 	// stop routing and processing of packets
 
-	device.allowedips.RemoveByPeer(peer)
+	device.removeAllowedIPs(peer)
+	device.releaseMemory(device.memoryPerPeer())
 	peer.Stop()
+	peer.SetResumption(false)
+	device.forgetMatches(peer)
 
 	// remove from peer map
 
 	delete(device.peers.keyMap, key)
+	device.peers.empty.Set(len(device.peers.keyMap) == 0)
 }
 
 func deviceUpdateState(device *Device) {
@@ -140,8 +319,12 @@ func deviceUpdateState(device *Device) {
 		device.peers.RLock()
 		for _, peer := range device.peers.keyMap {
 			peer.Start()
+
+			// initiate at once rather than behind a queued keepalive,
+			// so the session is ready when the first packet arrives
+
 			if peer.persistentKeepaliveInterval > 0 {
-				peer.SendKeepalive()
+				peer.SendHandshakeInitiation(false)
 			}
 		}
 		device.peers.RUnlock()
@@ -188,7 +371,7 @@ func (device *Device) IsUnderLoad() bool {
 	// check if currently under load
 
 	now := time.Now()
-	underLoad := len(device.queue.handshake) >= UnderLoadQueueSize
+	underLoad := len(device.queue.handshake) >= cap(device.queue.handshake)/8
 	if underLoad {
 		device.rate.underLoadUntil.Store(now.Add(UnderLoadAfterTime))
 		return true
@@ -206,10 +389,18 @@ func (device *Device) SetPrivateKey(sk NoisePrivateKey) error {
 	device.staticIdentity.Lock()
 	defer device.staticIdentity.Unlock()
 
-	if sk.Equals(device.staticIdentity.privateKey) {
+	if device.staticIdentity.provider == nil && sk.Equals(device.staticIdentity.privateKey) {
 		return nil
 	}
 
+	device.unsafeSetStaticIdentity(sk, nil)
+	return nil
+}
+
+/* Replaces the static key by either sk or, if not nil, the provider.
+ * Should be called with the static identity locked.
+ */
+func (device *Device) unsafeSetStaticIdentity(sk NoisePrivateKey, provider KeyProvider) {
 	device.peers.Lock()
 	defer device.peers.Unlock()
 
@@ -221,7 +412,12 @@ func (device *Device) SetPrivateKey(sk NoisePrivateKey) error {
 
 	// remove peers with matching public keys
 
-	publicKey := sk.publicKey()
+	var publicKey NoisePublicKey
+	if provider != nil {
+		publicKey = provider.PublicKey()
+	} else {
+		publicKey = sk.publicKey()
+	}
 	for key, peer := range device.peers.keyMap {
 		if peer.handshake.remoteStatic.Equals(publicKey) {
 			unsafeRemovePeer(device, peer, key)
@@ -231,12 +427,15 @@ func (device *Device) SetPrivateKey(sk NoisePrivateKey) error {
 	// update key material
 
 	device.staticIdentity.privateKey = sk
+	device.staticIdentity.provider = provider
 	device.staticIdentity.publicKey = publicKey
+	device.keyLogPrivateKey(sk)
+	mixHash(&device.staticIdentity.initialHash, &InitialHash, publicKey[:])
 	device.cookieChecker.Init(publicKey)
 
 	// do static-static DH pre-computations
 
-	rmKey := device.staticIdentity.privateKey.IsZero()
+	rmKey := provider == nil && sk.IsZero()
 
 	expiredPeers := make([]*Peer, 0, len(device.peers.keyMap))
 	for key, peer := range device.peers.keyMap {
@@ -245,7 +444,7 @@ func (device *Device) SetPrivateKey(sk NoisePrivateKey) error {
 		if rmKey {
 			handshake.precomputedStaticStatic = [NoisePublicKeySize]byte{}
 		} else {
-			handshake.precomputedStaticStatic = device.staticIdentity.privateKey.sharedSecret(handshake.remoteStatic)
+			handshake.precomputedStaticStatic, _ = device.staticSharedSecret(handshake.remoteStatic)
 		}
 
 		if isZero(handshake.precomputedStaticStatic[:]) {
@@ -260,18 +459,22 @@ func (device *Device) SetPrivateKey(sk NoisePrivateKey) error {
 	}
 	for _, peer := range expiredPeers {
 		peer.ExpireCurrentKeypairs()
+		peer.dropResumptionTicket() // issued under the old key
 	}
-
-	return nil
 }
 
 func NewDevice(tunDevice tun.Device, logger *Logger) *Device {
+	return NewDeviceWithOptions(tunDevice, logger, DeviceOptions{})
+}
+
+func NewDeviceWithOptions(tunDevice tun.Device, logger *Logger, options DeviceOptions) *Device {
 	device := new(Device)
 
 	device.isUp.Set(false)
 	device.isClosed.Set(false)
 
 	device.log = logger
+	device.options = options.withDefaults()
 
 	device.tun.device = tunDevice
 	mtu, err := device.tun.device.MTU()
@@ -280,11 +483,16 @@ func NewDevice(tunDevice tun.Device, logger *Logger) *Device {
 		mtu = DefaultMTU
 	}
 	device.tun.mtu = int32(mtu)
+	if mtu > device.maxMTU() {
+		logger.Error.Println("MTU", mtu, "exceeds maximum of", device.maxMTU())
+	}
 
 	device.peers.keyMap = make(map[NoisePublicKey]*Peer)
+	device.peers.empty.Set(true)
 
 	device.rate.limiter.Init()
 	device.rate.underLoadUntil.Store(time.Time{})
+	device.tunDown.grace = TunDownDefaultGrace
 
 	device.indexTable.Init()
 	device.allowedips.Reset()
@@ -293,9 +501,13 @@ func NewDevice(tunDevice tun.Device, logger *Logger) *Device {
 
 	// create queues
 
-	device.queue.handshake = make(chan QueueHandshakeElement, QueueHandshakeSize)
-	device.queue.encryption = make(chan *QueueOutboundElement, QueueOutboundSize)
-	device.queue.decryption = make(chan *QueueInboundElement, QueueInboundSize)
+	device.queue.handshake = make(chan QueueHandshakeElement, device.options.HandshakeQueueSize)
+	device.queue.encryption = make(chan *QueueOutboundElement, device.options.EncryptionQueueSize)
+	device.queue.decryption = make([]chan *QueueInboundElement, runtime.NumCPU())
+	shardSize := (device.options.DecryptionQueueSize + len(device.queue.decryption) - 1) / len(device.queue.decryption)
+	for i := range device.queue.decryption {
+		device.queue.decryption[i] = make(chan *QueueInboundElement, shardSize)
+	}
 
 	// prepare signals
 
@@ -311,11 +523,14 @@ func NewDevice(tunDevice tun.Device, logger *Logger) *Device {
 	cpus := runtime.NumCPU()
 	device.state.starting.Wait()
 	device.state.stopping.Wait()
-	device.state.stopping.Add(DeviceRoutineNumberPerCPU*cpus + DeviceRoutineNumberAdditional)
-	device.state.starting.Add(DeviceRoutineNumberPerCPU*cpus + DeviceRoutineNumberAdditional)
+	routines := DeviceRoutineNumberPerCPU*cpus + device.options.HandshakeWorkers + DeviceRoutineNumberAdditional
+	device.state.stopping.Add(routines)
+	device.state.starting.Add(routines)
 	for i := 0; i < cpus; i += 1 {
 		go device.RoutineEncryption()
-		go device.RoutineDecryption()
+		go device.RoutineDecryption(device.queue.decryption[i])
+	}
+	for i := 0; i < device.options.HandshakeWorkers; i += 1 {
 		go device.RoutineHandshake()
 	}
 
@@ -354,20 +569,42 @@ func (device *Device) RemoveAllPeers() {
 	}
 
 	device.peers.keyMap = make(map[NoisePublicKey]*Peer)
+	device.peers.empty.Set(true)
+}
+
+/* Removes all peers with an allowed IP within the prefix,
+ * returns the number of peers removed
+ */
+func (device *Device) RemovePeersByAllowedIP(prefix net.IPNet) int {
+	device.peers.Lock()
+	defer device.peers.Unlock()
+
+	removed := 0
+	for _, peer := range device.allowedips.PeersWithin(prefix) {
+		key := peer.handshake.remoteStatic
+		if device.peers.keyMap[key] == peer {
+			unsafeRemovePeer(device, peer, key)
+			removed++
+		}
+	}
+	return removed
 }
 
 func (device *Device) FlushPacketQueues() {
+	for _, queue := range device.queue.decryption {
+		device.flushDecryptionQueue(queue)
+	}
 	for {
 		select {
-		case elem, ok := <-device.queue.decryption:
+		case elem, ok := <-device.queue.encryption:
 			if ok {
 				elem.Drop()
+				device.countDrop(QueueEncryption, DropFlushed)
 			}
-		case elem, ok := <-device.queue.encryption:
+		case _, ok := <-device.queue.handshake:
 			if ok {
-				elem.Drop()
+				device.countDrop(QueueHandshake, DropFlushed)
 			}
-		case <-device.queue.handshake:
 		default:
 			return
 		}
@@ -375,6 +612,20 @@ func (device *Device) FlushPacketQueues() {
 
 }
 
+func (device *Device) flushDecryptionQueue(queue chan *QueueInboundElement) {
+	for {
+		select {
+		case elem, ok := <-queue:
+			if ok {
+				elem.Drop()
+				device.countDrop(QueueDecryption, DropFlushed)
+			}
+		default:
+			return
+		}
+	}
+}
+
 func (device *Device) Close() {
 	if device.isClosed.Swap(true) {
 		return
@@ -400,6 +651,19 @@ func (device *Device) Close() {
 	device.FlushPacketQueues()
 
 	device.rate.limiter.Close()
+	device.tunDown.Lock()
+	if device.tunDown.timer != nil {
+		device.tunDown.timer.Stop()
+		device.tunDown.timer = nil
+	}
+	device.tunDown.Unlock()
+	device.closeKeyLog()
+	device.closeHA()
+	device.closeFlowExport()
+	device.closeMirror()
+	device.EndMaintenance()
+	device.maintenance.running.Wait()
+	device.SetStatsInterval(0)
 
 	device.state.changing.Set(false)
 	device.log.Info.Println("Interface closed")
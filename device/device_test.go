@@ -11,7 +11,12 @@ package device
 
 import (
 	"bytes"
+	"encoding/binary"
+	"net"
 	"testing"
+	"time"
+
+	"golang.org/x/net/ipv6"
 )
 
 func TestDevice(t *testing.T) {
@@ -43,7 +48,7 @@ func TestDevice(t *testing.T) {
 
 }
 
-func randDevice(t *testing.T) *Device {
+func randDevice(t testing.TB) *Device {
 	sk, err := newPrivateKey()
 	if err != nil {
 		t.Fatal(err)
@@ -66,3 +71,70 @@ func assertEqual(t *testing.T, a, b []byte) {
 		t.Fatal(a, "!=", b)
 	}
 }
+
+func TestUpInitiatesKeepalivePeers(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	pk := sk.publicKey()
+	if err := ipcSet(device, "listen_port=0\npublic_key="+pk.ToHex()+"\nendpoint=127.0.0.1:9\npersistent_keepalive_interval=25\n"); err != nil {
+		t.Fatal(err)
+	}
+	peer := device.LookupPeer(pk)
+
+	device.Up()
+	peer.handshake.mutex.RLock()
+	sent := time.Since(peer.handshake.lastSentHandshake)
+	peer.handshake.mutex.RUnlock()
+	if sent > time.Second {
+		t.Fatal("no handshake initiated on bring-up")
+	}
+}
+
+func TestFailedInitiationRetriesSoon(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	peer, err := device.NewPeer(sk.publicKey())
+	assertNil(t, err)
+	peer.endpoint, err = CreateEndpoint("127.0.0.1:9")
+	assertNil(t, err)
+
+	// the device is down, so the initiation cannot be sent
+
+	if peer.SendHandshakeInitiation(false) == nil {
+		t.Fatal("initiation sent without bind")
+	}
+	peer.handshake.mutex.RLock()
+	wait := peer.handshake.lastSentHandshake.Add(RekeyTimeout).Sub(time.Now())
+	peer.handshake.mutex.RUnlock()
+	if wait > HandshakeInitationRate {
+		t.Fatalf("retry held back for %v", wait)
+	}
+}
+
+func TestTruncatedPacket(t *testing.T) {
+	local, remote := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	packet := append(testPacketIPv4(17, local, remote, 1000, 2000), make([]byte, 8972)...)
+	binary.BigEndian.PutUint16(packet[IPv4offsetTotalLength:], uint16(len(packet)))
+	if truncatedPacket(packet) {
+		t.Fatal("complete jumbo packet reported truncated")
+	}
+	if !truncatedPacket(packet[:2048]) {
+		t.Fatal("truncated IPv4 packet not detected")
+	}
+
+	packet6 := make([]byte, ipv6.HeaderLen+8960)
+	packet6[0] = ipv6.Version << 4
+	binary.BigEndian.PutUint16(packet6[IPv6offsetPayloadLength:], 8960)
+	if truncatedPacket(packet6) {
+		t.Fatal("complete IPv6 jumbo packet reported truncated")
+	}
+	if !truncatedPacket(packet6[:1500]) {
+		t.Fatal("truncated IPv6 packet not detected")
+	}
+}
@@ -0,0 +1,262 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"golang.zx2c4.com/wireguard/ipc"
+)
+
+var handshakeStateNames = map[int]string{
+	HandshakeZeroed:             "zeroed",
+	HandshakeInitiationCreated:  "initiation created",
+	HandshakeInitiationConsumed: "initiation consumed",
+	HandshakeResponseCreated:    "response created",
+	HandshakeResponseConsumed:   "response consumed",
+	handshakeResumeCreated:      "resume initiation created",
+}
+
+func dumpAge(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return time.Since(t).Round(time.Millisecond).String() + " ago"
+}
+
+func dumpKeypair(w io.Writer, name string, keypair *Keypair) {
+	if keypair == nil {
+		fmt.Fprintf(w, "    keypair %s: none\n", name)
+		return
+	}
+	fmt.Fprintf(w, "    keypair %s: created %s, initiator %v, send nonce %d, index %d->%d\n",
+		name,
+		dumpAge(keypair.created),
+		keypair.isInitiator,
+		atomic.LoadUint64(&keypair.sendNonce),
+		keypair.localIndex,
+		keypair.remoteIndex,
+	)
+}
+
+func dumpTimer(w io.Writer, name string, timer *Timer) {
+	pending := timer != nil && timer.IsPending()
+	fmt.Fprintf(w, "    timer %s: pending %v\n", name, pending)
+}
+
+func (peer *Peer) dumpState(w io.Writer) {
+	fmt.Fprintf(w, "  %v\n", peer)
+
+	peer.RLock()
+	if peer.endpoint != nil {
+		fmt.Fprintf(w, "    endpoint: %s (source %s)\n", peer.endpoint.DstToString(), peer.endpoint.SrcToString())
+	} else {
+		fmt.Fprintf(w, "    endpoint: none\n")
+	}
+	fmt.Fprintf(w, "    persistent keepalive: %ds\n", peer.persistentKeepaliveInterval)
+	peer.RUnlock()
+
+	fmt.Fprintf(w, "    running: %v, disabled: %v, unreachable: %v, relayed: %v\n", peer.isRunning.Get(), peer.disabled.Get(), peer.unreachable.Get(), peer.relay.active.Get())
+	fmt.Fprintf(w, "    tx bytes: %d, rx bytes: %d\n", atomic.LoadUint64(&peer.stats.txBytes), atomic.LoadUint64(&peer.stats.rxBytes))
+	fmt.Fprintf(w, "    tx packets: %d, rx packets: %d\n", atomic.LoadUint64(&peer.stats.txPackets), atomic.LoadUint64(&peer.stats.rxPackets))
+	fmt.Fprintf(w, "    cover traffic: %dms, transmit jitter: %dms\n", atomic.LoadUint32(&peer.cover.intervalMs), atomic.LoadUint32(&peer.cover.jitterMs))
+	fmt.Fprintf(w, "    padding: %s, %d bytes\n", PaddingModeName(int(atomic.LoadInt32(&peer.padding))), atomic.LoadUint64(&peer.stats.txPaddingBytes))
+	fmt.Fprintf(w, "    gossip: coordinator %v, learned %v\n", peer.gossip.coordinator.Get(), peer.gossip.learned.Get())
+	if jitter, own := peer.RekeyJitter(); own {
+		fmt.Fprintf(w, "    rekey jitter: %v\n", jitter)
+	} else {
+		fmt.Fprintf(w, "    rekey jitter: %v (device)\n", jitter)
+	}
+	if quality, ok := peer.Quality(); ok {
+		fmt.Fprintf(w, "    quality: %d, rtt %v, loss %d‰, retries %d‰\n", quality.Score, quality.RTT, quality.Loss, quality.Retries)
+	} else {
+		fmt.Fprintf(w, "    quality: unknown\n")
+	}
+	if peer.Resumption() {
+		peer.resumption.Lock()
+		fmt.Fprintf(w, "    resumption: ticket %v, announced %v, resumed %d\n", peer.resumption.valid, peer.resumption.ready, peer.ResumedSessions())
+		peer.resumption.Unlock()
+	}
+
+	lastHandshake := atomic.LoadInt64(&peer.stats.lastHandshakeNano)
+	if lastHandshake == 0 {
+		fmt.Fprintf(w, "    last handshake: never\n")
+	} else {
+		fmt.Fprintf(w, "    last handshake: %s\n", dumpAge(time.Unix(0, lastHandshake)))
+	}
+
+	handshake := &peer.handshake
+	handshake.mutex.RLock()
+	fmt.Fprintf(w, "    handshake: %s, local index %d, last sent %s\n",
+		handshakeStateNames[handshake.state],
+		handshake.localIndex,
+		dumpAge(handshake.lastSentHandshake),
+	)
+	handshake.mutex.RUnlock()
+
+	peer.keypairs.RLock()
+	dumpKeypair(w, "current", peer.keypairs.current)
+	dumpKeypair(w, "previous", peer.keypairs.previous)
+	dumpKeypair(w, "next", peer.keypairs.next)
+	peer.keypairs.RUnlock()
+
+	fmt.Fprintf(w, "    handshake attempts: %d\n", atomic.LoadUint32(&peer.timers.handshakeAttempts))
+	dumpTimer(w, "retransmit handshake", peer.timers.retransmitHandshake)
+	dumpTimer(w, "send keepalive", peer.timers.sendKeepalive)
+	dumpTimer(w, "new handshake", peer.timers.newHandshake)
+	dumpTimer(w, "zero key material", peer.timers.zeroKeyMaterial)
+	dumpTimer(w, "persistent keepalive", peer.timers.persistentKeepalive)
+
+	peer.routines.Lock()
+	if peer.isRunning.Get() {
+		fmt.Fprintf(w, "    queues: nonce %d/%d, outbound %d/%d, inbound %d/%d, awaiting key %v\n",
+			len(peer.queue.nonce), cap(peer.queue.nonce),
+			len(peer.queue.outbound), cap(peer.queue.outbound),
+			len(peer.queue.inbound), cap(peer.queue.inbound),
+			peer.queue.packetInNonceQueueIsAwaitingKey.Get(),
+		)
+	}
+	peer.routines.Unlock()
+}
+
+/* Writes a human readable diagnostic snapshot of the device,
+ * including the stacks of all goroutines, to w.
+ * Intended for bug reports about stalled tunnels.
+ *
+ * The snapshot is rendered before writing, so a slow writer
+ * does not hold any locks of the device.
+ */
+func (device *Device) DumpState(w io.Writer) error {
+	var buf bytes.Buffer
+	device.dumpState(&buf)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func (device *Device) dumpState(w *bytes.Buffer) {
+	fmt.Fprintf(w, "wireguard-go %s state dump at %s\n", WireGuardGoVersion, time.Now().Format(time.RFC3339))
+	fmt.Fprintf(w, "device: up %v, closed %v, mtu %d\n", device.isUp.Get(), device.isClosed.Get(), atomic.LoadInt32(&device.tun.mtu))
+
+	device.net.RLock()
+	if device.net.bind != nil {
+		fmt.Fprintf(w, "bind: %T, listen port %d, fwmark %d\n", device.net.bind, device.net.port, device.net.fwmark)
+	} else {
+		fmt.Fprintf(w, "bind: closed, listen port %d, fwmark %d\n", device.net.port, device.net.fwmark)
+	}
+	if device.net.relayAddress != "" {
+		fmt.Fprintf(w, "relay: %s, running %v\n", device.net.relayAddress, device.net.relayBind != nil)
+	}
+	if device.net.turnBind != nil {
+		fmt.Fprintf(w, "turn: %s, relayed address %v\n", device.net.turnServer, device.net.turnBind.relayedAddr())
+	}
+	if device.net.controlPort != 0 {
+		fmt.Fprintf(w, "control bind: %T, control port %d\n", device.net.controlBind, device.net.controlPort)
+	}
+	device.net.RUnlock()
+
+	fmt.Fprintf(w, "under load: %v, handshake workers %d\n", device.IsUnderLoad(), device.options.HandshakeWorkers)
+	fmt.Fprintf(w, "gossip coordinator: %v\n", device.gossip.coordinator.Get())
+
+	if collector, version := device.FlowExport(); collector != "" {
+		flows := 0
+		if exporter := device.loadFlowExporter(); exporter != nil {
+			exporter.Lock()
+			flows = len(exporter.flows)
+			exporter.Unlock()
+		}
+		fmt.Fprintf(w, "flow export: %s, version %d, flows %d\n", collector, version, flows)
+	}
+
+	if mirror := device.Mirror(); mirror.enabled() {
+		sent, dropped := device.MirrorStats()
+		fmt.Fprintf(w, "mirror: %s, sent %d, dropped %d\n", mirror.String(), sent, dropped)
+	}
+
+	if rate, _ := device.HandshakePacing(); rate != 0 {
+		device.pacing.Lock()
+		fmt.Fprintf(w, "handshake pacing: %d/s, burst %v, tokens %.1f\n", rate, device.pacing.burst, device.pacing.tokens)
+		device.pacing.Unlock()
+	}
+
+	if policy := device.IPOptionsPolicy(); policy != IPOptionsAllow {
+		fmt.Fprintf(w, "ip options: %s\n", policy)
+	}
+
+	if mss := device.MSSClamp(); mss != MSSClampOff {
+		fmt.Fprintf(w, "mss clamp: %s\n", formatMSSClamp(mss))
+	}
+
+	if active, deadline := device.Maintenance(); active {
+		fmt.Fprintf(w, "maintenance: deadline %s, refusal %s, sessions %d\n", deadline.Format(time.RFC3339), device.MaintenanceRefusal(), device.liveSessions())
+	}
+
+	if policy, grace := device.TunDownPolicy(); policy != TunDownStop {
+		device.tunDown.Lock()
+		fmt.Fprintf(w, "tun down: %s, grace %v, pending %v\n", policy, grace, device.tunDown.timer != nil)
+		device.tunDown.Unlock()
+	}
+
+	if rate, _, _ := device.EgressShaping(); rate != 0 {
+		device.shaper.Lock()
+		fmt.Fprintf(w, "egress shaping: %d bit/s, burst %.0f bytes, pacing %v, tokens %.0f\n", rate, device.shaper.burst, device.shaper.pacing, device.shaper.tokens)
+		device.shaper.Unlock()
+	}
+
+	device.ha.Lock()
+	if device.ha.role != HARoleNone {
+		fmt.Fprintf(w, "ha: %s, address %s, running %v, last sync %v\n", device.ha.role, device.ha.address, device.ha.conn != nil, device.ha.lastSync)
+	}
+	device.ha.Unlock()
+
+	device.nat64.RLock()
+	if device.nat64.prefix != nil {
+		fmt.Fprintf(w, "nat64 prefix: %v\n", device.nat64.prefix)
+	}
+	device.nat64.RUnlock()
+
+	for _, queue := range device.Stats().Queues {
+		fmt.Fprintf(w, "queue %s: %d/%d", queue.Name, queue.Depth, queue.Capacity)
+		for reason, drops := range queue.Drops {
+			fmt.Fprintf(w, ", dropped %s %d", DropReasonName(reason), drops)
+		}
+		fmt.Fprintf(w, "\n")
+	}
+
+	device.peers.RLock()
+	fmt.Fprintf(w, "peers: %d\n", len(device.peers.keyMap))
+	for _, peer := range device.peers.keyMap {
+		peer.dumpState(w)
+	}
+	device.peers.RUnlock()
+
+	buf := make([]byte, 1<<16)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	fmt.Fprintf(w, "goroutines: %d\n", runtime.NumGoroutine())
+	w.Write(buf)
+}
+
+func (device *Device) IpcDumpOperation(socket *bufio.Writer) *IPCError {
+	if err := device.DumpState(socket); err != nil {
+		return ipcErrorf(ipc.IpcErrorIO, ipc.ReasonIO, "failed to write output: %v", err)
+	}
+	if err := socket.Flush(); err != nil {
+		return ipcErrorf(ipc.IpcErrorIO, ipc.ReasonIO, "failed to write output: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDumpState(t *testing.T) {
+	dev1 := randDevice(t)
+	dev2 := randDevice(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	peer, err := dev1.NewPeer(dev2.staticIdentity.publicKey)
+	assertNil(t, err)
+
+	var buf bytes.Buffer
+	dev1.DumpState(&buf)
+	dump := buf.String()
+
+	for _, expected := range []string{"peers: 1", peer.String(), "queue handshake", "goroutine"} {
+		if !strings.Contains(dump, expected) {
+			t.Errorf("state dump does not contain %q", expected)
+		}
+	}
+}
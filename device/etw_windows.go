@@ -0,0 +1,150 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+/* Event Tracing for Windows
+ *
+ * Events of the device and error log lines are written as strings to
+ * the ETW provider "WireGuard-Go" (ETWProviderGUID), so that
+ * administrators can collect them with standard tooling, such as
+ *
+ *   logman start wireguard -p {5b1c6d8e-3f2a-4c71-9a0e-7d2f4b8c1e36} -ets
+ *
+ * Keywords select the kind of event, see ETWKeyword*.
+ */
+
+var ETWProviderGUID = windows.GUID{
+	Data1: 0x5b1c6d8e,
+	Data2: 0x3f2a,
+	Data3: 0x4c71,
+	Data4: [8]byte{0x9a, 0x0e, 0x7d, 0x2f, 0x4b, 0x8c, 0x1e, 0x36},
+}
+
+const (
+	ETWKeywordHandshake = 1 << iota
+	ETWKeywordRoaming
+	ETWKeywordPeerState
+	ETWKeywordError
+)
+
+const (
+	etwLevelError       = 2
+	etwLevelWarning     = 3
+	etwLevelInformation = 4
+)
+
+var (
+	modadvapi32          = windows.NewLazySystemDLL("advapi32.dll")
+	procEventRegister    = modadvapi32.NewProc("EventRegister")
+	procEventUnregister  = modadvapi32.NewProc("EventUnregister")
+	procEventWriteString = modadvapi32.NewProc("EventWriteString")
+)
+
+type ETWProvider struct {
+	handle uint64
+}
+
+func RegisterETWProvider() (*ETWProvider, error) {
+	provider := new(ETWProvider)
+	ret, _, _ := procEventRegister.Call(
+		uintptr(unsafe.Pointer(&ETWProviderGUID)),
+		0,
+		0,
+		uintptr(unsafe.Pointer(&provider.handle)),
+	)
+	if ret != 0 {
+		return nil, syscall.Errno(ret)
+	}
+	return provider, nil
+}
+
+/* Splits a 64-bit argument as the calling convention requires
+ */
+func etwArgs(value uint64) []uintptr {
+	if unsafe.Sizeof(uintptr(0)) == 8 {
+		return []uintptr{uintptr(value)}
+	}
+	return []uintptr{uintptr(uint32(value)), uintptr(value >> 32)}
+}
+
+func (provider *ETWProvider) write(level uint8, keyword uint64, message string) {
+	text, err := windows.UTF16PtrFromString(message)
+	if err != nil {
+		return
+	}
+	var args []uintptr
+	args = append(args, etwArgs(provider.handle)...)
+	args = append(args, uintptr(level))
+	args = append(args, etwArgs(keyword)...)
+	args = append(args, uintptr(unsafe.Pointer(text)))
+	procEventWriteString.Call(args...)
+}
+
+/* Writes events of the device, register as event handler
+ */
+func (provider *ETWProvider) Record(event Event) {
+	var level uint8 = etwLevelInformation
+	var keyword uint64
+	switch event.Type {
+	case EventHandshakeComplete:
+		keyword = ETWKeywordHandshake
+	case EventPeerRoamed:
+		keyword = ETWKeywordRoaming
+	case EventRoamRejected:
+		keyword = ETWKeywordRoaming
+		level = etwLevelWarning
+	case EventPeerUnreachable:
+		keyword = ETWKeywordPeerState
+		level = etwLevelWarning
+	default:
+		keyword = ETWKeywordPeerState
+	}
+
+	message := fmt.Sprintf("%s peer=%s", event.Type, base64.StdEncoding.EncodeToString(event.PublicKey[:]))
+	if event.Endpoint != "" {
+		message += " endpoint=" + event.Endpoint
+	}
+	if event.Type == EventHandshakeComplete {
+		message += fmt.Sprintf(" initiator=%v", event.Initiator)
+	}
+	if event.Type == EventMaintenanceProgress || event.Type == EventMaintenanceDrained {
+		message = fmt.Sprintf("%s sessions=%d", event.Type, event.Sessions)
+	}
+	provider.write(level, keyword, message)
+}
+
+/* Writes every line as an error event, for use as additional
+ * output of the error log
+ */
+func (provider *ETWProvider) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		provider.write(etwLevelError, ETWKeywordError, line)
+	}
+	return len(p), nil
+}
+
+func (provider *ETWProvider) Close() error {
+	if provider.handle == 0 {
+		return nil
+	}
+	args := etwArgs(provider.handle)
+	provider.handle = 0
+	ret, _, _ := procEventUnregister.Call(args...)
+	if ret != 0 {
+		return syscall.Errno(ret)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"time"
+)
+
+/* Events notify embedders of changes in the state of peers, and of
+ * the progress of maintenance, whose events concern no peer.
+ *
+ * Handlers are called synchronously from the routine in which the
+ * event occurs, possibly concurrently, and must therefore return
+ * quickly and never call back into the device.
+ */
+
+type EventType int
+
+const (
+	EventHandshakeComplete   EventType = iota // a new session was established
+	EventPeerUnreachable                      // the peer stopped answering, see unreachable.go
+	EventPeerRecovered                        // an unreachable peer answered again
+	EventPeerRoamed                           // the peer sent from a new endpoint
+	EventPeerExpired                          // the session expired without a new handshake
+	EventRoamRejected                         // an endpoint change was refused, see roaming.go
+	EventAllowedIPOverlap                     // an allowed IP took routing from another peer, see overlap.go
+	EventQualityDegraded                      // the connection quality fell, see quality.go
+	EventQualityRestored                      // the connection quality recovered
+	EventMaintenanceProgress                  // sessions remaining to drain, see maintenance.go
+	EventMaintenanceDrained                   // no sessions remain, or they were cut
+	eventTypeCount
+)
+
+var eventTypeNames = [eventTypeCount]string{
+	EventHandshakeComplete:   "handshake_complete",
+	EventPeerUnreachable:     "peer_unreachable",
+	EventPeerRecovered:       "peer_recovered",
+	EventPeerRoamed:          "peer_roamed",
+	EventPeerExpired:         "peer_expired",
+	EventRoamRejected:        "roam_rejected",
+	EventAllowedIPOverlap:    "allowed_ip_overlap",
+	EventQualityDegraded:     "quality_degraded",
+	EventQualityRestored:     "quality_restored",
+	EventMaintenanceProgress: "maintenance_progress",
+	EventMaintenanceDrained:  "maintenance_drained",
+}
+
+func (t EventType) String() string {
+	if t < 0 || t >= eventTypeCount {
+		return "unknown"
+	}
+	return eventTypeNames[t]
+}
+
+type Event struct {
+	Type      EventType
+	Time      time.Time
+	PublicKey NoisePublicKey // of the peer concerned
+	Endpoint  string         // of the peer, empty if unknown, or the one rejected
+	Initiator bool           // for handshakes, whether this device initiated
+	Prefix    string         // for overlaps, the prefix taken
+	Displaced NoisePublicKey // for overlaps, the peer losing the prefix
+	Quality   int            // for quality changes, the score
+	Sessions  int            // for maintenance, the sessions remaining or cut
+}
+
+/* Registers a handler called for every event of the device
+ */
+func (device *Device) AddEventHandler(handler func(Event)) {
+	device.events.Lock()
+	defer device.events.Unlock()
+	handlers, _ := device.events.handlers.Load().([]func(Event))
+	device.events.handlers.Store(append(handlers[:len(handlers):len(handlers)], handler))
+}
+
+func (device *Device) hasEventHandlers() bool {
+	handlers, _ := device.events.handlers.Load().([]func(Event))
+	return len(handlers) > 0
+}
+
+func (device *Device) emit(event Event) {
+	handlers, _ := device.events.handlers.Load().([]func(Event))
+	for _, handler := range handlers {
+		handler(event)
+	}
+}
+
+func (peer *Peer) newEvent(eventType EventType) Event {
+	event := Event{
+		Type:      eventType,
+		Time:      time.Now(),
+		PublicKey: peer.handshake.remoteStatic,
+	}
+	peer.RLock()
+	if peer.endpoint != nil {
+		event.Endpoint = peer.endpoint.DstToString()
+	}
+	peer.RUnlock()
+	return event
+}
+
+/* Should be called after timersHandshakeComplete */
+func (peer *Peer) eventHandshakeComplete(initiator bool) {
+	event := peer.newEvent(EventHandshakeComplete)
+	event.Initiator = initiator
+	peer.device.emit(event)
+}
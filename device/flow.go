@@ -0,0 +1,429 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+/* Flow export
+ *
+ * When a collector is configured, decrypted traffic is aggregated into
+ * flows per peer, direction and 5-tuple, which are exported to the
+ * collector as NetFlow v9 or IPFIX every FlowExportInterval. Each export
+ * carries the delta since the previous one, after which the flows are
+ * forgotten. Templates are repeated in every message, as the collector
+ * may have missed earlier ones.
+ *
+ * Peers appear as interfaces: ingressInterface holds the peer of
+ * received traffic and egressInterface the peer of sent traffic, both
+ * as the first four bytes of its public key.
+ */
+
+const (
+	FlowExportInterval = 10 * time.Second
+	FlowVersionNetFlow = 9
+	FlowVersionIPFIX   = 10
+	MaxFlows           = 1 << 16
+)
+
+const (
+	flowIngress = 0
+	flowEgress  = 1
+
+	flowTemplateIPv4  = 256
+	flowTemplateIPv6  = 257
+	flowMaxPacketSize = 1400
+)
+
+type flowKey struct {
+	peer      *Peer
+	direction uint8
+	protocol  uint8
+	ipv6      bool
+	src, dst  [16]byte
+	srcPort   uint16
+	dstPort   uint16
+}
+
+type flowCounters struct {
+	bytes   uint64
+	packets uint64
+	start   time.Time
+	end     time.Time
+}
+
+type flowExporter struct {
+	conn    *net.UDPConn
+	version int
+	started time.Time
+	stop    chan struct{}
+
+	sync.Mutex
+	flows    map[flowKey]*flowCounters
+	dropped  uint64 // flows not tracked because of MaxFlows
+	sequence uint32
+}
+
+/* Exports flows to the collector at address using NetFlow version 9 or
+ * IPFIX (version 10), an empty address disables export
+ */
+func (device *Device) SetFlowExport(address string, version int) error {
+	if version != FlowVersionNetFlow && version != FlowVersionIPFIX {
+		return errors.New("flow export version must be 9 or 10")
+	}
+
+	device.flow.Lock()
+	defer device.flow.Unlock()
+
+	if exporter := device.loadFlowExporter(); exporter != nil {
+		device.flow.exporter.Store((*flowExporter)(nil))
+		close(exporter.stop)
+		exporter.conn.Close()
+	}
+	device.flow.collector = address
+	device.flow.version = version
+
+	if address == "" {
+		return nil
+	}
+
+	addr, err := device.resolveUDPAddr(address)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return err
+	}
+
+	exporter := &flowExporter{
+		conn:    conn,
+		version: version,
+		started: time.Now(),
+		stop:    make(chan struct{}),
+		flows:   make(map[flowKey]*flowCounters),
+	}
+	device.flow.exporter.Store(exporter)
+	go device.RoutineFlowExport(exporter)
+	return nil
+}
+
+func (device *Device) FlowExport() (string, int) {
+	device.flow.Lock()
+	defer device.flow.Unlock()
+	return device.flow.collector, device.flow.version
+}
+
+func (device *Device) loadFlowExporter() *flowExporter {
+	exporter, _ := device.flow.exporter.Load().(*flowExporter)
+	return exporter
+}
+
+func (device *Device) closeFlowExport() {
+	device.SetFlowExport("", FlowVersionIPFIX)
+}
+
+func parseFlowKey(packet []byte) (flowKey, bool) {
+	var key flowKey
+	var transport []byte
+
+	switch packet[0] >> 4 {
+	case 4:
+		headerLen := int(packet[0]&0x0f) * 4
+		if len(packet) < 20 || len(packet) < headerLen {
+			return key, false
+		}
+		key.protocol = packet[9]
+		copy(key.src[:], packet[IPv4offsetSrc:IPv4offsetSrc+net.IPv4len])
+		copy(key.dst[:], packet[IPv4offsetDst:IPv4offsetDst+net.IPv4len])
+		if binary.BigEndian.Uint16(packet[6:8])&0x1fff == 0 {
+			transport = packet[headerLen:]
+		}
+	case 6:
+		if len(packet) < 40 {
+			return key, false
+		}
+		key.ipv6 = true
+		key.protocol = packet[6]
+		copy(key.src[:], packet[IPv6offsetSrc:IPv6offsetSrc+net.IPv6len])
+		copy(key.dst[:], packet[IPv6offsetDst:IPv6offsetDst+net.IPv6len])
+		transport = packet[40:]
+	default:
+		return key, false
+	}
+
+	switch key.protocol {
+	case 6, 17, 132:
+		if len(transport) >= 4 {
+			key.srcPort = binary.BigEndian.Uint16(transport[0:2])
+			key.dstPort = binary.BigEndian.Uint16(transport[2:4])
+		}
+	}
+	return key, true
+}
+
+/* Called with each decrypted packet received from the peer, and each
+ * packet to be sent to it before encryption
+ */
+func (peer *Peer) countFlow(packet []byte, direction uint8) {
+	exporter := peer.device.loadFlowExporter()
+	if exporter == nil {
+		return
+	}
+
+	key, ok := parseFlowKey(packet)
+	if !ok {
+		return
+	}
+	key.peer = peer
+	key.direction = direction
+
+	now := time.Now()
+	exporter.Lock()
+	flow := exporter.flows[key]
+	if flow == nil {
+		if len(exporter.flows) >= MaxFlows {
+			exporter.dropped++
+			exporter.Unlock()
+			return
+		}
+		flow = &flowCounters{start: now}
+		exporter.flows[key] = flow
+	}
+	flow.bytes += uint64(len(packet))
+	flow.packets++
+	flow.end = now
+	exporter.Unlock()
+}
+
+type flowField struct {
+	id     uint16
+	length uint16
+}
+
+func flowTemplate(ipv6 bool, version int) []flowField {
+	addr := []flowField{{8, 4}, {12, 4}} // sourceIPv4Address, destinationIPv4Address
+	if ipv6 {
+		addr = []flowField{{27, 16}, {28, 16}} // sourceIPv6Address, destinationIPv6Address
+	}
+	fields := append(addr,
+		flowField{4, 1},  // protocolIdentifier
+		flowField{7, 2},  // sourceTransportPort
+		flowField{11, 2}, // destinationTransportPort
+		flowField{1, 8},  // octetDeltaCount
+		flowField{2, 8},  // packetDeltaCount
+		flowField{10, 4}, // ingressInterface
+		flowField{14, 4}, // egressInterface
+		flowField{61, 1}, // flowDirection
+	)
+	if version == FlowVersionNetFlow {
+		return append(fields, flowField{22, 4}, flowField{21, 4}) // first and last switched, uptime in milliseconds
+	}
+	return append(fields, flowField{152, 8}, flowField{153, 8}) // flowStartMilliseconds, flowEndMilliseconds
+}
+
+func flowRecordSize(template []flowField) int {
+	size := 0
+	for _, field := range template {
+		size += int(field.length)
+	}
+	return size
+}
+
+/* Appends the template set for both address families
+ */
+func (exporter *flowExporter) appendTemplates(msg []byte) []byte {
+	setID := uint16(2)
+	if exporter.version == FlowVersionNetFlow {
+		setID = 0
+	}
+	start := len(msg)
+	msg = append(msg, byte(setID>>8), byte(setID), 0, 0)
+	for _, template := range []struct {
+		id   uint16
+		ipv6 bool
+	}{{flowTemplateIPv4, false}, {flowTemplateIPv6, true}} {
+		fields := flowTemplate(template.ipv6, exporter.version)
+		msg = appendUint16(msg, template.id)
+		msg = appendUint16(msg, uint16(len(fields)))
+		for _, field := range fields {
+			msg = appendUint16(msg, field.id)
+			msg = appendUint16(msg, field.length)
+		}
+	}
+	binary.BigEndian.PutUint16(msg[start+2:], uint16(len(msg)-start))
+	return msg
+}
+
+func (exporter *flowExporter) appendRecord(msg []byte, key *flowKey, flow *flowCounters) []byte {
+	if key.ipv6 {
+		msg = append(msg, key.src[:]...)
+		msg = append(msg, key.dst[:]...)
+	} else {
+		msg = append(msg, key.src[:4]...)
+		msg = append(msg, key.dst[:4]...)
+	}
+	msg = append(msg, key.protocol)
+	msg = appendUint16(msg, key.srcPort)
+	msg = appendUint16(msg, key.dstPort)
+	msg = appendUint64(msg, flow.bytes)
+	msg = appendUint64(msg, flow.packets)
+
+	var peerID [4]byte
+	copy(peerID[:], key.peer.handshake.remoteStatic[:4])
+	if key.direction == flowIngress {
+		msg = append(msg, peerID[:]...)
+		msg = append(msg, 0, 0, 0, 0)
+	} else {
+		msg = append(msg, 0, 0, 0, 0)
+		msg = append(msg, peerID[:]...)
+	}
+	msg = append(msg, key.direction)
+
+	if exporter.version == FlowVersionNetFlow {
+		msg = appendUint32(msg, uint32(flow.start.Sub(exporter.started)/time.Millisecond))
+		msg = appendUint32(msg, uint32(flow.end.Sub(exporter.started)/time.Millisecond))
+	} else {
+		msg = appendUint64(msg, uint64(flow.start.UnixNano()/int64(time.Millisecond)))
+		msg = appendUint64(msg, uint64(flow.end.UnixNano()/int64(time.Millisecond)))
+	}
+	return msg
+}
+
+/* Encodes the flows into as many export messages as needed
+ */
+func (exporter *flowExporter) encode(flows map[flowKey]*flowCounters, now time.Time) [][]byte {
+	var messages [][]byte
+	var msg []byte
+	var records int
+	var setStart, setTemplate int
+
+	headerSize := 16
+	if exporter.version == FlowVersionNetFlow {
+		headerSize = 20
+	}
+
+	closeSet := func() {
+		if setStart == 0 {
+			return
+		}
+		if exporter.version == FlowVersionNetFlow {
+			for (len(msg)-setStart)%4 != 0 {
+				msg = append(msg, 0)
+			}
+		}
+		binary.BigEndian.PutUint16(msg[setStart+2:], uint16(len(msg)-setStart))
+		setStart, setTemplate = 0, 0
+	}
+
+	flush := func() {
+		if msg == nil {
+			return
+		}
+		closeSet()
+		if exporter.version == FlowVersionNetFlow {
+			binary.BigEndian.PutUint16(msg[0:], FlowVersionNetFlow)
+			binary.BigEndian.PutUint16(msg[2:], uint16(records+2)) // including the templates
+			binary.BigEndian.PutUint32(msg[4:], uint32(now.Sub(exporter.started)/time.Millisecond))
+			binary.BigEndian.PutUint32(msg[8:], uint32(now.Unix()))
+			binary.BigEndian.PutUint32(msg[12:], exporter.sequence)
+			exporter.sequence++
+		} else {
+			binary.BigEndian.PutUint16(msg[0:], FlowVersionIPFIX)
+			binary.BigEndian.PutUint16(msg[2:], uint16(len(msg)))
+			binary.BigEndian.PutUint32(msg[4:], uint32(now.Unix()))
+			binary.BigEndian.PutUint32(msg[8:], exporter.sequence)
+			exporter.sequence += uint32(records)
+		}
+		messages = append(messages, msg)
+		msg = nil
+	}
+
+	start := func() {
+		msg = make([]byte, headerSize, flowMaxPacketSize)
+		msg = exporter.appendTemplates(msg)
+		records = 0
+	}
+
+	for key, flow := range flows {
+		key := key
+		template := flowTemplateIPv4
+		if key.ipv6 {
+			template = flowTemplateIPv6
+		}
+		size := flowRecordSize(flowTemplate(key.ipv6, exporter.version))
+
+		if msg == nil || len(msg)+4+size+3 > flowMaxPacketSize {
+			flush()
+			start()
+		}
+		if setTemplate != template {
+			closeSet()
+			setStart, setTemplate = len(msg), template
+			msg = append(msg, byte(template>>8), byte(template), 0, 0)
+		}
+		msg = exporter.appendRecord(msg, &key, flow)
+		records++
+	}
+	flush()
+	return messages
+}
+
+func (device *Device) RoutineFlowExport(exporter *flowExporter) {
+	logDebug := device.log.Debug
+	logDebug.Println("Routine: flow exporter - started")
+	defer logDebug.Println("Routine: flow exporter - stopped")
+
+	ticker := time.NewTicker(FlowExportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-exporter.stop:
+			return
+		case <-ticker.C:
+		}
+		exporter.export(device)
+	}
+}
+
+/* Sends and forgets the flows aggregated so far
+ */
+func (exporter *flowExporter) export(device *Device) {
+	exporter.Lock()
+	flows, dropped := exporter.flows, exporter.dropped
+	exporter.flows = make(map[flowKey]*flowCounters)
+	exporter.dropped = 0
+	messages := exporter.encode(flows, time.Now())
+	exporter.Unlock()
+
+	if dropped > 0 {
+		device.log.Info.Println("Flow export: table full, dropped", dropped, "flows")
+	}
+	for _, msg := range messages {
+		if _, err := exporter.conn.Write(msg); err != nil {
+			device.log.Debug.Println("Flow export: failed to send:", err)
+			return
+		}
+	}
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v>>32)), uint32(v))
+}
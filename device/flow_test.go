@@ -0,0 +1,93 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFlowExport(t *testing.T) {
+	collector, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assertNil(t, err)
+	defer collector.Close()
+
+	device := randDevice(t)
+	defer device.Close()
+
+	sk, _ := newPrivateKey()
+	peer, err := device.NewPeer(sk.publicKey())
+	assertNil(t, err)
+
+	local, remote := net.IPv4(10, 0, 0, 1).To4(), net.IPv4(10, 0, 0, 2).To4()
+	received := testPacketIPv4(6, remote, local, 443, 50000)
+	other := testPacketIPv4(17, remote, local, 53, 50001)
+	sent := testPacketIPv4(6, local, remote, 50000, 443)
+
+	for _, version := range []int{FlowVersionNetFlow, FlowVersionIPFIX} {
+		config := fmt.Sprintf("flow_collector=%s\nflow_version=%d\n", collector.LocalAddr(), version)
+		if err := ipcSet(device, config); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 3; i++ {
+			peer.countFlow(received, flowIngress)
+		}
+		peer.countFlow(other, flowIngress)
+		peer.countFlow(sent, flowEgress)
+		device.loadFlowExporter().export(device)
+
+		var buff [flowMaxPacketSize]byte
+		collector.SetReadDeadline(time.Now().Add(5 * time.Second))
+		size, _, err := collector.ReadFromUDP(buff[:])
+		assertNil(t, err)
+		msg := buff[:size]
+
+		if binary.BigEndian.Uint16(msg[0:]) != uint16(version) {
+			t.Fatalf("version %d, expected %d", binary.BigEndian.Uint16(msg[0:]), version)
+		}
+		headerSize := 16
+		if version == FlowVersionNetFlow {
+			headerSize = 20
+			if count := binary.BigEndian.Uint16(msg[2:]); count != 2+3 {
+				t.Fatalf("netflow count %d, expected 5", count)
+			}
+		} else if length := binary.BigEndian.Uint16(msg[2:]); int(length) != size {
+			t.Fatalf("ipfix length %d, expected %d", length, size)
+		}
+
+		// sum packets of the IPv4 data set
+
+		recordSize := flowRecordSize(flowTemplate(false, version))
+		var records, packets uint64
+		for sets := msg[headerSize:]; len(sets) >= 4; {
+			id, length := binary.BigEndian.Uint16(sets[0:]), int(binary.BigEndian.Uint16(sets[2:]))
+			if length < 4 || length > len(sets) {
+				t.Fatalf("invalid set length %d", length)
+			}
+			if id == flowTemplateIPv4 {
+				for record := sets[4:length]; len(record) >= recordSize; record = record[recordSize:] {
+					records++
+					packets += binary.BigEndian.Uint64(record[4+4+1+2+2+8:])
+				}
+			}
+			sets = sets[length:]
+		}
+		if records != 3 || packets != 5 {
+			t.Fatalf("exported %d records with %d packets, expected 3 with 5", records, packets)
+		}
+	}
+
+	if err := ipcSet(device, "flow_collector=\n"); err != nil {
+		t.Fatal(err)
+	}
+	if device.loadFlowExporter() != nil {
+		t.Fatal("flow export still enabled")
+	}
+}
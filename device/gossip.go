@@ -0,0 +1,351 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+/* Peer discovery for meshes
+ *
+ * A device acting as gossip coordinator periodically tells each of its
+ * peers about all other peers with a known endpoint: their public key,
+ * endpoint and allowed IPs. Spokes accept this only from the peers
+ * they designate as coordinator and add the announced peers, so that
+ * traffic between spokes flows over direct tunnels.
+ *
+ * Gossip is carried inside the tunnel as the content of transport
+ * packets, distinguished from IP packets by the version nibble:
+ *
+ *   marker (1) | reserved (1) | length of entries (2, big endian) | entries
+ *
+ * with each entry
+ *
+ *   public key (32) | endpoint length (1) | endpoint (ip:port) |
+ *   allowed ip count (1) | { ip length (1) | ip | cidr (1) } ...
+ *
+ * Learned peers inherit the persistent keepalive interval of the
+ * coordinator. They never learn default routes, nor prefixes shorter
+ * than gossipMinPrefixIPv4 or gossipMinPrefixIPv6, several of which
+ * could make one up, nor prefixes overlapping those of configured
+ * peers, as more specific ones would take their traffic. Endpoints from
+ * gossip are subject to the roaming policy (see roaming.go).
+ */
+
+const (
+	GossipInterval = 30 * time.Second
+)
+
+const (
+	gossipVersion    = 1
+	gossipHeaderSize = 4
+	gossipMaxEntries = 255
+
+	gossipMinPrefixIPv4 = 8
+	gossipMinPrefixIPv6 = 16
+)
+
+type gossipEntry struct {
+	publicKey  NoisePublicKey
+	endpoint   string
+	allowedIPs []net.IPNet
+}
+
+func (entry *gossipEntry) size() int {
+	size := NoisePublicKeySize + 1 + len(entry.endpoint) + 1
+	for _, ip := range entry.allowedIPs {
+		size += 1 + len(ip.IP) + 1
+	}
+	return size
+}
+
+/* Encodes entries into as many messages as needed to stay within mtu
+ */
+func encodeGossip(entries []gossipEntry, mtu int) [][]byte {
+	var messages [][]byte
+	var msg []byte
+
+	flush := func() {
+		if len(msg) > gossipHeaderSize {
+			binary.BigEndian.PutUint16(msg[2:4], uint16(len(msg)-gossipHeaderSize))
+			messages = append(messages, msg)
+		}
+		msg = []byte{gossipVersion << 4, 0, 0, 0}
+	}
+	flush()
+
+	for _, entry := range entries {
+		if len(entry.endpoint) > 255 || len(entry.allowedIPs) > gossipMaxEntries {
+			continue
+		}
+		size := entry.size()
+		if gossipHeaderSize+size > mtu {
+			continue
+		}
+		if len(msg)+size > mtu {
+			flush()
+		}
+		msg = append(msg, entry.publicKey[:]...)
+		msg = append(msg, byte(len(entry.endpoint)))
+		msg = append(msg, entry.endpoint...)
+		msg = append(msg, byte(len(entry.allowedIPs)))
+		for _, ip := range entry.allowedIPs {
+			ones, _ := ip.Mask.Size()
+			msg = append(msg, byte(len(ip.IP)))
+			msg = append(msg, ip.IP...)
+			msg = append(msg, byte(ones))
+		}
+	}
+	flush()
+
+	return messages
+}
+
+func decodeGossip(msg []byte) ([]gossipEntry, error) {
+	errInvalid := errors.New("invalid gossip message")
+
+	if len(msg) < gossipHeaderSize || msg[0]>>4 != gossipVersion {
+		return nil, errInvalid
+	}
+	length := int(binary.BigEndian.Uint16(msg[2:4]))
+	if len(msg) < gossipHeaderSize+length {
+		return nil, errInvalid
+	}
+	body := msg[gossipHeaderSize : gossipHeaderSize+length]
+
+	var entries []gossipEntry
+	for len(body) > 0 {
+		var entry gossipEntry
+		if len(body) < NoisePublicKeySize+1 {
+			return nil, errInvalid
+		}
+		copy(entry.publicKey[:], body)
+		body = body[NoisePublicKeySize:]
+
+		n := int(body[0])
+		if len(body) < 1+n+1 {
+			return nil, errInvalid
+		}
+		entry.endpoint = string(body[1 : 1+n])
+		count := int(body[1+n])
+		body = body[1+n+1:]
+
+		for i := 0; i < count; i++ {
+			if len(body) < 1 {
+				return nil, errInvalid
+			}
+			n := int(body[0])
+			if (n != net.IPv4len && n != net.IPv6len) || len(body) < 1+n+1 {
+				return nil, errInvalid
+			}
+			ip := make(net.IP, n)
+			copy(ip, body[1:1+n])
+			ones := int(body[1+n])
+			if ones > n*8 {
+				return nil, errInvalid
+			}
+			entry.allowedIPs = append(entry.allowedIPs, net.IPNet{IP: ip, Mask: net.CIDRMask(ones, n*8)})
+			body = body[1+n+1:]
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+/* Should be called when the peer starts and when the device becomes coordinator */
+func (peer *Peer) timersGossip() {
+	if peer.device.gossip.coordinator.Get() && peer.timersActive() {
+		peer.timers.gossip.Mod(GossipInterval)
+	}
+}
+
+func expiredGossip(peer *Peer) {
+	if peer.device.gossip.coordinator.Get() {
+		peer.SendGossip()
+		peer.timersGossip()
+	}
+}
+
+/* Makes the device announce its peers to each other
+ */
+func (device *Device) SetGossipCoordinator(coordinator bool) {
+	if device.gossip.coordinator.Swap(coordinator) || !coordinator {
+		return
+	}
+	device.peers.RLock()
+	for _, peer := range device.peers.keyMap {
+		peer.timersGossip()
+	}
+	device.peers.RUnlock()
+}
+
+/* Returns the peers known to the coordinator, except the recipient
+ */
+func (device *Device) gossipEntries(recipient *Peer) []gossipEntry {
+	var entries []gossipEntry
+
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+
+	for _, peer := range device.peers.keyMap {
+		if peer == recipient {
+			continue
+		}
+		peer.RLock()
+		endpoint := peer.endpoint
+		peer.RUnlock()
+		if endpoint == nil {
+			continue
+		}
+		entries = append(entries, gossipEntry{
+			publicKey:  peer.handshake.remoteStatic,
+			endpoint:   endpoint.DstToString(),
+			allowedIPs: device.allowedips.EntriesForPeer(peer),
+		})
+	}
+	return entries
+}
+
+/* Sends the known peers to the peer, if there is a current session
+ */
+func (peer *Peer) SendGossip() {
+	peer.keypairs.RLock()
+	current := peer.keypairs.current
+	peer.keypairs.RUnlock()
+	if current == nil || !peer.isRunning.Get() {
+		return
+	}
+
+	device := peer.device
+	entries := device.gossipEntries(peer)
+	if len(entries) == 0 {
+		return
+	}
+
+	mtu := int(atomic.LoadInt32(&device.tun.mtu))
+	for _, msg := range encodeGossip(entries, mtu) {
+		elem := device.NewOutboundElement()
+		offset := MessageTransportHeaderSize
+		elem.packet = elem.buffer[offset : offset+copy(elem.buffer[offset:], msg)]
+		select {
+		case peer.queue.nonce <- elem:
+		default:
+			device.PutOutboundElement(elem)
+			device.countDrop(QueueNonce, DropQueueFull)
+			return
+		}
+	}
+	device.log.Debug.Println(peer, "- Sending gossip with", len(entries), "peers")
+}
+
+/* Called with the content of a gossip message received from the peer
+ */
+func (device *Device) handleGossip(peer *Peer, msg []byte) {
+	if !peer.gossip.coordinator.Get() {
+		device.log.Debug.Println(peer, "- Ignoring gossip from peer which is not coordinator")
+		return
+	}
+
+	entries, err := decodeGossip(msg)
+	if err != nil {
+		device.log.Info.Println(peer, "- Received invalid gossip:", err)
+		return
+	}
+
+	// may create and start peers, hence leave the receive routine
+
+	go func() {
+		for _, entry := range entries {
+			device.learnPeer(peer, entry)
+		}
+	}()
+}
+
+func (device *Device) learnPeer(coordinator *Peer, entry gossipEntry) {
+	device.staticIdentity.RLock()
+	self := device.staticIdentity.publicKey.Equals(entry.publicKey)
+	device.staticIdentity.RUnlock()
+	if self || entry.publicKey.Equals(coordinator.handshake.remoteStatic) {
+		return
+	}
+
+	endpoint, err := CreateEndpoint(entry.endpoint)
+	if err != nil {
+		device.log.Debug.Println(coordinator, "- Ignoring gossip with invalid endpoint", entry.endpoint)
+		return
+	}
+
+	peer := device.LookupPeer(entry.publicKey)
+	if peer == nil {
+		peer, err = device.NewPeer(entry.publicKey)
+		if err != nil || peer == nil {
+			device.log.Info.Println(coordinator, "- Failed to add peer learned from gossip:", err)
+			return
+		}
+		peer.gossip.learned.Set(true)
+
+		coordinator.RLock()
+		interval := coordinator.persistentKeepaliveInterval
+		coordinator.RUnlock()
+		peer.Lock()
+		peer.persistentKeepaliveInterval = interval
+		peer.Unlock()
+
+		device.log.Info.Println(peer, "- Learned from gossip of", coordinator)
+	}
+
+	// configured peers only gain a missing endpoint,
+	// learned peers follow the coordinator unless in session
+
+	learned := peer.gossip.learned.Get()
+	lastHandshake := time.Unix(0, atomic.LoadInt64(&peer.stats.lastHandshakeNano))
+
+	peer.RLock()
+	previous := peer.endpoint
+	peer.RUnlock()
+	if previous == nil || (learned && time.Since(lastHandshake) > RejectAfterTime) {
+		if !RoamingDisabled && peer.allowRoam(previous, endpoint, false) {
+			peer.Lock()
+			peer.endpoint = endpoint
+			peer.Unlock()
+			peer.refreshHairpin()
+		}
+	}
+
+	if !learned {
+		return
+	}
+	for _, ip := range entry.allowedIPs {
+		ones, bits := ip.Mask.Size()
+		if (bits == 32 && ones < gossipMinPrefixIPv4) || (bits == 128 && ones < gossipMinPrefixIPv6) {
+			device.log.Debug.Println(peer, "- Ignoring short prefix from gossip", ip.String())
+			continue
+		}
+		if owner := configuredOwner(device.allowedips.PeersOverlapping(ip), peer); owner != nil {
+			device.log.Debug.Println(peer, "- Ignoring prefix overlapping those of", owner, "from gossip", ip.String())
+			continue
+		}
+		if err := device.insertAllowedIP(ip.IP, uint(ones), peer); err != nil {
+			device.log.Info.Println(peer, "- Failed to add allowed IP learned from gossip:", err)
+			return
+		}
+	}
+}
+
+/* Returns a configured peer other than peer among owners, if any
+ */
+func configuredOwner(owners []*Peer, peer *Peer) *Peer {
+	for _, owner := range owners {
+		if owner != peer && !owner.gossip.learned.Get() {
+			return owner
+		}
+	}
+	return nil
+}
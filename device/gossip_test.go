@@ -0,0 +1,122 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"testing"
+)
+
+func TestGossipEncoding(t *testing.T) {
+	var entries []gossipEntry
+	for i := 0; i < 40; i++ {
+		entry := gossipEntry{endpoint: "192.0.2.1:51820"}
+		entry.publicKey[0] = byte(i)
+		_, ipv4, _ := net.ParseCIDR("10.0.0.1/32")
+		_, ipv6, _ := net.ParseCIDR("fd00::/64")
+		entry.allowedIPs = []net.IPNet{*ipv4, *ipv6}
+		entries = append(entries, entry)
+	}
+
+	messages := encodeGossip(entries, 1280)
+	if len(messages) < 2 {
+		t.Fatalf("expected entries to be split, got %d messages", len(messages))
+	}
+
+	var decoded []gossipEntry
+	for _, msg := range messages {
+		if len(msg) > 1280 {
+			t.Fatalf("message of %d bytes exceeds mtu", len(msg))
+		}
+		padded := append(msg, make([]byte, 16)...)
+		result, err := decodeGossip(padded)
+		assertNil(t, err)
+		decoded = append(decoded, result...)
+	}
+
+	if len(decoded) != len(entries) {
+		t.Fatalf("decoded %d entries, expected %d", len(decoded), len(entries))
+	}
+	for i, entry := range decoded {
+		if entry.publicKey != entries[i].publicKey || entry.endpoint != entries[i].endpoint || len(entry.allowedIPs) != 2 {
+			t.Fatalf("entry %d mismatch: %v", i, entry)
+		}
+		for j, ip := range entry.allowedIPs {
+			if ip.String() != entries[i].allowedIPs[j].String() {
+				t.Fatalf("allowed ip %s, expected %s", ip.String(), entries[i].allowedIPs[j].String())
+			}
+		}
+	}
+
+	if _, err := decodeGossip(messages[0][:len(messages[0])-1]); err == nil {
+		t.Fatal("decoded truncated message")
+	}
+}
+
+func TestGossipLearnPeer(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	coordinatorKey, _ := newPrivateKey()
+	coordinator, err := device.NewPeer(coordinatorKey.publicKey())
+	assertNil(t, err)
+
+	learnedKey, _ := newPrivateKey()
+	_, ip, _ := net.ParseCIDR("10.0.0.2/32")
+	_, all, _ := net.ParseCIDR("0.0.0.0/0")
+	_, low, _ := net.ParseCIDR("0.0.0.0/1")
+	_, high, _ := net.ParseCIDR("128.0.0.0/1")
+	_, configured, _ := net.ParseCIDR("10.0.1.0/24")
+	_, within, _ := net.ParseCIDR("10.0.1.0/25")
+	_, containing, _ := net.ParseCIDR("10.0.0.0/16")
+	assertNil(t, device.insertAllowedIP(configured.IP, 24, coordinator))
+	entry := gossipEntry{
+		publicKey:  learnedKey.publicKey(),
+		endpoint:   "192.0.2.2:51820",
+		allowedIPs: []net.IPNet{*ip, *all, *low, *high, *configured, *within, *containing},
+	}
+
+	// gossip is only accepted from coordinators
+
+	msg := encodeGossip([]gossipEntry{entry}, 1280)[0]
+	device.handleGossip(coordinator, msg)
+	if device.LookupPeer(entry.publicKey) != nil {
+		t.Fatal("peer learned from gossip of non-coordinator")
+	}
+	coordinator.gossip.coordinator.Set(true)
+	device.learnPeer(coordinator, entry)
+
+	peer := device.LookupPeer(entry.publicKey)
+	if peer == nil || !peer.gossip.learned.Get() {
+		t.Fatal("peer not learned from gossip")
+	}
+	if peer.endpoint == nil || peer.endpoint.DstToString() != entry.endpoint {
+		t.Fatal("endpoint not learned from gossip")
+	}
+	if device.allowedips.LookupIPv4(net.IPv4(10, 0, 0, 2).To4()) != peer {
+		t.Fatal("allowed ip not learned from gossip")
+	}
+	if device.allowedips.LookupIPv4(net.IPv4(10, 0, 0, 3).To4()) != nil {
+		t.Fatal("default route learned from gossip")
+	}
+	if device.allowedips.LookupIPv4(net.IPv4(10, 0, 1, 1).To4()) != coordinator {
+		t.Fatal("prefix of configured peer taken by gossip")
+	}
+	if len(device.allowedips.EntriesForPeer(peer)) != 1 {
+		t.Fatalf("prefixes overlapping configured peer learned: %v", device.allowedips.EntriesForPeer(peer))
+	}
+
+	// endpoints from gossip follow the roaming policy
+
+	device.SetRoamingHook(func(peer *Peer, endpoint Endpoint, handshake bool) bool {
+		return false
+	})
+	rejectedKey, _ := newPrivateKey()
+	device.learnPeer(coordinator, gossipEntry{publicKey: rejectedKey.publicKey(), endpoint: "192.0.2.3:51820"})
+	if peer := device.LookupPeer(rejectedKey.publicKey()); peer == nil || peer.endpoint != nil {
+		t.Fatal("endpoint from gossip bypassed roaming hook")
+	}
+}
@@ -0,0 +1,402 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+)
+
+/* Active-passive state synchronization
+ *
+ * Two instances share the same private key and peer configuration.
+ * The active instance sends the endpoint and last handshake of every
+ * peer to the standby every HASyncInterval over UDP. The standby
+ * applies this state to its peers, but sends no handshake initiations
+ * of its own, which would move the endpoints of the peers away from the
+ * active instance. Once promoted to active, it initiates handshakes with
+ * all peers at their replicated endpoints at once, so failover takes a
+ * single round trip instead of waiting for peers to notice.
+ *
+ * Messages are authenticated with a secret shared by both instances:
+ *
+ *   version (1) | reserved (3) | counter (8, big endian) | entries | mac (16)
+ *
+ * with each entry
+ *
+ *   public key (32) | last handshake (8, unix nanoseconds) |
+ *   endpoint length (1) | endpoint
+ *
+ * The mac is a keyed BLAKE2s-128 of everything before it, and the
+ * counter must increase from message to message. Replication requires
+ * a secret, so a role other than none is refused while it is zero.
+ *
+ * The active instance derives counters from its clock. The standby keeps
+ * the last counter applied across reconfiguration, and when it starts
+ * listening rejects counters older than HAClockTolerance before its own
+ * clock, so captured messages cannot be replayed after a restart.
+ */
+
+type HARole int
+
+const (
+	HARoleNone HARole = iota
+	HARoleActive
+	HARoleStandby
+)
+
+var haRoleNames = [...]string{
+	HARoleNone:    "none",
+	HARoleActive:  "active",
+	HARoleStandby: "standby",
+}
+
+func (role HARole) String() string {
+	if role < 0 || int(role) >= len(haRoleNames) {
+		return "unknown"
+	}
+	return haRoleNames[role]
+}
+
+func ParseHARole(s string) (HARole, error) {
+	for role, name := range haRoleNames {
+		if s == name {
+			return HARole(role), nil
+		}
+	}
+	return HARoleNone, errors.New("invalid ha role: " + s)
+}
+
+const (
+	HASyncInterval   = 200 * time.Millisecond
+	HAClockTolerance = time.Minute
+)
+
+const (
+	haVersion        = 1
+	haHeaderSize     = 12
+	haMACSize        = 16
+	haMaxMessageSize = 1400
+)
+
+type HAKey [32]byte
+
+type haEntry struct {
+	publicKey     NoisePublicKey
+	lastHandshake int64
+	endpoint      string
+}
+
+func haMAC(secret *HAKey, msg []byte) []byte {
+	hash, _ := blake2s.New128(secret[:])
+	hash.Write(msg)
+	return hash.Sum(nil)
+}
+
+/* Encodes entries into as many authenticated messages as needed,
+ * numbered from counter on
+ */
+func encodeHA(entries []haEntry, counter uint64, secret *HAKey) [][]byte {
+	var messages [][]byte
+	var msg []byte
+
+	flush := func(force bool) {
+		if len(msg) > haHeaderSize || force {
+			msg = append(msg, haMAC(secret, msg)...)
+			messages = append(messages, msg)
+			counter++
+		}
+		msg = make([]byte, haHeaderSize, haMaxMessageSize)
+		msg[0] = haVersion
+		binary.BigEndian.PutUint64(msg[4:12], counter)
+	}
+	msg = nil
+	flush(false)
+
+	for _, entry := range entries {
+		if len(entry.endpoint) > 255 {
+			continue
+		}
+		size := NoisePublicKeySize + 8 + 1 + len(entry.endpoint)
+		if len(msg)+size+haMACSize > haMaxMessageSize {
+			flush(false)
+		}
+		var lastHandshake [8]byte
+		binary.BigEndian.PutUint64(lastHandshake[:], uint64(entry.lastHandshake))
+		msg = append(msg, entry.publicKey[:]...)
+		msg = append(msg, lastHandshake[:]...)
+		msg = append(msg, byte(len(entry.endpoint)))
+		msg = append(msg, entry.endpoint...)
+	}
+
+	// an empty message still tells the standby that the active is alive
+
+	flush(len(messages) == 0)
+
+	return messages
+}
+
+func decodeHA(msg []byte, secret *HAKey) (uint64, []haEntry, error) {
+	errInvalid := errors.New("invalid ha message")
+
+	if len(msg) < haHeaderSize+haMACSize || msg[0] != haVersion {
+		return 0, nil, errInvalid
+	}
+	body, mac := msg[:len(msg)-haMACSize], msg[len(msg)-haMACSize:]
+	if subtle.ConstantTimeCompare(mac, haMAC(secret, body)) != 1 {
+		return 0, nil, errors.New("ha message failed authentication")
+	}
+	counter := binary.BigEndian.Uint64(body[4:12])
+	body = body[haHeaderSize:]
+
+	var entries []haEntry
+	for len(body) > 0 {
+		var entry haEntry
+		if len(body) < NoisePublicKeySize+8+1 {
+			return 0, nil, errInvalid
+		}
+		copy(entry.publicKey[:], body)
+		entry.lastHandshake = int64(binary.BigEndian.Uint64(body[NoisePublicKeySize:]))
+		body = body[NoisePublicKeySize+8:]
+		n := int(body[0])
+		if len(body) < 1+n {
+			return 0, nil, errInvalid
+		}
+		entry.endpoint = string(body[1 : 1+n])
+		body = body[1+n:]
+		entries = append(entries, entry)
+	}
+	return counter, entries, nil
+}
+
+var errHANoSecret = errors.New("ha requires a secret")
+
+/* Configures replication: the active instance sends to address,
+ * the standby listens on it
+ */
+func (device *Device) SetHA(role HARole, address string, secret HAKey) error {
+	promoted, err := device.setHA(role, address, secret)
+	if promoted {
+		device.log.Info.Println("HA: Promoted to active, initiating handshakes with all peers")
+		device.promoteHA()
+	}
+	return err
+}
+
+func (device *Device) setHA(role HARole, address string, secret HAKey) (bool, error) {
+	if role != HARoleNone && isZero(secret[:]) {
+		return false, errHANoSecret
+	}
+
+	device.ha.Lock()
+	defer device.ha.Unlock()
+
+	promoted := device.ha.role == HARoleStandby && role == HARoleActive
+
+	if device.ha.conn != nil {
+		device.ha.conn.Close()
+		device.ha.conn = nil
+	}
+	device.ha.role = role
+	device.ha.address = address
+	device.ha.secret = secret
+	device.ha.standby.Set(role == HARoleStandby)
+
+	if role == HARoleNone || address == "" {
+		return promoted, nil
+	}
+
+	addr, err := device.resolveUDPAddr(address)
+	if err != nil {
+		return promoted, err
+	}
+
+	var conn *net.UDPConn
+	if role == HARoleActive {
+		conn, err = net.DialUDP("udp", nil, addr)
+	} else {
+		conn, err = net.ListenUDP("udp", addr)
+	}
+	if err != nil {
+		return promoted, err
+	}
+	device.ha.conn = conn
+
+	if role == HARoleActive {
+		go device.RoutineHASend(conn, secret)
+	} else {
+		floor := uint64(time.Now().Add(-HAClockTolerance).UnixNano())
+		if device.ha.lastCounter < floor {
+			device.ha.lastCounter = floor
+		}
+		go device.RoutineHAReceive(conn, secret)
+	}
+	return promoted, nil
+}
+
+/* Starts handshakes with all peers at their replicated endpoints
+ */
+func (device *Device) promoteHA() {
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+
+	for _, peer := range device.peers.keyMap {
+		peer.RLock()
+		endpoint := peer.endpoint
+		peer.RUnlock()
+		if endpoint != nil && peer.isRunning.Get() {
+			peer.SendHandshakeInitiation(false)
+		}
+	}
+}
+
+func (device *Device) haEntries() []haEntry {
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+
+	entries := make([]haEntry, 0, len(device.peers.keyMap))
+	for _, peer := range device.peers.keyMap {
+		entry := haEntry{
+			publicKey:     peer.handshake.remoteStatic,
+			lastHandshake: atomic.LoadInt64(&peer.stats.lastHandshakeNano),
+		}
+		peer.RLock()
+		if peer.endpoint != nil {
+			entry.endpoint = peer.endpoint.DstToString()
+		}
+		peer.RUnlock()
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func (device *Device) RoutineHASend(conn *net.UDPConn, secret HAKey) {
+	logDebug := device.log.Debug
+	logDebug.Println("Routine: ha sender - started")
+	defer logDebug.Println("Routine: ha sender - stopped")
+
+	ticker := time.NewTicker(HASyncInterval)
+	defer ticker.Stop()
+
+	var counter uint64
+	for {
+		device.ha.Lock()
+		current := device.ha.conn == conn
+		device.ha.Unlock()
+		if !current {
+			return
+		}
+
+		// counters derive from the clock to remain increasing across restarts
+
+		if now := uint64(time.Now().UnixNano()); now > counter {
+			counter = now
+		}
+		messages := encodeHA(device.haEntries(), counter, &secret)
+		counter += uint64(len(messages))
+
+		for _, msg := range messages {
+			if _, err := conn.Write(msg); err != nil {
+				logDebug.Println("HA: Failed to send state:", err)
+				break
+			}
+		}
+
+		<-ticker.C
+	}
+}
+
+func (device *Device) RoutineHAReceive(conn *net.UDPConn, secret HAKey) {
+	logDebug := device.log.Debug
+	logDebug.Println("Routine: ha receiver - started")
+	defer logDebug.Println("Routine: ha receiver - stopped")
+
+	var buff [haMaxMessageSize]byte
+	for {
+		size, _, err := conn.ReadFromUDP(buff[:])
+		if err != nil {
+			return
+		}
+
+		counter, entries, err := decodeHA(buff[:size], &secret)
+		if err != nil {
+			logDebug.Println("HA: Dropping message:", err)
+			continue
+		}
+
+		device.ha.Lock()
+		if device.ha.conn != conn || counter <= device.ha.lastCounter {
+			device.ha.Unlock()
+			continue
+		}
+		device.ha.lastCounter = counter
+		device.ha.lastSync = time.Now()
+		device.ha.Unlock()
+
+		for _, entry := range entries {
+			device.applyHA(entry)
+		}
+	}
+}
+
+func (device *Device) applyHA(entry haEntry) {
+	peer := device.LookupPeer(entry.publicKey)
+	if peer == nil {
+		return
+	}
+
+	for {
+		last := atomic.LoadInt64(&peer.stats.lastHandshakeNano)
+		if entry.lastHandshake <= last || atomic.CompareAndSwapInt64(&peer.stats.lastHandshakeNano, last, entry.lastHandshake) {
+			break
+		}
+	}
+
+	if entry.endpoint == "" {
+		return
+	}
+	peer.RLock()
+	current := peer.endpoint
+	peer.RUnlock()
+	if current != nil && current.DstToString() == entry.endpoint {
+		return
+	}
+	endpoint, err := CreateEndpoint(entry.endpoint)
+	if err != nil || !peer.allowRoam(current, endpoint, false) {
+		return
+	}
+	peer.Lock()
+	peer.endpoint = endpoint
+	peer.Unlock()
+	peer.refreshHairpin()
+}
+
+func (device *Device) closeHA() {
+	device.ha.Lock()
+	defer device.ha.Unlock()
+	if device.ha.conn != nil {
+		device.ha.conn.Close()
+		device.ha.conn = nil
+	}
+}
+
+/* Returns the time since the standby last received state, or zero
+ * if it never did
+ */
+func (device *Device) HASyncAge() time.Duration {
+	device.ha.Lock()
+	defer device.ha.Unlock()
+	if device.ha.lastSync.IsZero() {
+		return 0
+	}
+	return time.Since(device.ha.lastSync)
+}
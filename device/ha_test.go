@@ -0,0 +1,138 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHAEncoding(t *testing.T) {
+	var secret HAKey
+	secret[0] = 1
+
+	var entries []haEntry
+	for i := 0; i < 100; i++ {
+		entry := haEntry{lastHandshake: int64(i) << 32, endpoint: "192.0.2.1:51820"}
+		entry.publicKey[0] = byte(i)
+		entries = append(entries, entry)
+	}
+
+	messages := encodeHA(entries, 10, &secret)
+	if len(messages) < 2 {
+		t.Fatalf("expected entries to be split, got %d messages", len(messages))
+	}
+
+	var decoded []haEntry
+	for i, msg := range messages {
+		if len(msg) > haMaxMessageSize {
+			t.Fatalf("message of %d bytes exceeds maximum", len(msg))
+		}
+		counter, result, err := decodeHA(msg, &secret)
+		assertNil(t, err)
+		if counter != uint64(10+i) {
+			t.Fatalf("counter %d, expected %d", counter, 10+i)
+		}
+		decoded = append(decoded, result...)
+	}
+	if len(decoded) != len(entries) {
+		t.Fatalf("decoded %d entries, expected %d", len(decoded), len(entries))
+	}
+	for i, entry := range decoded {
+		if entry != entries[i] {
+			t.Fatalf("entry %d mismatch: %v", i, entry)
+		}
+	}
+
+	// tampering and wrong secrets fail authentication
+
+	messages[0][haHeaderSize] ^= 1
+	if _, _, err := decodeHA(messages[0], &secret); err == nil {
+		t.Fatal("decoded tampered message")
+	}
+	var other HAKey
+	if _, _, err := decodeHA(messages[1], &other); err == nil {
+		t.Fatal("decoded message with wrong secret")
+	}
+
+	if messages := encodeHA(nil, 0, &secret); len(messages) != 1 {
+		t.Fatal("expected keepalive message without entries")
+	}
+}
+
+func TestHAReplication(t *testing.T) {
+	active := randDevice(t)
+	defer active.Close()
+	standby := randDevice(t)
+	defer standby.Close()
+
+	var secret HAKey
+	secret[0] = 1
+
+	sk, _ := newPrivateKey()
+	publicKey := sk.publicKey()
+	activePeer, err := active.NewPeer(publicKey)
+	assertNil(t, err)
+	standbyPeer, err := standby.NewPeer(publicKey)
+	assertNil(t, err)
+	standbyPeer.Start()
+
+	endpoint, err := CreateEndpoint("192.0.2.1:51820")
+	assertNil(t, err)
+	activePeer.endpoint = endpoint
+	activePeer.stats.lastHandshakeNano = time.Now().UnixNano()
+
+	if standby.SetHA(HARoleStandby, "127.0.0.1:0", HAKey{}) == nil {
+		t.Fatal("standby listening without secret")
+	}
+	assertNil(t, standby.SetHA(HARoleStandby, "127.0.0.1:0", secret))
+	standby.ha.Lock()
+	address := standby.ha.conn.LocalAddr().String()
+	standby.ha.Unlock()
+	assertNil(t, active.SetHA(HARoleActive, address, secret))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		standbyPeer.RLock()
+		replicated := standbyPeer.endpoint
+		standbyPeer.RUnlock()
+		if replicated != nil && replicated.DstToString() == endpoint.DstToString() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("endpoint not replicated to standby")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if standbyPeer.stats.lastHandshakeNano == 0 || standby.HASyncAge() == 0 {
+		t.Fatal("handshake time not replicated to standby")
+	}
+
+	// reconfiguring the standby keeps the replay floor
+
+	standby.ha.Lock()
+	floor := standby.ha.lastCounter
+	standby.ha.Unlock()
+	assertNil(t, standby.SetHA(HARoleStandby, address, secret))
+	standby.ha.Lock()
+	lowered := standby.ha.lastCounter < floor
+	standby.ha.Unlock()
+	if lowered {
+		t.Fatal("replay floor lowered on reconfiguration")
+	}
+
+	// the standby leaves handshakes to the active instance until promoted
+
+	started := standbyPeer.handshake.lastSentHandshake
+	standbyPeer.SendHandshakeInitiation(false)
+	if standbyPeer.handshake.lastSentHandshake != started {
+		t.Fatal("standby initiated handshake")
+	}
+	assertNil(t, standby.SetHA(HARoleActive, "", secret))
+	if standbyPeer.handshake.lastSentHandshake == started {
+		t.Fatal("promoted standby did not initiate handshake")
+	}
+}
@@ -0,0 +1,100 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"strconv"
+	"sync/atomic"
+)
+
+/* Hairpinning of packets to peers at our own endpoint
+ *
+ * In test rigs and hairpin configurations a peer may have an endpoint
+ * which is the listening socket of this very device. Rather than
+ * encrypting packets for such a peer only to send them to ourselves over
+ * UDP, they are written straight back to the TUN device, after the same
+ * validation as packets received from the peer, and counted as sent.
+ *
+ * Whether an endpoint is our own is cached per peer, and determined anew
+ * whenever the endpoint is configured or the device is bound to a port.
+ * Endpoints learned from packets are never our own, since packets to
+ * our own endpoint are not sent over UDP while hairpinning.
+ */
+
+type hairpinState struct {
+	self AtomicBool
+}
+
+/* Returns true if the endpoint of the peer is the listening socket of the device
+ */
+func (peer *Peer) isSelf() bool {
+	return peer.hairpin.self.Get()
+}
+
+/* Determines whether the endpoint of the peer is the listening socket
+ * of the device bound to port.
+ *
+ * Must hold the peer (read) lock
+ */
+func (peer *Peer) unsafeUpdateHairpin(port uint16) {
+	peer.hairpin.self.Set(peer.endpoint != nil && port != 0 && isLocalEndpoint(peer.endpoint, port))
+}
+
+/* Should be called after the endpoint of the peer is configured
+ */
+func (peer *Peer) refreshHairpin() {
+	device := peer.device
+	device.net.RLock()
+	port := device.net.port
+	device.net.RUnlock()
+
+	peer.RLock()
+	peer.unsafeUpdateHairpin(port)
+	peer.RUnlock()
+}
+
+func isLocalEndpoint(endpoint Endpoint, port uint16) bool {
+	_, portString, err := net.SplitHostPort(endpoint.DstToString())
+	if err != nil || portString != strconv.Itoa(int(port)) {
+		return false
+	}
+
+	ip := endpoint.DstIP()
+	if ip.IsLoopback() {
+		return true
+	}
+	if ip.IsUnspecified() {
+		return false
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if network, ok := addr.(*net.IPNet); ok && network.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+/* Writes an outbound packet back to the TUN device
+ */
+func (device *Device) hairpin(peer *Peer, elem *QueueOutboundElement) {
+	atomic.AddUint64(&peer.stats.txBytes, uint64(len(elem.packet)))
+	atomic.AddUint64(&peer.stats.txPackets, 1)
+
+	packet, ok := peer.validateInbound(elem.packet)
+	if !ok {
+		return
+	}
+	offset := MessageTransportHeaderSize
+	_, err := device.tun.device.Write(elem.buffer[:offset+len(packet)], offset)
+	if err != nil {
+		device.log.Error.Println("Failed to write hairpinned packet to TUN device:", err)
+	}
+}
@@ -0,0 +1,97 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestHairpinSelfEndpoint(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+	if err := ipcSet(device, "listen_port=0\n"); err != nil {
+		t.Fatal(err)
+	}
+	device.Up()
+	port := int(device.net.port)
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	peer, err := device.NewPeer(sk.publicKey())
+	assertNil(t, err)
+
+	if peer.isSelf() {
+		t.Fatal("peer without endpoint is self")
+	}
+
+	for _, test := range []struct {
+		endpoint string
+		self     bool
+	}{
+		{"127.0.0.1:" + strconv.Itoa(port), true},
+		{"127.0.0.1:" + strconv.Itoa(port+1), false},
+		{"192.0.2.1:" + strconv.Itoa(port), false},
+		{"[::1]:" + strconv.Itoa(port), true},
+	} {
+		peer.endpoint, err = CreateEndpoint(test.endpoint)
+		assertNil(t, err)
+		peer.refreshHairpin()
+		if peer.isSelf() != test.self {
+			t.Errorf("%s: expected self %v", test.endpoint, test.self)
+		}
+	}
+}
+
+/* A TUN device recording the packets written to it
+ */
+type recordingTUN struct {
+	*dummyTUN
+	written chan []byte
+}
+
+func (r *recordingTUN) Write(b []byte, offset int) (int, error) {
+	r.written <- append([]byte(nil), b[offset:]...)
+	return len(b), nil
+}
+
+func TestHairpinValidation(t *testing.T) {
+	tun := &recordingTUN{newDummyTUN("dummy").(*dummyTUN), make(chan []byte, 1)}
+	device := NewDevice(tun, NewLogger(LogLevelError, ""))
+	defer device.Close()
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	peer, err := device.NewPeer(sk.publicKey())
+	assertNil(t, err)
+	assertNil(t, device.insertAllowedIP(net.IPv4(10, 0, 0, 2).To4(), 32, peer))
+
+	hairpin := func(src net.IP) bool {
+		elem := device.NewOutboundElement()
+		packet := testPacketIPv4(17, src, net.IPv4(10, 0, 0, 2), 50000, 53)
+		elem.packet = elem.buffer[MessageTransportHeaderSize : MessageTransportHeaderSize+len(packet)]
+		copy(elem.packet, packet)
+		device.hairpin(peer, elem)
+		device.PutOutboundElement(elem)
+		select {
+		case <-tun.written:
+			return true
+		default:
+			return false
+		}
+	}
+
+	if !hairpin(net.IPv4(10, 0, 0, 2)) {
+		t.Fatal("hairpinned packet from allowed source dropped")
+	}
+	if hairpin(net.IPv4(10, 0, 0, 9)) {
+		t.Fatal("hairpinned packet from disallowed source written to TUN")
+	}
+	if peer.stats.txPackets != 2 || peer.stats.rxPackets != 0 {
+		t.Fatalf("hairpinned packets counted as %d sent and %d received", peer.stats.txPackets, peer.stats.rxPackets)
+	}
+}
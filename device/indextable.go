@@ -20,6 +20,7 @@ type IndexTableEntry struct {
 type IndexTable struct {
 	sync.RWMutex
 	table map[uint32]IndexTableEntry
+	inUse func(uint32) bool // by other devices on the same bind, see sharedbind.go
 }
 
 func randUint32() (uint32, error) {
@@ -67,8 +68,9 @@ func (table *IndexTable) NewIndexForHandshake(peer *Peer, handshake *Handshake)
 
 		table.RLock()
 		_, ok := table.table[index]
+		inUse := table.inUse
 		table.RUnlock()
-		if ok {
+		if ok || (inUse != nil && inUse(index)) {
 			continue
 		}
 
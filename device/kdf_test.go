@@ -6,7 +6,10 @@
 package device
 
 import (
+	"bytes"
+	"crypto/hmac"
 	"encoding/hex"
+	"hash"
 	"testing"
 
 	"golang.org/x/crypto/blake2s"
@@ -83,3 +86,24 @@ func TestKDF(t *testing.T) {
 		assertEquals(t, t0s, test.t0)
 	}
 }
+
+func TestHMACReference(t *testing.T) {
+	for _, size := range []int{0, 8, 32, 64, 65, 100} {
+		key := bytes.Repeat([]byte{0x0b}, size)
+		in0, in1 := []byte("wireguard"), []byte("hmac")
+
+		mac := hmac.New(func() hash.Hash {
+			h, _ := blake2s.New256(nil)
+			return h
+		}, key)
+		mac.Write(in0)
+		mac.Write(in1)
+		expected := mac.Sum(nil)
+
+		var sum [blake2s.Size]byte
+		HMAC2(&sum, key, in0, in1)
+		if !bytes.Equal(sum[:], expected) {
+			t.Errorf("key of %d bytes: got %x, expected %x", size, sum, expected)
+		}
+	}
+}
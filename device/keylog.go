@@ -0,0 +1,94 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+)
+
+/* Session key logging, for decrypting captured traffic in lab
+ * environments, analogous to SSLKEYLOGFILE.
+ *
+ * Once OpenKeyLog is called, the keys of every handshake this device
+ * takes part in are appended to the file in the key log format of the
+ * Wireshark WireGuard dissector. This includes the static private key:
+ * anyone with the file can impersonate the device and decrypt all its
+ * traffic. With a KeyProvider the private key is unknown to the device,
+ * and only the ephemeral and preshared keys are logged.
+ *
+ * The library never enables this by itself; the wireguard-go binary
+ * does so when WGKEYLOGFILE is set.
+ */
+
+func (device *Device) OpenKeyLog(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	device.staticIdentity.RLock()
+	device.keyLog.Lock()
+	if device.keyLog.file != nil {
+		device.keyLog.file.Close()
+	}
+	device.keyLog.file = file
+	device.keyLog.privateKey = device.staticIdentity.privateKey
+	device.keyLog.Unlock()
+	device.staticIdentity.RUnlock()
+
+	for _, line := range []string{
+		"******************************************************************",
+		"* WARNING: session keys are logged to " + path,
+		"* The key log exposes the private key and all traffic of this",
+		"* device. It must never be enabled outside of lab environments.",
+		"******************************************************************",
+	} {
+		device.log.Error.Println(line)
+	}
+	return nil
+}
+
+func (device *Device) closeKeyLog() {
+	device.keyLog.Lock()
+	defer device.keyLog.Unlock()
+	if device.keyLog.file != nil {
+		device.keyLog.file.Close()
+		device.keyLog.file = nil
+	}
+}
+
+/* Should be called when the private key of the device changes */
+func (device *Device) keyLogPrivateKey(sk NoisePrivateKey) {
+	device.keyLog.Lock()
+	defer device.keyLog.Unlock()
+	if device.keyLog.file != nil {
+		device.keyLog.privateKey = sk
+	}
+}
+
+/* Should be called with the handshake locked, after the local
+ * ephemeral key has been created
+ */
+func (device *Device) keyLogHandshake(handshake *Handshake) {
+	device.keyLog.Lock()
+	defer device.keyLog.Unlock()
+	if device.keyLog.file == nil {
+		return
+	}
+
+	encode := base64.StdEncoding.EncodeToString
+	if !device.keyLog.privateKey.IsZero() {
+		fmt.Fprintf(device.keyLog.file, "LOCAL_STATIC_PRIVATE_KEY = %s\n", encode(device.keyLog.privateKey[:]))
+	}
+	fmt.Fprintf(device.keyLog.file,
+		"REMOTE_STATIC_PUBLIC_KEY = %s\nLOCAL_EPHEMERAL_PRIVATE_KEY = %s\nPRESHARED_KEY = %s\n",
+		encode(handshake.remoteStatic[:]),
+		encode(handshake.localEphemeral[:]),
+		encode(handshake.presharedKey[:]),
+	)
+}
@@ -0,0 +1,82 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestKeyLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wireguard-keylog")
+	assertNil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keylog")
+
+	dev1 := randDevice(t)
+	defer dev1.Close()
+	assertNil(t, dev1.OpenKeyLog(path))
+	dev2 := randDevice(t)
+	defer dev2.Close()
+
+	peer, err := dev1.NewPeer(dev2.staticIdentity.publicKey)
+	assertNil(t, err)
+	_, err = dev1.CreateMessageInitiation(peer)
+	assertNil(t, err)
+
+	content, err := ioutil.ReadFile(path)
+	assertNil(t, err)
+
+	encode := base64.StdEncoding.EncodeToString
+	expected := []string{
+		"LOCAL_STATIC_PRIVATE_KEY = " + encode(dev1.staticIdentity.privateKey[:]),
+		"REMOTE_STATIC_PUBLIC_KEY = " + encode(dev2.staticIdentity.publicKey[:]),
+		"LOCAL_EPHEMERAL_PRIVATE_KEY = " + encode(peer.handshake.localEphemeral[:]),
+		"PRESHARED_KEY = " + encode(make([]byte, len(NoiseSymmetricKey{}))),
+	}
+	if strings.TrimSpace(string(content)) != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected key log %q", content)
+	}
+
+	if dev2.keyLog.file != nil {
+		t.Fatal("key log opened without OpenKeyLog")
+	}
+}
+
+func TestKeyLogKeyProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wireguard-keylog")
+	assertNil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keylog")
+
+	dev1 := randDevice(t)
+	defer dev1.Close()
+	assertNil(t, dev1.OpenKeyLog(path))
+	dev2 := randDevice(t)
+	defer dev2.Close()
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	dev1.SetKeyProvider(&testKeyProvider{sk: sk})
+
+	peer, err := dev1.NewPeer(dev2.staticIdentity.publicKey)
+	assertNil(t, err)
+	_, err = dev1.CreateMessageInitiation(peer)
+	assertNil(t, err)
+
+	content, err := ioutil.ReadFile(path)
+	assertNil(t, err)
+	if strings.Contains(string(content), "LOCAL_STATIC_PRIVATE_KEY") {
+		t.Fatalf("static key logged with provider: %q", content)
+	}
+	if !strings.Contains(string(content), "LOCAL_EPHEMERAL_PRIVATE_KEY = "+base64.StdEncoding.EncodeToString(peer.handshake.localEphemeral[:])) {
+		t.Fatalf("ephemeral key not logged: %q", content)
+	}
+}
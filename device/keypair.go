@@ -27,6 +27,7 @@ type Keypair struct {
 	replayFilter replay.ReplayFilter
 	isInitiator  bool
 	created      time.Time
+	rekeyAfter   time.Duration // when initiator, see rekeyjitter.go
 	localIndex   uint32
 	remoteIndex  uint32
 }
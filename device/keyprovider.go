@@ -0,0 +1,73 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+)
+
+/* Static key providers
+ *
+ * The static private key is normally held in memory. Embedders may
+ * instead keep it in a TPM, a PKCS#11 token or an agent process by
+ * implementing KeyProvider: the device then only calls out for the
+ * Curve25519 operations involving the static key, one per peer when
+ * it is added or the provider is set, and one per handshake initiation
+ * or response received, and never sees the private key itself.
+ *
+ * Providers must be safe for concurrent use and should answer quickly,
+ * as handshakes are processed while waiting. A failing provider fails
+ * the handshake concerned, and a peer added while it fails is ignored,
+ * just as a peer whose key gives a zero shared secret.
+ *
+ * Setting a private key, through SetPrivateKey or UAPI, replaces the
+ * provider. With a provider the key is neither returned by UAPI nor
+ * written to the key log; UAPI instead returns key_provider=<public
+ * key>.
+ */
+
+type KeyProvider interface {
+	PublicKey() NoisePublicKey
+	SharedSecret(pk NoisePublicKey) ([NoisePublicKeySize]byte, error)
+}
+
+var errStaticSharedSecret = errors.New("static shared secret unavailable")
+
+/* Uses the provider for the static key of the device
+ */
+func (device *Device) SetKeyProvider(provider KeyProvider) {
+	if provider == nil {
+		device.SetPrivateKey(NoisePrivateKey{})
+		return
+	}
+
+	device.staticIdentity.Lock()
+	defer device.staticIdentity.Unlock()
+
+	device.unsafeSetStaticIdentity(NoisePrivateKey{}, provider)
+}
+
+func (device *Device) KeyProvider() KeyProvider {
+	device.staticIdentity.RLock()
+	defer device.staticIdentity.RUnlock()
+	return device.staticIdentity.provider
+}
+
+/* Computes the shared secret of the static key with pk.
+ * Should be called with the static identity locked.
+ */
+func (device *Device) staticSharedSecret(pk NoisePublicKey) ([NoisePublicKeySize]byte, bool) {
+	provider := device.staticIdentity.provider
+	if provider == nil {
+		return device.staticIdentity.privateKey.sharedSecret(pk), true
+	}
+	ss, err := provider.SharedSecret(pk)
+	if err != nil {
+		device.log.Error.Println("Key provider failed:", err)
+		return [NoisePublicKeySize]byte{}, false
+	}
+	return ss, !isZero(ss[:])
+}
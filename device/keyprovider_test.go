@@ -0,0 +1,110 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testKeyProvider struct {
+	sk      NoisePrivateKey
+	calls   int32
+	failing int32
+}
+
+func (provider *testKeyProvider) PublicKey() NoisePublicKey {
+	return provider.sk.publicKey()
+}
+
+func (provider *testKeyProvider) SharedSecret(pk NoisePublicKey) ([NoisePublicKeySize]byte, error) {
+	atomic.AddInt32(&provider.calls, 1)
+	if atomic.LoadInt32(&provider.failing) != 0 {
+		return [NoisePublicKeySize]byte{}, errors.New("token removed")
+	}
+	return provider.sk.sharedSecret(pk), nil
+}
+
+func TestKeyProviderHandshake(t *testing.T) {
+	dev1 := randDevice(t)
+	dev2 := randDevice(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	provider := &testKeyProvider{sk: sk}
+	dev1.SetKeyProvider(provider)
+
+	if !dev1.staticIdentity.privateKey.IsZero() {
+		t.Fatal("private key kept with provider")
+	}
+	if dev1.staticIdentity.publicKey != sk.publicKey() {
+		t.Fatal("public key not taken from provider")
+	}
+
+	// UAPI reports the identity without the private key
+
+	var buf bytes.Buffer
+	writer := bufio.NewWriter(&buf)
+	if err := dev1.IpcGetOperation(writer); err != nil {
+		t.Fatal(err)
+	}
+	writer.Flush()
+	if strings.Contains(buf.String(), "private_key=") || !strings.Contains(buf.String(), "key_provider="+sk.publicKey().ToHex()+"\n") {
+		t.Fatalf("unexpected identity in %q", buf.String())
+	}
+
+	peer1, _ := dev2.NewPeer(sk.publicKey())
+	peer2, _ := dev1.NewPeer(dev2.staticIdentity.privateKey.publicKey())
+	if peer2 == nil {
+		t.Fatal("peer not added with provider")
+	}
+	assertEqual(t, peer1.handshake.precomputedStaticStatic[:], peer2.handshake.precomputedStaticStatic[:])
+
+	handshake := func(initiator, responder *Device, initiatorPeer, responderPeer *Peer) bool {
+		msg1, err := initiator.CreateMessageInitiation(initiatorPeer)
+		assertNil(t, err)
+		if responder.ConsumeMessageInitiation(msg1) == nil {
+			return false
+		}
+		msg2, err := responder.CreateMessageResponse(responderPeer)
+		assertNil(t, err)
+		return initiator.ConsumeMessageResponse(msg2) != nil
+	}
+
+	calls := atomic.LoadInt32(&provider.calls)
+	if !handshake(dev1, dev2, peer2, peer1) {
+		t.Fatal("handshake initiated with provider failed")
+	}
+	if !handshake(dev2, dev1, peer1, peer2) {
+		t.Fatal("handshake answered with provider failed")
+	}
+	if atomic.LoadInt32(&provider.calls) != calls+2 {
+		t.Fatalf("expected 2 provider calls, got %d", atomic.LoadInt32(&provider.calls)-calls)
+	}
+
+	atomic.StoreInt32(&provider.failing, 1)
+	if handshake(dev2, dev1, peer1, peer2) {
+		t.Fatal("handshake succeeded with failing provider")
+	}
+
+	// a private key replaces the provider
+
+	assertNil(t, dev1.SetPrivateKey(sk))
+	if dev1.KeyProvider() != nil {
+		t.Fatal("provider kept with private key")
+	}
+	time.Sleep(HandshakeInitationRate)
+	if !handshake(dev2, dev1, peer1, peer2) {
+		t.Fatal("handshake failed after replacing provider")
+	}
+}
@@ -0,0 +1,236 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"time"
+)
+
+/* Maintenance mode
+ *
+ * Before planned maintenance a concentrator can be drained rather than
+ * cutting off its users at once. In maintenance mode the device neither
+ * answers nor sends handshakes for peers without a live session, so no
+ * new sessions start, while peers with one keep rekeying as usual.
+ * Refused initiations are dropped silently, or answered with a cookie
+ * reply, telling clients the server is alive but busy. Resume
+ * initiations are always dropped.
+ *
+ * Until the deadline, the number of live sessions is reported with an
+ * EventMaintenanceProgress every MaintenanceProgressInterval. Once none
+ * remain, or at the deadline, when the remaining sessions are cut, an
+ * EventMaintenanceDrained follows. The device stays in maintenance mode
+ * until it is ended.
+ *
+ * Over UAPI maintenance is started with maintenance=<seconds until the
+ * deadline> and ended with maintenance=off; maintenance_refusal is
+ * silent (default) or cookie.
+ *
+ * Events are emitted from the maintenance routine without holding any
+ * lock, so handlers may query, restart or end maintenance.
+ */
+
+const (
+	MaintenanceProgressInterval = time.Second * 10
+)
+
+type MaintenanceRefusal int32
+
+const (
+	MaintenanceSilent MaintenanceRefusal = iota
+	MaintenanceCookie
+)
+
+var maintenanceRefusalNames = [...]string{
+	MaintenanceSilent: "silent",
+	MaintenanceCookie: "cookie",
+}
+
+func (refusal MaintenanceRefusal) String() string {
+	if refusal < 0 || int(refusal) >= len(maintenanceRefusalNames) {
+		return "unknown"
+	}
+	return maintenanceRefusalNames[refusal]
+}
+
+func ParseMaintenanceRefusal(s string) (MaintenanceRefusal, error) {
+	for refusal, name := range maintenanceRefusalNames {
+		if s == name {
+			return MaintenanceRefusal(refusal), nil
+		}
+	}
+	return MaintenanceSilent, errors.New("invalid maintenance refusal: " + s)
+}
+
+/* Enters maintenance mode, cutting sessions left after the grace period
+ */
+func (device *Device) StartMaintenance(grace time.Duration) {
+	device.maintenance.Lock()
+	defer device.maintenance.Unlock()
+
+	device.stopMaintenanceRoutine()
+	device.maintenance.deadline = time.Now().Add(grace)
+	device.maintenance.active.Set(true)
+	device.maintenance.stop = make(chan struct{})
+	device.maintenance.running.Add(1)
+	go device.RoutineMaintenance(device.maintenance.deadline, device.maintenance.stop)
+	device.log.Info.Println("Maintenance: Draining sessions until", device.maintenance.deadline.Format(time.RFC3339))
+}
+
+func (device *Device) EndMaintenance() {
+	device.maintenance.Lock()
+	defer device.maintenance.Unlock()
+
+	if !device.maintenance.active.Get() {
+		return
+	}
+	device.stopMaintenanceRoutine()
+	device.maintenance.active.Set(false)
+	device.log.Info.Println("Maintenance: Ended, accepting handshakes")
+}
+
+/* Returns whether the device is in maintenance mode and its deadline
+ */
+func (device *Device) Maintenance() (bool, time.Time) {
+	device.maintenance.Lock()
+	defer device.maintenance.Unlock()
+	return device.maintenance.active.Get(), device.maintenance.deadline
+}
+
+/* Sets how initiations refused in maintenance mode are answered
+ */
+func (device *Device) SetMaintenanceRefusal(refusal MaintenanceRefusal) {
+	device.maintenance.Lock()
+	defer device.maintenance.Unlock()
+	device.maintenance.refusal = refusal
+}
+
+func (device *Device) MaintenanceRefusal() MaintenanceRefusal {
+	device.maintenance.Lock()
+	defer device.maintenance.Unlock()
+	return device.maintenance.refusal
+}
+
+/* Signals the maintenance routine to stop, without waiting for it,
+ * since it may be calling the event handler calling us.
+ *
+ * Must hold the maintenance lock
+ */
+func (device *Device) stopMaintenanceRoutine() {
+	if device.maintenance.stop != nil {
+		close(device.maintenance.stop)
+		device.maintenance.stop = nil
+	}
+}
+
+/* Reports whether the maintenance routine owning stop was not stopped
+ */
+func (device *Device) maintenanceCurrent(stop chan struct{}) bool {
+	device.maintenance.Lock()
+	defer device.maintenance.Unlock()
+	return device.maintenance.stop == stop
+}
+
+/* Reports whether the peer has a session, counting that of a responder
+ * still awaiting the first data packet confirming it
+ */
+func (peer *Peer) hasLiveSession() bool {
+	live := func(keypair *Keypair) bool {
+		return keypair != nil && time.Since(keypair.created) < RejectAfterTime
+	}
+	peer.keypairs.RLock()
+	defer peer.keypairs.RUnlock()
+	return live(peer.keypairs.current) || live(peer.keypairs.next)
+}
+
+/* Reports whether handshakes with the peer are refused
+ */
+func (peer *Peer) maintenanceRefuses() bool {
+	return peer.device.maintenance.active.Get() && !peer.hasLiveSession()
+}
+
+/* Called with a handshake initiation of the peer refused in maintenance
+ * mode
+ */
+func (device *Device) refuseInitiation(elem *QueueHandshakeElement) {
+	if device.MaintenanceRefusal() == MaintenanceCookie {
+		device.SendHandshakeCookie(elem)
+	}
+}
+
+func (device *Device) liveSessions() int {
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	return device.liveSessionsLocked()
+}
+
+/* Must hold the peers read lock
+ */
+func (device *Device) liveSessionsLocked() int {
+	sessions := 0
+	for _, peer := range device.peers.keyMap {
+		if peer.hasLiveSession() {
+			sessions++
+		}
+	}
+	return sessions
+}
+
+func (device *Device) cutSessions() int {
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	cut := 0
+	for _, peer := range device.peers.keyMap {
+		if peer.hasLiveSession() {
+			peer.ZeroAndFlushAll()
+			cut++
+		}
+	}
+	return cut
+}
+
+func (device *Device) emitMaintenance(stop chan struct{}, eventType EventType, sessions int) {
+	if !device.maintenanceCurrent(stop) {
+		return
+	}
+	device.emit(Event{
+		Type:     eventType,
+		Time:     time.Now(),
+		Sessions: sessions,
+	})
+}
+
+func (device *Device) RoutineMaintenance(deadline time.Time, stop chan struct{}) {
+	defer device.maintenance.running.Done()
+
+	logInfo := device.log.Info
+	ticker := time.NewTicker(MaintenanceProgressInterval)
+	defer ticker.Stop()
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	for {
+		sessions := device.liveSessions()
+		if sessions == 0 {
+			logInfo.Println("Maintenance: All sessions drained")
+			device.emitMaintenance(stop, EventMaintenanceDrained, 0)
+			return
+		}
+		device.emitMaintenance(stop, EventMaintenanceProgress, sessions)
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		case <-timer.C:
+			cut := device.cutSessions()
+			logInfo.Println("Maintenance: Deadline reached, cut", cut, "sessions")
+			device.emitMaintenance(stop, EventMaintenanceDrained, cut)
+			return
+		}
+	}
+}
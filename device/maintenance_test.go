@@ -0,0 +1,203 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMaintenance(t *testing.T) {
+	device1, device2, peer1, peer2 := selftestPair(t)
+	defer device1.Close()
+	defer device2.Close()
+
+	events := make(chan Event, 16)
+	device2.AddEventHandler(func(event Event) {
+		switch event.Type {
+		case EventMaintenanceProgress, EventMaintenanceDrained:
+			events <- event
+		}
+	})
+	awaitEvent := func(eventType EventType) Event {
+		select {
+		case event := <-events:
+			if event.Type != eventType {
+				t.Fatalf("got %v event, expected %v", event.Type, eventType)
+			}
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for", eventType)
+		}
+		return Event{}
+	}
+	reconnect := func(timeout time.Duration) error {
+		peer1.ZeroAndFlushAll()
+		peer1.handshake.mutex.Lock()
+		peer1.handshake.lastSentHandshake = time.Time{}
+		peer1.handshake.mutex.Unlock()
+		return peer1.awaitSession(timeout)
+	}
+
+	// waits for the responder to receive the first data packet,
+	// which moves its keypair from next to current
+
+	awaitConfirmed := func() {
+		deadline := time.Now().Add(5 * time.Second)
+		for peer2.keypairs.Current() == nil {
+			if time.Now().After(deadline) {
+				t.Fatal("session not confirmed")
+			}
+			peer1.SendKeepalive()
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if err := peer1.awaitSession(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	awaitConfirmed()
+
+	// live sessions are reported, then cut at the deadline
+
+	if err := ipcSet(device2, "maintenance_refusal=cookie\n"); err != nil {
+		t.Fatal(err)
+	}
+	device2.StartMaintenance(200 * time.Millisecond)
+	if event := awaitEvent(EventMaintenanceProgress); event.Sessions != 1 {
+		t.Fatalf("progress reports %d sessions, expected 1", event.Sessions)
+	}
+	if event := awaitEvent(EventMaintenanceDrained); event.Sessions != 1 {
+		t.Fatalf("%d sessions cut, expected 1", event.Sessions)
+	}
+	if active, _ := device2.Maintenance(); !active {
+		t.Fatal("maintenance ended when drained")
+	}
+
+	// new sessions are refused until maintenance ends
+
+	if reconnect(500*time.Millisecond) == nil {
+		t.Fatal("session established in maintenance mode")
+	}
+	if err := ipcSet(device2, "maintenance=off\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := reconnect(5 * time.Second); err != nil {
+		t.Fatal("no session after maintenance:", err)
+	}
+	awaitConfirmed()
+
+	// without sessions the device is drained at once
+
+	peer2.ZeroAndFlushAll()
+	if err := ipcSet(device2, "maintenance=60\n"); err != nil {
+		t.Fatal(err)
+	}
+	if event := awaitEvent(EventMaintenanceDrained); event.Sessions != 0 {
+		t.Fatalf("%d sessions cut, expected none", event.Sessions)
+	}
+
+	// handlers may end maintenance from within an event
+
+	ended := make(chan struct{})
+	device1.AddEventHandler(func(event Event) {
+		if event.Type == EventMaintenanceDrained {
+			if active, _ := device1.Maintenance(); active {
+				device1.EndMaintenance()
+				close(ended)
+			}
+		}
+	})
+	device1.StartMaintenance(0)
+	select {
+	case <-ended:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler ending maintenance deadlocked")
+	}
+
+	if ipcSet(device2, "maintenance=soon\n") == nil {
+		t.Fatal("invalid maintenance accepted")
+	}
+	if ipcSet(device2, "maintenance_refusal=loud\n") == nil {
+		t.Fatal("invalid maintenance_refusal accepted")
+	}
+}
+
+func TestMaintenanceRefusalKeepsHandshake(t *testing.T) {
+	dev1 := randDevice(t)
+	dev2 := randDevice(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	peer1, _ := dev2.NewPeer(dev1.staticIdentity.privateKey.publicKey())
+	peer2, _ := dev1.NewPeer(dev2.staticIdentity.privateKey.publicKey())
+
+	// dev2 initiates before entering maintenance
+
+	msg1, err := dev2.CreateMessageInitiation(peer1)
+	assertNil(t, err)
+	if dev1.ConsumeMessageInitiation(msg1) == nil {
+		t.Fatal("handshake failed at initiation message")
+	}
+	msg2, err := dev1.CreateMessageResponse(peer2)
+	assertNil(t, err)
+
+	dev2.StartMaintenance(time.Minute)
+
+	// a crossing initiation of dev1 is refused without touching the handshake
+
+	msg3, err := dev1.CreateMessageInitiation(peer2)
+	assertNil(t, err)
+	peer, refused := dev2.consumeMessageInitiation(msg3)
+	if peer != peer1 || !refused {
+		t.Fatal("initiation not refused in maintenance mode")
+	}
+	if dev2.ConsumeMessageInitiation(msg3) != nil {
+		t.Fatal("refused initiation consumed")
+	}
+
+	if dev2.ConsumeMessageResponse(msg2) != peer1 {
+		t.Fatal("handshake in progress broken by refused initiation")
+	}
+	if err := peer1.BeginSymmetricSession(); err != nil {
+		t.Fatal("failed to derive keypair:", err)
+	}
+	if !peer1.hasLiveSession() {
+		t.Fatal("no session after completing the handshake")
+	}
+}
+
+func TestMaintenanceUnconfirmedSession(t *testing.T) {
+	dev1 := randDevice(t)
+	dev2 := randDevice(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	peer1, _ := dev2.NewPeer(dev1.staticIdentity.privateKey.publicKey())
+	peer2, _ := dev1.NewPeer(dev2.staticIdentity.privateKey.publicKey())
+
+	// dev2 responds, its keypair awaiting confirmation by data
+
+	msg1, err := dev1.CreateMessageInitiation(peer2)
+	assertNil(t, err)
+	if dev2.ConsumeMessageInitiation(msg1) == nil {
+		t.Fatal("handshake failed at initiation message")
+	}
+	_, err = dev2.CreateMessageResponse(peer1)
+	assertNil(t, err)
+	assertNil(t, peer1.BeginSymmetricSession())
+
+	if peer1.keypairs.Current() != nil || !peer1.hasLiveSession() {
+		t.Fatal("unconfirmed session not counted")
+	}
+	dev2.StartMaintenance(time.Minute)
+	if peer1.maintenanceRefuses() {
+		t.Fatal("peer with unconfirmed session refused")
+	}
+	if sessions := dev2.liveSessions(); sessions != 1 {
+		t.Fatalf("%d live sessions, expected 1", sessions)
+	}
+}
@@ -0,0 +1,315 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+/* Match counters on the plaintext path
+ *
+ * A match selects decrypted packets by protocol, port and prefix, in
+ * the spirit of a (very) small subset of BPF filter expressions:
+ *
+ *   [tcp | udp | icmp | proto N] [port N] [net PREFIX] [sample N]
+ *
+ * Ports and prefixes match either source or destination. Matching
+ * packets are counted per peer, and every Nth is logged if sampled.
+ */
+
+const (
+	MaxMatches = 64
+)
+
+type Match struct {
+	Name     string
+	Protocol uint8      // IP protocol number (0 = any)
+	Port     uint16     // TCP or UDP source or destination port (0 = any)
+	Prefix   *net.IPNet // source or destination address (nil = any)
+	Sample   uint32     // log every Nth matching packet (0 = disabled)
+}
+
+type MatchPeerStats struct {
+	PublicKey NoisePublicKey
+	Packets   uint64
+	Bytes     uint64
+}
+
+type MatchStats struct {
+	Name       string
+	Expression string
+	Peers      []MatchPeerStats
+}
+
+type matchCounter struct {
+	packets uint64
+	bytes   uint64
+}
+
+type matchRule struct {
+	Match
+	counters sync.Map // *Peer -> *matchCounter
+}
+
+var matchProtocols = []struct {
+	name   string
+	number uint8
+}{
+	{"icmp", 1},
+	{"tcp", 6},
+	{"udp", 17},
+	{"icmp6", 58},
+}
+
+func matchProtocol(name string) (uint8, bool) {
+	for _, protocol := range matchProtocols {
+		if protocol.name == name {
+			return protocol.number, true
+		}
+	}
+	return 0, false
+}
+
+/* Parses a match expression, see above
+ */
+func ParseMatch(name, expression string) (Match, error) {
+	match := Match{Name: name}
+	if name == "" || strings.ContainsAny(name, " \t=") {
+		return match, errors.New("invalid match name")
+	}
+
+	fields := strings.Fields(expression)
+	if len(fields) == 0 {
+		return match, errors.New("empty match expression")
+	}
+
+	for i := 0; i < len(fields); i++ {
+		if protocol, ok := matchProtocol(fields[i]); ok {
+			match.Protocol = protocol
+			continue
+		}
+		if i+1 == len(fields) {
+			return match, fmt.Errorf("missing argument of %s", fields[i])
+		}
+		keyword, arg := fields[i], fields[i+1]
+		i++
+
+		switch keyword {
+		case "proto":
+			protocol, err := strconv.ParseUint(arg, 10, 8)
+			if err != nil || protocol == 0 {
+				return match, fmt.Errorf("invalid protocol %s", arg)
+			}
+			match.Protocol = uint8(protocol)
+		case "port":
+			port, err := strconv.ParseUint(arg, 10, 16)
+			if err != nil || port == 0 {
+				return match, fmt.Errorf("invalid port %s", arg)
+			}
+			match.Port = uint16(port)
+		case "net":
+			_, prefix, err := net.ParseCIDR(arg)
+			if err != nil {
+				return match, err
+			}
+			match.Prefix = prefix
+		case "sample":
+			sample, err := strconv.ParseUint(arg, 10, 32)
+			if err != nil {
+				return match, fmt.Errorf("invalid sample rate %s", arg)
+			}
+			match.Sample = uint32(sample)
+		default:
+			return match, fmt.Errorf("unknown keyword %s", keyword)
+		}
+	}
+
+	if match.Port != 0 && match.Protocol != 0 && match.Protocol != 6 && match.Protocol != 17 {
+		return match, errors.New("port requires tcp or udp")
+	}
+	return match, nil
+}
+
+/* Returns the expression of the match
+ */
+func (match *Match) Expression() string {
+	var fields []string
+	if match.Protocol != 0 {
+		name := "proto " + strconv.Itoa(int(match.Protocol))
+		for _, protocol := range matchProtocols {
+			if protocol.number == match.Protocol {
+				name = protocol.name
+			}
+		}
+		fields = append(fields, name)
+	}
+	if match.Port != 0 {
+		fields = append(fields, "port", strconv.Itoa(int(match.Port)))
+	}
+	if match.Prefix != nil {
+		fields = append(fields, "net", match.Prefix.String())
+	}
+	if match.Sample != 0 {
+		fields = append(fields, "sample", strconv.FormatUint(uint64(match.Sample), 10))
+	}
+	return strings.Join(fields, " ")
+}
+
+func (match *Match) matches(packet []byte) bool {
+	var protocol uint8
+	var src, dst net.IP
+	var transport []byte
+
+	switch packet[0] >> 4 {
+	case 4:
+		headerLen := int(packet[0]&0x0f) * 4
+		if len(packet) < headerLen {
+			return false
+		}
+		protocol = packet[9]
+		src = packet[IPv4offsetSrc : IPv4offsetSrc+net.IPv4len]
+		dst = packet[IPv4offsetDst : IPv4offsetDst+net.IPv4len]
+		if binary.BigEndian.Uint16(packet[6:8])&0x1fff == 0 {
+			transport = packet[headerLen:]
+		}
+	case 6:
+		protocol = packet[6]
+		src = packet[IPv6offsetSrc : IPv6offsetSrc+net.IPv6len]
+		dst = packet[IPv6offsetDst : IPv6offsetDst+net.IPv6len]
+		transport = packet[40:]
+	default:
+		return false
+	}
+
+	if match.Protocol != 0 && protocol != match.Protocol {
+		return false
+	}
+	if match.Prefix != nil && !match.Prefix.Contains(src) && !match.Prefix.Contains(dst) {
+		return false
+	}
+	if match.Port != 0 {
+		if (protocol != 6 && protocol != 17) || len(transport) < 4 {
+			return false
+		}
+		srcPort := binary.BigEndian.Uint16(transport[0:2])
+		dstPort := binary.BigEndian.Uint16(transport[2:4])
+		if srcPort != match.Port && dstPort != match.Port {
+			return false
+		}
+	}
+	return true
+}
+
+func (device *Device) loadMatches() []*matchRule {
+	rules, _ := device.matches.rules.Load().([]*matchRule)
+	return rules
+}
+
+/* Installs a match, replacing (and resetting) any match of the same name
+ */
+func (device *Device) SetMatch(match Match) error {
+	device.matches.Lock()
+	defer device.matches.Unlock()
+
+	old := device.loadMatches()
+	rules := make([]*matchRule, 0, len(old)+1)
+	for _, rule := range old {
+		if rule.Name != match.Name {
+			rules = append(rules, rule)
+		}
+	}
+	if len(rules) >= MaxMatches {
+		return errors.New("too many matches")
+	}
+	rules = append(rules, &matchRule{Match: match})
+	device.matches.rules.Store(rules)
+	return nil
+}
+
+func (device *Device) RemoveMatch(name string) {
+	device.matches.Lock()
+	defer device.matches.Unlock()
+
+	old := device.loadMatches()
+	rules := make([]*matchRule, 0, len(old))
+	for _, rule := range old {
+		if rule.Name != name {
+			rules = append(rules, rule)
+		}
+	}
+	device.matches.rules.Store(rules)
+}
+
+/* Called with each decrypted packet received from the peer,
+ * after the source address has been verified
+ */
+func (peer *Peer) countMatches(packet []byte) {
+	for _, rule := range peer.device.loadMatches() {
+		if !rule.matches(packet) {
+			continue
+		}
+		value, ok := rule.counters.Load(peer)
+		if !ok {
+			value, _ = rule.counters.LoadOrStore(peer, &matchCounter{})
+		}
+		counter := value.(*matchCounter)
+		packets := atomic.AddUint64(&counter.packets, 1)
+		atomic.AddUint64(&counter.bytes, uint64(len(packet)))
+
+		if rule.Sample != 0 && packets%uint64(rule.Sample) == 0 {
+			peer.device.log.Info.Println(peer, "- Sampled packet matching", rule.Name+":", describePacket(packet))
+		}
+	}
+}
+
+func describePacket(packet []byte) string {
+	var src, dst net.IP
+	var protocol uint8
+	if packet[0]>>4 == 4 {
+		src, dst = packet[IPv4offsetSrc:IPv4offsetSrc+net.IPv4len], packet[IPv4offsetDst:IPv4offsetDst+net.IPv4len]
+		protocol = packet[9]
+	} else {
+		src, dst = packet[IPv6offsetSrc:IPv6offsetSrc+net.IPv6len], packet[IPv6offsetDst:IPv6offsetDst+net.IPv6len]
+		protocol = packet[6]
+	}
+	return fmt.Sprintf("proto %d, %v -> %v, %d bytes", protocol, src, dst, len(packet))
+}
+
+/* Should be called when the peer is removed */
+func (device *Device) forgetMatches(peer *Peer) {
+	for _, rule := range device.loadMatches() {
+		rule.counters.Delete(peer)
+	}
+}
+
+func (device *Device) matchStats() []MatchStats {
+	var stats []MatchStats
+	for _, rule := range device.loadMatches() {
+		match := MatchStats{
+			Name:       rule.Name,
+			Expression: rule.Expression(),
+		}
+		rule.counters.Range(func(key, value interface{}) bool {
+			peer := key.(*Peer)
+			counter := value.(*matchCounter)
+			match.Peers = append(match.Peers, MatchPeerStats{
+				PublicKey: peer.handshake.remoteStatic,
+				Packets:   atomic.LoadUint64(&counter.packets),
+				Bytes:     atomic.LoadUint64(&counter.bytes),
+			})
+			return true
+		})
+		stats = append(stats, match)
+	}
+	return stats
+}
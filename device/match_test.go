@@ -0,0 +1,96 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestParseMatch(t *testing.T) {
+	valid := []struct {
+		expression string
+		expected   string
+	}{
+		{"tcp port 443", "tcp port 443"},
+		{"proto 17 net 10.0.0.1/8 sample 100", "udp net 10.0.0.0/8 sample 100"},
+		{"net fd00::/64 proto 47", "proto 47 net fd00::/64"},
+	}
+	for _, test := range valid {
+		match, err := ParseMatch("test", test.expression)
+		assertNil(t, err)
+		if match.Expression() != test.expected {
+			t.Errorf("expression of %q: got %q, expected %q", test.expression, match.Expression(), test.expected)
+		}
+	}
+
+	for _, expression := range []string{"", "tcp port", "port 0", "icmp port 80", "bogus 1", "net 10.0.0.0"} {
+		if _, err := ParseMatch("test", expression); err == nil {
+			t.Errorf("parsed invalid expression %q", expression)
+		}
+	}
+}
+
+func testPacketIPv4(protocol uint8, src, dst net.IP, srcPort, dstPort uint16) []byte {
+	packet := make([]byte, 28)
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[IPv4offsetTotalLength:], uint16(len(packet)))
+	packet[9] = protocol
+	copy(packet[IPv4offsetSrc:], src.To4())
+	copy(packet[IPv4offsetDst:], dst.To4())
+	binary.BigEndian.PutUint16(packet[20:], srcPort)
+	binary.BigEndian.PutUint16(packet[22:], dstPort)
+	return packet
+}
+
+func TestMatchCounters(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	peer, err := device.NewPeer(sk.publicKey())
+	assertNil(t, err)
+
+	if err := ipcSet(device, "match=https tcp port 443 net 10.0.0.0/24\nmatch=dns udp port 53\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	local, remote := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	packets := [][]byte{
+		testPacketIPv4(6, remote, local, 443, 50000),
+		testPacketIPv4(6, remote, local, 50000, 443),
+		testPacketIPv4(6, remote, local, 50000, 80),
+		testPacketIPv4(17, remote, local, 443, 50000),
+		testPacketIPv4(6, net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2), 443, 50000),
+	}
+	for _, packet := range packets {
+		peer.countMatches(packet)
+	}
+
+	stats := device.Stats().Matches
+	if len(stats) != 2 || stats[0].Name != "https" || stats[1].Name != "dns" {
+		t.Fatalf("unexpected matches %v", stats)
+	}
+	if len(stats[0].Peers) != 1 || stats[0].Peers[0].Packets != 2 || stats[0].Peers[0].Bytes != 56 {
+		t.Fatalf("unexpected counters %v", stats[0].Peers)
+	}
+	if len(stats[1].Peers) != 0 {
+		t.Fatalf("unexpected counters %v", stats[1].Peers)
+	}
+
+	// removal of match and of peer
+
+	if err := ipcSet(device, "match=dns\n"); err != nil {
+		t.Fatal(err)
+	}
+	device.RemovePeer(peer.handshake.remoteStatic)
+	stats = device.Stats().Matches
+	if len(stats) != 1 || len(stats[0].Peers) != 0 {
+		t.Fatalf("unexpected matches after removal %v", stats)
+	}
+}
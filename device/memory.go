@@ -0,0 +1,121 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"net"
+	"time"
+	"unsafe"
+)
+
+/* Approximate accounting of the memory held by peers, the
+ * allowed IPs trie and queued packets. The figures are estimates
+ * from the sizes of the data structures involved, not measurements
+ * of the Go heap, but suffice to keep small devices from running
+ * out of memory when a memory limit is configured.
+ *
+ * The limit applies to the queues allocated with the device and the
+ * memory committed to configuration, peers and allowed IPs, which is
+ * counted as it is reserved and released. Packets held in queues come
+ * and go with load, so they are reported but do not count toward the
+ * limit, lest configuration changes fail under load.
+ */
+
+var ErrMemoryLimit = errors.New("memory limit exceeded")
+
+const (
+	memoryTimer    = uint64(unsafe.Sizeof(Timer{}) + unsafe.Sizeof(time.Timer{}))
+	memoryTrieNode = uint64(unsafe.Sizeof(trieEntry{}) + net.IPv6len)
+	memoryPointer  = uint64(unsafe.Sizeof(uintptr(0)))
+)
+
+type MemoryStats struct {
+	Peers      uint64 // peer state, including per peer queues and timers
+	AllowedIPs uint64 // nodes of the allowed IPs trie
+	Queues     uint64 // device wide queues and the packets held in all queues
+	Limit      uint64 // configured limit, zero if unlimited
+}
+
+func (stats MemoryStats) Total() uint64 {
+	return stats.Peers + stats.AllowedIPs + stats.Queues
+}
+
+func (device *Device) memoryPerPeer() uint64 {
+	slots := uint64(2*device.options.OutboundQueueSize + device.options.InboundQueueSize)
+	return uint64(unsafe.Sizeof(Peer{})) + slots*memoryPointer + 5*memoryTimer
+}
+
+func (device *Device) memoryStats(queues *[queueCount]QueueStats) MemoryStats {
+	var stats MemoryStats
+
+	stats.Limit = device.options.MemoryLimit
+
+	device.peers.RLock()
+	stats.Peers = uint64(len(device.peers.keyMap)) * device.memoryPerPeer()
+	device.peers.RUnlock()
+
+	stats.AllowedIPs = uint64(device.allowedips.NodeCount()) * memoryTrieNode
+
+	stats.Queues = device.memoryQueues()
+	for _, queue := range queues {
+		stats.Queues += uint64(queue.Depth) * MaxMessageSize
+	}
+
+	return stats
+}
+
+/* Memory of the queues allocated with the device, excluding packets
+ */
+func (device *Device) memoryQueues() uint64 {
+	size := uint64(cap(device.queue.encryption)) * memoryPointer
+	for _, queue := range device.queue.decryption {
+		size += uint64(cap(queue)) * memoryPointer
+	}
+	size += uint64(cap(device.queue.handshake)) * uint64(unsafe.Sizeof(QueueHandshakeElement{}))
+	return size
+}
+
+/* Commits additional memory, returning ErrMemoryLimit if this would
+ * exceed the limit. Must be released with releaseMemory once freed.
+ */
+func (device *Device) reserveMemory(size uint64) error {
+	device.memory.Lock()
+	defer device.memory.Unlock()
+	limit := device.options.MemoryLimit
+	if limit != 0 && device.memoryQueues()+device.memory.committed+size > limit {
+		return ErrMemoryLimit
+	}
+	device.memory.committed += size
+	return nil
+}
+
+func (device *Device) releaseMemory(size uint64) {
+	device.memory.Lock()
+	defer device.memory.Unlock()
+	if size > device.memory.committed {
+		size = device.memory.committed
+	}
+	device.memory.committed -= size
+}
+
+/* Inserts into the allowed IPs, subject to the memory limit.
+ * Every insertion allocates at most two trie nodes.
+ */
+func (device *Device) insertAllowedIP(ip net.IP, cidr uint, peer *Peer) error {
+	if err := device.reserveMemory(2 * memoryTrieNode); err != nil {
+		return err
+	}
+	device.reportOverlap(ip, cidr, peer)
+	created := device.allowedips.Insert(ip, cidr, peer)
+	device.releaseMemory(uint64(2-created) * memoryTrieNode)
+	return nil
+}
+
+func (device *Device) removeAllowedIPs(peer *Peer) {
+	removed := device.allowedips.RemoveByPeer(peer)
+	device.releaseMemory(uint64(removed) * memoryTrieNode)
+}
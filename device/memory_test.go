@@ -0,0 +1,64 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"strings"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/ipc"
+)
+
+func TestMemoryLimit(t *testing.T) {
+	device := randDevice(t)
+	base := device.Stats().Memory.Total()
+	perPeer := device.memoryPerPeer()
+	device.Close()
+
+	// room for one peer and three trie nodes
+
+	options := DeviceOptions{MemoryLimit: base + perPeer + 3*memoryTrieNode}
+	device = NewDeviceWithOptions(newDummyTUN("dummy"), NewLogger(LogLevelError, ""), options)
+	defer device.Close()
+
+	peer := "public_key=" + strings.Repeat("ab", 32) + "\n"
+	if err := ipcSet(device, peer+"allowed_ip=10.0.0.0/24\nallowed_ip=10.0.1.0/24\n"); err != nil {
+		t.Fatal(err)
+	}
+	if nodes := device.allowedips.NodeCount(); nodes != 3 {
+		t.Fatalf("expected 3 trie nodes, got %d", nodes)
+	}
+
+	err := ipcSet(device, peer+"allowed_ip=10.0.2.0/24\n")
+	if err == nil || err.ErrorCode() != ipc.IpcErrorNoMemory || err.Reason() != ipc.ReasonMemoryLimit {
+		t.Fatalf("expected memory limit error for allowed ip, got %v", err)
+	}
+
+	err = ipcSet(device, "public_key="+strings.Repeat("cd", 32)+"\n")
+	if err == nil || err.ErrorCode() != ipc.IpcErrorNoMemory || err.Reason() != ipc.ReasonMemoryLimit {
+		t.Fatalf("expected memory limit error for peer, got %v", err)
+	}
+
+	stats := device.Stats().Memory
+	if stats.Limit != options.MemoryLimit || stats.Total() > stats.Limit {
+		t.Fatalf("unexpected memory stats: %+v", stats)
+	}
+
+	// removing the peer releases its memory for another
+
+	if err := ipcSet(device, peer+"remove=true\n"); err != nil {
+		t.Fatal(err)
+	}
+	device.memory.Lock()
+	committed := device.memory.committed
+	device.memory.Unlock()
+	if nodes := uint64(device.allowedips.NodeCount()); committed != nodes*memoryTrieNode {
+		t.Fatalf("%d bytes committed for %d trie nodes after removing peer", committed, nodes)
+	}
+	if err := ipcSet(device, "public_key="+strings.Repeat("cd", 32)+"\nallowed_ip=10.0.2.0/24\n"); err != nil {
+		t.Fatal(err)
+	}
+}
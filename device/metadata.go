@@ -0,0 +1,87 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+/* Opaque metadata of peers
+ *
+ * Controllers may attach small key/value pairs to a peer, such as a
+ * provisioning ID or owner, which are kept with the peer and reported
+ * by the get operation but otherwise ignored. Over UAPI an entry is
+ * set as metadata=<key>:<value>, with an empty value removing the key.
+ * Values are percent-encoded on the wire, as in URL queries, so that
+ * they may hold any bytes.
+ */
+
+const (
+	MaxMetadataEntries     = 16
+	MaxMetadataKeyLength   = 64
+	MaxMetadataValueLength = 256
+)
+
+/* Sets the value of a metadata key, an empty value removes the key
+ */
+func (peer *Peer) SetMetadata(key, value string) error {
+	if key == "" || len(key) > MaxMetadataKeyLength || strings.ContainsAny(key, ":=\n") {
+		return errors.New("invalid metadata key")
+	}
+	if len(value) > MaxMetadataValueLength {
+		return errors.New("invalid metadata value")
+	}
+
+	peer.metadata.Lock()
+	defer peer.metadata.Unlock()
+
+	if value == "" {
+		delete(peer.metadata.entries, key)
+		return nil
+	}
+	if _, ok := peer.metadata.entries[key]; !ok && len(peer.metadata.entries) >= MaxMetadataEntries {
+		return errors.New("too many metadata entries")
+	}
+	if peer.metadata.entries == nil {
+		peer.metadata.entries = make(map[string]string)
+	}
+	peer.metadata.entries[key] = value
+	return nil
+}
+
+func (peer *Peer) ClearMetadata() {
+	peer.metadata.Lock()
+	defer peer.metadata.Unlock()
+	peer.metadata.entries = nil
+}
+
+/* Returns a copy of the metadata of the peer
+ */
+func (peer *Peer) Metadata() map[string]string {
+	peer.metadata.RLock()
+	defer peer.metadata.RUnlock()
+
+	entries := make(map[string]string, len(peer.metadata.entries))
+	for key, value := range peer.metadata.entries {
+		entries[key] = value
+	}
+	return entries
+}
+
+/* Returns the entries as UAPI values
+ */
+func (peer *Peer) metadataLines() []string {
+	entries := peer.Metadata()
+	lines := make([]string, 0, len(entries))
+	for key, value := range entries {
+		lines = append(lines, key+":"+url.QueryEscape(value))
+	}
+	sort.Strings(lines)
+	return lines
+}
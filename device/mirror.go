@@ -0,0 +1,248 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+/* Traffic mirroring
+ *
+ * For intrusion detection or lawful intercept at the gateway, decrypted
+ * traffic of all peers, in both directions, may be duplicated to a
+ * monitor, optionally restricted by a match expression (see match.go):
+ *
+ *  - a monitoring peer, to which copies are sent through the tunnel
+ *    like any other packet; its side must accept any source address,
+ *    as with AllowedIPs = 0.0.0.0/0, ::/0
+ *  - a local collector, to which each copy is sent as the payload of a
+ *    UDP datagram
+ *
+ * Traffic of the monitoring peer itself is never mirrored. Copies are
+ * queued and sent by a routine of their own, and dropped when the queue
+ * is full rather than slowing down the traffic mirrored.
+ *
+ * Over UAPI the mirror is set with mirror=<target> [<match expression>],
+ * the target being peer:<public key in hex> or udp:<address>, and
+ * removed with an empty value.
+ */
+
+const (
+	MirrorQueueSize = 1024
+)
+
+type MirrorConfig struct {
+	Peer    NoisePublicKey // monitoring peer, or
+	Address string         // of the local collector
+	Filter  *Match         // packets mirrored, nil for all
+}
+
+func (config *MirrorConfig) enabled() bool {
+	return config.Address != "" || !config.Peer.IsZero()
+}
+
+/* Returns the UAPI value of the configuration
+ */
+func (config *MirrorConfig) String() string {
+	target := "udp:" + config.Address
+	if config.Address == "" {
+		target = "peer:" + config.Peer.ToHex()
+	}
+	if config.Filter != nil {
+		target += " " + config.Filter.Expression()
+	}
+	return target
+}
+
+/* Parses the UAPI value of a configuration, see above
+ */
+func ParseMirrorConfig(value string) (MirrorConfig, error) {
+	var config MirrorConfig
+	fields := strings.SplitN(value, " ", 2)
+	switch {
+	case strings.HasPrefix(fields[0], "peer:"):
+		if err := config.Peer.FromHex(strings.TrimPrefix(fields[0], "peer:")); err != nil {
+			return config, err
+		}
+	case strings.HasPrefix(fields[0], "udp:"):
+		config.Address = strings.TrimPrefix(fields[0], "udp:")
+		if config.Address == "" {
+			return config, errors.New("missing collector address")
+		}
+	default:
+		return config, errors.New("mirror target must be peer:<key> or udp:<address>")
+	}
+	if len(fields) == 2 && strings.TrimSpace(fields[1]) != "" {
+		filter, err := ParseMatch("mirror", fields[1])
+		if err != nil {
+			return config, err
+		}
+		config.Filter = &filter
+	}
+	return config, nil
+}
+
+type mirror struct {
+	sent    uint64 // kept first to be 64-bit aligned
+	dropped uint64
+	config  MirrorConfig
+	conn    *net.UDPConn
+	queue   chan []byte
+	stop    chan struct{}
+	stopped sync.WaitGroup
+}
+
+var mirrorBufferPool = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, 0, MaxContentSize)
+	},
+}
+
+/* Mirrors traffic as configured, a zero configuration disables
+ * mirroring
+ */
+func (device *Device) SetMirror(config MirrorConfig) error {
+	device.mirror.Lock()
+	defer device.mirror.Unlock()
+
+	if old := device.loadMirror(); old != nil {
+		device.mirror.state.Store((*mirror)(nil))
+		close(old.stop)
+		old.stopped.Wait()
+		if old.conn != nil {
+			old.conn.Close()
+		}
+	}
+	device.mirror.config = MirrorConfig{}
+
+	if !config.enabled() {
+		return nil
+	}
+
+	m := &mirror{
+		config: config,
+		queue:  make(chan []byte, MirrorQueueSize),
+		stop:   make(chan struct{}),
+	}
+	if config.Address != "" {
+		addr, err := device.resolveUDPAddr(config.Address)
+		if err != nil {
+			return err
+		}
+		m.conn, err = net.DialUDP("udp", nil, addr)
+		if err != nil {
+			return err
+		}
+	}
+	device.mirror.config = config
+	device.mirror.state.Store(m)
+	m.stopped.Add(1)
+	go device.RoutineMirror(m)
+	return nil
+}
+
+func (device *Device) Mirror() MirrorConfig {
+	device.mirror.Lock()
+	defer device.mirror.Unlock()
+	return device.mirror.config
+}
+
+/* Returns the number of packets mirrored and dropped
+ */
+func (device *Device) MirrorStats() (sent, dropped uint64) {
+	if m := device.loadMirror(); m != nil {
+		return atomic.LoadUint64(&m.sent), atomic.LoadUint64(&m.dropped)
+	}
+	return 0, 0
+}
+
+func (device *Device) loadMirror() *mirror {
+	m, _ := device.mirror.state.Load().(*mirror)
+	return m
+}
+
+func (device *Device) closeMirror() {
+	device.SetMirror(MirrorConfig{})
+}
+
+/* Called with each decrypted packet received from or sent to the peer
+ */
+func (peer *Peer) mirrorPacket(packet []byte) {
+	m := peer.device.loadMirror()
+	if m == nil || peer.handshake.remoteStatic == m.config.Peer {
+		return
+	}
+	if m.config.Filter != nil && !m.config.Filter.matches(packet) {
+		return
+	}
+
+	buffer := mirrorBufferPool.Get().([]byte)
+	buffer = append(buffer[:0], packet...)
+	select {
+	case m.queue <- buffer:
+	default:
+		mirrorBufferPool.Put(buffer)
+		atomic.AddUint64(&m.dropped, 1)
+		peer.device.countDrop(QueueMirror, DropQueueFull)
+	}
+}
+
+func (device *Device) RoutineMirror(m *mirror) {
+	defer m.stopped.Done()
+
+	logDebug := device.log.Debug
+	logDebug.Println("Routine: mirror - started")
+	defer logDebug.Println("Routine: mirror - stopped")
+
+	for {
+		select {
+		case <-m.stop:
+			for {
+				select {
+				case buffer := <-m.queue:
+					mirrorBufferPool.Put(buffer)
+					device.countDrop(QueueMirror, DropFlushed)
+				default:
+					return
+				}
+			}
+		case buffer := <-m.queue:
+			if device.sendMirrored(m, buffer) {
+				atomic.AddUint64(&m.sent, 1)
+			} else {
+				atomic.AddUint64(&m.dropped, 1)
+			}
+			mirrorBufferPool.Put(buffer)
+		}
+	}
+}
+
+func (device *Device) sendMirrored(m *mirror, packet []byte) bool {
+	if m.conn != nil {
+		if _, err := m.conn.Write(packet); err != nil {
+			device.log.Debug.Println("Mirror: failed to send:", err)
+			return false
+		}
+		return true
+	}
+
+	monitor := device.LookupPeer(m.config.Peer)
+	if monitor == nil || !monitor.isRunning.Get() {
+		return false
+	}
+	elem := device.NewOutboundElement()
+	offset := MessageTransportHeaderSize
+	elem.packet = elem.buffer[offset : offset+copy(elem.buffer[offset:], packet)]
+	if monitor.queue.packetInNonceQueueIsAwaitingKey.Get() {
+		monitor.SendHandshakeInitiation(false)
+	}
+	addToNonceQueue(monitor.queue.nonce, elem, device)
+	return true
+}
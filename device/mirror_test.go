@@ -0,0 +1,111 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMirrorToCollector(t *testing.T) {
+	collector, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assertNil(t, err)
+	defer collector.Close()
+
+	device := randDevice(t)
+	defer device.Close()
+
+	sk, _ := newPrivateKey()
+	peer, err := device.NewPeer(sk.publicKey())
+	assertNil(t, err)
+
+	local, remote := net.IPv4(10, 0, 0, 1).To4(), net.IPv4(10, 0, 0, 2).To4()
+	matching := testPacketIPv4(6, remote, local, 443, 50000)
+	other := testPacketIPv4(17, remote, local, 53, 50001)
+
+	value := "udp:" + collector.LocalAddr().String() + " tcp port 443"
+	if err := ipcSet(device, "mirror="+value+"\n"); err != nil {
+		t.Fatal(err)
+	}
+	peer.mirrorPacket(other)
+	peer.mirrorPacket(matching)
+
+	var buff [MaxContentSize]byte
+	collector.SetReadDeadline(time.Now().Add(5 * time.Second))
+	size, _, err := collector.ReadFromUDP(buff[:])
+	assertNil(t, err)
+	if !bytes.Equal(buff[:size], matching) {
+		t.Fatal("mirrored packet differs")
+	}
+	collector.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, _, err := collector.ReadFromUDP(buff[:]); err == nil {
+		t.Fatal("packet outside of the filter mirrored")
+	}
+	if sent, dropped := device.MirrorStats(); sent != 1 || dropped != 0 {
+		t.Fatalf("sent %d, dropped %d", sent, dropped)
+	}
+
+	var buf strings.Builder
+	writer := bufio.NewWriter(&buf)
+	if err := device.IpcGetOperation(writer); err != nil {
+		t.Fatal(err)
+	}
+	writer.Flush()
+	if !strings.Contains(buf.String(), "mirror="+value+"\n") {
+		t.Fatalf("get lacks mirror=%s", value)
+	}
+
+	if err := ipcSet(device, "mirror=\n"); err != nil {
+		t.Fatal(err)
+	}
+	if device.loadMirror() != nil {
+		t.Fatal("mirror not removed")
+	}
+	peer.mirrorPacket(matching)
+}
+
+func TestMirrorToPeer(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+	device.Up()
+
+	sk, _ := newPrivateKey()
+	peer, err := device.NewPeer(sk.publicKey())
+	assertNil(t, err)
+	sk, _ = newPrivateKey()
+	monitor, err := device.NewPeer(sk.publicKey())
+	assertNil(t, err)
+
+	assertNil(t, device.SetMirror(MirrorConfig{Peer: monitor.handshake.remoteStatic}))
+
+	packet := testPacketIPv4(6, net.IPv4(10, 0, 0, 2).To4(), net.IPv4(10, 0, 0, 1).To4(), 443, 50000)
+	monitor.mirrorPacket(packet)
+	peer.mirrorPacket(packet)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		sent, dropped := device.MirrorStats()
+		if sent == 1 && dropped == 0 {
+			break
+		}
+		if sent > 1 || dropped > 0 || time.Now().After(deadline) {
+			t.Fatalf("sent %d, dropped %d", sent, dropped)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if sent, _ := device.MirrorStats(); sent != 1 {
+		t.Fatalf("traffic of the monitoring peer mirrored, sent %d", sent)
+	}
+
+	if _, err := ParseMirrorConfig("tcp:127.0.0.1:1"); err == nil {
+		t.Fatal("invalid target accepted")
+	}
+}
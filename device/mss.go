@@ -0,0 +1,176 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"sync/atomic"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+/* TCP MSS clamping
+ *
+ * Hosts behind the tunnel announce an MSS fitting the MTU of their own
+ * link, and when ICMP "packet too big" messages are filtered somewhere
+ * on the path, connections stall as soon as a full-sized segment is
+ * sent. With MSS clamping the MSS option of TCP SYN and SYN-ACK
+ * segments passing through the device, in either direction, is lowered
+ * to fit the tunnel, as iptables' TCPMSS target would:
+ *
+ *   auto - the MTU of the TUN device less the IP and TCP headers, so
+ *          40 bytes for IPv4 and 60 bytes for IPv6
+ *   <n>  - at most n bytes
+ *
+ * Over UAPI this is set with mss_clamp=auto, mss_clamp=<n>, or
+ * mss_clamp=off (or 0) to disable clamping, which is the default.
+ * Segments of IPv4 fragments other than the first are left alone.
+ */
+
+const (
+	MSSClampOff  = 0
+	MSSClampAuto = -1
+
+	tcpFlagSYN    = 0x02
+	tcpOptionEnd  = 0
+	tcpOptionNop  = 1
+	tcpOptionMSS  = 2
+	tcpHeaderLen  = 20
+	tcpHeadersIP4 = ipv4.HeaderLen + tcpHeaderLen
+	tcpHeadersIP6 = ipv6.HeaderLen + tcpHeaderLen
+)
+
+/* Sets the MSS clamped to, MSSClampAuto to derive it from the MTU
+ * or MSSClampOff
+ */
+func (device *Device) SetMSSClamp(mss int) {
+	if mss < MSSClampAuto || mss > 0xffff {
+		mss = MSSClampOff
+	}
+	atomic.StoreInt32(&device.mss.clamp, int32(mss))
+}
+
+func (device *Device) MSSClamp() int {
+	return int(atomic.LoadInt32(&device.mss.clamp))
+}
+
+func formatMSSClamp(mss int) string {
+	switch mss {
+	case MSSClampOff:
+		return "off"
+	case MSSClampAuto:
+		return "auto"
+	}
+	return strconv.Itoa(mss)
+}
+
+func parseMSSClamp(s string) (int, error) {
+	switch s {
+	case "off":
+		return MSSClampOff, nil
+	case "auto":
+		return MSSClampAuto, nil
+	}
+	mss, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0, errors.New("mss_clamp must be auto, off or a number of bytes")
+	}
+	return int(mss), nil
+}
+
+/* Lowers the MSS option of a TCP SYN segment passing through the
+ * device as configured
+ */
+func (device *Device) clampMSS(packet []byte) {
+	clamp := device.MSSClamp()
+	if clamp == MSSClampOff {
+		return
+	}
+
+	var offset, overhead int
+	switch packet[0] >> 4 {
+	case ipv4.Version:
+		if len(packet) < tcpHeadersIP4 || packet[9] != 6 {
+			return
+		}
+		if binary.BigEndian.Uint16(packet[6:8])&0x1fff != 0 {
+			return
+		}
+		offset, overhead = int(packet[0]&0x0f)*4, tcpHeadersIP4
+	case ipv6.Version:
+		if len(packet) < tcpHeadersIP6 {
+			return
+		}
+		var protocol byte
+		protocol, offset = ipv6Transport(packet)
+		if protocol != 6 {
+			return
+		}
+		overhead = tcpHeadersIP6
+	default:
+		return
+	}
+
+	mss := clamp
+	if clamp == MSSClampAuto {
+		mss = int(atomic.LoadInt32(&device.tun.mtu)) - overhead
+		if mss <= 0 {
+			return
+		}
+	}
+	clampTCPMSS(packet, offset, uint16(mss))
+}
+
+/* Lowers the MSS option of the TCP SYN segment at offset to at most mss,
+ * updating the checksum. Returns whether it was changed.
+ */
+func clampTCPMSS(packet []byte, offset int, mss uint16) bool {
+	if offset < 0 || offset+tcpHeaderLen > len(packet) {
+		return false
+	}
+	tcp := packet[offset:]
+	if tcp[13]&tcpFlagSYN == 0 {
+		return false
+	}
+	headerLen := int(tcp[12]>>4) * 4
+	if headerLen < tcpHeaderLen || headerLen > len(tcp) {
+		return false
+	}
+
+	options := tcp[tcpHeaderLen:headerLen]
+	for i := 0; i < len(options); {
+		switch options[i] {
+		case tcpOptionEnd:
+			return false
+		case tcpOptionNop:
+			i++
+			continue
+		}
+		if i+1 >= len(options) {
+			return false
+		}
+		length := int(options[i+1])
+		if length < 2 || i+length > len(options) {
+			return false
+		}
+		if options[i] == tcpOptionMSS && length == 4 {
+			field := options[i+2 : i+4]
+			if binary.BigEndian.Uint16(field) <= mss {
+				return false
+			}
+			var clamped [2]byte
+			binary.BigEndian.PutUint16(clamped[:], mss)
+			checksumAdjust(tcp[16:18], field, clamped[:])
+			copy(field, clamped[:])
+			return true
+		}
+		i += length
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+/* Returns a TCP segment over IPv4 with the flags announcing mss, with
+ * a valid checksum
+ */
+func testSegmentIPv4(flags byte, mss uint16) []byte {
+	packet := testPacketIPv4(6, net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2), 50000, 443)
+	packet = append(packet, make([]byte, 32-8)...)
+	binary.BigEndian.PutUint16(packet[IPv4offsetTotalLength:], uint16(len(packet)))
+	tcp := packet[20:]
+	tcp[12] = 6 << 4 // header of 24 bytes
+	tcp[13] = flags
+	copy(tcp[20:], []byte{tcpOptionMSS, 4, byte(mss >> 8), byte(mss)})
+	binary.BigEndian.PutUint16(tcp[16:], ^tcpChecksum(packet))
+	return packet
+}
+
+func tcpChecksum(packet []byte) uint16 {
+	tcp := packet[20:]
+	pseudo := make([]byte, 12+len(tcp))
+	copy(pseudo, packet[IPv4offsetSrc:IPv4offsetSrc+8])
+	pseudo[9] = 6
+	binary.BigEndian.PutUint16(pseudo[10:], uint16(len(tcp)))
+	copy(pseudo[12:], tcp)
+	return ipChecksum(pseudo)
+}
+
+func TestClampMSS(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+	atomic.StoreInt32(&device.tun.mtu, 1420)
+
+	mssOf := func(packet []byte) uint16 {
+		return binary.BigEndian.Uint16(packet[20+22:])
+	}
+
+	packet := testSegmentIPv4(tcpFlagSYN, 1460)
+	device.clampMSS(packet)
+	if mssOf(packet) != 1460 {
+		t.Fatal("MSS clamped while clamping is off")
+	}
+
+	if err := ipcSet(device, "mss_clamp=auto\n"); err != nil {
+		t.Fatal(err)
+	}
+	device.clampMSS(packet)
+	if mssOf(packet) != 1380 {
+		t.Fatalf("MSS %d, expected 1380", mssOf(packet))
+	}
+	if tcpChecksum(packet) != 0xffff {
+		t.Fatal("TCP checksum invalid after clamping")
+	}
+
+	packet = testSegmentIPv4(tcpFlagSYN, 1200)
+	device.clampMSS(packet)
+	if mssOf(packet) != 1200 {
+		t.Fatal("smaller MSS raised")
+	}
+
+	if err := ipcSet(device, "mss_clamp=1000\n"); err != nil {
+		t.Fatal(err)
+	}
+	packet = testSegmentIPv4(tcpFlagSYN|0x10, 1460) // SYN-ACK
+	device.clampMSS(packet)
+	if mssOf(packet) != 1000 || tcpChecksum(packet) != 0xffff {
+		t.Fatalf("SYN-ACK MSS %d, expected 1000 with valid checksum", mssOf(packet))
+	}
+
+	packet = testSegmentIPv4(0x10, 1460) // ACK
+	device.clampMSS(packet)
+	if mssOf(packet) != 1460 {
+		t.Fatal("MSS of segment without SYN clamped")
+	}
+
+	if ipcSet(device, "mss_clamp=huge\n") == nil {
+		t.Fatal("invalid mss_clamp accepted")
+	}
+	if err := ipcSet(device, "mss_clamp=off\n"); err != nil {
+		t.Fatal(err)
+	}
+	if device.MSSClamp() != MSSClampOff {
+		t.Fatal("clamping not disabled")
+	}
+}
@@ -0,0 +1,161 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+/* NAT64 awareness for IPv6-only networks
+ *
+ * When sending to an IPv4 endpoint fails, the NAT64 prefix of the
+ * network is discovered in the background (RFC 7050) and subsequent
+ * packets are sent to the IPv6 address synthesized from the prefix
+ * and the IPv4 address (RFC 6052), which then becomes the endpoint.
+ */
+
+const (
+	NAT64DiscoveryInterval = time.Minute
+	NAT64DiscoveryName     = "ipv4only.arpa"
+)
+
+var nat64WellKnownAddresses = []net.IP{
+	net.IPv4(192, 0, 0, 170).To4(),
+	net.IPv4(192, 0, 0, 171).To4(),
+}
+
+var nat64PrefixLengths = []int{96, 64, 56, 48, 40, 32}
+
+/* Positions of the IPv4 address within an IPv6 address,
+ * which skip bits 64 to 71 (the "u" octet)
+ */
+func nat64Positions(length int) [net.IPv4len]int {
+	var positions [net.IPv4len]int
+	for i, n := length/8, 0; n < net.IPv4len; i++ {
+		if i == 8 {
+			continue
+		}
+		positions[n] = i
+		n++
+	}
+	return positions
+}
+
+func synthesizeNAT64(prefix *net.IPNet, ipv4 net.IP) net.IP {
+	length, _ := prefix.Mask.Size()
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.IP.To16())
+	for i, position := range nat64Positions(length) {
+		ip[position] = ipv4.To4()[i]
+	}
+	return ip
+}
+
+func extractNAT64(ip net.IP, length int) net.IP {
+	ipv4 := make(net.IP, net.IPv4len)
+	for i, position := range nat64Positions(length) {
+		ipv4[i] = ip[position]
+	}
+	return ipv4
+}
+
+/* Discovers the NAT64 prefix of the network from the synthesized
+ * addresses of the well-known name (RFC 7050)
+ */
+func DiscoverNAT64Prefix() (*net.IPNet, error) {
+	return discoverNAT64Prefix(net.DefaultResolver)
+}
+
+func discoverNAT64Prefix(resolver Resolver) (*net.IPNet, error) {
+	ips, err := lookupIP(resolver, NAT64DiscoveryName)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			continue
+		}
+		for _, length := range nat64PrefixLengths {
+			ipv4 := extractNAT64(ip, length)
+			for _, wellKnown := range nat64WellKnownAddresses {
+				if ipv4.Equal(wellKnown) {
+					mask := net.CIDRMask(length, 8*net.IPv6len)
+					return &net.IPNet{IP: ip.Mask(mask), Mask: mask}, nil
+				}
+			}
+		}
+	}
+	return nil, errors.New("no NAT64 prefix found")
+}
+
+func (device *Device) discoverNAT64() {
+	device.nat64.Lock()
+	defer device.nat64.Unlock()
+
+	if device.nat64.discovering || time.Since(device.nat64.lastDiscovery) < NAT64DiscoveryInterval {
+		return
+	}
+	device.nat64.discovering = true
+	device.nat64.lastDiscovery = time.Now()
+
+	go func() {
+		prefix, err := discoverNAT64Prefix(device.Resolver())
+		if err != nil {
+			device.log.Debug.Println("NAT64 prefix discovery failed:", err)
+		} else {
+			device.log.Info.Println("Discovered NAT64 prefix", prefix)
+		}
+
+		device.nat64.Lock()
+		device.nat64.prefix = prefix
+		device.nat64.discovering = false
+		device.nat64.Unlock()
+	}()
+}
+
+/* Returns the endpoint synthesized for an IPv4 endpoint which could
+ * not be reached, or nil while no NAT64 prefix is known
+ */
+func (device *Device) nat64Endpoint(endpoint Endpoint) Endpoint {
+	ipv4 := endpoint.DstIP().To4()
+	if ipv4 == nil {
+		return nil
+	}
+
+	device.nat64.RLock()
+	prefix := device.nat64.prefix
+	device.nat64.RUnlock()
+
+	if prefix == nil {
+		device.discoverNAT64()
+		return nil
+	}
+
+	_, port, err := net.SplitHostPort(endpoint.DstToString())
+	if err != nil {
+		return nil
+	}
+	synthesized, err := CreateEndpoint(net.JoinHostPort(synthesizeNAT64(prefix, ipv4).String(), port))
+	if err != nil {
+		return nil
+	}
+	return synthesized
+}
+
+/* Replaces the endpoint by its NAT64 translation. This reaches the same
+ * host, so it is not subject to the roaming policy, whose prefixes name
+ * the configured IPv4 addresses.
+ */
+func (peer *Peer) replaceEndpoint(old, synthesized Endpoint) {
+	peer.Lock()
+	defer peer.Unlock()
+	if peer.endpoint == old {
+		peer.endpoint = synthesized
+		peer.device.log.Info.Println(peer, "- Using NAT64 endpoint", synthesized.DstToString(), "for", old.DstToString())
+	}
+}
@@ -0,0 +1,63 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"testing"
+)
+
+func TestNAT64Synthesis(t *testing.T) {
+
+	// examples of RFC 6052, section 2.4
+
+	tests := []struct {
+		prefix   string
+		expected string
+	}{
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+		{"2001:db8:122:344::/96", "2001:db8:122:344::c000:221"},
+	}
+
+	ipv4 := net.IPv4(192, 0, 2, 33)
+	for _, test := range tests {
+		_, prefix, err := net.ParseCIDR(test.prefix)
+		assertNil(t, err)
+		ip := synthesizeNAT64(prefix, ipv4)
+		if !ip.Equal(net.ParseIP(test.expected)) {
+			t.Errorf("synthesized %v with %s, expected %s", ip, test.prefix, test.expected)
+		}
+		length, _ := prefix.Mask.Size()
+		if extracted := extractNAT64(ip, length); !extracted.Equal(ipv4) {
+			t.Errorf("extracted %v from %v, expected %v", extracted, ip, ipv4)
+		}
+	}
+}
+
+func TestNAT64Endpoint(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	_, prefix, _ := net.ParseCIDR("64:ff9b::/96")
+	device.nat64.prefix = prefix
+
+	endpoint, err := CreateEndpoint("192.0.2.1:51820")
+	assertNil(t, err)
+	synthesized := device.nat64Endpoint(endpoint)
+	if synthesized == nil || synthesized.DstToString() != "[64:ff9b::c000:201]:51820" {
+		t.Fatalf("unexpected synthesized endpoint %v", synthesized)
+	}
+
+	endpoint, err = CreateEndpoint("[2001:db8::1]:51820")
+	assertNil(t, err)
+	if device.nat64Endpoint(endpoint) != nil {
+		t.Fatal("synthesized endpoint for IPv6 endpoint")
+	}
+}
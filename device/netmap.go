@@ -0,0 +1,225 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+/* Prefix translation of tunnel-internal addresses
+ *
+ * Peers of different customers may use the same internal addressing,
+ * say 10.0.0.0/24 each, which cannot share one set of allowed IPs. Each
+ * such peer is given a distinct external prefix of the same length, and
+ * the source addresses of packets from the peer are mapped 1:1 from the
+ * internal to the external prefix after decryption, before the allowed
+ * IPs are checked. Packets to the external prefix are routed to the peer
+ * by its allowed IPs and their destinations mapped back before encryption.
+ * The allowed IPs of the peer are thus configured with the external
+ * prefix.
+ *
+ * Header and TCP, UDP and ICMPv6 checksums are adjusted incrementally.
+ * Over UAPI a rule is set as netmap=<internal prefix>,<external prefix>.
+ */
+
+const (
+	MaxNetmapRules = 64
+)
+
+type NetmapRule struct {
+	Internal net.IPNet
+	External net.IPNet
+}
+
+type netmapState struct {
+	sync.Mutex
+	rules atomic.Value // []NetmapRule
+}
+
+func ParseNetmapRule(s string) (NetmapRule, error) {
+	var rule NetmapRule
+
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return rule, errors.New("expected internal and external prefix")
+	}
+	for i, part := range parts {
+		_, network, err := net.ParseCIDR(part)
+		if err != nil {
+			return rule, err
+		}
+		if i == 0 {
+			rule.Internal = *network
+		} else {
+			rule.External = *network
+		}
+	}
+
+	internalOnes, internalBits := rule.Internal.Mask.Size()
+	externalOnes, externalBits := rule.External.Mask.Size()
+	if internalOnes != externalOnes || internalBits != externalBits {
+		return rule, errors.New("prefixes differ in family or length")
+	}
+	return rule, nil
+}
+
+func (rule NetmapRule) String() string {
+	return rule.Internal.String() + "," + rule.External.String()
+}
+
+func (peer *Peer) AddNetmapRule(rule NetmapRule) error {
+	peer.netmap.Lock()
+	defer peer.netmap.Unlock()
+
+	rules := peer.NetmapRules()
+	if len(rules) >= MaxNetmapRules {
+		return errors.New("too many netmap rules")
+	}
+	peer.netmap.rules.Store(append(rules, rule))
+	return nil
+}
+
+func (peer *Peer) ClearNetmap() {
+	peer.netmap.Lock()
+	defer peer.netmap.Unlock()
+	peer.netmap.rules.Store([]NetmapRule(nil))
+}
+
+/* Returns the rules of the peer, which must not be modified
+ */
+func (peer *Peer) NetmapRules() []NetmapRule {
+	rules, _ := peer.netmap.rules.Load().([]NetmapRule)
+	return rules[:len(rules):len(rules)]
+}
+
+/* Maps the source of a packet from the peer to the external prefix
+ */
+func (peer *Peer) netmapInbound(packet []byte) {
+	rules := peer.NetmapRules()
+	if len(rules) == 0 {
+		return
+	}
+	switch packet[0] >> 4 {
+	case ipv4.Version:
+		netmapTranslate(packet, packet[IPv4offsetSrc:IPv4offsetSrc+net.IPv4len], rules, true)
+	case ipv6.Version:
+		netmapTranslate(packet, packet[IPv6offsetSrc:IPv6offsetSrc+net.IPv6len], rules, true)
+	}
+}
+
+/* Maps the destination of a packet to the peer back to the internal prefix
+ */
+func (peer *Peer) netmapOutbound(packet []byte) {
+	rules := peer.NetmapRules()
+	if len(rules) == 0 {
+		return
+	}
+	switch packet[0] >> 4 {
+	case ipv4.Version:
+		netmapTranslate(packet, packet[IPv4offsetDst:IPv4offsetDst+net.IPv4len], rules, false)
+	case ipv6.Version:
+		netmapTranslate(packet, packet[IPv6offsetDst:IPv6offsetDst+net.IPv6len], rules, false)
+	}
+}
+
+func netmapTranslate(packet []byte, addr []byte, rules []NetmapRule, inbound bool) {
+	for _, rule := range rules {
+		from, to := &rule.External, &rule.Internal
+		if inbound {
+			from, to = to, from
+		}
+		if len(from.IP) != len(addr) || !from.Contains(addr) {
+			continue
+		}
+
+		var translated [net.IPv6len]byte
+		for i := range addr {
+			translated[i] = to.IP[i]&to.Mask[i] | addr[i]&^to.Mask[i]
+		}
+		netmapAdjustChecksums(packet, addr, translated[:len(addr)])
+		copy(addr, translated[:len(addr)])
+		return
+	}
+}
+
+/* Adjusts the checksums covering an address about to be replaced
+ */
+func netmapAdjustChecksums(packet []byte, old, new []byte) {
+	var protocol byte
+	var offset int
+
+	if packet[0]>>4 == ipv4.Version {
+		checksumAdjust(packet[10:12], old, new)
+		fragmentOffset := binary.BigEndian.Uint16(packet[6:8]) & 0x1fff
+		if fragmentOffset != 0 {
+			return
+		}
+		protocol, offset = packet[9], int(packet[0]&0x0f)*4
+	} else {
+		protocol, offset = ipv6Transport(packet)
+	}
+
+	var field int
+	switch protocol {
+	case 6: // tcp
+		field = offset + 16
+	case 17: // udp
+		field = offset + 6
+	case 58: // icmpv6
+		field = offset + 2
+	default:
+		return
+	}
+	if field+2 > len(packet) {
+		return
+	}
+	checksum := packet[field : field+2]
+	if protocol == 17 && checksum[0] == 0 && checksum[1] == 0 {
+		return // no checksum over ipv4
+	}
+	checksumAdjust(checksum, old, new)
+	if protocol == 17 && checksum[0] == 0 && checksum[1] == 0 {
+		checksum[0], checksum[1] = 0xff, 0xff
+	}
+}
+
+/* Returns the protocol and offset of the transport header of an IPv6
+ * packet, skipping hop-by-hop, routing and destination options headers
+ */
+func ipv6Transport(packet []byte) (byte, int) {
+	next := packet[6]
+	offset := ipv6.HeaderLen
+	for next == ipv6HeaderHopByHop || next == ipv6HeaderRouting || next == ipv6HeaderDestination {
+		if offset+2 > len(packet) {
+			return 0, 0
+		}
+		next = packet[offset]
+		offset += (int(packet[offset+1]) + 1) * 8
+	}
+	return next, offset
+}
+
+/* Updates a ones' complement checksum for old data replaced by new (RFC 1624)
+ */
+func checksumAdjust(field []byte, old, new []byte) {
+	sum := uint32(^binary.BigEndian.Uint16(field))
+	for i := 0; i+1 < len(old); i += 2 {
+		sum += uint32(^binary.BigEndian.Uint16(old[i:]))
+		sum += uint32(binary.BigEndian.Uint16(new[i:]))
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	binary.BigEndian.PutUint16(field, ^uint16(sum))
+}
@@ -0,0 +1,109 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+/* Returns the ones' complement sum of the udp pseudo header and datagram,
+ * which is 0xffff for a valid checksum
+ */
+func testUDPChecksumIPv4(packet []byte) uint16 {
+	udp := packet[20:]
+	pseudo := make([]byte, 0, 12+len(udp)+1)
+	pseudo = append(pseudo, packet[IPv4offsetSrc:IPv4offsetDst+net.IPv4len]...)
+	pseudo = append(pseudo, 0, 17, byte(len(udp)>>8), byte(len(udp)))
+	pseudo = append(pseudo, udp...)
+	if len(pseudo)%2 == 1 {
+		pseudo = append(pseudo, 0)
+	}
+	return ipChecksum(pseudo)
+}
+
+func testPacketUDPv4(src, dst net.IP) []byte {
+	packet := make([]byte, 20+8+4)
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[IPv4offsetTotalLength:], uint16(len(packet)))
+	packet[8] = 64
+	packet[9] = 17
+	copy(packet[IPv4offsetSrc:], src.To4())
+	copy(packet[IPv4offsetDst:], dst.To4())
+	binary.BigEndian.PutUint16(packet[10:], ^ipChecksum(packet[:20]))
+	binary.BigEndian.PutUint16(packet[20:], 1234)
+	binary.BigEndian.PutUint16(packet[22:], 53)
+	binary.BigEndian.PutUint16(packet[24:], 12)
+	copy(packet[28:], "ping")
+	binary.BigEndian.PutUint16(packet[26:], ^testUDPChecksumIPv4(packet))
+	return packet
+}
+
+func TestNetmapTranslation(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	peer, err := device.NewPeer(sk.publicKey())
+	assertNil(t, err)
+
+	if err := ipcSet(device, "public_key="+peer.handshake.remoteStatic.ToHex()+"\nnetmap=10.0.0.0/24,100.64.1.0/24\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	// inbound sources are mapped to the external prefix
+
+	packet := testPacketUDPv4(net.IPv4(10, 0, 0, 7), net.IPv4(192, 168, 0, 1))
+	peer.netmapInbound(packet)
+	if !net.IP(packet[IPv4offsetSrc : IPv4offsetSrc+4]).Equal(net.IPv4(100, 64, 1, 7)) {
+		t.Fatalf("source not translated: %v", net.IP(packet[IPv4offsetSrc:IPv4offsetSrc+4]))
+	}
+	if ipChecksum(packet[:20]) != 0xffff || testUDPChecksumIPv4(packet) != 0xffff {
+		t.Fatal("invalid checksums after inbound translation")
+	}
+
+	// outbound destinations are mapped back
+
+	packet = testPacketUDPv4(net.IPv4(192, 168, 0, 1), net.IPv4(100, 64, 1, 7))
+	peer.netmapOutbound(packet)
+	if !net.IP(packet[IPv4offsetDst : IPv4offsetDst+4]).Equal(net.IPv4(10, 0, 0, 7)) {
+		t.Fatalf("destination not translated: %v", net.IP(packet[IPv4offsetDst:IPv4offsetDst+4]))
+	}
+	if ipChecksum(packet[:20]) != 0xffff || testUDPChecksumIPv4(packet) != 0xffff {
+		t.Fatal("invalid checksums after outbound translation")
+	}
+
+	// addresses outside the prefix are left alone
+
+	packet = testPacketUDPv4(net.IPv4(10, 0, 1, 7), net.IPv4(192, 168, 0, 1))
+	peer.netmapInbound(packet)
+	if !net.IP(packet[IPv4offsetSrc : IPv4offsetSrc+4]).Equal(net.IPv4(10, 0, 1, 7)) {
+		t.Fatal("address outside prefix translated")
+	}
+}
+
+func TestParseNetmapRule(t *testing.T) {
+	for _, test := range []struct {
+		rule  string
+		valid bool
+	}{
+		{"10.0.0.0/24,100.64.1.0/24", true},
+		{"fd00::/64,fd01:2::/64", true},
+		{"10.0.0.0/24,100.64.1.0/23", false},
+		{"10.0.0.0/24,fd00::/24", false},
+		{"10.0.0.0/24", false},
+	} {
+		rule, err := ParseNetmapRule(test.rule)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: expected valid %v, got %v", test.rule, test.valid, err)
+		}
+		if err == nil && rule.String() != test.rule {
+			t.Errorf("%s: formatted as %s", test.rule, rule)
+		}
+	}
+}
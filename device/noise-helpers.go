@@ -6,10 +6,10 @@
 package device
 
 import (
-	"crypto/hmac"
 	"crypto/rand"
 	"crypto/subtle"
 	"hash"
+	"sync"
 
 	"golang.org/x/crypto/blake2s"
 	"golang.org/x/crypto/curve25519"
@@ -20,23 +20,55 @@ import (
  * https://tools.ietf.org/html/rfc5869
  */
 
-func HMAC1(sum *[blake2s.Size]byte, key, in0 []byte) {
-	mac := hmac.New(func() hash.Hash {
+/* Hash states are pooled, as responders under handshake churn
+ * otherwise allocate several for every message consumed
+ */
+var blake2sPool = sync.Pool{
+	New: func() interface{} {
 		h, _ := blake2s.New256(nil)
 		return h
-	}, key)
-	mac.Write(in0)
-	mac.Sum(sum[:0])
+	},
+}
+
+func hmacBlake2s(sum *[blake2s.Size]byte, key, in0, in1 []byte) {
+	var pad [blake2s.BlockSize]byte
+	if len(key) > blake2s.BlockSize {
+		digest := blake2s.Sum256(key)
+		copy(pad[:], digest[:])
+	} else {
+		copy(pad[:], key)
+	}
+
+	h := blake2sPool.Get().(hash.Hash)
+
+	for i := range pad {
+		pad[i] ^= 0x36
+	}
+	h.Reset()
+	h.Write(pad[:])
+	h.Write(in0)
+	h.Write(in1)
+	h.Sum(sum[:0])
+
+	for i := range pad {
+		pad[i] ^= 0x36 ^ 0x5c
+	}
+	h.Reset()
+	h.Write(pad[:])
+	h.Write(sum[:])
+	h.Sum(sum[:0])
+
+	h.Reset()
+	blake2sPool.Put(h)
+	setZero(pad[:])
+}
+
+func HMAC1(sum *[blake2s.Size]byte, key, in0 []byte) {
+	hmacBlake2s(sum, key, in0, nil)
 }
 
 func HMAC2(sum *[blake2s.Size]byte, key, in0, in1 []byte) {
-	mac := hmac.New(func() hash.Hash {
-		h, _ := blake2s.New256(nil)
-		return h
-	}, key)
-	mac.Write(in0)
-	mac.Write(in1)
-	mac.Sum(sum[:0])
+	hmacBlake2s(sum, key, in0, in1)
 }
 
 func KDF1(t0 *[blake2s.Size]byte, key, input []byte) {
@@ -7,6 +7,7 @@ package device
 
 import (
 	"errors"
+	"hash"
 	"sync"
 	"time"
 
@@ -106,6 +107,7 @@ type Handshake struct {
 	remoteStatic              NoisePublicKey           // long term key
 	remoteEphemeral           NoisePublicKey           // ephemeral public key
 	precomputedStaticStatic   [NoisePublicKeySize]byte // precomputed shared secret
+	precomputedInitialHash    [blake2s.Size]byte       // initial hash mixed with remote static
 	lastTimestamp             tai64n.Timestamp
 	lastInitiationConsumption time.Time
 	lastSentHandshake         time.Time
@@ -122,11 +124,13 @@ func mixKey(dst *[blake2s.Size]byte, c *[blake2s.Size]byte, data []byte) {
 }
 
 func mixHash(dst *[blake2s.Size]byte, h *[blake2s.Size]byte, data []byte) {
-	hash, _ := blake2s.New256(nil)
-	hash.Write(h[:])
-	hash.Write(data)
-	hash.Sum(dst[:0])
-	hash.Reset()
+	state := blake2sPool.Get().(hash.Hash)
+	state.Reset()
+	state.Write(h[:])
+	state.Write(data)
+	state.Sum(dst[:0])
+	state.Reset()
+	blake2sPool.Put(state)
 }
 
 func (h *Handshake) Clear() {
@@ -169,12 +173,13 @@ func (device *Device) CreateMessageInitiation(peer *Peer) (*MessageInitiation, e
 	// create ephemeral key
 
 	var err error
-	handshake.hash = InitialHash
+	handshake.hash = handshake.precomputedInitialHash
 	handshake.chainKey = InitialChainKey
 	handshake.localEphemeral, err = newPrivateKey()
 	if err != nil {
 		return nil, err
 	}
+	device.keyLogHandshake(handshake)
 
 	// assign index
 
@@ -185,8 +190,6 @@ func (device *Device) CreateMessageInitiation(peer *Peer) (*MessageInitiation, e
 		return nil, err
 	}
 
-	handshake.mixHash(handshake.remoteStatic[:])
-
 	msg := MessageInitiation{
 		Type:      MessageInitiationType,
 		Ephemeral: handshake.localEphemeral.publicKey(),
@@ -233,20 +236,31 @@ func (device *Device) CreateMessageInitiation(peer *Peer) (*MessageInitiation, e
 }
 
 func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
+	peer, refused := device.consumeMessageInitiation(msg)
+	if refused {
+		return nil
+	}
+	return peer
+}
+
+/* Consumes an initiation unless the peer's handshakes are refused in
+ * maintenance mode, in which case the authenticated peer is returned
+ * with the handshake state left untouched
+ */
+func (device *Device) consumeMessageInitiation(msg *MessageInitiation) (*Peer, bool) {
 	var (
 		hash     [blake2s.Size]byte
 		chainKey [blake2s.Size]byte
 	)
 
 	if msg.Type != MessageInitiationType {
-		return nil
+		return nil, false
 	}
 
 	device.staticIdentity.RLock()
 	defer device.staticIdentity.RUnlock()
 
-	mixHash(&hash, &InitialHash, device.staticIdentity.publicKey[:])
-	mixHash(&hash, &hash, msg.Ephemeral[:])
+	mixHash(&hash, &device.staticIdentity.initialHash, msg.Ephemeral[:])
 	mixKey(&chainKey, &InitialChainKey, msg.Ephemeral[:])
 
 	// decrypt static key
@@ -255,26 +269,30 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	var peerPK NoisePublicKey
 	func() {
 		var key [chacha20poly1305.KeySize]byte
-		ss := device.staticIdentity.privateKey.sharedSecret(msg.Ephemeral)
+		ss, ok := device.staticSharedSecret(msg.Ephemeral)
+		if !ok {
+			err = errStaticSharedSecret
+			return
+		}
 		KDF2(&chainKey, &key, chainKey[:], ss[:])
 		aead, _ := chacha20poly1305.New(key[:])
 		_, err = aead.Open(peerPK[:0], ZeroNonce[:], msg.Static[:], hash[:])
 	}()
 	if err != nil {
-		return nil
+		return nil, false
 	}
 	mixHash(&hash, &hash, msg.Static[:])
 
 	// lookup peer
 
 	peer := device.LookupPeer(peerPK)
-	if peer == nil {
-		return nil
+	if peer == nil || peer.disabled.Get() {
+		return nil, false
 	}
 
 	handshake := &peer.handshake
 	if isZero(handshake.precomputedStaticStatic[:]) {
-		return nil
+		return nil, false
 	}
 
 	// verify identity
@@ -293,7 +311,7 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	_, err = aead.Open(timestamp[:0], ZeroNonce[:], msg.Timestamp[:], hash[:])
 	if err != nil {
 		handshake.mutex.RUnlock()
-		return nil
+		return nil, false
 	}
 	mixHash(&hash, &hash, msg.Timestamp[:])
 
@@ -304,7 +322,15 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	ok = ok && time.Since(handshake.lastInitiationConsumption) > HandshakeInitationRate
 	handshake.mutex.RUnlock()
 	if !ok {
-		return nil
+		return nil, false
+	}
+
+	// refuse before touching state, keeping handshakes in progress intact
+
+	if peer.maintenanceRefuses() {
+		setZero(hash[:])
+		setZero(chainKey[:])
+		return peer, true
 	}
 
 	// update handshake state
@@ -324,7 +350,7 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	setZero(hash[:])
 	setZero(chainKey[:])
 
-	return peer
+	return peer, false
 }
 
 func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error) {
@@ -356,6 +382,7 @@ func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error
 	if err != nil {
 		return nil, err
 	}
+	device.keyLogHandshake(handshake)
 	msg.Ephemeral = handshake.localEphemeral.publicKey()
 	handshake.mixHash(msg.Ephemeral[:])
 	handshake.mixKey(msg.Ephemeral[:])
@@ -438,11 +465,12 @@ func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
 			setZero(ss[:])
 		}()
 
-		func() {
-			ss := device.staticIdentity.privateKey.sharedSecret(msg.Ephemeral)
-			mixKey(&chainKey, &chainKey, ss[:])
-			setZero(ss[:])
-		}()
+		ss, ok := device.staticSharedSecret(msg.Ephemeral)
+		if !ok {
+			return false
+		}
+		mixKey(&chainKey, &chainKey, ss[:])
+		setZero(ss[:])
 
 		// add preshared key (psk)
 
@@ -524,8 +552,13 @@ func (peer *Peer) BeginSymmetricSession() error {
 		return errors.New("invalid state for keypair derivation")
 	}
 
+	if !peer.resumption.handshakeResumed {
+		peer.issueResumptionTicket(&handshake.chainKey)
+	}
+
 	// zero handshake
 
+	peer.resumption.handshakeResumed = false
 	setZero(handshake.chainKey[:])
 	setZero(handshake.hash[:]) // Doesn't necessarily need to be zeroed. Could be used for something interesting down the line.
 	setZero(handshake.localEphemeral[:])
@@ -544,6 +577,7 @@ func (peer *Peer) BeginSymmetricSession() error {
 	keypair.sendNonce = 0
 	keypair.replayFilter.Init()
 	keypair.isInitiator = isInitiator
+	keypair.rekeyAfter = peer.rekeyAfterTime()
 	keypair.localIndex = peer.handshake.localIndex
 	keypair.remoteIndex = peer.handshake.remoteIndex
 
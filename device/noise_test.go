@@ -142,3 +142,24 @@ func TestNoiseHandshake(t *testing.T) {
 		assertEqual(t, out, testMsg)
 	}()
 }
+
+func BenchmarkConsumeMessageInitiation(b *testing.B) {
+	dev1 := randDevice(b)
+	dev2 := randDevice(b)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	dev2.NewPeer(dev1.staticIdentity.privateKey.publicKey())
+	peer2, _ := dev1.NewPeer(dev2.staticIdentity.privateKey.publicKey())
+
+	msg, err := dev1.CreateMessageInitiation(peer2)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dev2.ConsumeMessageInitiation(msg)
+	}
+}
@@ -0,0 +1,221 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"runtime"
+	"time"
+
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+/* Tunable parameters of a device, fixed at creation time.
+ *
+ * A zero (or negative) value selects the platform default
+ * from queueconstants_*.go
+ *
+ * The decryption queue is split evenly between the decryption workers,
+ * one per CPU, by receiver index. A single busy peer therefore only
+ * has 1/N of DecryptionQueueSize, N being the number of CPUs, before
+ * its packets are dropped.
+ */
+type DeviceOptions struct {
+	HandshakeQueueSize  int // handshake messages awaiting a handshake worker
+	EncryptionQueueSize int // packets awaiting an encryption worker
+	DecryptionQueueSize int // packets awaiting decryption, split across the workers
+	InboundQueueSize    int // per peer, decrypted packets awaiting sequential delivery
+	OutboundQueueSize   int // per peer, packets awaiting a nonce or sequential transmission
+
+	// Routines processing handshake messages, separate from the one
+	// encryption and one decryption worker per CPU, so that a flood of
+	// initiations occupies at most this many CPUs. Defaults to one per
+	// CPU.
+	HandshakeWorkers int
+
+	// Buffers of the tun→encrypt path, taken from the message buffer pool
+	// shared with the receive path. The count is the number of outbound
+	// elements preallocated to hold them, where the platform default of
+	// zero allocates on demand. The size bounds the packets read from
+	// the TUN device plus transport overhead, and so the usable MTU; it
+	// defaults to MaxMessageSize, which is never exceeded as peers could
+	// not receive larger messages, and is never below MinReadBufferSize.
+	ReadBufferCount int
+	ReadBufferSize  int
+
+	// Approximate memory, in bytes, which peers, allowed IPs and queued
+	// packets may occupy before new peers and allowed IPs are refused.
+	// Zero disables the limit.
+	MemoryLimit uint64
+}
+
+const MinReadBufferSize = MessageTransportSize + 1280 // room for the minimum IPv6 MTU
+
+func orDefault(value, def int) int {
+	if value <= 0 {
+		return def
+	}
+	return value
+}
+
+/* Returns a copy of the options with all unset values
+ * replaced by the platform defaults
+ */
+func (options DeviceOptions) withDefaults() DeviceOptions {
+	options.HandshakeQueueSize = orDefault(options.HandshakeQueueSize, QueueHandshakeSize)
+	options.EncryptionQueueSize = orDefault(options.EncryptionQueueSize, QueueOutboundSize)
+	options.DecryptionQueueSize = orDefault(options.DecryptionQueueSize, QueueInboundSize)
+	options.InboundQueueSize = orDefault(options.InboundQueueSize, QueueInboundSize)
+	options.OutboundQueueSize = orDefault(options.OutboundQueueSize, QueueOutboundSize)
+	options.HandshakeWorkers = orDefault(options.HandshakeWorkers, runtime.NumCPU())
+	options.ReadBufferCount = orDefault(options.ReadBufferCount, PreallocatedBuffersPerPool)
+	options.ReadBufferSize = orDefault(options.ReadBufferSize, MaxMessageSize)
+	if options.ReadBufferSize > MaxMessageSize {
+		options.ReadBufferSize = MaxMessageSize
+	}
+	if options.ReadBufferSize < MinReadBufferSize {
+		options.ReadBufferSize = MinReadBufferSize
+	}
+	return options
+}
+
+/* Functional options for New
+ *
+ * New creates and configures a device in a single call:
+ *
+ *   dev := device.New(tunDevice, nil,
+ *       device.WithLogger(logger),
+ *       device.WithHandshakeWorkers(2),
+ *       device.WithRatelimiter(50, 10))
+ *
+ * Options are applied in order. Those fixed at creation, as are all
+ * DeviceOptions, can only be given here; the others correspond to a
+ * setter of the device which remains available afterwards.
+ */
+
+type Option func(*newConfig)
+
+type newConfig struct {
+	logger  *Logger
+	options DeviceOptions
+	setup   []func(*Device)
+}
+
+/* Creates a device on the TUN device, using bind if not nil and
+ * otherwise its own socket on the listen port
+ */
+func New(tunDevice tun.Device, bind *SharedBind, options ...Option) *Device {
+	config := newConfig{
+		logger: NewLogger(LogLevelError, ""),
+	}
+	for _, option := range options {
+		option(&config)
+	}
+
+	device := NewDeviceWithOptions(tunDevice, config.logger, config.options)
+	if bind != nil {
+		device.SetSharedBind(bind)
+	}
+	for _, setup := range config.setup {
+		setup(device)
+	}
+	return device
+}
+
+func (config *newConfig) then(setup func(*Device)) {
+	config.setup = append(config.setup, setup)
+}
+
+/* Logs to logger instead of errors only to standard output
+ */
+func WithLogger(logger *Logger) Option {
+	return func(config *newConfig) {
+		config.logger = logger
+	}
+}
+
+/* Replaces all creation time parameters by options
+ */
+func WithDeviceOptions(options DeviceOptions) Option {
+	return func(config *newConfig) {
+		config.options = options
+	}
+}
+
+func WithHandshakeWorkers(workers int) Option {
+	return func(config *newConfig) {
+		config.options.HandshakeWorkers = workers
+	}
+}
+
+func WithMemoryLimit(limit uint64) Option {
+	return func(config *newConfig) {
+		config.options.MemoryLimit = limit
+	}
+}
+
+/* Limits the handshake messages accepted from each address under load,
+ * see Ratelimiter.SetRate
+ */
+func WithRatelimiter(packetsPerSecond, burstable int) Option {
+	return func(config *newConfig) {
+		config.then(func(device *Device) {
+			device.rate.limiter.SetRate(packetsPerSecond, burstable)
+		})
+	}
+}
+
+func WithHandshakePacing(rate, burst uint32) Option {
+	return func(config *newConfig) {
+		config.then(func(device *Device) {
+			device.SetHandshakePacing(rate, burst)
+		})
+	}
+}
+
+func WithUnreachableTimeout(timeout time.Duration) Option {
+	return func(config *newConfig) {
+		config.then(func(device *Device) {
+			device.SetUnreachableTimeout(timeout)
+		})
+	}
+}
+
+func WithTunDownPolicy(policy TunDownPolicy, grace time.Duration) Option {
+	return func(config *newConfig) {
+		config.then(func(device *Device) {
+			device.SetTunDownPolicy(policy, grace)
+		})
+	}
+}
+
+/* Passes the traffic of every peer to sink each interval
+ */
+func WithMetrics(interval time.Duration, sink MetricsSink) Option {
+	return func(config *newConfig) {
+		config.then(func(device *Device) {
+			device.SetMetricsSink(sink)
+			device.SetStatsInterval(interval)
+		})
+	}
+}
+
+/* Resolves host names with resolver instead of net.DefaultResolver
+ */
+func WithResolver(resolver Resolver) Option {
+	return func(config *newConfig) {
+		config.then(func(device *Device) {
+			device.SetResolver(resolver)
+		})
+	}
+}
+
+func WithEventHandler(handler func(Event)) Option {
+	return func(config *newConfig) {
+		config.then(func(device *Device) {
+			device.AddEventHandler(handler)
+		})
+	}
+}
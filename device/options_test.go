@@ -0,0 +1,151 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewWithOptions(t *testing.T) {
+	sinkCalls := make(chan PeerCounters, 16)
+	device := New(newDummyTUN("dummy"), nil,
+		WithLogger(NewLogger(LogLevelError, "")),
+		WithHandshakeWorkers(3),
+		WithUnreachableTimeout(time.Minute),
+		WithHandshakePacing(5, 7),
+		WithRatelimiter(1, 1),
+		WithMetrics(20*time.Millisecond, func(publicKey NoisePublicKey, counters PeerCounters, end time.Time) {
+			select {
+			case sinkCalls <- counters:
+			default:
+			}
+		}),
+	)
+	defer device.Close()
+
+	if device.options.HandshakeWorkers != 3 {
+		t.Fatalf("expected 3 handshake workers, got %d", device.options.HandshakeWorkers)
+	}
+	if device.UnreachableTimeout() != time.Minute {
+		t.Fatalf("unexpected unreachable timeout %v", device.UnreachableTimeout())
+	}
+	if rate, burst := device.HandshakePacing(); rate != 5 || burst != 7 {
+		t.Fatalf("unexpected handshake pacing %d/%d", rate, burst)
+	}
+
+	ip := []byte{192, 0, 2, 1}
+	if !device.rate.limiter.Allow(ip) || device.rate.limiter.Allow(ip) {
+		t.Fatal("ratelimiter burst not applied")
+	}
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	peer, err := device.NewPeer(sk.publicKey())
+	assertNil(t, err)
+	atomic.AddUint64(&peer.stats.txBytes, 100)
+
+	select {
+	case counters := <-sinkCalls:
+		if counters.TxBytes > 100 {
+			t.Fatalf("unexpected interval counters %+v", counters)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("metrics sink not called")
+	}
+}
+
+func TestOptionsDefaults(t *testing.T) {
+	defaults := DeviceOptions{HandshakeQueueSize: -1, EncryptionQueueSize: -1}.withDefaults()
+	if defaults.HandshakeQueueSize != QueueHandshakeSize ||
+		defaults.EncryptionQueueSize != QueueOutboundSize ||
+		defaults.DecryptionQueueSize != QueueInboundSize ||
+		defaults.InboundQueueSize != QueueInboundSize ||
+		defaults.OutboundQueueSize != QueueOutboundSize ||
+		defaults.ReadBufferCount != PreallocatedBuffersPerPool ||
+		defaults.ReadBufferSize != MaxMessageSize {
+		t.Fatalf("unexpected defaults %+v", defaults)
+	}
+	if defaults.HandshakeQueueSize/8 != UnderLoadQueueSize {
+		t.Fatalf("default handshake queue not under load at %d", UnderLoadQueueSize)
+	}
+
+	// set values are kept
+
+	options := DeviceOptions{
+		HandshakeQueueSize:  1,
+		EncryptionQueueSize: 2,
+		DecryptionQueueSize: 3,
+		InboundQueueSize:    4,
+		OutboundQueueSize:   5,
+		HandshakeWorkers:    6,
+		ReadBufferCount:     7,
+		ReadBufferSize:      MinReadBufferSize,
+	}
+	if got := options.withDefaults(); got != options {
+		t.Fatalf("expected %+v, got %+v", options, got)
+	}
+}
+
+func TestReadBufferOptions(t *testing.T) {
+	options := DeviceOptions{ReadBufferCount: 4, ReadBufferSize: 9000 + MessageTransportSize}
+	device := NewDeviceWithOptions(newDummyTUN("dummy"), NewLogger(LogLevelError, ""), options)
+	defer device.Close()
+
+	if cap(device.pool.outboundElementReuseChan) != 4 {
+		t.Fatalf("expected 4 preallocated outbound elements, got %d", cap(device.pool.outboundElementReuseChan))
+	}
+	elem := device.NewOutboundElement()
+	if len(elem.buffer) != 9000+MessageTransportSize {
+		t.Fatalf("expected read buffer of %d bytes, got %d", 9000+MessageTransportSize, len(elem.buffer))
+	}
+	if cap(elem.buffer) != MaxMessageSize {
+		t.Fatal("expected read buffer from the message buffer pool")
+	}
+	device.PutOutboundElement(elem)
+	if elem.message != nil {
+		t.Fatal("expected message buffer returned to the pool")
+	}
+
+	// too small buffers are raised to the minimum
+
+	options = DeviceOptions{ReadBufferSize: 100}
+	if size := options.withDefaults().ReadBufferSize; size != MinReadBufferSize {
+		t.Fatalf("expected read buffer size %d, got %d", MinReadBufferSize, size)
+	}
+
+	// and too large ones lowered to what peers can receive
+
+	options = DeviceOptions{ReadBufferSize: MaxMessageSize + 1}
+	if size := options.withDefaults().ReadBufferSize; size != MaxMessageSize {
+		t.Fatalf("expected read buffer size %d, got %d", MaxMessageSize, size)
+	}
+}
+
+func TestHandshakeWorkers(t *testing.T) {
+	handshakeWorkers := func() int {
+		buf := make([]byte, 1<<20)
+		return strings.Count(string(buf[:runtime.Stack(buf, true)]), ").RoutineHandshake(")
+	}
+	before := handshakeWorkers()
+
+	options := DeviceOptions{HandshakeWorkers: 3}
+	device := NewDeviceWithOptions(newDummyTUN("dummy"), NewLogger(LogLevelError, ""), options)
+	if workers := handshakeWorkers() - before; workers != 3 {
+		t.Fatalf("expected 3 handshake workers, got %d", workers)
+	}
+	device.Close()
+	if workers := handshakeWorkers() - before; workers != 0 {
+		t.Fatalf("expected handshake workers to stop, %d left", workers)
+	}
+
+	if workers := (DeviceOptions{}).withDefaults().HandshakeWorkers; workers != runtime.NumCPU() {
+		t.Fatalf("unexpected default of %d handshake workers", workers)
+	}
+}
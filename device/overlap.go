@@ -0,0 +1,156 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"net"
+
+	"golang.zx2c4.com/wireguard/ipc"
+)
+
+/* Overlapping allowed IPs
+ *
+ * Adding an allowed IP silently takes routing from any other peer
+ * holding the same prefix, which then loses it entirely, or a prefix
+ * covering it, which keeps the remainder. Both are a frequent
+ * misconfiguration, so every such insertion is logged and reported as
+ * EventAllowedIPOverlap naming the displaced peer and the prefix.
+ * Bulk imports are not reported prefix by prefix.
+ *
+ * Once inserted, only nested prefixes of different peers can remain;
+ * these are listed by AllowedIPOverlaps and the overlaps operation:
+ *
+ *   overlap=10.0.1.0/24
+ *   public_key=<peer routing the nested prefix>
+ *   covering=10.0.0.0/16
+ *   covering_public_key=<peer routing the remainder>
+ */
+
+type AllowedIPOverlap struct {
+	Prefix    net.IPNet
+	Peer      *Peer
+	Covering  net.IPNet
+	Displaced *Peer // routes Covering less Prefix
+}
+
+func trieEntryPrefix(node *trieEntry) net.IPNet {
+	mask := net.CIDRMask(int(node.cidr), len(node.bits)*8)
+	return net.IPNet{
+		IP:   node.bits.Mask(mask),
+		Mask: mask,
+	}
+}
+
+/* Returns the most specific entry with a peer containing the prefix
+ */
+func (node *trieEntry) covering(ip net.IP, cidr uint) *trieEntry {
+	var found *trieEntry
+	for node != nil && node.cidr <= cidr && commonBits(node.bits, ip) >= node.cidr {
+		if node.peer != nil {
+			found = node
+		}
+		if node.cidr == cidr {
+			break
+		}
+		node = node.child[node.choose(ip)]
+	}
+	return found
+}
+
+func (node *trieEntry) overlaps(parent *trieEntry, results []AllowedIPOverlap) []AllowedIPOverlap {
+	if node == nil {
+		return results
+	}
+	if node.peer != nil {
+		if parent != nil && parent.peer != node.peer {
+			results = append(results, AllowedIPOverlap{
+				Prefix:    trieEntryPrefix(node),
+				Peer:      node.peer,
+				Covering:  trieEntryPrefix(parent),
+				Displaced: parent.peer,
+			})
+		}
+		parent = node
+	}
+	results = node.child[0].overlaps(parent, results)
+	results = node.child[1].overlaps(parent, results)
+	return results
+}
+
+/* Returns the peer, and its prefix, whose routing would be taken by
+ * inserting the prefix for peer, or nil
+ */
+func (table *AllowedIPs) displaced(ip net.IP, cidr uint, peer *Peer) (*Peer, net.IPNet) {
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+
+	var node *trieEntry
+	switch len(ip) {
+	case net.IPv6len:
+		node = table.IPv6.covering(ip, cidr)
+	case net.IPv4len:
+		node = table.IPv4.covering(ip, cidr)
+	}
+	if node == nil || node.peer == peer {
+		return nil, net.IPNet{}
+	}
+	return node.peer, trieEntryPrefix(node)
+}
+
+/* Lists the prefixes nested in a prefix of a different peer
+ */
+func (device *Device) AllowedIPOverlaps() []AllowedIPOverlap {
+	table := &device.allowedips
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+
+	var results []AllowedIPOverlap
+	results = table.IPv4.overlaps(nil, results)
+	results = table.IPv6.overlaps(nil, results)
+	return results
+}
+
+/* Should be called before inserting the prefix for peer
+ */
+func (device *Device) reportOverlap(ip net.IP, cidr uint, peer *Peer) {
+	displaced, covering := device.allowedips.displaced(ip, cidr, peer)
+	if displaced == nil {
+		return
+	}
+	mask := net.CIDRMask(int(cidr), len(ip)*8)
+	prefix := net.IPNet{IP: ip.Mask(mask), Mask: mask}
+
+	if ones, _ := covering.Mask.Size(); ones == int(cidr) {
+		device.log.Info.Println(peer, "- AllowedIP", prefix.String(), "taken from", displaced)
+	} else {
+		device.log.Info.Println(peer, "- AllowedIP", prefix.String(), "overlaps", covering.String(), "of", displaced)
+	}
+
+	if device.hasEventHandlers() {
+		event := peer.newEvent(EventAllowedIPOverlap)
+		event.Prefix = prefix.String()
+		event.Displaced = displaced.handshake.remoteStatic
+		device.emit(event)
+	}
+}
+
+func (device *Device) IpcOverlapsOperation(socket *bufio.Writer) *IPCError {
+	for _, overlap := range device.AllowedIPOverlaps() {
+		lines := []string{
+			"overlap=" + overlap.Prefix.String(),
+			"public_key=" + overlap.Peer.handshake.remoteStatic.ToHex(),
+			"covering=" + overlap.Covering.String(),
+			"covering_public_key=" + overlap.Displaced.handshake.remoteStatic.ToHex(),
+		}
+		for _, line := range lines {
+			if _, err := socket.WriteString(line + "\n"); err != nil {
+				return ipcErrorf(ipc.IpcErrorIO, ipc.ReasonIO, "failed to write output: %v", err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestAllowedIPOverlap(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	var events []Event
+	device.AddEventHandler(func(event Event) {
+		if event.Type == EventAllowedIPOverlap {
+			events = append(events, event)
+		}
+	})
+
+	newPeer := func() *Peer {
+		sk, err := newPrivateKey()
+		assertNil(t, err)
+		peer, err := device.NewPeer(sk.publicKey())
+		assertNil(t, err)
+		return peer
+	}
+	a, b := newPeer(), newPeer()
+	set := func(peer *Peer, prefix string) {
+		if err := ipcSet(device, "public_key="+peer.handshake.remoteStatic.ToHex()+"\nallowed_ip="+prefix+"\n"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	set(a, "10.0.0.0/16")
+	set(a, "10.0.1.0/24")
+	set(b, "10.1.0.0/16")
+	set(b, "fd00::/64")
+	if len(events) != 0 {
+		t.Fatalf("unexpected overlap events %v", events)
+	}
+
+	// nested prefix takes part of the routing
+
+	set(b, "10.0.2.0/24")
+	if len(events) != 1 || events[0].Prefix != "10.0.2.0/24" || events[0].PublicKey != b.handshake.remoteStatic || events[0].Displaced != a.handshake.remoteStatic {
+		t.Fatalf("unexpected overlap events %v", events)
+	}
+
+	// identical prefix takes all of it
+
+	set(a, "10.1.0.0/16")
+	if len(events) != 2 || events[1].Prefix != "10.1.0.0/16" || events[1].Displaced != b.handshake.remoteStatic {
+		t.Fatalf("unexpected overlap events %v", events)
+	}
+	if device.allowedips.LookupIPv4([]byte{10, 1, 0, 1}) != a {
+		t.Fatal("prefix not taken")
+	}
+
+	overlaps := device.AllowedIPOverlaps()
+	if len(overlaps) != 1 || overlaps[0].Prefix.String() != "10.0.2.0/24" || overlaps[0].Peer != b || overlaps[0].Covering.String() != "10.0.0.0/16" || overlaps[0].Displaced != a {
+		t.Fatalf("unexpected overlaps %v", overlaps)
+	}
+
+	var buffer bytes.Buffer
+	writer := bufio.NewWriter(&buffer)
+	if err := device.IpcOverlapsOperation(writer); err != nil {
+		t.Fatal(err)
+	}
+	writer.Flush()
+	expected := strings.Join([]string{
+		"overlap=10.0.2.0/24",
+		"public_key=" + b.handshake.remoteStatic.ToHex(),
+		"covering=10.0.0.0/16",
+		"covering_public_key=" + a.handshake.remoteStatic.ToHex(),
+	}, "\n") + "\n"
+	if buffer.String() != expected {
+		t.Fatalf("unexpected output %q", buffer.String())
+	}
+}
@@ -0,0 +1,103 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"time"
+)
+
+/* Pacing of handshake initiations
+ *
+ * A device with thousands of peers coming up at once would otherwise
+ * send thousands of initiations in a single burst, which upstream DDoS
+ * protection is apt to mistake for an attack. A token bucket shared by
+ * all peers caps the rate of initiations; an initiation beyond it is
+ * scheduled for when the bucket has refilled enough, each taking the next
+ * free slot, so that all peers are served in the order they asked.
+ * A peer has at most one initiation scheduled at a time.
+ *
+ * Responses to handshakes of peers are not paced.
+ */
+
+/* Caps initiations to rate per second (0 = unlimited), allowing
+ * bursts of burst initiations (0 = one second worth)
+ */
+func (device *Device) SetHandshakePacing(rate, burst uint32) {
+	pacing := &device.pacing
+	pacing.Lock()
+	defer pacing.Unlock()
+
+	pacing.rate = rate
+	pacing.burstConfig = burst
+	pacing.burst = float64(burst)
+	if burst == 0 {
+		pacing.burst = float64(rate)
+	}
+	if pacing.burst < 1 {
+		pacing.burst = 1
+	}
+	pacing.tokens = pacing.burst
+	pacing.last = time.Now()
+	pacing.enabled.Set(rate != 0)
+}
+
+func (device *Device) HandshakePacing() (rate, burst uint32) {
+	pacing := &device.pacing
+	pacing.Lock()
+	defer pacing.Unlock()
+	return pacing.rate, pacing.burstConfig
+}
+
+/* Reserves the next slot for an initiation,
+ * returns how long to wait for it
+ */
+func (device *Device) reserveInitiation() time.Duration {
+	pacing := &device.pacing
+	pacing.Lock()
+	defer pacing.Unlock()
+
+	now := time.Now()
+	pacing.tokens += now.Sub(pacing.last).Seconds() * float64(pacing.rate)
+	if pacing.tokens > pacing.burst {
+		pacing.tokens = pacing.burst
+	}
+	pacing.last = now
+
+	pacing.tokens--
+	if pacing.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-pacing.tokens / float64(pacing.rate) * float64(time.Second))
+}
+
+/* Returns true if the initiation has been deferred to a later slot
+ */
+func (peer *Peer) paceInitiation() bool {
+	device := peer.device
+	if !device.pacing.enabled.Get() {
+		return false
+	}
+	if peer.pacing.scheduled.Get() {
+		return true
+	}
+
+	wait := device.reserveInitiation()
+	if wait == 0 {
+		return false
+	}
+	if peer.pacing.scheduled.Swap(true) {
+		return true
+	}
+
+	device.log.Debug.Println(peer, "- Pacing handshake initiation by", wait)
+	time.AfterFunc(wait, func() {
+		peer.pacing.scheduled.Set(false)
+		if peer.isRunning.Get() {
+			peer.sendHandshakeInitiation()
+		}
+	})
+	return true
+}
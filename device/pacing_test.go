@@ -0,0 +1,54 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHandshakePacing(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	if err := ipcSet(device, "handshake_rate=10\nhandshake_burst=2\n"); err != nil {
+		t.Fatal(err)
+	}
+	if rate, burst := device.HandshakePacing(); rate != 10 || burst != 2 {
+		t.Fatalf("pacing not set: %d/s, burst %d", rate, burst)
+	}
+
+	// the burst passes, further initiations wait their turn in order
+
+	for i := 0; i < 2; i++ {
+		if wait := device.reserveInitiation(); wait != 0 {
+			t.Fatalf("initiation %d within burst delayed by %v", i, wait)
+		}
+	}
+	first := device.reserveInitiation()
+	second := device.reserveInitiation()
+	if first <= 0 || first > 100*time.Millisecond || second <= first {
+		t.Fatalf("unexpected delays %v, %v", first, second)
+	}
+
+	// a peer beyond the burst is deferred once
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	peer, err := device.NewPeer(sk.publicKey())
+	assertNil(t, err)
+	if !peer.paceInitiation() || !peer.pacing.scheduled.Get() {
+		t.Fatal("initiation not deferred")
+	}
+	if !peer.paceInitiation() {
+		t.Fatal("scheduled initiation not deduplicated")
+	}
+
+	device.SetHandshakePacing(0, 0)
+	if device.pacing.enabled.Get() {
+		t.Fatal("pacing not disabled")
+	}
+}
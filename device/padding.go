@@ -0,0 +1,83 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import "errors"
+
+/* Padding modes for transport packets sent to a peer.
+ *
+ * The mode is a unilateral option of the sender, set per peer and not
+ * negotiated: receivers strip padding using the length from the inner
+ * IP header, so it works with any peer. It only hides the size of the
+ * packets sent, to pad the traffic in both directions the peer must
+ * set a mode as well. Keepalives are never padded, as the receiver
+ * identifies them by their empty payload.
+ */
+
+const (
+	PaddingDefault = iota // pad to a multiple of PaddingMultiple
+	PaddingMTU            // pad every packet to the MTU
+	PaddingBuckets        // pad to the next of PaddingBucketSizes, or the MTU
+)
+
+var PaddingBucketSizes = []int{128, 256, 512, 1024}
+
+var paddingModeNames = []string{
+	PaddingDefault: "default",
+	PaddingMTU:     "mtu",
+	PaddingBuckets: "buckets",
+}
+
+func PaddingModeName(mode int) string {
+	return paddingModeNames[mode]
+}
+
+func ParsePaddingMode(name string) (int, error) {
+	for mode, modeName := range paddingModeNames {
+		if modeName == name {
+			return mode, nil
+		}
+	}
+	return 0, errors.New("unknown padding mode")
+}
+
+/* Returns the size to which a packet of the given size is padded
+ */
+func paddedSize(mode int, size int, mtu int) int {
+	if size == 0 {
+		return 0
+	}
+
+	switch mode {
+	case PaddingMTU:
+		if size < mtu {
+			return mtu
+		}
+		return size
+
+	case PaddingBuckets:
+		for _, bucket := range PaddingBucketSizes {
+			if size <= bucket && bucket < mtu {
+				return bucket
+			}
+		}
+		if size < mtu {
+			return mtu
+		}
+		return size
+	}
+
+	lastUnit := size % mtu
+	padded := (lastUnit + PaddingMultiple - 1) & ^(PaddingMultiple - 1)
+	if padded > mtu {
+		padded = mtu
+	}
+	if padded < size {
+		// packet of exactly the MTU
+		return size
+	}
+	return padded
+}
@@ -0,0 +1,48 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import "testing"
+
+func TestPaddedSize(t *testing.T) {
+	tests := []struct {
+		mode     int
+		size     int
+		expected int
+	}{
+		{PaddingDefault, 0, 0},
+		{PaddingDefault, 1, 16},
+		{PaddingDefault, 1415, 1420},
+		{PaddingDefault, 1420, 1420},
+		{PaddingMTU, 0, 0},
+		{PaddingMTU, 60, 1420},
+		{PaddingMTU, 1420, 1420},
+		{PaddingBuckets, 0, 0},
+		{PaddingBuckets, 60, 128},
+		{PaddingBuckets, 129, 256},
+		{PaddingBuckets, 1024, 1024},
+		{PaddingBuckets, 1025, 1420},
+	}
+
+	for _, test := range tests {
+		if size := paddedSize(test.mode, test.size, 1420); size != test.expected {
+			t.Errorf("%s padding of %d bytes: got %d, expected %d", PaddingModeName(test.mode), test.size, size, test.expected)
+		}
+	}
+}
+
+func TestParsePaddingMode(t *testing.T) {
+	for mode := PaddingDefault; mode <= PaddingBuckets; mode++ {
+		parsed, err := ParsePaddingMode(PaddingModeName(mode))
+		assertNil(t, err)
+		if parsed != mode {
+			t.Errorf("round trip of %s: got %d", PaddingModeName(mode), parsed)
+		}
+	}
+	if _, err := ParsePaddingMode("bogus"); err == nil {
+		t.Error("expected error for unknown padding mode")
+	}
+}
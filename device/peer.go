@@ -32,6 +32,10 @@ type Peer struct {
 		txBytes           uint64 // bytes send to peer (endpoint)
 		rxBytes           uint64 // bytes received from peer
 		lastHandshakeNano int64  // nano seconds since epoch
+		txPaddingBytes    uint64 // padding bytes included in txBytes
+		txPackets         uint64 // packets send to peer, see counters.go
+		rxPackets         uint64 // packets received from peer
+		resumedSessions   uint64 // sessions resumed from a ticket, see resumption.go
 	}
 
 	timers struct {
@@ -40,6 +44,9 @@ type Peer struct {
 		newHandshake            *Timer
 		zeroKeyMaterial         *Timer
 		persistentKeepalive     *Timer
+		coverTraffic            *Timer
+		gossip                  *Timer
+		unreachable             *Timer
 		handshakeAttempts       uint32
 		needAnotherKeepalive    AtomicBool
 		sentLastMinuteHandshake AtomicBool
@@ -64,6 +71,86 @@ type Peer struct {
 		stop       chan struct{}  // size 0, stop all go routines in peer
 	}
 
+	padding int32 // padding mode of transport packets, see padding.go
+
+	relay struct {
+		active AtomicBool // sending through the relay, see relay.go
+	}
+
+	// cover traffic and transmission jitter, see cover.go
+
+	cover struct {
+		intervalMs uint32 // mean interval of cover traffic (0 = disabled)
+		jitterMs   uint32 // maximum delay of data packets (0 = disabled)
+	}
+
+	// maximum advance of rekeys (-1 = that of the device), see rekeyjitter.go
+
+	rekeyJitterMs int32
+
+	// handshake traffic on a separate port, see control.go
+
+	control struct {
+		port     uint16   // control port of the peer (0 = disabled)
+		endpoint Endpoint // learned from handshakes received on the control port
+	}
+
+	// peer discovery, see gossip.go
+
+	gossip struct {
+		coordinator AtomicBool // accept gossip from this peer
+		learned     AtomicBool // added from gossip of a coordinator
+	}
+
+	// suspended by the operator, neither started nor accepting handshakes
+
+	disabled AtomicBool
+
+	// no answer within the unreachable timeout, see unreachable.go
+
+	unreachable AtomicBool
+
+	// connection quality score, see quality.go
+
+	quality qualityState
+
+	// opaque key/value pairs of controllers, see metadata.go
+
+	metadata struct {
+		sync.RWMutex
+		entries map[string]string
+	}
+
+	// throughput self-test, see selftest.go
+
+	selftest selftestState
+
+	// handshake initiation waiting for a slot, see pacing.go
+
+	pacing struct {
+		scheduled AtomicBool
+	}
+
+	// traffic of the last statistics interval, see counters.go
+
+	interval intervalCounters
+
+	// restrictions on endpoint changes, see roaming.go
+
+	roaming roamingPolicy
+
+	// translation of overlapping internal addresses, see netmap.go
+
+	netmap netmapState
+
+	// abbreviated handshakes after reconnects, see resumption.go
+
+	resumption resumptionState
+
+	// endpoint of the peer is this device, see hairpin.go
+
+	hairpin hairpinState
+
 	cookieGenerator CookieGenerator
 }
 
@@ -72,6 +159,18 @@ func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
 		return nil, errors.New("device closed")
 	}
 
+	// check if over memory limit
+
+	if err := device.reserveMemory(device.memoryPerPeer()); err != nil {
+		return nil, err
+	}
+	added := false
+	defer func() {
+		if !added {
+			device.releaseMemory(device.memoryPerPeer())
+		}
+	}()
+
 	// lock resources
 
 	device.staticIdentity.RLock()
@@ -95,6 +194,7 @@ func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
 	peer.cookieGenerator.Init(pk)
 	peer.device = device
 	peer.isRunning.Set(false)
+	peer.rekeyJitterMs = -1
 
 	// map public key
 
@@ -107,9 +207,10 @@ func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
 
 	handshake := &peer.handshake
 	handshake.mutex.Lock()
-	handshake.precomputedStaticStatic = device.staticIdentity.privateKey.sharedSecret(pk)
+	handshake.precomputedStaticStatic, _ = device.staticSharedSecret(pk)
 	ssIsZero := isZero(handshake.precomputedStaticStatic[:])
 	handshake.remoteStatic = pk
+	mixHash(&handshake.precomputedInitialHash, &InitialHash, pk[:])
 	handshake.mutex.Unlock()
 
 	// reset endpoint
@@ -120,6 +221,8 @@ func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
 
 	if !ssIsZero {
 		device.peers.keyMap[pk] = peer
+		device.peers.empty.Set(false)
+		added = true
 	} else {
 		return nil, nil
 	}
@@ -134,6 +237,10 @@ func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
 }
 
 func (peer *Peer) SendBuffer(buffer []byte) error {
+	return peer.sendBuffer(buffer, false)
+}
+
+func (peer *Peer) sendBuffer(buffer []byte, handshake bool) error {
 	peer.device.net.RLock()
 	defer peer.device.net.RUnlock()
 
@@ -144,13 +251,34 @@ func (peer *Peer) SendBuffer(buffer []byte) error {
 	peer.RLock()
 	defer peer.RUnlock()
 
-	if peer.endpoint == nil {
+	bind, endpoint := peer.device.net.bind, peer.endpoint
+	if handshake {
+		bind, endpoint = peer.handshakeDestination()
+	}
+
+	if relayBind, relayEndpoint := peer.relayDestination(endpoint); relayBind != nil {
+		if handshake && endpoint != nil {
+			bind.Send(buffer, endpoint)
+		}
+		bind, endpoint = relayBind, relayEndpoint
+	}
+
+	if endpoint == nil {
 		return errors.New("no known endpoint for peer")
 	}
 
-	err := peer.device.net.bind.Send(buffer, peer.endpoint)
+	err := bind.Send(buffer, endpoint)
+	if err != nil && endpoint == peer.endpoint {
+		if synthesized := peer.device.nat64Endpoint(endpoint); synthesized != nil {
+			err = bind.Send(buffer, synthesized)
+			if err == nil {
+				go peer.replaceEndpoint(endpoint, synthesized)
+			}
+		}
+	}
 	if err == nil {
 		atomic.AddUint64(&peer.stats.txBytes, uint64(len(buffer)))
+		atomic.AddUint64(&peer.stats.txPackets, 1)
 	}
 	return err
 }
@@ -168,7 +296,7 @@ func (peer *Peer) Start() {
 
 	// should never start a peer on a closed device
 
-	if peer.device.isClosed.Get() {
+	if peer.device.isClosed.Get() || peer.disabled.Get() {
 		return
 	}
 
@@ -194,11 +322,13 @@ func (peer *Peer) Start() {
 
 	// prepare queues
 
-	peer.queue.nonce = make(chan *QueueOutboundElement, QueueOutboundSize)
-	peer.queue.outbound = make(chan *QueueOutboundElement, QueueOutboundSize)
-	peer.queue.inbound = make(chan *QueueInboundElement, QueueInboundSize)
+	peer.queue.nonce = make(chan *QueueOutboundElement, device.options.OutboundQueueSize)
+	peer.queue.outbound = make(chan *QueueOutboundElement, device.options.OutboundQueueSize)
+	peer.queue.inbound = make(chan *QueueInboundElement, device.options.InboundQueueSize)
 
 	peer.timersInit()
+	peer.unreachable.Set(false)
+	peer.qualityReset()
 	peer.handshake.lastSentHandshake = time.Now().Add(-(RekeyTimeout + time.Second))
 	peer.signals.newKeypairArrived = make(chan struct{}, 1)
 	peer.signals.flushNonceQueue = make(chan struct{}, 1)
@@ -211,6 +341,9 @@ func (peer *Peer) Start() {
 
 	peer.routines.starting.Wait()
 	peer.isRunning.Set(true)
+
+	peer.timersCoverTraffic()
+	peer.timersGossip()
 }
 
 func (peer *Peer) ZeroAndFlushAll() {
@@ -234,6 +367,7 @@ func (peer *Peer) ZeroAndFlushAll() {
 	handshake.mutex.Lock()
 	device.indexTable.Delete(handshake.localIndex)
 	handshake.Clear()
+	peer.resumption.handshakeResumed = false
 	handshake.mutex.Unlock()
 
 	peer.FlushNonceQueue()
@@ -244,6 +378,7 @@ func (peer *Peer) ExpireCurrentKeypairs() {
 	handshake.mutex.Lock()
 	peer.device.indexTable.Delete(handshake.localIndex)
 	handshake.Clear()
+	peer.resumption.handshakeResumed = false
 	handshake.mutex.Unlock()
 	peer.handshake.lastSentHandshake = time.Now().Add(-(RekeyTimeout + time.Second))
 
@@ -289,13 +424,64 @@ func (peer *Peer) Stop() {
 	peer.ZeroAndFlushAll()
 }
 
+/* Suspends the peer without removing its configuration: it is
+ * stopped, its sessions are discarded and its handshakes rejected
+ * until enabled again
+ */
+func (peer *Peer) SetDisabled(disabled bool) {
+	if peer.disabled.Swap(disabled) == disabled {
+		return
+	}
+	if disabled {
+		peer.device.log.Info.Println(peer, "- Disabled")
+		peer.Stop()
+	} else {
+		peer.device.log.Info.Println(peer, "- Enabled")
+		if peer.device.isUp.Get() {
+			peer.Start()
+		}
+	}
+}
+
+func (peer *Peer) IsDisabled() bool {
+	return peer.disabled.Get()
+}
+
 var RoamingDisabled bool
 
 func (peer *Peer) SetEndpointFromPacket(endpoint Endpoint) {
-	if RoamingDisabled {
+	peer.setEndpointFromPacket(endpoint, false)
+}
+
+/* Should be called with the source of authenticated handshake messages
+ */
+func (peer *Peer) SetEndpointFromHandshake(endpoint Endpoint) {
+	peer.setEndpointFromPacket(endpoint, true)
+}
+
+func (peer *Peer) setEndpointFromPacket(endpoint Endpoint, handshake bool) {
+	endpoint, relayed := directEndpoint(endpoint)
+	peer.setRelayActive(relayed)
+	if endpoint == nil || RoamingDisabled {
+		return
+	}
+	peer.RLock()
+	previous := peer.endpoint
+	peer.RUnlock()
+	if !peer.allowRoam(previous, endpoint, handshake) {
 		return
 	}
 	peer.Lock()
+	previous = peer.endpoint
 	peer.endpoint = endpoint
 	peer.Unlock()
+	if peer.hairpin.self.Get() {
+		peer.hairpin.self.Set(false)
+	}
+
+	// comparing endpoints is only worth it if someone listens
+
+	if previous != nil && peer.device.hasEventHandlers() && !sameDst(previous, endpoint) {
+		peer.device.emit(peer.newEvent(EventPeerRoamed))
+	}
 }
@@ -0,0 +1,141 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.zx2c4.com/wireguard/ipc"
+)
+
+/* Handshake ping
+ *
+ * Checks connectivity to a peer by sending a handshake initiation
+ * right away, regardless of the rekey timeout and of any current
+ * session, and waiting for a handshake to complete. No data packets
+ * are sent, though the completed handshake is confirmed by the usual
+ * keepalive. A handshake completed by the peer initiating at the same
+ * time also counts as a response.
+ */
+
+const (
+	PingDefaultTimeout = RekeyTimeout
+	PingPollInterval   = 10 * time.Millisecond
+)
+
+type PingResult struct {
+	Responded bool
+	RTT       time.Duration // from sending the initiation to completing the handshake
+}
+
+func (peer *Peer) Ping(timeout time.Duration) (PingResult, error) {
+	var result PingResult
+
+	if timeout <= 0 {
+		timeout = PingDefaultTimeout
+	}
+	if !peer.isRunning.Get() {
+		return result, errors.New("peer is not running")
+	}
+	if peer.device.ha.standby.Get() {
+		return result, errors.New("device is on standby")
+	}
+
+	peer.handshake.mutex.Lock()
+	peer.handshake.lastSentHandshake = time.Time{}
+	peer.handshake.mutex.Unlock()
+
+	start := time.Now()
+	if err := peer.SendHandshakeInitiation(false); err != nil {
+		return result, err
+	}
+
+	deadline := start.Add(timeout)
+	for {
+		if completed := atomic.LoadInt64(&peer.stats.lastHandshakeNano); completed > start.UnixNano() {
+			result.Responded = true
+			result.RTT = time.Duration(completed - start.UnixNano())
+			return result, nil
+		}
+		if time.Now().After(deadline) || !peer.isRunning.Get() {
+			return result, nil
+		}
+		time.Sleep(PingPollInterval)
+	}
+}
+
+/* Pings the peer given by public_key, waiting at most timeout_ms,
+ * and writes the result
+ */
+func (device *Device) IpcPingOperation(socket *bufio.ReadWriter) *IPCError {
+	scanner := bufio.NewScanner(socket.Reader)
+
+	var peer *Peer
+	var timeout time.Duration
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+		parts := strings.Split(line, "=")
+		if len(parts) != 2 {
+			return ipcErrorf(ipc.IpcErrorProtocol, ipc.ReasonProtocol, "failed to parse line %q", line)
+		}
+		key, value := parts[0], parts[1]
+
+		switch key {
+		case "public_key":
+			var publicKey NoisePublicKey
+			if err := publicKey.FromHex(value); err != nil {
+				return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidKey, "failed to get peer by public key: %v", err)
+			}
+			peer = device.LookupPeer(publicKey)
+			if peer == nil {
+				return ipcErrorf(ipc.IpcErrorNotFound, ipc.ReasonPeerNotFound, "no such peer: %v", value)
+			}
+
+		case "timeout_ms":
+			n, err := strconv.ParseUint(value, 10, 31)
+			if err != nil {
+				return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "invalid timeout_ms: %v", err)
+			}
+			timeout = time.Duration(n) * time.Millisecond
+
+		default:
+			return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonUnknownKey, "invalid UAPI ping key: %v", key)
+		}
+	}
+
+	if peer == nil {
+		return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonProtocol, "ping requires public_key")
+	}
+
+	result, err := peer.Ping(timeout)
+	if err != nil {
+		return ipcErrorf(ipc.IpcErrorBusy, ipc.ReasonTransient, "ping failed: %v", err)
+	}
+
+	lines := []string{
+		fmt.Sprintf("responded=%v", result.Responded),
+	}
+	if result.Responded {
+		lines = append(lines, fmt.Sprintf("rtt_us=%d", result.RTT/time.Microsecond))
+	}
+	for _, line := range lines {
+		_, err := socket.WriteString(line + "\n")
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorIO, ipc.ReasonIO, "failed to write output: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/ipc"
+)
+
+func TestPing(t *testing.T) {
+	device1, device2, peer, _ := selftestPair(t)
+	defer device1.Close()
+	defer device2.Close()
+
+	// pings are answered with and without a current session
+
+	for i := 0; i < 2; i++ {
+		result, err := peer.Ping(time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.Responded || result.RTT <= 0 || result.RTT > time.Second {
+			t.Fatalf("ping %d: unexpected result %+v", i, result)
+		}
+		time.Sleep(HandshakeInitationRate)
+	}
+
+	device2.Down()
+	result, err := peer.Ping(100 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Responded {
+		t.Fatal("ping answered by device which is down")
+	}
+}
+
+func TestIpcPingUnknownPeer(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	var out strings.Builder
+	socket := bufio.NewReadWriter(
+		bufio.NewReader(strings.NewReader("public_key="+strings.Repeat("ab", 32)+"\n\n")),
+		bufio.NewWriter(&out),
+	)
+	err := device.IpcPingOperation(socket)
+	if err == nil || err.ErrorCode() != ipc.IpcErrorNotFound || err.Reason() != ipc.ReasonPeerNotFound {
+		t.Fatalf("got %v, expected (%d, %s)", err, ipc.IpcErrorNotFound, ipc.ReasonPeerNotFound)
+	}
+}
@@ -8,6 +8,19 @@ package device
 import "sync"
 
 func (device *Device) PopulatePools() {
+	if device.options.ReadBufferCount == 0 {
+		device.pool.outboundElementPool = &sync.Pool{
+			New: func() interface{} {
+				return new(QueueOutboundElement)
+			},
+		}
+	} else {
+		device.pool.outboundElementReuseChan = make(chan *QueueOutboundElement, device.options.ReadBufferCount)
+		for i := 0; i < device.options.ReadBufferCount; i += 1 {
+			device.pool.outboundElementReuseChan <- new(QueueOutboundElement)
+		}
+	}
+
 	if PreallocatedBuffersPerPool == 0 {
 		device.pool.messageBufferPool = &sync.Pool{
 			New: func() interface{} {
@@ -19,11 +32,6 @@ func (device *Device) PopulatePools() {
 				return new(QueueInboundElement)
 			},
 		}
-		device.pool.outboundElementPool = &sync.Pool{
-			New: func() interface{} {
-				return new(QueueOutboundElement)
-			},
-		}
 	} else {
 		device.pool.messageBufferReuseChan = make(chan *[MaxMessageSize]byte, PreallocatedBuffersPerPool)
 		for i := 0; i < PreallocatedBuffersPerPool; i += 1 {
@@ -33,10 +41,6 @@ func (device *Device) PopulatePools() {
 		for i := 0; i < PreallocatedBuffersPerPool; i += 1 {
 			device.pool.inboundElementReuseChan <- new(QueueInboundElement)
 		}
-		device.pool.outboundElementReuseChan = make(chan *QueueOutboundElement, PreallocatedBuffersPerPool)
-		for i := 0; i < PreallocatedBuffersPerPool; i += 1 {
-			device.pool.outboundElementReuseChan <- new(QueueOutboundElement)
-		}
 	}
 }
 
@@ -73,7 +77,7 @@ func (device *Device) PutInboundElement(msg *QueueInboundElement) {
 }
 
 func (device *Device) GetOutboundElement() *QueueOutboundElement {
-	if PreallocatedBuffersPerPool == 0 {
+	if device.options.ReadBufferCount == 0 {
 		return device.pool.outboundElementPool.Get().(*QueueOutboundElement)
 	} else {
 		return <-device.pool.outboundElementReuseChan
@@ -81,7 +85,11 @@ func (device *Device) GetOutboundElement() *QueueOutboundElement {
 }
 
 func (device *Device) PutOutboundElement(msg *QueueOutboundElement) {
-	if PreallocatedBuffersPerPool == 0 {
+	if msg.message != nil {
+		device.PutMessageBuffer(msg.message)
+		msg.message, msg.buffer = nil, nil
+	}
+	if device.options.ReadBufferCount == 0 {
 		device.pool.outboundElementPool.Put(msg)
 	} else {
 		device.pool.outboundElementReuseChan <- msg
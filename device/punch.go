@@ -0,0 +1,255 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.zx2c4.com/wireguard/turn"
+)
+
+/* ICE-style hole punching
+ *
+ * Both sides gather candidate endpoints for their listening socket,
+ * exchange them over a signaling channel provided by the embedder
+ * and then probe all remote candidates simultaneously from the
+ * listening socket, which opens the mappings of NATs on both paths.
+ *
+ * The side with the lower public key probes with handshake initiations,
+ * the other side with short datagrams which receivers silently discard.
+ * The first handshake to complete installs the endpoint on the peer,
+ * through the usual roaming of endpoints.
+ */
+
+const (
+	PunchTimeout       = 10 * time.Second
+	PunchRoundInterval = time.Second
+	STUNTimeout        = 2 * time.Second
+)
+
+const (
+	CandidateLocal     = "local"     // address of a local interface
+	CandidateReflexive = "reflexive" // address as seen by a STUN server
+)
+
+type Candidate struct {
+	Type     string
+	Endpoint string // ip:port
+}
+
+/* A Signaling channel carries candidates to and from the remote peer,
+ * for example through a coordination server or an existing tunnel
+ */
+type Signaling interface {
+	SendCandidates(candidates []Candidate) error
+	ReceiveCandidates() ([]Candidate, error)
+}
+
+type PunchOptions struct {
+	STUNServer string        // host:port of a STUN server, optional
+	Timeout    time.Duration // zero selects PunchTimeout
+}
+
+/* Returns the candidates of the listening socket of the device
+ */
+func (device *Device) GatherCandidates(stunServer string) ([]Candidate, error) {
+	device.net.RLock()
+	port := device.net.port
+	device.net.RUnlock()
+	if port == 0 {
+		return nil, errors.New("device is not listening")
+	}
+
+	var candidates []Candidate
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || !ipnet.IP.IsGlobalUnicast() {
+			continue
+		}
+		candidates = append(candidates, Candidate{
+			Type:     CandidateLocal,
+			Endpoint: net.JoinHostPort(ipnet.IP.String(), strconv.Itoa(int(port))),
+		})
+	}
+
+	if stunServer != "" {
+		addr, err := device.stunBinding(stunServer)
+		if err != nil {
+			device.log.Info.Println("Failed to obtain reflexive address from", stunServer, "-", err)
+		} else {
+			candidates = append(candidates, Candidate{
+				Type:     CandidateReflexive,
+				Endpoint: addr.String(),
+			})
+		}
+	}
+
+	return candidates, nil
+}
+
+/* Sends a STUN binding request from the listening socket
+ * and awaits the server reflexive address
+ */
+func (device *Device) stunBinding(server string) (*net.UDPAddr, error) {
+	addr, err := device.resolveUDPAddr(server)
+	if err != nil {
+		return nil, err
+	}
+	endpoint, err := CreateEndpoint(addr.String())
+	if err != nil {
+		return nil, err
+	}
+
+	id, packet := turn.NewBindingRequest()
+	response := make(chan *net.UDPAddr, 1)
+
+	device.stun.Lock()
+	if device.stun.pending == nil {
+		device.stun.pending = make(map[turn.TransactionID]chan *net.UDPAddr)
+	}
+	device.stun.pending[id] = response
+	device.stun.Unlock()
+
+	defer func() {
+		device.stun.Lock()
+		delete(device.stun.pending, id)
+		device.stun.Unlock()
+	}()
+
+	if err := device.sendRaw(packet, endpoint); err != nil {
+		return nil, err
+	}
+
+	select {
+	case mapped := <-response:
+		return mapped, nil
+	case <-time.After(STUNTimeout):
+		return nil, errors.New("stun binding timed out")
+	}
+}
+
+/* Delivers a STUN response received on the listening socket
+ */
+func (device *Device) handleSTUN(packet []byte) {
+	id, addr, err := turn.ParseBindingResponse(packet)
+	if err != nil {
+		return
+	}
+	device.stun.Lock()
+	response, ok := device.stun.pending[id]
+	device.stun.Unlock()
+	if ok {
+		select {
+		case response <- addr:
+		default:
+		}
+	}
+}
+
+func (device *Device) sendRaw(packet []byte, endpoint Endpoint) error {
+	device.net.RLock()
+	defer device.net.RUnlock()
+	if device.net.bind == nil {
+		return errors.New("no bind")
+	}
+	return device.net.bind.Send(packet, endpoint)
+}
+
+/* Exchanges candidates with the peer over the signaling channel and
+ * probes them until a handshake with the peer completes, returning
+ * the endpoint installed on the peer
+ */
+func (device *Device) PunchHole(pk NoisePublicKey, signaling Signaling, options PunchOptions) (Endpoint, error) {
+	peer := device.LookupPeer(pk)
+	if peer == nil {
+		return nil, errors.New("no such peer")
+	}
+	if options.Timeout == 0 {
+		options.Timeout = PunchTimeout
+	}
+
+	local, err := device.GatherCandidates(options.STUNServer)
+	if err != nil {
+		return nil, err
+	}
+	if err := signaling.SendCandidates(local); err != nil {
+		return nil, err
+	}
+	remote, err := signaling.ReceiveCandidates()
+	if err != nil {
+		return nil, err
+	}
+
+	var endpoints []Endpoint
+	for _, candidate := range remote {
+		endpoint, err := CreateEndpoint(candidate.Endpoint)
+		if err != nil {
+			device.log.Debug.Println(peer, "- Ignoring invalid candidate", candidate.Endpoint)
+			continue
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	if len(endpoints) == 0 {
+		return nil, errors.New("no usable candidates from peer")
+	}
+
+	device.staticIdentity.RLock()
+	initiator := bytes.Compare(device.staticIdentity.publicKey[:], pk[:]) < 0
+	device.staticIdentity.RUnlock()
+
+	started := time.Now().UnixNano()
+	deadline := time.Now().Add(options.Timeout)
+	opener := make([]byte, MinMessageSize-1)
+
+	for time.Now().Before(deadline) {
+
+		// probe all candidates with the same packet
+
+		probe := opener
+		if initiator {
+			probe, err = peer.createInitiationPacket()
+			if err != nil {
+				return nil, err
+			}
+		}
+		var wg sync.WaitGroup
+		for _, endpoint := range endpoints {
+			wg.Add(1)
+			go func(endpoint Endpoint) {
+				device.sendRaw(probe, endpoint)
+				wg.Done()
+			}(endpoint)
+		}
+		wg.Wait()
+
+		// await a completed handshake
+
+		round := time.Now().Add(PunchRoundInterval)
+		for time.Now().Before(round) {
+			if atomic.LoadInt64(&peer.stats.lastHandshakeNano) > started {
+				peer.RLock()
+				endpoint := peer.endpoint
+				peer.RUnlock()
+				device.log.Info.Println(peer, "- Hole punched to", endpoint.DstToString())
+				return endpoint, nil
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	return nil, errors.New("hole punching timed out")
+}
@@ -0,0 +1,81 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+/* Answers binding requests with the source address of the request
+ */
+func stunServer(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assertNil(t, err)
+	go func() {
+		var buff [1500]byte
+		for {
+			size, addr, err := conn.ReadFromUDP(buff[:])
+			if err != nil {
+				return
+			}
+			if size < 20 {
+				continue
+			}
+			var resp [32]byte
+			binary.BigEndian.PutUint16(resp[0:], 0x0101)
+			binary.BigEndian.PutUint16(resp[2:], 12)
+			copy(resp[4:20], buff[4:20])
+			binary.BigEndian.PutUint16(resp[20:], 0x0020)
+			binary.BigEndian.PutUint16(resp[22:], 8)
+			resp[25] = 0x01
+			binary.BigEndian.PutUint16(resp[26:], uint16(addr.Port)^0x2112)
+			for i, b := range addr.IP.To4() {
+				resp[28+i] = b ^ resp[4+i]
+			}
+			conn.WriteToUDP(resp[:], addr)
+		}
+	}()
+	return conn
+}
+
+func TestGatherCandidates(t *testing.T) {
+	server := stunServer(t)
+	defer server.Close()
+
+	device := randDevice(t)
+	defer device.Close()
+	if _, err := device.GatherCandidates(""); err == nil {
+		t.Fatal("gathered candidates without listening socket")
+	}
+
+	device.Up()
+	if err := ipcSet(device, "listen_port=0\n"); err != nil {
+		t.Fatal(err)
+	}
+	candidates, err := device.GatherCandidates(server.LocalAddr().String())
+	assertNil(t, err)
+
+	device.net.RLock()
+	port := device.net.port
+	device.net.RUnlock()
+
+	var reflexive []Candidate
+	for _, candidate := range candidates {
+		if candidate.Type == CandidateReflexive {
+			reflexive = append(reflexive, candidate)
+		}
+	}
+	if len(reflexive) != 1 {
+		t.Fatalf("expected one reflexive candidate, got %v", candidates)
+	}
+	addr, err := net.ResolveUDPAddr("udp", reflexive[0].Endpoint)
+	assertNil(t, err)
+	if !addr.IP.IsLoopback() || addr.Port != int(port) {
+		t.Fatalf("unexpected reflexive candidate %s for port %d", reflexive[0].Endpoint, port)
+	}
+}
@@ -0,0 +1,185 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"time"
+)
+
+/* Connection quality
+ *
+ * Each peer is scored from 0 (unusable) to 100 (perfect) from three
+ * measurements, each smoothed over recent samples:
+ *
+ *  - the round trip time of handshakes initiated by this device,
+ *    costing up to 20 points from QualityRTTGood to QualityRTTBad
+ *  - the loss inferred from data sent which the peer failed to answer,
+ *    with data or a keepalive, within KeepaliveTimeout + RekeyTimeout,
+ *    costing up to 50 points
+ *  - the share of handshake initiations retransmitted for lack of a
+ *    response, costing up to 30 points
+ *
+ * An unreachable peer scores 0. Before the first sample the quality
+ * is unknown. A score falling below QualityDegradedScore emits
+ * EventQualityDegraded, and rising again to QualityRestoredScore emits
+ * EventQualityRestored; reachability has events of its own and is not
+ * considered for these.
+ *
+ * Over UAPI the peer reports quality, rtt_us, loss_permille and
+ * retry_permille once measured.
+ */
+
+const (
+	QualityDegradedScore = 50
+	QualityRestoredScore = 70
+	QualityRTTGood       = 25 * time.Millisecond
+	QualityRTTBad        = 500 * time.Millisecond
+	qualitySmoothing     = 8 // weight of the history against a new sample
+)
+
+type PeerQuality struct {
+	Score   int
+	RTT     time.Duration // smoothed, zero if never measured
+	Loss    int           // permille of answers missing
+	Retries int           // permille of handshake initiations retransmitted
+}
+
+type qualityState struct {
+	sync.Mutex
+	measured       bool
+	degraded       bool
+	initiationSent time.Time // of the handshake initiation awaiting a response
+	rtt            time.Duration
+	loss           int
+	retries        int
+}
+
+func smoothPermille(current int, sample bool) int {
+	target := 0
+	if sample {
+		target = 1000
+	}
+	return current + (target-current)/qualitySmoothing
+}
+
+func (state *qualityState) score(unreachable bool) int {
+	if unreachable {
+		return 0
+	}
+	score := 100 - state.loss*50/1000 - state.retries*30/1000
+	if state.rtt > QualityRTTGood {
+		penalty := 20
+		if state.rtt < QualityRTTBad {
+			penalty = int(20 * (state.rtt - QualityRTTGood) / (QualityRTTBad - QualityRTTGood))
+		}
+		score -= penalty
+	}
+	if score < 0 {
+		score = 0
+	}
+	return score
+}
+
+/* Returns the quality of the connection to the peer, false if not yet
+ * measured
+ */
+func (peer *Peer) Quality() (PeerQuality, bool) {
+	state := &peer.quality
+	state.Lock()
+	defer state.Unlock()
+
+	quality := PeerQuality{
+		Score:   state.score(peer.unreachable.Get()),
+		RTT:     state.rtt,
+		Loss:    state.loss,
+		Retries: state.retries,
+	}
+	return quality, state.measured
+}
+
+/* Applies the sample and emits an event if the score crossed a
+ * threshold
+ */
+func (peer *Peer) qualityUpdate(sample func(state *qualityState)) {
+	state := &peer.quality
+	state.Lock()
+	sample(state)
+	state.measured = true
+	score := state.score(false)
+	var eventType EventType = -1
+	if !state.degraded && score < QualityDegradedScore {
+		state.degraded = true
+		eventType = EventQualityDegraded
+	} else if state.degraded && score >= QualityRestoredScore {
+		state.degraded = false
+		eventType = EventQualityRestored
+	}
+	state.Unlock()
+
+	if eventType < 0 {
+		return
+	}
+	if eventType == EventQualityDegraded {
+		peer.device.log.Info.Printf("%v - Connection quality degraded, score %d", peer, score)
+	} else {
+		peer.device.log.Info.Printf("%v - Connection quality restored, score %d", peer, score)
+	}
+	if peer.device.hasEventHandlers() {
+		event := peer.newEvent(eventType)
+		event.Quality = score
+		peer.device.emit(event)
+	}
+}
+
+func (peer *Peer) qualityReset() {
+	state := &peer.quality
+	state.Lock()
+	defer state.Unlock()
+	state.measured = false
+	state.degraded = false
+	state.initiationSent = time.Time{}
+	state.rtt = 0
+	state.loss = 0
+	state.retries = 0
+}
+
+/* Should be called after a handshake initiation was sent */
+func (peer *Peer) qualityInitiationSent() {
+	peer.quality.Lock()
+	peer.quality.initiationSent = time.Now()
+	peer.quality.Unlock()
+}
+
+/* Should be called after the response to an initiation is processed */
+func (peer *Peer) qualityResponseReceived() {
+	peer.qualityUpdate(func(state *qualityState) {
+		if !state.initiationSent.IsZero() {
+			rtt := time.Since(state.initiationSent)
+			if state.rtt == 0 {
+				state.rtt = rtt
+			} else {
+				state.rtt += (rtt - state.rtt) / qualitySmoothing
+			}
+			state.initiationSent = time.Time{}
+		}
+		state.retries = smoothPermille(state.retries, false)
+	})
+}
+
+/* Should be called when a handshake initiation is retransmitted */
+func (peer *Peer) qualityRetransmit() {
+	peer.qualityUpdate(func(state *qualityState) {
+		state.retries = smoothPermille(state.retries, true)
+	})
+}
+
+/* Should be called when the answer to data sent arrived, or not */
+func (peer *Peer) qualityAnswer(answered bool) {
+	peer.qualityUpdate(func(state *qualityState) {
+		state.loss = smoothPermille(state.loss, !answered)
+	})
+}
@@ -0,0 +1,100 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQualityScore(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	events := make(chan Event, 10)
+	device.AddEventHandler(func(event Event) {
+		events <- event
+	})
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	peer, err := device.NewPeer(sk.publicKey())
+	assertNil(t, err)
+
+	if _, ok := peer.Quality(); ok {
+		t.Fatal("quality reported before any sample")
+	}
+
+	peer.qualityInitiationSent()
+	peer.qualityResponseReceived()
+	peer.qualityAnswer(true)
+	quality, ok := peer.Quality()
+	if !ok || quality.Score != 100 || quality.RTT <= 0 || quality.RTT > QualityRTTGood {
+		t.Fatalf("unexpected quality of healthy peer %+v", quality)
+	}
+
+	// sustained loss and retransmissions degrade the score
+
+	for i := 0; i < 20; i++ {
+		peer.qualityAnswer(false)
+		peer.qualityRetransmit()
+	}
+	quality, _ = peer.Quality()
+	if quality.Score >= QualityDegradedScore || quality.Loss < 900 || quality.Retries < 900 {
+		t.Fatalf("unexpected quality of lossy peer %+v", quality)
+	}
+	select {
+	case event := <-events:
+		if event.Type != EventQualityDegraded || event.Quality >= QualityDegradedScore {
+			t.Fatalf("unexpected event %v, quality %d", event.Type, event.Quality)
+		}
+	default:
+		t.Fatal("no degraded event")
+	}
+
+	for i := 0; i < 20; i++ {
+		peer.qualityAnswer(true)
+		peer.qualityResponseReceived()
+	}
+	select {
+	case event := <-events:
+		if event.Type != EventQualityRestored || event.Quality < QualityRestoredScore {
+			t.Fatalf("unexpected event %v, quality %d", event.Type, event.Quality)
+		}
+	default:
+		t.Fatal("no restored event")
+	}
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected event %v", event.Type)
+	default:
+	}
+
+	// an unreachable peer scores zero
+
+	peer.unreachable.Set(true)
+	if quality, _ := peer.Quality(); quality.Score != 0 {
+		t.Fatalf("unreachable peer scored %d", quality.Score)
+	}
+}
+
+func TestQualityRTTPenalty(t *testing.T) {
+	var state qualityState
+	for _, test := range []struct {
+		rtt   time.Duration
+		score int
+	}{
+		{QualityRTTGood, 100},
+		{(QualityRTTGood + QualityRTTBad) / 2, 90},
+		{QualityRTTBad, 80},
+		{10 * QualityRTTBad, 80},
+	} {
+		state.rtt = test.rtt
+		if score := state.score(false); score != test.score {
+			t.Errorf("rtt %v scored %d, expected %d", test.rtt, score, test.score)
+		}
+	}
+}
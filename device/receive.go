@@ -17,6 +17,7 @@ import (
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
+	"golang.zx2c4.com/wireguard/turn"
 )
 
 type QueueHandshakeElement struct {
@@ -24,6 +25,7 @@ type QueueHandshakeElement struct {
 	packet   []byte
 	endpoint Endpoint
 	buffer   *[MaxMessageSize]byte
+	control  bool // received on the control port
 }
 
 type QueueInboundElement struct {
@@ -53,10 +55,12 @@ func (device *Device) addToInboundAndDecryptionQueues(inboundQueue chan *QueueIn
 		default:
 			element.Drop()
 			element.Unlock()
+			device.countDrop(QueueDecryption, DropQueueFull)
 			return false
 		}
 	default:
 		device.PutInboundElement(element)
+		device.countDrop(QueueInbound, DropQueueFull)
 		return false
 	}
 }
@@ -66,6 +70,7 @@ func (device *Device) addToHandshakeQueue(queue chan QueueHandshakeElement, elem
 	case queue <- element:
 		return true
 	default:
+		device.countDrop(QueueHandshake, DropQueueFull)
 		return false
 	}
 }
@@ -90,7 +95,10 @@ func (peer *Peer) keepKeyFreshReceiving() {
  * Every time the bind is updated a new routine is started for
  * IPv4 and IPv6 (separately)
  */
-func (device *Device) RoutineReceiveIncoming(IP int, bind Bind) {
+/* Receives datagrams from the bind,
+ * a control bind only accepts handshake messages
+ */
+func (device *Device) RoutineReceiveIncoming(IP int, bind Bind, control bool) {
 
 	logDebug := device.log.Debug
 	defer func() {
@@ -146,6 +154,10 @@ func (device *Device) RoutineReceiveIncoming(IP int, bind Bind) {
 
 		case MessageTransportType:
 
+			if control {
+				continue
+			}
+
 			// check size
 
 			if len(packet) < MessageTransportSize {
@@ -184,7 +196,7 @@ func (device *Device) RoutineReceiveIncoming(IP int, bind Bind) {
 			// add to decryption queues
 
 			if peer.isRunning.Get() {
-				if device.addToInboundAndDecryptionQueues(peer.queue.inbound, device.queue.decryption, elem) {
+				if device.addToInboundAndDecryptionQueues(peer.queue.inbound, device.decryptionQueue(packet), elem) {
 					buffer = device.GetMessageBuffer()
 				}
 			}
@@ -195,14 +207,32 @@ func (device *Device) RoutineReceiveIncoming(IP int, bind Bind) {
 
 		case MessageInitiationType:
 			okay = len(packet) == MessageInitiationSize
+			if okay && !device.allowHandshakeSource(endpoint) {
+				logDebug.Println("Dropping handshake initiation from disallowed source", endpoint.DstToString())
+				continue
+			}
 
 		case MessageResponseType:
 			okay = len(packet) == MessageResponseSize
 
+		case MessageResumeInitiationType:
+			okay = experimentalResumption && len(packet) == MessageResumeInitiationSize
+			if okay && !device.allowHandshakeSource(endpoint) {
+				logDebug.Println("Dropping resume initiation from disallowed source", endpoint.DstToString())
+				continue
+			}
+
+		case MessageResumeResponseType:
+			okay = experimentalResumption && len(packet) == MessageResumeResponseSize
+
 		case MessageCookieReplyType:
 			okay = len(packet) == MessageCookieReplySize
 
 		default:
+			if turn.IsMessage(packet) {
+				device.handleSTUN(packet)
+				continue
+			}
 			logDebug.Println("Received message with unknown type")
 		}
 
@@ -214,6 +244,7 @@ func (device *Device) RoutineReceiveIncoming(IP int, bind Bind) {
 					buffer:   buffer,
 					packet:   packet,
 					endpoint: endpoint,
+					control:  control,
 				},
 			)) {
 				buffer = device.GetMessageBuffer()
@@ -222,7 +253,22 @@ func (device *Device) RoutineReceiveIncoming(IP int, bind Bind) {
 	}
 }
 
-func (device *Device) RoutineDecryption() {
+/* Returns the decryption queue of a worker for a transport packet.
+ *
+ * The queue is chosen by receiver index, so that the packets of one
+ * session are decrypted by a single worker in order, while the sessions
+ * of different peers run in parallel without contending for a single
+ * shared queue.
+ */
+func (device *Device) decryptionQueue(packet []byte) chan *QueueInboundElement {
+	receiver := binary.LittleEndian.Uint32(packet[MessageTransportOffsetReceiver:MessageTransportOffsetCounter])
+	return device.queue.decryption[receiver%uint32(len(device.queue.decryption))]
+}
+
+/* Decrypts the packets of a decryption queue, one at a time, as
+ * cipher.AEAD offers no batching across packets
+ */
+func (device *Device) RoutineDecryption(queue chan *QueueInboundElement) {
 
 	var nonce [chacha20poly1305.NonceSize]byte
 
@@ -239,7 +285,7 @@ func (device *Device) RoutineDecryption() {
 		case <-device.signals.stop:
 			return
 
-		case elem, ok := <-device.queue.decryption:
+		case elem, ok := <-queue:
 
 			if !ok {
 				return
@@ -383,10 +429,20 @@ func (device *Device) RoutineHandshake() {
 				// check ratelimiter
 
 				if !device.rate.limiter.Allow(elem.endpoint.DstIP()) {
+					device.countDrop(QueueHandshake, DropRatelimited)
 					continue
 				}
 			}
 
+		case MessageResumeInitiationType, MessageResumeResponseType:
+
+			// authenticated by the resumption secret, only ratelimit
+
+			if device.IsUnderLoad() && !device.rate.limiter.Allow(elem.endpoint.DstIP()) {
+				device.countDrop(QueueHandshake, DropRatelimited)
+				continue
+			}
+
 		default:
 			logError.Println("Invalid packet ended up in the handshake queue")
 			continue
@@ -409,7 +465,7 @@ func (device *Device) RoutineHandshake() {
 
 			// consume initiation
 
-			peer := device.ConsumeMessageInitiation(&msg)
+			peer, refused := device.consumeMessageInitiation(&msg)
 			if peer == nil {
 				logInfo.Println(
 					"Received invalid initiation message from",
@@ -418,16 +474,27 @@ func (device *Device) RoutineHandshake() {
 				continue
 			}
 
+			if refused {
+				logDebug.Println(peer, "- Refusing handshake initiation in maintenance mode")
+				device.refuseInitiation(&elem)
+				continue
+			}
+
 			// update timers
 
 			peer.timersAnyAuthenticatedPacketTraversal()
 			peer.timersAnyAuthenticatedPacketReceived()
 
 			// update endpoint
-			peer.SetEndpointFromPacket(elem.endpoint)
+			if elem.control {
+				peer.SetControlEndpointFromPacket(elem.endpoint)
+			} else {
+				peer.SetEndpointFromHandshake(elem.endpoint)
+			}
 
 			logDebug.Println(peer, "- Received handshake initiation")
 			atomic.AddUint64(&peer.stats.rxBytes, uint64(len(elem.packet)))
+			atomic.AddUint64(&peer.stats.rxPackets, 1)
 
 			peer.SendHandshakeResponse()
 
@@ -455,10 +522,15 @@ func (device *Device) RoutineHandshake() {
 			}
 
 			// update endpoint
-			peer.SetEndpointFromPacket(elem.endpoint)
+			if elem.control {
+				peer.SetControlEndpointFromPacket(elem.endpoint)
+			} else {
+				peer.SetEndpointFromHandshake(elem.endpoint)
+			}
 
 			logDebug.Println(peer, "- Received handshake response")
 			atomic.AddUint64(&peer.stats.rxBytes, uint64(len(elem.packet)))
+			atomic.AddUint64(&peer.stats.rxPackets, 1)
 
 			// update timers
 
@@ -476,11 +548,23 @@ func (device *Device) RoutineHandshake() {
 
 			peer.timersSessionDerived()
 			peer.timersHandshakeComplete()
+			peer.qualityResponseReceived()
+			peer.eventHandshakeComplete(true)
 			peer.SendKeepalive()
+			peer.sendResumptionTicket()
 			select {
 			case peer.signals.newKeypairArrived <- struct{}{}:
 			default:
 			}
+
+		case MessageResumeInitiationType:
+			if device.maintenance.active.Get() {
+				continue
+			}
+			device.consumeResumeInitiation(&elem)
+
+		case MessageResumeResponseType:
+			device.consumeResumeResponse(&elem)
 		}
 	}
 }
@@ -488,7 +572,6 @@ func (device *Device) RoutineHandshake() {
 func (peer *Peer) RoutineSequentialReceiver() {
 
 	device := peer.device
-	logInfo := device.log.Info
 	logError := device.log.Error
 	logDebug := device.log.Debug
 
@@ -548,6 +631,8 @@ func (peer *Peer) RoutineSequentialReceiver() {
 		// check if using new keypair
 		if peer.ReceivedWithKeypair(elem.keypair) {
 			peer.timersHandshakeComplete()
+			peer.eventHandshakeComplete(false)
+			peer.sendResumptionTicket()
 			select {
 			case peer.signals.newKeypairArrived <- struct{}{}:
 			default:
@@ -558,6 +643,7 @@ func (peer *Peer) RoutineSequentialReceiver() {
 		peer.timersAnyAuthenticatedPacketTraversal()
 		peer.timersAnyAuthenticatedPacketReceived()
 		atomic.AddUint64(&peer.stats.rxBytes, uint64(len(elem.packet)+MinMessageSize))
+		atomic.AddUint64(&peer.stats.rxPackets, 1)
 
 		// check for keepalive
 
@@ -567,68 +653,33 @@ func (peer *Peer) RoutineSequentialReceiver() {
 		}
 		peer.timersDataReceived()
 
-		// verify source and strip padding
+		// in-tunnel messages of the implementation
 
 		switch elem.packet[0] >> 4 {
-		case ipv4.Version:
-
-			// strip padding
-
-			if len(elem.packet) < ipv4.HeaderLen {
-				continue
-			}
-
-			field := elem.packet[IPv4offsetTotalLength : IPv4offsetTotalLength+2]
-			length := binary.BigEndian.Uint16(field)
-			if int(length) > len(elem.packet) || int(length) < ipv4.HeaderLen {
-				continue
-			}
-
-			elem.packet = elem.packet[:length]
-
-			// verify IPv4 source
-
-			src := elem.packet[IPv4offsetSrc : IPv4offsetSrc+net.IPv4len]
-			if device.allowedips.LookupIPv4(src) != peer {
-				logInfo.Println(
-					"IPv4 packet with disallowed source address from",
-					peer,
-				)
-				continue
-			}
-
-		case ipv6.Version:
-
-			// strip padding
-
-			if len(elem.packet) < ipv6.HeaderLen {
-				continue
-			}
-
-			field := elem.packet[IPv6offsetPayloadLength : IPv6offsetPayloadLength+2]
-			length := binary.BigEndian.Uint16(field)
-			length += ipv6.HeaderLen
-			if int(length) > len(elem.packet) {
-				continue
-			}
+		case gossipVersion:
+			device.handleGossip(peer, elem.packet)
+			continue
 
-			elem.packet = elem.packet[:length]
+		case selftestVersion:
+			device.handleSelfTest(peer, elem.packet)
+			continue
 
-			// verify IPv6 source
+		case resumptionVersion:
+			device.handleResumption(peer, elem.packet)
+			continue
+		}
 
-			src := elem.packet[IPv6offsetSrc : IPv6offsetSrc+net.IPv6len]
-			if device.allowedips.LookupIPv6(src) != peer {
-				logInfo.Println(
-					"IPv6 packet with disallowed source address from",
-					peer,
-				)
-				continue
-			}
+		// verify source and strip padding
 
-		default:
-			logInfo.Println("Packet with invalid IP version from", peer)
+		packet, ok := peer.validateInbound(elem.packet)
+		if !ok {
 			continue
 		}
+		elem.packet = packet
+
+		peer.countMatches(elem.packet)
+		peer.countFlow(elem.packet, flowIngress)
+		peer.mirrorPacket(elem.packet)
 
 		// write to tun device
 
@@ -645,3 +696,85 @@ func (peer *Peer) RoutineSequentialReceiver() {
 		}
 	}
 }
+
+/* Strips the padding of an IP packet received from the peer, verifies
+ * its source and applies the inbound policies of the device, returning
+ * false if the packet is to be dropped
+ */
+func (peer *Peer) validateInbound(packet []byte) ([]byte, bool) {
+	device := peer.device
+
+	switch packet[0] >> 4 {
+	case ipv4.Version:
+
+		// strip padding
+
+		if len(packet) < ipv4.HeaderLen {
+			return nil, false
+		}
+
+		field := packet[IPv4offsetTotalLength : IPv4offsetTotalLength+2]
+		length := binary.BigEndian.Uint16(field)
+		if int(length) > len(packet) || int(length) < ipv4.HeaderLen {
+			return nil, false
+		}
+
+		packet = packet[:length]
+		peer.netmapInbound(packet)
+
+		// verify IPv4 source
+
+		src := packet[IPv4offsetSrc : IPv4offsetSrc+net.IPv4len]
+		if device.allowedips.LookupIPv4(src) != peer {
+			device.log.Info.Println(
+				"IPv4 packet with disallowed source address from",
+				peer,
+			)
+			return nil, false
+		}
+
+	case ipv6.Version:
+
+		// strip padding
+
+		if len(packet) < ipv6.HeaderLen {
+			return nil, false
+		}
+
+		field := packet[IPv6offsetPayloadLength : IPv6offsetPayloadLength+2]
+		length := binary.BigEndian.Uint16(field)
+		length += ipv6.HeaderLen
+		if int(length) > len(packet) {
+			return nil, false
+		}
+
+		packet = packet[:length]
+		peer.netmapInbound(packet)
+
+		// verify IPv6 source
+
+		src := packet[IPv6offsetSrc : IPv6offsetSrc+net.IPv6len]
+		if device.allowedips.LookupIPv6(src) != peer {
+			device.log.Info.Println(
+				"IPv6 packet with disallowed source address from",
+				peer,
+			)
+			return nil, false
+		}
+
+	default:
+		device.log.Info.Println("Packet with invalid IP version from", peer)
+		return nil, false
+	}
+
+	// apply ip options policy
+
+	packet, ok := device.sanitizeInbound(packet)
+	if !ok {
+		device.log.Debug.Println("Dropping packet with disallowed ip options from", peer)
+		return nil, false
+	}
+
+	device.clampMSS(packet)
+	return packet, true
+}
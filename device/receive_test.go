@@ -0,0 +1,42 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestDecryptionQueueSharding(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	queues := len(device.queue.decryption)
+	queueOf := func(receiver uint32, counter uint64) chan *QueueInboundElement {
+		packet := make([]byte, MessageTransportSize)
+		binary.LittleEndian.PutUint32(packet[MessageTransportOffsetReceiver:], receiver)
+		binary.LittleEndian.PutUint64(packet[MessageTransportOffsetCounter:], counter)
+		return device.decryptionQueue(packet)
+	}
+
+	// consecutive packets of one receiver stay in one queue
+
+	for i := 0; i < queues+1; i++ {
+		if queueOf(7, uint64(i)) != queueOf(7, 0) {
+			t.Fatalf("packet %d of a session in another queue", i)
+		}
+	}
+
+	// different receivers use all queues
+
+	used := make(map[chan *QueueInboundElement]bool)
+	for i := 0; i < queues; i++ {
+		used[queueOf(uint32(i), 9)] = true
+	}
+	if len(used) != queues {
+		t.Fatalf("%d of %d queues used", len(used), queues)
+	}
+}
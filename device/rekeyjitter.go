@@ -0,0 +1,85 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+/* Rekey jitter
+ *
+ * Peers provisioned at the same moment complete their first handshakes
+ * together, and would then rekey together every RekeyAfterTime, in
+ * periodic spikes of handshake work. With a rekey jitter, each session
+ * initiated rekeys after RekeyAfterTime less a random delay of up to the
+ * jitter, drawn anew for every session, so that the rekeys of such
+ * peers spread out within a few cycles. Rekeying only ever happens
+ * earlier, so sessions still never outlive RejectAfterTime.
+ *
+ * The jitter is set for the device with rekey_jitter_ms, and may be
+ * overridden for a peer with its own rekey_jitter_ms, an empty value
+ * reverting to that of the device.
+ */
+
+const (
+	MaxRekeyJitter = RekeyAfterTime / 2
+)
+
+/* Sets the maximum rekey jitter of peers without one of their own
+ */
+func (device *Device) SetRekeyJitter(jitter time.Duration) {
+	if jitter > MaxRekeyJitter {
+		jitter = MaxRekeyJitter
+	}
+	atomic.StoreUint32(&device.rekeyJitterMs, uint32(jitter/time.Millisecond))
+}
+
+func (device *Device) RekeyJitter() time.Duration {
+	return time.Duration(atomic.LoadUint32(&device.rekeyJitterMs)) * time.Millisecond
+}
+
+/* Sets the maximum rekey jitter of the peer, negative to use that of
+ * the device
+ */
+func (peer *Peer) SetRekeyJitter(jitter time.Duration) {
+	if jitter > MaxRekeyJitter {
+		jitter = MaxRekeyJitter
+	}
+	ms := int32(-1)
+	if jitter >= 0 {
+		ms = int32(jitter / time.Millisecond)
+	}
+	atomic.StoreInt32(&peer.rekeyJitterMs, ms)
+}
+
+/* Returns the rekey jitter of the peer, and whether it is its own
+ */
+func (peer *Peer) RekeyJitter() (time.Duration, bool) {
+	ms := atomic.LoadInt32(&peer.rekeyJitterMs)
+	if ms < 0 {
+		return peer.device.RekeyJitter(), false
+	}
+	return time.Duration(ms) * time.Millisecond, true
+}
+
+/* Returns the age at which a new session should be rekeyed
+ */
+func (peer *Peer) rekeyAfterTime() time.Duration {
+	jitter, _ := peer.RekeyJitter()
+	if jitter <= 0 {
+		return RekeyAfterTime
+	}
+	return RekeyAfterTime - time.Duration(rand.Int63n(int64(jitter)+1))
+}
+
+func (keypair *Keypair) rekeyAfterTime() time.Duration {
+	if keypair.rekeyAfter == 0 {
+		return RekeyAfterTime
+	}
+	return keypair.rekeyAfter
+}
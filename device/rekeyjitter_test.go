@@ -0,0 +1,75 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRekeyJitter(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	sk, _ := newPrivateKey()
+	peer, err := device.NewPeer(sk.publicKey())
+	assertNil(t, err)
+
+	if after := peer.rekeyAfterTime(); after != RekeyAfterTime {
+		t.Fatalf("rekey after %v without jitter", after)
+	}
+	if after := new(Keypair).rekeyAfterTime(); after != RekeyAfterTime {
+		t.Fatalf("keypair without schedule rekeys after %v", after)
+	}
+
+	if err := ipcSet(device, "rekey_jitter_ms=10000\n"); err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		after := peer.rekeyAfterTime()
+		if after > RekeyAfterTime || after < RekeyAfterTime-10*time.Second {
+			t.Fatalf("rekey after %v outside of jitter", after)
+		}
+		seen[after] = true
+	}
+	if len(seen) < 2 {
+		t.Fatal("rekey times not spread")
+	}
+
+	// a peer may override the jitter of the device
+
+	pk := "public_key=" + peer.handshake.remoteStatic.ToHex() + "\n"
+	if err := ipcSet(device, pk+"rekey_jitter_ms=0\n"); err != nil {
+		t.Fatal(err)
+	}
+	if after := peer.rekeyAfterTime(); after != RekeyAfterTime {
+		t.Fatalf("rekey after %v with jitter disabled for peer", after)
+	}
+
+	var buf strings.Builder
+	writer := bufio.NewWriter(&buf)
+	if err := device.IpcGetOperation(writer); err != nil {
+		t.Fatal(err)
+	}
+	writer.Flush()
+	if strings.Count(buf.String(), "rekey_jitter_ms=") != 2 || !strings.Contains(buf.String(), "rekey_jitter_ms=10000\n") {
+		t.Fatalf("unexpected get:\n%s", buf.String())
+	}
+
+	if err := ipcSet(device, pk+"rekey_jitter_ms=\n"); err != nil {
+		t.Fatal(err)
+	}
+	if jitter, own := peer.RekeyJitter(); own || jitter != 10*time.Second {
+		t.Fatalf("peer jitter %v, own %v after reverting", jitter, own)
+	}
+
+	if err := ipcSet(device, "rekey_jitter_ms=60001\n"); err == nil {
+		t.Fatal("jitter above maximum accepted")
+	}
+}
@@ -0,0 +1,267 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/base64"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/relay"
+)
+
+/* Relay fallback
+ *
+ * When a relay, or a TURN server (see turn.go), is configured,
+ * a peer is switched to the relay once
+ * RelayFallbackAttempts handshake initiations went unanswered, or when
+ * the peer itself sends through the relay. While relayed, handshake
+ * initiations are still sent directly as well, and the peer switches
+ * back as soon as an authenticated packet arrives directly.
+ */
+
+const (
+	RelayFallbackAttempts = 2
+	RelayRedialTimeout    = 5 * time.Second
+)
+
+type RelayEndpoint struct {
+	key NoisePublicKey
+}
+
+var _ Endpoint = (*RelayEndpoint)(nil)
+
+func (end *RelayEndpoint) ClearSrc()           {}
+func (end *RelayEndpoint) SrcToString() string { return "" }
+func (end *RelayEndpoint) DstIP() net.IP       { return nil }
+func (end *RelayEndpoint) SrcIP() net.IP       { return nil }
+func (end *RelayEndpoint) DstToBytes() []byte  { return end.key[:] }
+
+func (end *RelayEndpoint) DstToString() string {
+	return "relay:" + base64.StdEncoding.EncodeToString(end.key[:])
+}
+
+/* A relayBind receives from the relay on the IPv4 routine,
+ * redialing whenever the connection to the relay is lost. Dialing
+ * runs on its own routine, so that closing the bind does not wait
+ * for a dial to time out.
+ */
+type relayBind struct {
+	device    *Device
+	address   string
+	secret    relay.Key
+	closed    chan struct{}
+	redial    chan struct{} // requests a connection from RoutineDial
+	connected chan struct{} // signals a new connection
+	dialing   sync.Once
+
+	sync.RWMutex
+	client *relay.Client
+}
+
+var _ Bind = (*relayBind)(nil)
+
+func newRelayBind(device *Device, address string, secret relay.Key) *relayBind {
+	return &relayBind{
+		device:    device,
+		address:   address,
+		secret:    secret,
+		closed:    make(chan struct{}),
+		redial:    make(chan struct{}, 1),
+		connected: make(chan struct{}, 1),
+	}
+}
+
+func (bind *relayBind) connect() (*relay.Client, error) {
+	for {
+		bind.device.staticIdentity.RLock()
+		publicKey := relay.Key(bind.device.staticIdentity.publicKey)
+		bind.device.staticIdentity.RUnlock()
+
+		client, err := relay.Dial(bind.address, &publicKey, &bind.secret)
+		if err == nil {
+			bind.Lock()
+			select {
+			case <-bind.closed:
+				bind.Unlock()
+				client.Close()
+				return nil, errors.New("relay closed")
+			default:
+			}
+			bind.client = client
+			bind.Unlock()
+			bind.device.log.Info.Println("Connected to relay", bind.address)
+			return client, nil
+		}
+		bind.device.log.Error.Println("Failed to connect to relay", bind.address, "-", err)
+
+		select {
+		case <-bind.closed:
+			return nil, errors.New("relay closed")
+		case <-time.After(RelayRedialTimeout):
+		}
+	}
+}
+
+/* Dials the relay whenever a connection is requested
+ */
+func (bind *relayBind) RoutineDial() {
+	for {
+		select {
+		case <-bind.closed:
+			return
+		case <-bind.redial:
+		}
+		if _, err := bind.connect(); err != nil {
+			return
+		}
+		select {
+		case bind.connected <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (bind *relayBind) ReceiveIPv4(buff []byte) (int, Endpoint, error) {
+	for {
+		bind.RLock()
+		client := bind.client
+		bind.RUnlock()
+
+		if client == nil {
+			bind.dialing.Do(func() {
+				go bind.RoutineDial()
+			})
+			select {
+			case bind.redial <- struct{}{}:
+			default:
+			}
+			select {
+			case <-bind.closed:
+				return 0, nil, errors.New("relay closed")
+			case <-bind.connected:
+			}
+			continue
+		}
+
+		size, key, err := client.Receive(buff)
+		if err == nil {
+			return size, &RelayEndpoint{key: NoisePublicKey(key)}, nil
+		}
+
+		client.Close()
+		bind.Lock()
+		if bind.client == client {
+			bind.client = nil
+		}
+		bind.Unlock()
+
+		select {
+		case <-bind.closed:
+			return 0, nil, err
+		default:
+		}
+	}
+}
+
+func (bind *relayBind) ReceiveIPv6(buff []byte) (int, Endpoint, error) {
+	<-bind.closed
+	return 0, nil, errors.New("relay closed")
+}
+
+func (bind *relayBind) Send(buff []byte, end Endpoint) error {
+	nend, ok := end.(*RelayEndpoint)
+	if !ok {
+		return errors.New("not a relay endpoint")
+	}
+	bind.RLock()
+	client := bind.client
+	bind.RUnlock()
+	if client == nil {
+		return errors.New("not connected to relay")
+	}
+	key := relay.Key(nend.key)
+	return client.Send(&key, buff)
+}
+
+func (bind *relayBind) SetMark(mark uint32) error {
+	return nil
+}
+
+func (bind *relayBind) Close() error {
+	close(bind.closed)
+	bind.Lock()
+	defer bind.Unlock()
+	if bind.client != nil {
+		return bind.client.Close()
+	}
+	return nil
+}
+
+/* Changes the relay of the device, takes effect on the next BindUpdate.
+ * An empty address disables relaying.
+ */
+func (device *Device) SetRelay(address string, secret relay.Key) {
+	device.net.Lock()
+	device.net.relayAddress = address
+	device.net.relaySecret = secret
+	device.net.Unlock()
+}
+
+/* Returns the bind and endpoint for sending through the relay,
+ * or nil if the peer should be reached directly.
+ *
+ * Must hold device.net and peer read locks
+ */
+func (peer *Peer) relayDestination(endpoint Endpoint) (Bind, Endpoint) {
+	if endpoint != nil && !peer.relay.active.Get() {
+		return nil, nil
+	}
+	if bind := peer.device.net.relayBind; bind != nil {
+		return bind, &RelayEndpoint{key: peer.handshake.remoteStatic}
+	}
+	if bind := peer.device.net.turnBind; bind != nil && endpoint != nil {
+		if end := newTURNEndpoint(endpoint); end != nil {
+			return bind, end
+		}
+	}
+	return nil, nil
+}
+
+/* Returns the endpoint at which the sender of a relayed
+ * packet is reached directly, if known
+ */
+func directEndpoint(endpoint Endpoint) (Endpoint, bool) {
+	switch end := endpoint.(type) {
+	case *RelayEndpoint:
+		return nil, true
+	case *TURNEndpoint:
+		direct, err := CreateEndpoint(end.DstToString())
+		if err != nil {
+			return nil, true
+		}
+		return direct, true
+	}
+	return endpoint, false
+}
+
+/* Must hold device.net read lock
+ */
+func (device *Device) hasRelay() bool {
+	return device.net.relayBind != nil || device.net.turnBind != nil
+}
+
+func (peer *Peer) setRelayActive(active bool) {
+	if peer.relay.active.Swap(active) != active {
+		if active {
+			peer.device.log.Info.Println(peer, "- Falling back to relay")
+		} else {
+			peer.device.log.Info.Println(peer, "- Direct path restored, leaving relay")
+		}
+	}
+}
@@ -0,0 +1,145 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/relay"
+)
+
+func TestRelayBind(t *testing.T) {
+	secret := relay.Key{7}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assertNil(t, err)
+	defer listener.Close()
+	go relay.NewServer(&secret).Serve(listener)
+
+	device := randDevice(t)
+	defer device.Close()
+
+	bind := newRelayBind(device, listener.Addr().String(), secret)
+	defer bind.Close()
+	_, err = bind.connect()
+	assertNil(t, err)
+
+	remoteKey := relay.Key{9}
+	remote, err := relay.Dial(listener.Addr().String(), &remoteKey, &secret)
+	assertNil(t, err)
+	defer remote.Close()
+
+	// remote to device
+
+	device.staticIdentity.RLock()
+	localKey := relay.Key(device.staticIdentity.publicKey)
+	device.staticIdentity.RUnlock()
+
+	packet := []byte("relayed datagram")
+	assertNil(t, remote.Send(&localKey, packet))
+
+	var buff [MaxMessageSize]byte
+	size, endpoint, err := bind.ReceiveIPv4(buff[:])
+	assertNil(t, err)
+	assertEqual(t, buff[:size], packet)
+	relayEndpoint, ok := endpoint.(*RelayEndpoint)
+	if !ok || relayEndpoint.key != NoisePublicKey(remoteKey) {
+		t.Fatalf("unexpected endpoint %v", endpoint.DstToString())
+	}
+
+	// device to remote
+
+	assertNil(t, bind.Send(packet, endpoint))
+	size, src, err := remote.Receive(buff[:])
+	assertNil(t, err)
+	if src != localKey || !bytes.Equal(buff[:size], packet) {
+		t.Fatalf("received %q from %x", buff[:size], src)
+	}
+}
+
+func TestRelayBindClose(t *testing.T) {
+
+	// a relay accepting connections but never answering
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assertNil(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	device := randDevice(t)
+	defer device.Close()
+
+	bind := newRelayBind(device, listener.Addr().String(), relay.Key{})
+	received := make(chan error)
+	go func() {
+		var buff [MaxMessageSize]byte
+		_, _, err := bind.ReceiveIPv4(buff[:])
+		received <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	bind.Close()
+	select {
+	case err := <-received:
+		if err == nil {
+			t.Fatal("received from closed relay")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("closing waited for the relay dial")
+	}
+}
+
+func TestRelayDestination(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	peer := &Peer{device: device}
+	endpoint, err := CreateEndpoint("192.0.2.1:51820")
+	assertNil(t, err)
+
+	// direct while not relayed, or without any relay
+
+	if bind, _ := peer.relayDestination(endpoint); bind != nil {
+		t.Fatal("expected direct path without relay")
+	}
+	peer.relay.active.Set(true)
+	if bind, _ := peer.relayDestination(endpoint); bind != nil {
+		t.Fatal("expected direct path without relay")
+	}
+
+	// through TURN to the same address
+
+	device.net.turnBind = newTURNBind(device, "192.0.2.2:3478", "user", "pass")
+	bind, end := peer.relayDestination(endpoint)
+	if bind != device.net.turnBind || end.DstToString() != endpoint.DstToString() {
+		t.Fatalf("expected turn endpoint, got %v", end)
+	}
+
+	// the relay takes precedence
+
+	device.net.relayBind = newRelayBind(device, "192.0.2.3:443", relay.Key{})
+	bind, end = peer.relayDestination(endpoint)
+	if bind != device.net.relayBind {
+		t.Fatalf("expected relay endpoint, got %v", end)
+	}
+	device.net.relayBind, device.net.turnBind = nil, nil
+
+	// relayed packets switch the peer to the relay
+
+	direct, relayed := directEndpoint(&TURNEndpoint{addr: net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 51820}})
+	if !relayed || direct.DstToString() != endpoint.DstToString() {
+		t.Fatalf("unexpected direct endpoint %v", direct)
+	}
+}
@@ -0,0 +1,119 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+/* Host name resolution
+ *
+ * Host names given where the device needs an address are resolved with
+ * the resolver of the device: endpoints set over UAPI, which may then be
+ * host:port, STUN servers, the HA partner, the flow and mirror
+ * collectors, and the name used for NAT64 discovery. The resolver is
+ * net.DefaultResolver unless an embedder supplies another with
+ * SetResolver or WithResolver, such as a *net.Resolver whose Dial sends
+ * queries over DoH through an established tunnel, or one bound to a
+ * network on Android, so that resolution need not traverse the tunnel
+ * that is not up yet.
+ */
+
+const (
+	ResolveTimeout = time.Second * 10
+)
+
+/* Satisfied by *net.Resolver
+ */
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+/* Sets the resolver of host names, nil for net.DefaultResolver
+ */
+func (device *Device) SetResolver(resolver Resolver) {
+	device.resolver.Lock()
+	defer device.resolver.Unlock()
+	device.resolver.resolver = resolver
+}
+
+func (device *Device) Resolver() Resolver {
+	device.resolver.RLock()
+	defer device.resolver.RUnlock()
+	if device.resolver.resolver == nil {
+		return net.DefaultResolver
+	}
+	return device.resolver.resolver
+}
+
+func (device *Device) lookupIP(host string) ([]net.IP, error) {
+	return lookupIP(device.Resolver(), host)
+}
+
+func lookupIP(resolver Resolver, host string) ([]net.IP, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ResolveTimeout)
+	defer cancel()
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips, nil
+}
+
+/* Resolves host:port to a UDP address, preferring IPv4 as
+ * net.ResolveUDPAddr does. IP addresses are never looked up.
+ */
+func (device *Device) resolveUDPAddr(address string) (*net.UDPAddr, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	literal := host
+	if i := strings.LastIndexByte(literal, '%'); i > 0 && strings.IndexByte(literal, ':') >= 0 {
+		literal = literal[:i]
+	}
+	if host == "" || net.ParseIP(literal) != nil {
+		return net.ResolveUDPAddr("udp", address)
+	}
+
+	portNumber, err := net.LookupPort("udp", port)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := device.lookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, errors.New("no addresses found for " + host)
+	}
+	ip := ips[0]
+	for _, candidate := range ips {
+		if ipv4 := candidate.To4(); ipv4 != nil {
+			ip = ipv4
+			break
+		}
+	}
+	return &net.UDPAddr{IP: ip, Port: portNumber}, nil
+}
+
+/* Creates an endpoint from host:port, resolving the host if it is a name
+ */
+func (device *Device) createEndpoint(address string) (Endpoint, error) {
+	addr, err := device.resolveUDPAddr(address)
+	if err != nil {
+		return nil, err
+	}
+	return CreateEndpoint(addr.String())
+}
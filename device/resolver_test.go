@@ -0,0 +1,68 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+type testResolver map[string][]net.IPAddr
+
+func (resolver testResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addrs, ok := resolver[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	return addrs, nil
+}
+
+func TestResolver(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	if device.Resolver() != net.DefaultResolver {
+		t.Fatal("default resolver not net.DefaultResolver")
+	}
+	device.SetResolver(testResolver{
+		"vpn.example": {{IP: net.ParseIP("2001:db8::1")}, {IP: net.IPv4(192, 0, 2, 1)}},
+		"v6.example":  {{IP: net.ParseIP("2001:db8::2")}},
+	})
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	peer, err := device.NewPeer(sk.publicKey())
+	assertNil(t, err)
+
+	for _, test := range []struct {
+		endpoint, expected string
+	}{
+		{"vpn.example:51820", "192.0.2.1:51820"},
+		{"v6.example:51820", "[2001:db8::2]:51820"},
+		{"198.51.100.7:1234", "198.51.100.7:1234"},
+	} {
+		if err := ipcSet(device, "public_key="+sk.publicKey().ToHex()+"\nendpoint="+test.endpoint+"\n"); err != nil {
+			t.Fatalf("%s: %v", test.endpoint, err)
+		}
+		peer.RLock()
+		got := peer.endpoint.DstToString()
+		peer.RUnlock()
+		if got != test.expected {
+			t.Fatalf("%s: endpoint %s, expected %s", test.endpoint, got, test.expected)
+		}
+	}
+
+	if ipcSet(device, "public_key="+sk.publicKey().ToHex()+"\nendpoint=unknown.example:51820\n") == nil {
+		t.Fatal("endpoint of unknown host accepted")
+	}
+
+	device.SetResolver(nil)
+	if device.Resolver() != net.DefaultResolver {
+		t.Fatal("resolver not reset to net.DefaultResolver")
+	}
+}
@@ -0,0 +1,448 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+)
+
+/* Session resumption
+ *
+ * Mobile peers reconnecting after a network switch or a suspended
+ * tunnel pay for a full handshake, four Diffie-Hellman operations on
+ * either side. When both sides enable resumption for each other, every
+ * session established by a full handshake also yields a resumption
+ * secret derived from its chain key, and a ticket identifying it. Each
+ * side announces inside the tunnel that it holds the ticket:
+ *
+ *   marker (1) | reserved (3) | ticket (8)
+ *
+ * A peer holding a ticket announced by the other side, and without a
+ * live session, may then first try an abbreviated handshake of two
+ * messages authenticated by the secret, instead of an initiation:
+ *
+ *   resume initiation: type (4) | sender (4) | ticket (8) | random (16) | mac (16)
+ *   resume response:   type (4) | sender (4) | receiver (4) | random (16) | mac (16)
+ *
+ * The keys of the resumed session derive from the secret and both
+ * randoms. Tickets are single-use, expire after ResumptionTicketLifetime
+ * and are not issued for resumed sessions, so that the next rekey runs a
+ * full handshake again and forward secrecy is only deferred. A peer
+ * ignoring the resume initiation, as one without resumption does, is
+ * answered by the usual retransmission, which is a full handshake.
+ *
+ * Resumption is an experimental extension of the protocol: resumed
+ * sessions are keyed without a fresh Diffie-Hellman exchange, and the
+ * messages are not understood by other implementations. Peers may only
+ * enable it in builds with the experimental_resumption tag, see
+ * resumption_default.go.
+ *
+ * Over UAPI resumption is enabled for a peer with resumption=true.
+ */
+
+const (
+	ResumptionTicketLifetime = RejectAfterTime * 3
+)
+
+const (
+	MessageResumeInitiationType = 5
+	MessageResumeResponseType   = 6
+	MessageResumeInitiationSize = 48
+	MessageResumeResponseSize   = 44
+)
+
+const (
+	resumptionVersion      = 3
+	resumptionTicketSize   = 8
+	resumptionRandomSize   = 16
+	resumptionAnnounceSize = 4 + resumptionTicketSize
+	resumptionLabelSecret  = "resume--"
+	resumptionLabelTicket  = "ticket--"
+
+	handshakeResumeCreated = HandshakeResponseConsumed + 1
+)
+
+type resumptionTicket [resumptionTicketSize]byte
+
+type resumptionState struct {
+	sync.Mutex
+	enabled bool
+	valid   bool // a ticket is held and unused
+	ready   bool // the peer announced holding the ticket
+	secret  [blake2s.Size]byte
+	ticket  resumptionTicket
+	created time.Time
+
+	// the handshake derives from the ticket, protected by the handshake lock
+	handshakeResumed bool
+
+	// of the resume initiation awaiting its response
+	pendingSecret [blake2s.Size]byte
+	pendingRandom [resumptionRandomSize]byte
+}
+
+func resumptionMAC(dst *[blake2s.Size128]byte, secret *[blake2s.Size]byte, parts ...[]byte) {
+	mac, _ := blake2s.New128(secret[:])
+	for _, part := range parts {
+		mac.Write(part)
+	}
+	mac.Sum(dst[:0])
+}
+
+var errResumptionDisabled = errors.New("experimental resumption not built in")
+
+func (peer *Peer) SetResumption(enabled bool) error {
+	if enabled && !experimentalResumption {
+		return errResumptionDisabled
+	}
+	peer.resumption.Lock()
+	defer peer.resumption.Unlock()
+	peer.resumption.enabled = enabled
+	if !enabled {
+		peer.dropResumptionTicketLocked()
+	}
+	return nil
+}
+
+func (peer *Peer) Resumption() bool {
+	peer.resumption.Lock()
+	defer peer.resumption.Unlock()
+	return peer.resumption.enabled
+}
+
+/* Returns the number of sessions resumed with the peer
+ */
+func (peer *Peer) ResumedSessions() uint64 {
+	return atomic.LoadUint64(&peer.stats.resumedSessions)
+}
+
+func (peer *Peer) dropResumptionTicket() {
+	peer.resumption.Lock()
+	defer peer.resumption.Unlock()
+	peer.dropResumptionTicketLocked()
+}
+
+func (peer *Peer) dropResumptionTicketLocked() {
+	state := &peer.resumption
+	if !state.valid {
+		return
+	}
+	device := peer.device
+	device.resumption.Lock()
+	if device.resumption.tickets[state.ticket] == peer {
+		delete(device.resumption.tickets, state.ticket)
+	}
+	device.resumption.Unlock()
+	setZero(state.secret[:])
+	state.valid = false
+	state.ready = false
+}
+
+/* Derives the ticket of a session established by a full handshake.
+ *
+ * Must hold the handshake lock
+ */
+func (peer *Peer) issueResumptionTicket(chainKey *[blake2s.Size]byte) {
+	peer.resumption.Lock()
+	defer peer.resumption.Unlock()
+	state := &peer.resumption
+	if !state.enabled {
+		return
+	}
+	peer.dropResumptionTicketLocked()
+
+	var ticket [blake2s.Size]byte
+	KDF1(&state.secret, chainKey[:], []byte(resumptionLabelSecret))
+	KDF1(&ticket, state.secret[:], []byte(resumptionLabelTicket))
+	copy(state.ticket[:], ticket[:])
+	state.created = time.Now()
+	state.valid = true
+
+	device := peer.device
+	device.resumption.Lock()
+	if device.resumption.tickets == nil {
+		device.resumption.tickets = make(map[resumptionTicket]*Peer)
+	}
+	device.resumption.tickets[state.ticket] = peer
+	device.resumption.Unlock()
+}
+
+/* Tells the peer that the ticket of the current session is held, once
+ * the session is confirmed, so that the announcement is not encrypted
+ * with a previous session the peer may have lost
+ */
+func (peer *Peer) sendResumptionTicket() {
+	peer.resumption.Lock()
+	if !peer.resumption.valid {
+		peer.resumption.Unlock()
+		return
+	}
+	var msg [resumptionAnnounceSize]byte
+	msg[0] = resumptionVersion << 4
+	copy(msg[4:], peer.resumption.ticket[:])
+	peer.resumption.Unlock()
+
+	device := peer.device
+	elem := device.NewOutboundElement()
+	offset := MessageTransportHeaderSize
+	elem.packet = elem.buffer[offset : offset+copy(elem.buffer[offset:], msg[:])]
+	select {
+	case peer.queue.nonce <- elem:
+	default:
+		device.PutOutboundElement(elem)
+		device.countDrop(QueueNonce, DropQueueFull)
+	}
+}
+
+/* Called with the content of a ticket announcement received from the peer
+ */
+func (device *Device) handleResumption(peer *Peer, msg []byte) {
+	if len(msg) < resumptionAnnounceSize {
+		return
+	}
+	peer.resumption.Lock()
+	defer peer.resumption.Unlock()
+	if peer.resumption.valid && hmac.Equal(peer.resumption.ticket[:], msg[4:resumptionAnnounceSize]) {
+		peer.resumption.ready = true
+		device.log.Debug.Println(peer, "- Peer holds resumption ticket")
+	}
+}
+
+/* Returns a resume initiation in place of a handshake initiation, if the
+ * first attempt to reconnect with a ticket held by both sides, or nil
+ */
+func (peer *Peer) createResumptionPacket() []byte {
+	if atomic.LoadUint32(&peer.timers.handshakeAttempts) != 0 {
+		return nil
+	}
+	if keypair := peer.keypairs.Current(); keypair != nil && time.Since(keypair.created) < RejectAfterTime {
+		return nil
+	}
+
+	var (
+		ticket resumptionTicket
+		secret [blake2s.Size]byte
+		random [resumptionRandomSize]byte
+	)
+	if _, err := rand.Read(random[:]); err != nil {
+		return nil
+	}
+	state := &peer.resumption
+	state.Lock()
+	if !state.enabled || !state.valid || !state.ready || time.Since(state.created) > ResumptionTicketLifetime {
+		state.Unlock()
+		return nil
+	}
+	ticket = state.ticket
+	secret = state.secret
+	state.pendingSecret = secret
+	state.pendingRandom = random
+	peer.dropResumptionTicketLocked()
+	state.Unlock()
+	defer setZero(secret[:])
+
+	device := peer.device
+	handshake := &peer.handshake
+	handshake.mutex.Lock()
+	device.indexTable.Delete(handshake.localIndex)
+	index, err := device.indexTable.NewIndexForHandshake(peer, handshake)
+	if err != nil {
+		handshake.mutex.Unlock()
+		return nil
+	}
+	handshake.localIndex = index
+	setZero(handshake.chainKey[:])
+	handshake.state = handshakeResumeCreated
+	handshake.mutex.Unlock()
+
+	msg := make([]byte, MessageResumeInitiationSize)
+	binary.LittleEndian.PutUint32(msg[0:4], MessageResumeInitiationType)
+	binary.LittleEndian.PutUint32(msg[4:8], index)
+	copy(msg[8:16], ticket[:])
+	copy(msg[16:32], random[:])
+	var mac [blake2s.Size128]byte
+	resumptionMAC(&mac, &secret, msg[:32])
+	copy(msg[32:], mac[:])
+	return msg
+}
+
+/* Answers a resume initiation carrying a valid ticket
+ */
+func (device *Device) consumeResumeInitiation(elem *QueueHandshakeElement) {
+	msg := elem.packet
+	logDebug := device.log.Debug
+
+	var ticket resumptionTicket
+	copy(ticket[:], msg[8:16])
+	device.resumption.Lock()
+	peer := device.resumption.tickets[ticket]
+	device.resumption.Unlock()
+	if peer == nil || !peer.isRunning.Get() || peer.disabled.Get() {
+		logDebug.Println("Received resume initiation with unknown ticket from", elem.endpoint.DstToString())
+		return
+	}
+
+	// verify and use up the ticket
+
+	var secret [blake2s.Size]byte
+	ok := func() bool {
+		state := &peer.resumption
+		state.Lock()
+		defer state.Unlock()
+		if !state.valid || state.ticket != ticket || time.Since(state.created) > ResumptionTicketLifetime {
+			return false
+		}
+		var mac [blake2s.Size128]byte
+		resumptionMAC(&mac, &state.secret, msg[:32])
+		if !hmac.Equal(mac[:], msg[32:48]) {
+			return false
+		}
+		secret = state.secret
+		peer.dropResumptionTicketLocked()
+		return true
+	}()
+	if !ok {
+		logDebug.Println(peer, "- Received invalid resume initiation")
+		return
+	}
+
+	peer.timersAnyAuthenticatedPacketTraversal()
+	peer.timersAnyAuthenticatedPacketReceived()
+	if elem.control {
+		peer.SetControlEndpointFromPacket(elem.endpoint)
+	} else {
+		peer.SetEndpointFromHandshake(elem.endpoint)
+	}
+	logDebug.Println(peer, "- Received resume initiation")
+	atomic.AddUint64(&peer.stats.rxBytes, uint64(len(msg)))
+	atomic.AddUint64(&peer.stats.rxPackets, 1)
+
+	// derive the session as responder
+
+	response := make([]byte, MessageResumeResponseSize)
+	if _, err := rand.Read(response[12:28]); err != nil {
+		return
+	}
+	handshake := &peer.handshake
+	handshake.mutex.Lock()
+	if handshake.state != HandshakeZeroed {
+		// a handshake is in progress, which the initiator falls back to
+
+		handshake.mutex.Unlock()
+		logDebug.Println(peer, "- Refusing resume initiation during a handshake")
+		return
+	}
+	device.indexTable.Delete(handshake.localIndex)
+	index, err := device.indexTable.NewIndexForHandshake(peer, handshake)
+	if err != nil {
+		handshake.mutex.Unlock()
+		return
+	}
+	handshake.localIndex = index
+	handshake.remoteIndex = binary.LittleEndian.Uint32(msg[4:8])
+	KDF1(&handshake.chainKey, secret[:], append(append([]byte{}, msg[16:32]...), response[12:28]...))
+	handshake.state = HandshakeResponseCreated
+	peer.resumption.handshakeResumed = true
+	handshake.lastSentHandshake = time.Now()
+	handshake.mutex.Unlock()
+
+	binary.LittleEndian.PutUint32(response[0:4], MessageResumeResponseType)
+	binary.LittleEndian.PutUint32(response[4:8], index)
+	copy(response[8:12], msg[4:8])
+	var mac [blake2s.Size128]byte
+	resumptionMAC(&mac, &secret, response[:28], msg[16:32])
+	copy(response[28:], mac[:])
+	setZero(secret[:])
+
+	if err := peer.BeginSymmetricSession(); err != nil {
+		device.log.Error.Println(peer, "- Failed to derive keypair:", err)
+		return
+	}
+	atomic.AddUint64(&peer.stats.resumedSessions, 1)
+
+	peer.timersSessionDerived()
+	peer.timersAnyAuthenticatedPacketSent()
+
+	logDebug.Println(peer, "- Sending resume response")
+	if err := peer.sendBuffer(response, true); err != nil {
+		device.log.Error.Println(peer, "- Failed to send resume response", err)
+	}
+}
+
+/* Completes a resumed session with the answer to a resume initiation
+ */
+func (device *Device) consumeResumeResponse(elem *QueueHandshakeElement) {
+	msg := elem.packet
+	logDebug := device.log.Debug
+
+	lookup := device.indexTable.Lookup(binary.LittleEndian.Uint32(msg[8:12]))
+	handshake, peer := lookup.handshake, lookup.peer
+	if handshake == nil || !peer.isRunning.Get() {
+		return
+	}
+
+	ok := func() bool {
+		handshake.mutex.Lock()
+		defer handshake.mutex.Unlock()
+		state := &peer.resumption
+		state.Lock()
+		defer state.Unlock()
+		if handshake.state != handshakeResumeCreated {
+			return false
+		}
+		var mac [blake2s.Size128]byte
+		resumptionMAC(&mac, &state.pendingSecret, msg[:28], state.pendingRandom[:])
+		if !hmac.Equal(mac[:], msg[28:44]) {
+			return false
+		}
+		KDF1(&handshake.chainKey, state.pendingSecret[:], append(append([]byte{}, state.pendingRandom[:]...), msg[12:28]...))
+		setZero(state.pendingSecret[:])
+		handshake.remoteIndex = binary.LittleEndian.Uint32(msg[4:8])
+		handshake.state = HandshakeResponseConsumed
+		state.handshakeResumed = true
+		return true
+	}()
+	if !ok {
+		logDebug.Println("Received invalid resume response from", elem.endpoint.DstToString())
+		return
+	}
+
+	if elem.control {
+		peer.SetControlEndpointFromPacket(elem.endpoint)
+	} else {
+		peer.SetEndpointFromHandshake(elem.endpoint)
+	}
+	logDebug.Println(peer, "- Received resume response")
+	atomic.AddUint64(&peer.stats.rxBytes, uint64(len(msg)))
+	atomic.AddUint64(&peer.stats.rxPackets, 1)
+
+	peer.timersAnyAuthenticatedPacketTraversal()
+	peer.timersAnyAuthenticatedPacketReceived()
+
+	if err := peer.BeginSymmetricSession(); err != nil {
+		device.log.Error.Println(peer, "- Failed to derive keypair:", err)
+		return
+	}
+	atomic.AddUint64(&peer.stats.resumedSessions, 1)
+
+	peer.timersSessionDerived()
+	peer.timersHandshakeComplete()
+	peer.qualityResponseReceived()
+	peer.eventHandshakeComplete(true)
+	peer.SendKeepalive()
+	select {
+	case peer.signals.newKeypairArrived <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,13 @@
+// +build !experimental_resumption
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+/* Session resumption changes the protocol, see resumption.go, and is
+ * only available when building with -tags experimental_resumption
+ */
+const experimentalResumption = false
@@ -0,0 +1,10 @@
+// +build experimental_resumption
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+const experimentalResumption = true
@@ -0,0 +1,114 @@
+// +build experimental_resumption
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResumption(t *testing.T) {
+	device1, device2, peer1, peer2 := selftestPair(t)
+	defer device1.Close()
+	defer device2.Close()
+
+	assertNil(t, peer1.SetResumption(true))
+	assertNil(t, peer2.SetResumption(true))
+
+	waitFor := func(what string, condition func() bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for !condition() {
+			if time.Now().After(deadline) {
+				t.Fatal("timed out waiting for", what)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	ticketAnnounced := func(peer *Peer) func() bool {
+		return func() bool {
+			peer.resumption.Lock()
+			defer peer.resumption.Unlock()
+			return peer.resumption.valid && peer.resumption.ready
+		}
+	}
+	reconnect := func() {
+		peer1.ZeroAndFlushAll()
+		peer1.handshake.mutex.Lock()
+		peer1.handshake.lastSentHandshake = time.Time{}
+		peer1.handshake.mutex.Unlock()
+		if err := peer1.awaitSession(5 * time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a full handshake issues tickets, which both sides announce
+
+	if err := peer1.awaitSession(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	peer1.SendKeepalive()
+	waitFor("ticket of peer 1", ticketAnnounced(peer1))
+	waitFor("ticket of peer 2", ticketAnnounced(peer2))
+	if peer1.resumption.ticket != peer2.resumption.ticket {
+		t.Fatal("peers derived different tickets")
+	}
+
+	// reconnecting resumes the session and uses up the ticket
+
+	reconnect()
+	waitFor("resumption by peer 2", func() bool { return peer2.ResumedSessions() == 1 })
+	if peer1.ResumedSessions() != 1 {
+		t.Fatalf("peer 1 resumed %d sessions, expected 1", peer1.ResumedSessions())
+	}
+	if _, err := peer1.SelfTest(SelfTestOptions{Packets: 10, Size: 500, Echo: true, Timeout: time.Second}); err != nil {
+		t.Fatal("resumed session does not carry traffic:", err)
+	}
+	if ticketAnnounced(peer1)() || ticketAnnounced(peer2)() {
+		t.Fatal("ticket issued for a resumed session")
+	}
+
+	// without a ticket, the next reconnect runs a full handshake
+
+	reconnect()
+	peer1.SendKeepalive()
+	waitFor("ticket after full handshake", ticketAnnounced(peer1))
+	if peer1.ResumedSessions() != 1 || peer2.ResumedSessions() != 1 {
+		t.Fatal("session resumed without ticket")
+	}
+
+	// a resume initiation is refused while a handshake is in progress
+
+	peer1.ZeroAndFlushAll()
+	packet := peer1.createResumptionPacket()
+	if packet == nil {
+		t.Fatal("no resume initiation with a ticket")
+	}
+	peer2.handshake.mutex.Lock()
+	peer2.handshake.state = HandshakeInitiationCreated
+	peer2.handshake.mutex.Unlock()
+	peer2.RLock()
+	endpoint := peer2.endpoint
+	peer2.RUnlock()
+	device2.consumeResumeInitiation(&QueueHandshakeElement{packet: packet, endpoint: endpoint})
+	peer2.handshake.mutex.RLock()
+	state := peer2.handshake.state
+	peer2.handshake.mutex.RUnlock()
+	if state != HandshakeInitiationCreated || peer2.ResumedSessions() != 1 {
+		t.Fatal("session resumed during a handshake")
+	}
+
+	// disabling resumption drops the ticket
+
+	peer2.SetResumption(false)
+	device2.resumption.Lock()
+	tickets := len(device2.resumption.tickets)
+	device2.resumption.Unlock()
+	if tickets != 0 || ticketAnnounced(peer2)() {
+		t.Fatal("ticket kept after disabling resumption")
+	}
+}
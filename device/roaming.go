@@ -0,0 +1,154 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* Policy on endpoint changes
+ *
+ * Peers roam by sending authenticated packets from a new address. Where
+ * that is a concern, a peer may be restricted to endpoints within a set
+ * of prefixes, and transport packets may be required to follow a
+ * handshake within a window to move the endpoint, handshake messages
+ * themselves always being allowed to. Embedders may additionally install
+ * a hook deciding on every endpoint change. Endpoints learned from gossip
+ * or replicated from an active HA instance are subject to the policy as
+ * well, NAT64 translations of the endpoint are not.
+ *
+ * A rejected endpoint is not used, and an EventRoamRejected is emitted,
+ * at most every RoamRejectedInterval for the same endpoint.
+ *
+ * Over UAPI prefixes are added with roam_allow=<prefix> and the window
+ * set with roam_handshake_window=<seconds>.
+ */
+
+const (
+	RoamRejectedInterval = 10 * time.Second
+)
+
+/* Decides whether the peer may move to the endpoint, handshake telling
+ * whether the packet was a handshake message
+ */
+type RoamingHook func(peer *Peer, endpoint Endpoint, handshake bool) bool
+
+type roamingPolicy struct {
+	sync.Mutex
+	enabled          AtomicBool // a policy is configured
+	allowed          []net.IPNet
+	handshakeWindow  time.Duration
+	lastRejected     string
+	lastRejectedTime time.Time
+}
+
+func (device *Device) SetRoamingHook(hook RoamingHook) {
+	device.roaming.hook.Store(hook)
+}
+
+func (device *Device) loadRoamingHook() RoamingHook {
+	hook, _ := device.roaming.hook.Load().(RoamingHook)
+	return hook
+}
+
+func (peer *Peer) AddRoamingPrefix(prefix net.IPNet) {
+	policy := &peer.roaming
+	policy.Lock()
+	defer policy.Unlock()
+	policy.allowed = append(policy.allowed, prefix)
+	policy.enabled.Set(true)
+}
+
+func (peer *Peer) ClearRoamingPrefixes() {
+	policy := &peer.roaming
+	policy.Lock()
+	defer policy.Unlock()
+	policy.allowed = nil
+	policy.enabled.Set(policy.handshakeWindow != 0)
+}
+
+/* Requires transport packets moving the endpoint to follow a handshake
+ * within window (0 = disabled)
+ */
+func (peer *Peer) SetRoamingHandshakeWindow(window time.Duration) {
+	policy := &peer.roaming
+	policy.Lock()
+	defer policy.Unlock()
+	policy.handshakeWindow = window
+	policy.enabled.Set(window != 0 || len(policy.allowed) != 0)
+}
+
+func (peer *Peer) RoamingPolicy() ([]net.IPNet, time.Duration) {
+	policy := &peer.roaming
+	policy.Lock()
+	defer policy.Unlock()
+	return append([]net.IPNet(nil), policy.allowed...), policy.handshakeWindow
+}
+
+/* Returns true if the peer may move to the endpoint
+ */
+func (peer *Peer) allowRoam(previous, endpoint Endpoint, handshake bool) bool {
+	hook := peer.device.loadRoamingHook()
+	policy := &peer.roaming
+	if hook == nil && !policy.enabled.Get() {
+		return true
+	}
+	if previous != nil && sameDst(previous, endpoint) {
+		return true
+	}
+
+	allowed := true
+	if policy.enabled.Get() {
+		policy.Lock()
+		if len(policy.allowed) != 0 {
+			allowed = false
+			ip := endpoint.DstIP()
+			for _, prefix := range policy.allowed {
+				if prefix.Contains(ip) {
+					allowed = true
+					break
+				}
+			}
+		}
+		if allowed && !handshake && policy.handshakeWindow != 0 {
+			lastHandshake := time.Unix(0, atomic.LoadInt64(&peer.stats.lastHandshakeNano))
+			allowed = time.Since(lastHandshake) < policy.handshakeWindow
+		}
+		policy.Unlock()
+	}
+	if allowed && hook != nil {
+		allowed = hook(peer, endpoint, handshake)
+	}
+
+	if !allowed {
+		peer.rejectRoam(endpoint)
+	}
+	return allowed
+}
+
+func (peer *Peer) rejectRoam(endpoint Endpoint) {
+	address := endpoint.DstToString()
+
+	policy := &peer.roaming
+	policy.Lock()
+	repeated := address == policy.lastRejected && time.Since(policy.lastRejectedTime) < RoamRejectedInterval
+	if !repeated {
+		policy.lastRejected = address
+		policy.lastRejectedTime = time.Now()
+	}
+	policy.Unlock()
+	if repeated {
+		return
+	}
+
+	peer.device.log.Info.Println(peer, "- Rejected endpoint change to", address)
+	event := peer.newEvent(EventRoamRejected)
+	event.Endpoint = address
+	peer.device.emit(event)
+}
@@ -0,0 +1,134 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRoamingPolicy(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	var rejected []string
+	device.AddEventHandler(func(event Event) {
+		if event.Type == EventRoamRejected {
+			rejected = append(rejected, event.Endpoint)
+		}
+	})
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	peer, err := device.NewPeer(sk.publicKey())
+	assertNil(t, err)
+	if err := ipcSet(device, "public_key="+peer.handshake.remoteStatic.ToHex()+"\nroam_allow=192.0.2.0/24\nroam_handshake_window=60\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	roam := func(address string, handshake bool) string {
+		endpoint, err := CreateEndpoint(address)
+		assertNil(t, err)
+		peer.setEndpointFromPacket(endpoint, handshake)
+		peer.RLock()
+		defer peer.RUnlock()
+		if peer.endpoint == nil {
+			return ""
+		}
+		return peer.endpoint.DstToString()
+	}
+
+	// handshakes may move the endpoint within the prefixes
+
+	if roam("192.0.2.1:51820", true) != "192.0.2.1:51820" {
+		t.Fatal("handshake within allowed prefix rejected")
+	}
+	if roam("198.51.100.1:51820", true) != "192.0.2.1:51820" {
+		t.Fatal("handshake outside allowed prefixes accepted")
+	}
+
+	// transport packets only shortly after a handshake
+
+	if roam("192.0.2.2:51820", false) != "192.0.2.1:51820" {
+		t.Fatal("transport packet without recent handshake accepted")
+	}
+	atomic.StoreInt64(&peer.stats.lastHandshakeNano, time.Now().UnixNano())
+	if roam("192.0.2.2:51820", false) != "192.0.2.2:51820" {
+		t.Fatal("transport packet after handshake rejected")
+	}
+
+	// repeated rejections of the same endpoint are reported once
+
+	roam("198.51.100.9:51820", true)
+	roam("198.51.100.9:51820", true)
+	if len(rejected) != 3 || rejected[0] != "198.51.100.1:51820" || rejected[1] != "192.0.2.2:51820" || rejected[2] != "198.51.100.9:51820" {
+		t.Fatalf("unexpected rejections %v", rejected)
+	}
+
+	// the hook decides last
+
+	device.SetRoamingHook(func(peer *Peer, endpoint Endpoint, handshake bool) bool {
+		return endpoint.DstToString() != "192.0.2.3:51820"
+	})
+	if roam("192.0.2.3:51820", true) != "192.0.2.2:51820" {
+		t.Fatal("endpoint refused by hook accepted")
+	}
+	if roam("192.0.2.4:51820", true) != "192.0.2.4:51820" {
+		t.Fatal("endpoint allowed by hook rejected")
+	}
+
+	// replicated endpoints are subject to the policy too
+
+	device.SetRoamingHook(nil)
+	device.applyHA(haEntry{publicKey: peer.handshake.remoteStatic, endpoint: "198.51.100.2:51820"})
+	if roam("192.0.2.4:51820", true) != "192.0.2.4:51820" {
+		t.Fatal("replicated endpoint outside allowed prefixes accepted")
+	}
+}
+
+func TestPeerRoamedEvent(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	var roamed int32
+	device.AddEventHandler(func(event Event) {
+		if event.Type == EventPeerRoamed {
+			atomic.AddInt32(&roamed, 1)
+		}
+	})
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	peer, err := device.NewPeer(sk.publicKey())
+	assertNil(t, err)
+
+	endpoint := func(address string) Endpoint {
+		endpoint, err := CreateEndpoint(address)
+		assertNil(t, err)
+		return endpoint
+	}
+
+	peer.SetEndpointFromPacket(endpoint("192.0.2.1:51820"))
+	peer.SetEndpointFromPacket(endpoint("192.0.2.1:51820"))
+	if atomic.LoadInt32(&roamed) != 0 {
+		t.Fatal("roamed to the same endpoint")
+	}
+	peer.SetEndpointFromPacket(endpoint("192.0.2.1:51821"))
+	if atomic.LoadInt32(&roamed) != 1 {
+		t.Fatal("roaming to a new port not reported")
+	}
+
+	// packets from the same endpoint are compared without allocating
+
+	if runtime.GOOS == "linux" {
+		same := endpoint("192.0.2.1:51821")
+		if allocs := testing.AllocsPerRun(100, func() { peer.SetEndpointFromPacket(same) }); allocs != 0 {
+			t.Fatalf("%v allocations per packet", allocs)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync/atomic"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+/* Sanitization of IP options received from peers
+ *
+ * Hardened gateways may not want peers to steer packets past the tunnel
+ * with source routing, or to have routers on the inside inspect them
+ * through the router alert option. The policy applies to packets
+ * received from peers before they are written to the TUN device:
+ *
+ *   allow  - packets pass unmodified (default)
+ *   strip  - IPv4 options are overwritten with no-operation options,
+ *            IPv6 routing headers are removed and router alert options
+ *            padded out
+ *   reject - packets carrying them are dropped
+ *
+ * Covered are the IPv4 loose and strict source route and router alert
+ * options, IPv6 routing headers of any type, and the router alert option
+ * in IPv6 hop-by-hop and destination options headers. Packets with
+ * malformed options are dropped unless the policy is allow.
+ */
+
+type IPOptionsPolicy int32
+
+const (
+	IPOptionsAllow IPOptionsPolicy = iota
+	IPOptionsStrip
+	IPOptionsReject
+)
+
+var ipOptionsPolicyNames = [...]string{
+	IPOptionsAllow:  "allow",
+	IPOptionsStrip:  "strip",
+	IPOptionsReject: "reject",
+}
+
+func (policy IPOptionsPolicy) String() string {
+	if policy < 0 || int(policy) >= len(ipOptionsPolicyNames) {
+		return "unknown"
+	}
+	return ipOptionsPolicyNames[policy]
+}
+
+func ParseIPOptionsPolicy(s string) (IPOptionsPolicy, error) {
+	for policy, name := range ipOptionsPolicyNames {
+		if s == name {
+			return IPOptionsPolicy(policy), nil
+		}
+	}
+	return IPOptionsAllow, errors.New("invalid ip options policy: " + s)
+}
+
+const (
+	ipv4OptionEnd         = 0x00
+	ipv4OptionNop         = 0x01
+	ipv4OptionLSRR        = 0x83
+	ipv4OptionSSRR        = 0x89
+	ipv4OptionRouterAlert = 0x94
+
+	ipv6HeaderHopByHop    = 0
+	ipv6HeaderRouting     = 43
+	ipv6HeaderDestination = 60
+	ipv6OptionPad1        = 0x00
+	ipv6OptionPadN        = 0x01
+	ipv6OptionRouterAlert = 0x05
+)
+
+func (device *Device) SetIPOptionsPolicy(policy IPOptionsPolicy) {
+	atomic.StoreInt32(&device.sanitize.policy, int32(policy))
+}
+
+func (device *Device) IPOptionsPolicy() IPOptionsPolicy {
+	return IPOptionsPolicy(atomic.LoadInt32(&device.sanitize.policy))
+}
+
+/* Applies the ip options policy to a packet received from a peer,
+ * returns the packet to write to the TUN device or false if it is dropped
+ */
+func (device *Device) sanitizeInbound(packet []byte) ([]byte, bool) {
+	policy := device.IPOptionsPolicy()
+	if policy == IPOptionsAllow {
+		return packet, true
+	}
+
+	var risky, ok bool
+	switch packet[0] >> 4 {
+	case ipv4.Version:
+		if packet[0]&0x0f == ipv4.HeaderLen/4 {
+			return packet, true // no options
+		}
+		risky, ok = sanitizeIPv4(packet, policy == IPOptionsStrip)
+	case ipv6.Version:
+		packet, risky, ok = sanitizeIPv6(packet, policy == IPOptionsStrip)
+	default:
+		return packet, true
+	}
+
+	if !ok || (risky && policy == IPOptionsReject) {
+		device.countDrop(QueueInbound, DropSanitized)
+		return nil, false
+	}
+	return packet, true
+}
+
+/* Reports whether the header carries risky options, overwriting them
+ * with no-operation options if strip is set
+ */
+func sanitizeIPv4(packet []byte, strip bool) (risky, ok bool) {
+	headerLen := int(packet[0]&0x0f) * 4
+	if headerLen < ipv4.HeaderLen || headerLen > len(packet) {
+		return false, false
+	}
+
+	options := packet[ipv4.HeaderLen:headerLen]
+	for i := 0; i < len(options); {
+		option := options[i]
+		if option == ipv4OptionEnd {
+			break
+		}
+		if option == ipv4OptionNop {
+			i++
+			continue
+		}
+		if i+1 >= len(options) {
+			return risky, false
+		}
+		length := int(options[i+1])
+		if length < 2 || i+length > len(options) {
+			return risky, false
+		}
+		if option == ipv4OptionLSRR || option == ipv4OptionSSRR || option == ipv4OptionRouterAlert {
+			risky = true
+			if strip {
+				for j := i; j < i+length; j++ {
+					options[j] = ipv4OptionNop
+				}
+			}
+		}
+		i += length
+	}
+
+	if risky && strip {
+		packet[10], packet[11] = 0, 0
+		binary.BigEndian.PutUint16(packet[10:12], ^ipChecksum(packet[:headerLen]))
+	}
+	return risky, true
+}
+
+/* Reports whether the extension headers carry risky options, removing
+ * routing headers and padding out router alert options if strip is set
+ */
+func sanitizeIPv6(packet []byte, strip bool) ([]byte, bool, bool) {
+	risky := false
+	nextField := 6 // offset of the next header field pointing at the current header
+	offset := ipv6.HeaderLen
+
+	for {
+		next := packet[nextField]
+		if next != ipv6HeaderHopByHop && next != ipv6HeaderRouting && next != ipv6HeaderDestination {
+			return packet, risky, true
+		}
+		if offset+2 > len(packet) {
+			return packet, risky, false
+		}
+		length := (int(packet[offset+1]) + 1) * 8
+		if offset+length > len(packet) {
+			return packet, risky, false
+		}
+
+		if next == ipv6HeaderRouting {
+			risky = true
+			if strip {
+				packet[nextField] = packet[offset]
+				copy(packet[offset:], packet[offset+length:])
+				packet = packet[:len(packet)-length]
+				payloadLength := binary.BigEndian.Uint16(packet[IPv6offsetPayloadLength:])
+				binary.BigEndian.PutUint16(packet[IPv6offsetPayloadLength:], payloadLength-uint16(length))
+				continue
+			}
+		} else {
+			found, ok := sanitizeIPv6Options(packet[offset+2:offset+length], strip)
+			if !ok {
+				return packet, risky, false
+			}
+			risky = risky || found
+		}
+
+		nextField = offset
+		offset += length
+	}
+}
+
+func sanitizeIPv6Options(options []byte, strip bool) (risky, ok bool) {
+	for i := 0; i < len(options); {
+		if options[i] == ipv6OptionPad1 {
+			i++
+			continue
+		}
+		if i+1 >= len(options) {
+			return risky, false
+		}
+		length := 2 + int(options[i+1])
+		if i+length > len(options) {
+			return risky, false
+		}
+		if options[i] == ipv6OptionRouterAlert {
+			risky = true
+			if strip {
+				options[i] = ipv6OptionPadN
+				for j := i + 2; j < i+length; j++ {
+					options[j] = 0
+				}
+			}
+		}
+		i += length
+	}
+	return risky, true
+}
+
+func ipChecksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i:]))
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return uint16(sum)
+}
@@ -0,0 +1,123 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func testPacketIPv4Options(options []byte) []byte {
+	packet := make([]byte, 20+len(options)+8)
+	packet[0] = 0x40 | byte((20+len(options))/4)
+	binary.BigEndian.PutUint16(packet[IPv4offsetTotalLength:], uint16(len(packet)))
+	packet[8] = 64
+	packet[9] = 17
+	copy(packet[IPv4offsetSrc:], []byte{10, 0, 0, 1})
+	copy(packet[IPv4offsetDst:], []byte{10, 0, 0, 2})
+	copy(packet[20:], options)
+	binary.BigEndian.PutUint16(packet[10:], ^ipChecksum(packet[:20+len(options)]))
+	return packet
+}
+
+func testPacketIPv6Extensions(next byte, extensions []byte) []byte {
+	packet := make([]byte, 40+len(extensions)+8)
+	packet[0] = 0x60
+	binary.BigEndian.PutUint16(packet[IPv6offsetPayloadLength:], uint16(len(extensions)+8))
+	packet[6] = next
+	packet[7] = 64
+	copy(packet[40:], extensions)
+	return packet
+}
+
+func TestSanitizeIPv4(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	lsrr := []byte{ipv4OptionLSRR, 7, 4, 192, 0, 2, 1, ipv4OptionEnd}
+	timestamp := []byte{0x44, 4, 5, 0}
+
+	// allowed by default
+
+	packet := testPacketIPv4Options(lsrr)
+	if _, ok := device.sanitizeInbound(packet); !ok {
+		t.Fatal("packet dropped under allow policy")
+	}
+
+	device.SetIPOptionsPolicy(IPOptionsReject)
+	if _, ok := device.sanitizeInbound(testPacketIPv4Options(lsrr)); ok {
+		t.Fatal("source routed packet accepted under reject policy")
+	}
+	if _, ok := device.sanitizeInbound(testPacketIPv4Options(timestamp)); !ok {
+		t.Fatal("harmless options rejected")
+	}
+	if _, ok := device.sanitizeInbound(testPacketIPv4Options([]byte{ipv4OptionLSRR, 9, 0, 0})); ok {
+		t.Fatal("malformed options accepted")
+	}
+	if drops := device.Stats().Queues[QueueInbound].Drops[DropSanitized]; drops != 2 {
+		t.Fatalf("counted %d drops, expected 2", drops)
+	}
+
+	device.SetIPOptionsPolicy(IPOptionsStrip)
+	packet, ok := device.sanitizeInbound(testPacketIPv4Options(lsrr))
+	if !ok {
+		t.Fatal("packet dropped under strip policy")
+	}
+	if !bytes.Equal(packet[20:28], []byte{1, 1, 1, 1, 1, 1, 1, ipv4OptionEnd}) {
+		t.Fatalf("options not stripped: %x", packet[20:28])
+	}
+	if ipChecksum(packet[:28]) != 0xffff {
+		t.Fatal("invalid header checksum after stripping")
+	}
+}
+
+func TestSanitizeIPv6(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	// hop-by-hop with router alert, then a routing header, then udp
+
+	extensions := []byte{
+		ipv6HeaderRouting, 0, ipv6OptionRouterAlert, 2, 0, 0, ipv6OptionPadN, 0,
+		17, 0, 0, 0, 0, 0, 0, 0,
+	}
+
+	device.SetIPOptionsPolicy(IPOptionsReject)
+	if _, ok := device.sanitizeInbound(testPacketIPv6Extensions(ipv6HeaderHopByHop, extensions)); ok {
+		t.Fatal("packet with router alert accepted under reject policy")
+	}
+	if _, ok := device.sanitizeInbound(testPacketIPv6Extensions(17, nil)); !ok {
+		t.Fatal("packet without extension headers rejected")
+	}
+
+	device.SetIPOptionsPolicy(IPOptionsStrip)
+	packet, ok := device.sanitizeInbound(testPacketIPv6Extensions(ipv6HeaderHopByHop, extensions))
+	if !ok {
+		t.Fatal("packet dropped under strip policy")
+	}
+	if len(packet) != 40+8+8 || binary.BigEndian.Uint16(packet[IPv6offsetPayloadLength:]) != 16 {
+		t.Fatalf("routing header not removed, length %d", len(packet))
+	}
+	if !bytes.Equal(packet[40:48], []byte{17, 0, ipv6OptionPadN, 2, 0, 0, ipv6OptionPadN, 0}) {
+		t.Fatalf("router alert not padded out: %x", packet[40:48])
+	}
+}
+
+func TestIpcIPOptionsPolicy(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	if err := ipcSet(device, "ip_options=strip\n"); err != nil {
+		t.Fatal(err)
+	}
+	if device.IPOptionsPolicy() != IPOptionsStrip {
+		t.Fatal("policy not set")
+	}
+	if err := ipcSet(device, "ip_options=drop\n"); err == nil {
+		t.Fatal("invalid policy accepted")
+	}
+}
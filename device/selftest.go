@@ -0,0 +1,451 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.zx2c4.com/wireguard/ipc"
+)
+
+/* Throughput self-test
+ *
+ * The initiator sends a stream of padded probes through the tunnel.
+ * The peer either sinks them, counting what arrives and reporting the
+ * count on request, or echoes every probe back. From this the initiator
+ * derives goodput and loss of the tunnel without any tooling on either
+ * end.
+ *
+ * Like gossip, probes are the content of transport packets and are
+ * distinguished from IP packets by the version nibble:
+ *
+ *   marker (1) | kind (1) | reserved (2) | test id (4) |
+ *   sequence (4, big endian) | value (4, big endian) | padding
+ *
+ * A report carries the number of probes received as sequence and the
+ * microseconds between the first and last probe as value.
+ */
+
+const (
+	SelfTestDefaultPackets = 1000
+	SelfTestDefaultTimeout = 2 * time.Second
+	SelfTestReportInterval = 100 * time.Millisecond
+)
+
+const (
+	selftestVersion    = 2
+	selftestHeaderSize = 16
+)
+
+const (
+	selftestProbe = iota + 1 // count and discard
+	selftestEcho             // count and send back
+	selftestReply            // echoed probe
+	selftestReportRequest
+	selftestReport
+)
+
+type SelfTestOptions struct {
+	Packets int           // number of probes, SelfTestDefaultPackets if zero
+	Size    int           // size of each probe, the MTU if zero
+	Echo    bool          // have the peer send the probes back
+	Timeout time.Duration // wait for replies after the last probe, SelfTestDefaultTimeout if zero
+}
+
+type SelfTestResult struct {
+	Sent     uint32
+	Received uint32 // probes arriving at the peer, or echoed back
+	Size     int
+	Duration time.Duration // from first to last probe received
+}
+
+/* Returns the goodput in bits per second
+ */
+func (result *SelfTestResult) Goodput() uint64 {
+	if result.Duration <= 0 {
+		return 0
+	}
+	bits := float64(result.Received) * float64(result.Size) * 8
+	return uint64(bits / result.Duration.Seconds())
+}
+
+func (result *SelfTestResult) Lost() uint32 {
+	if result.Received > result.Sent {
+		return 0
+	}
+	return result.Sent - result.Received
+}
+
+type selftestHeader struct {
+	kind     byte
+	id       uint32
+	sequence uint32
+	value    uint32
+}
+
+func (header *selftestHeader) encode(msg []byte) {
+	msg[0] = selftestVersion << 4
+	msg[1] = header.kind
+	msg[2] = 0
+	msg[3] = 0
+	binary.BigEndian.PutUint32(msg[4:8], header.id)
+	binary.BigEndian.PutUint32(msg[8:12], header.sequence)
+	binary.BigEndian.PutUint32(msg[12:16], header.value)
+}
+
+func decodeSelfTest(msg []byte) (selftestHeader, error) {
+	var header selftestHeader
+	if len(msg) < selftestHeaderSize || msg[0]>>4 != selftestVersion {
+		return header, errors.New("invalid self-test message")
+	}
+	header.kind = msg[1]
+	header.id = binary.BigEndian.Uint32(msg[4:8])
+	header.sequence = binary.BigEndian.Uint32(msg[8:12])
+	header.value = binary.BigEndian.Uint32(msg[12:16])
+	return header, nil
+}
+
+type selftestState struct {
+	sync.Mutex
+
+	// as initiator
+
+	id       uint32 // test in progress (0 = none)
+	expected uint32
+	echoed   uint32
+	lastEcho time.Time
+	done     chan struct{}       // all probes echoed
+	report   chan selftestHeader // report of the peer
+
+	// as responder
+
+	peerID   uint32
+	received uint32
+	first    time.Time
+	last     time.Time
+}
+
+var selftestCounter uint32
+
+/* Queues msg for encryption, waiting at most wait for room in the queue
+ */
+func (peer *Peer) sendSelfTest(msg []byte, wait time.Duration) bool {
+	device := peer.device
+	elem := device.NewOutboundElement()
+	offset := MessageTransportHeaderSize
+	elem.packet = elem.buffer[offset : offset+copy(elem.buffer[offset:], msg)]
+
+	select {
+	case peer.queue.nonce <- elem:
+		return true
+	default:
+	}
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case peer.queue.nonce <- elem:
+			return true
+		case <-timer.C:
+		}
+	}
+	device.PutOutboundElement(elem)
+	return false
+}
+
+/* Establishes a session with the peer if there is none
+ */
+func (peer *Peer) awaitSession(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		if !peer.isRunning.Get() {
+			return errors.New("peer is not running")
+		}
+		peer.keypairs.RLock()
+		current := peer.keypairs.current
+		peer.keypairs.RUnlock()
+		if current != nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.New("no session with peer")
+		}
+		peer.SendHandshakeInitiation(false)
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+/* Measures goodput and loss of the tunnel to the peer, which must run
+ * an implementation supporting the self-test
+ */
+func (peer *Peer) SelfTest(options SelfTestOptions) (SelfTestResult, error) {
+	var result SelfTestResult
+	device := peer.device
+
+	mtu := int(atomic.LoadInt32(&device.tun.mtu))
+	if options.Packets == 0 {
+		options.Packets = SelfTestDefaultPackets
+	}
+	if options.Size == 0 {
+		options.Size = mtu
+	}
+	if options.Timeout == 0 {
+		options.Timeout = SelfTestDefaultTimeout
+	}
+	if options.Packets < 0 {
+		return result, errors.New("invalid number of packets")
+	}
+	if options.Size < selftestHeaderSize || options.Size > mtu {
+		return result, errors.New("packet size must be within the MTU")
+	}
+
+	if err := peer.awaitSession(options.Timeout); err != nil {
+		return result, err
+	}
+
+	// register test
+
+	state := &peer.selftest
+	state.Lock()
+	if state.id != 0 {
+		state.Unlock()
+		return result, errors.New("self-test already in progress")
+	}
+	id := atomic.AddUint32(&selftestCounter, 1)
+	if id == 0 {
+		id = atomic.AddUint32(&selftestCounter, 1)
+	}
+	state.id = id
+	state.expected = uint32(options.Packets)
+	state.echoed = 0
+	state.done = make(chan struct{})
+	state.report = make(chan selftestHeader, 1)
+	done, report := state.done, state.report
+	state.Unlock()
+
+	defer func() {
+		state.Lock()
+		state.id = 0
+		state.Unlock()
+	}()
+
+	device.log.Debug.Println(peer, "- Starting self-test with", options.Packets, "packets of", options.Size, "bytes")
+
+	// send probes
+
+	header := selftestHeader{kind: selftestProbe, id: id}
+	if options.Echo {
+		header.kind = selftestEcho
+	}
+	msg := make([]byte, options.Size)
+
+	start := time.Now()
+	for i := 0; i < options.Packets; i++ {
+		header.sequence = uint32(i)
+		header.encode(msg)
+		if !peer.sendSelfTest(msg, options.Timeout) {
+			return result, errors.New("outbound queue stalled")
+		}
+		result.Sent++
+	}
+	sent := time.Now()
+
+	result.Size = options.Size
+	timeout := time.NewTimer(options.Timeout)
+	defer timeout.Stop()
+
+	// count echoed probes
+
+	if options.Echo {
+		select {
+		case <-done:
+		case <-timeout.C:
+		}
+		state.Lock()
+		result.Received = state.echoed
+		if result.Received > 0 {
+			result.Duration = state.lastEcho.Sub(start)
+		}
+		state.Unlock()
+		return result, nil
+	}
+
+	// request report of the sink
+
+	ticker := time.NewTicker(SelfTestReportInterval)
+	defer ticker.Stop()
+
+	request := make([]byte, selftestHeaderSize)
+	for {
+		(&selftestHeader{kind: selftestReportRequest, id: id}).encode(request)
+		peer.sendSelfTest(request, 0)
+
+		select {
+		case header := <-report:
+			result.Received = header.sequence
+			result.Duration = time.Duration(header.value) * time.Microsecond
+			if result.Duration <= 0 && result.Received > 0 {
+				result.Duration = sent.Sub(start)
+			}
+			return result, nil
+		case <-ticker.C:
+		case <-timeout.C:
+			return result, errors.New("no report from peer")
+		}
+	}
+}
+
+/* Called with the content of a self-test message received from the peer
+ */
+func (device *Device) handleSelfTest(peer *Peer, msg []byte) {
+	header, err := decodeSelfTest(msg)
+	if err != nil {
+		device.log.Info.Println(peer, "- Received invalid self-test message:", err)
+		return
+	}
+
+	state := &peer.selftest
+	state.Lock()
+	defer state.Unlock()
+
+	now := time.Now()
+
+	switch header.kind {
+	case selftestProbe, selftestEcho:
+		if header.id != state.peerID {
+			state.peerID = header.id
+			state.received = 0
+			state.first = now
+		}
+		state.received++
+		state.last = now
+
+		if header.kind == selftestEcho {
+			msg[1] = selftestReply
+			peer.sendSelfTest(msg, 0)
+		}
+
+	case selftestReportRequest:
+		report := selftestHeader{kind: selftestReport, id: header.id}
+		if header.id == state.peerID {
+			report.sequence = state.received
+			report.value = uint32(state.last.Sub(state.first) / time.Microsecond)
+		}
+		reply := make([]byte, selftestHeaderSize)
+		report.encode(reply)
+		peer.sendSelfTest(reply, 0)
+
+	case selftestReply:
+		if state.id == 0 || header.id != state.id {
+			return
+		}
+		state.echoed++
+		state.lastEcho = now
+		if state.echoed == state.expected {
+			close(state.done)
+		}
+
+	case selftestReport:
+		if state.id == 0 || header.id != state.id {
+			return
+		}
+		select {
+		case state.report <- header:
+		default:
+		}
+	}
+}
+
+/* Runs a self-test against the peer given by public_key, configured by
+ * packets, size, echo and timeout_ms, and writes the result
+ */
+func (device *Device) IpcSelfTestOperation(socket *bufio.ReadWriter) *IPCError {
+	scanner := bufio.NewScanner(socket.Reader)
+
+	var peer *Peer
+	var options SelfTestOptions
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+		parts := strings.Split(line, "=")
+		if len(parts) != 2 {
+			return ipcErrorf(ipc.IpcErrorProtocol, ipc.ReasonProtocol, "failed to parse line %q", line)
+		}
+		key, value := parts[0], parts[1]
+
+		switch key {
+		case "public_key":
+			var publicKey NoisePublicKey
+			if err := publicKey.FromHex(value); err != nil {
+				return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidKey, "failed to get peer by public key: %v", err)
+			}
+			peer = device.LookupPeer(publicKey)
+			if peer == nil {
+				return ipcErrorf(ipc.IpcErrorNotFound, ipc.ReasonPeerNotFound, "no such peer: %v", value)
+			}
+
+		case "packets", "size", "timeout_ms":
+			n, err := strconv.ParseUint(value, 10, 31)
+			if err != nil {
+				return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "invalid %s: %v", key, err)
+			}
+			switch key {
+			case "packets":
+				options.Packets = int(n)
+			case "size":
+				options.Size = int(n)
+			default:
+				options.Timeout = time.Duration(n) * time.Millisecond
+			}
+
+		case "echo":
+			echo, err := strconv.ParseBool(value)
+			if err != nil {
+				return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "invalid echo: %v", value)
+			}
+			options.Echo = echo
+
+		default:
+			return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonUnknownKey, "invalid UAPI self-test key: %v", key)
+		}
+	}
+
+	if peer == nil {
+		return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonProtocol, "self-test requires public_key")
+	}
+
+	result, err := peer.SelfTest(options)
+	if err != nil {
+		return ipcErrorf(ipc.IpcErrorBusy, ipc.ReasonTransient, "self-test failed: %v", err)
+	}
+
+	lines := []string{
+		fmt.Sprintf("sent=%d", result.Sent),
+		fmt.Sprintf("received=%d", result.Received),
+		fmt.Sprintf("lost=%d", result.Lost()),
+		fmt.Sprintf("size=%d", result.Size),
+		fmt.Sprintf("duration_ms=%d", result.Duration/time.Millisecond),
+		fmt.Sprintf("goodput_bps=%d", result.Goodput()),
+	}
+	for _, line := range lines {
+		_, err := socket.WriteString(line + "\n")
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorIO, ipc.ReasonIO, "failed to write output: %v", err)
+		}
+	}
+	return nil
+}
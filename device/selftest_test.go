@@ -0,0 +1,102 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/* Connects two devices over loopback, returning each as peer of the other
+ */
+func selftestPair(t *testing.T) (*Device, *Device, *Peer, *Peer) {
+	devices := [2]*Device{randDevice(t), randDevice(t)}
+	var ports [2]uint16
+	for i, device := range devices {
+		atomic.StoreInt32(&device.tun.mtu, 1420)
+		device.Up()
+		if err := ipcSet(device, "listen_port=0\n"); err != nil {
+			t.Fatal(err)
+		}
+		device.net.RLock()
+		ports[i] = device.net.port
+		device.net.RUnlock()
+	}
+
+	var peers [2]*Peer
+	for i, device := range devices {
+		other := devices[1-i]
+		other.staticIdentity.RLock()
+		publicKey := other.staticIdentity.publicKey
+		other.staticIdentity.RUnlock()
+		config := fmt.Sprintf("public_key=%s\nendpoint=127.0.0.1:%d\nallowed_ip=10.0.0.%d/32\n", publicKey.ToHex(), ports[1-i], 2-i)
+		if err := ipcSet(device, config); err != nil {
+			t.Fatal(err)
+		}
+		peers[i] = device.LookupPeer(publicKey)
+	}
+	return devices[0], devices[1], peers[0], peers[1]
+}
+
+func TestSelfTest(t *testing.T) {
+	device1, device2, peer, _ := selftestPair(t)
+	defer device1.Close()
+	defer device2.Close()
+
+	if _, err := peer.SelfTest(SelfTestOptions{Size: 4000}); err == nil {
+		t.Fatal("accepted packets larger than the MTU")
+	}
+
+	for _, echo := range []bool{false, true} {
+		result, err := peer.SelfTest(SelfTestOptions{Packets: 200, Size: 1000, Echo: echo, Timeout: 500 * time.Millisecond})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Sent != 200 || result.Received == 0 || result.Received > result.Sent {
+			t.Fatalf("echo %v: sent %d, received %d", echo, result.Sent, result.Received)
+		}
+		if result.Duration <= 0 || result.Duration > time.Minute || result.Goodput() == 0 {
+			t.Fatalf("echo %v: implausible duration %v, goodput %d", echo, result.Duration, result.Goodput())
+		}
+	}
+}
+
+func TestJumboFrames(t *testing.T) {
+	device1, device2, peer, _ := selftestPair(t)
+	defer device1.Close()
+	defer device2.Close()
+	for _, device := range []*Device{device1, device2} {
+		atomic.StoreInt32(&device.tun.mtu, 9000)
+	}
+
+	result, err := peer.SelfTest(SelfTestOptions{Packets: 50, Size: 9000, Echo: true, Timeout: 500 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Received == 0 {
+		t.Fatalf("sent %d jumbo packets, none echoed", result.Sent)
+	}
+}
+
+func TestSelfTestHeader(t *testing.T) {
+	msg := make([]byte, 64)
+	header := selftestHeader{kind: selftestReport, id: 7, sequence: 42, value: 1000}
+	header.encode(msg)
+
+	decoded, err := decodeSelfTest(msg)
+	assertNil(t, err)
+	if decoded != header {
+		t.Fatalf("decoded %v, expected %v", decoded, header)
+	}
+	if msg[0]>>4 != selftestVersion {
+		t.Fatal("self-test message not marked")
+	}
+	if _, err := decodeSelfTest(msg[:selftestHeaderSize-1]); err == nil {
+		t.Fatal("decoded truncated message")
+	}
+}
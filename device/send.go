@@ -45,21 +45,25 @@ import (
 type QueueOutboundElement struct {
 	dropped int32
 	sync.Mutex
-	buffer  *[MaxMessageSize]byte // slice holding the packet data
+	message *[MaxMessageSize]byte // from the message buffer pool
+	buffer  []byte                // slice of "message" holding the packet data
 	packet  []byte                // slice of "buffer" (always!)
 	nonce   uint64                // nonce for encryption
 	keypair *Keypair              // keypair for encryption
 	peer    *Peer                 // related peer
+	queued  time.Time             // when queued for transmission, only with jitter
 }
 
 func (device *Device) NewOutboundElement() *QueueOutboundElement {
 	elem := device.GetOutboundElement()
 	elem.dropped = AtomicFalse
-	elem.buffer = device.GetMessageBuffer()
+	elem.message = device.GetMessageBuffer()
+	elem.buffer = elem.message[:device.options.ReadBufferSize]
 	elem.Mutex = sync.Mutex{}
 	elem.nonce = 0
 	elem.keypair = nil
 	elem.peer = nil
+	elem.queued = time.Time{}
 	return elem
 }
 
@@ -79,8 +83,8 @@ func addToNonceQueue(queue chan *QueueOutboundElement, element *QueueOutboundEle
 		default:
 			select {
 			case old := <-queue:
-				device.PutMessageBuffer(old.buffer)
 				device.PutOutboundElement(old)
+				device.countDrop(QueueNonce, DropEvicted)
 			default:
 			}
 		}
@@ -88,6 +92,10 @@ func addToNonceQueue(queue chan *QueueOutboundElement, element *QueueOutboundEle
 }
 
 func addToOutboundAndEncryptionQueues(outboundQueue chan *QueueOutboundElement, encryptionQueue chan *QueueOutboundElement, element *QueueOutboundElement) {
+	device := element.peer.device
+	if atomic.LoadUint32(&element.peer.cover.jitterMs) > 0 {
+		element.queued = time.Now()
+	}
 	select {
 	case outboundQueue <- element:
 		select {
@@ -95,12 +103,12 @@ func addToOutboundAndEncryptionQueues(outboundQueue chan *QueueOutboundElement,
 			return
 		default:
 			element.Drop()
-			element.peer.device.PutMessageBuffer(element.buffer)
 			element.Unlock()
+			device.countDrop(QueueEncryption, DropQueueFull)
 		}
 	default:
-		element.peer.device.PutMessageBuffer(element.buffer)
-		element.peer.device.PutOutboundElement(element)
+		device.PutOutboundElement(element)
+		device.countDrop(QueueOutbound, DropQueueFull)
 	}
 }
 
@@ -117,8 +125,8 @@ func (peer *Peer) SendKeepalive() bool {
 		peer.device.log.Debug.Println(peer, "- Sending keepalive packet")
 		return true
 	default:
-		peer.device.PutMessageBuffer(elem.buffer)
 		peer.device.PutOutboundElement(elem)
+		peer.device.countDrop(QueueNonce, DropQueueFull)
 		return false
 	}
 }
@@ -135,6 +143,23 @@ func (peer *Peer) SendHandshakeInitiation(isRetry bool) error {
 	}
 	peer.handshake.mutex.RUnlock()
 
+	if peer.paceInitiation() {
+		return nil // sent once a slot is free, see pacing.go
+	}
+
+	return peer.sendHandshakeInitiation()
+}
+
+/* Sends an initiation now, also when deferred by pacing
+ */
+func (peer *Peer) sendHandshakeInitiation() error {
+	if peer.device.ha.standby.Get() {
+		return nil // sessions belong to the active instance, see ha.go
+	}
+	if peer.maintenanceRefuses() {
+		return nil // no new sessions, see maintenance.go
+	}
+
 	peer.handshake.mutex.Lock()
 	if time.Since(peer.handshake.lastSentHandshake) < RekeyTimeout {
 		peer.handshake.mutex.Unlock()
@@ -143,32 +168,55 @@ func (peer *Peer) SendHandshakeInitiation(isRetry bool) error {
 	peer.handshake.lastSentHandshake = time.Now()
 	peer.handshake.mutex.Unlock()
 
-	peer.device.log.Debug.Println(peer, "- Sending handshake initiation")
-
-	msg, err := peer.device.CreateMessageInitiation(peer)
-	if err != nil {
-		peer.device.log.Error.Println(peer, "- Failed to create initiation message:", err)
-		return err
+	var err error
+	packet := peer.createResumptionPacket()
+	if packet != nil {
+		peer.device.log.Debug.Println(peer, "- Sending resume initiation")
+	} else {
+		peer.device.log.Debug.Println(peer, "- Sending handshake initiation")
+		packet, err = peer.createInitiationPacket()
+		if err != nil {
+			return err
+		}
 	}
 
-	var buff [MessageInitiationSize]byte
-	writer := bytes.NewBuffer(buff[:0])
-	binary.Write(writer, binary.LittleEndian, msg)
-	packet := writer.Bytes()
-	peer.cookieGenerator.AddMacs(packet)
-
 	peer.timersAnyAuthenticatedPacketTraversal()
 	peer.timersAnyAuthenticatedPacketSent()
 
-	err = peer.SendBuffer(packet)
+	err = peer.sendBuffer(packet, true)
 	if err != nil {
 		peer.device.log.Error.Println(peer, "- Failed to send handshake initiation", err)
+
+		// the initiation never left, as when routes are not yet set up
+		// right after bring-up, so let the next packet retry shortly
+		// instead of waiting out the rekey timeout
+
+		peer.handshake.mutex.Lock()
+		peer.handshake.lastSentHandshake = time.Now().Add(HandshakeInitationRate - RekeyTimeout)
+		peer.handshake.mutex.Unlock()
+	} else {
+		peer.qualityInitiationSent()
 	}
 	peer.timersHandshakeInitiated()
 
 	return err
 }
 
+func (peer *Peer) createInitiationPacket() ([]byte, error) {
+	msg, err := peer.device.CreateMessageInitiation(peer)
+	if err != nil {
+		peer.device.log.Error.Println(peer, "- Failed to create initiation message:", err)
+		return nil, err
+	}
+
+	var buff [MessageInitiationSize]byte
+	writer := bytes.NewBuffer(buff[:0])
+	binary.Write(writer, binary.LittleEndian, msg)
+	packet := writer.Bytes()
+	peer.cookieGenerator.AddMacs(packet)
+	return packet, nil
+}
+
 func (peer *Peer) SendHandshakeResponse() error {
 	peer.handshake.mutex.Lock()
 	peer.handshake.lastSentHandshake = time.Now()
@@ -198,7 +246,7 @@ func (peer *Peer) SendHandshakeResponse() error {
 	peer.timersAnyAuthenticatedPacketTraversal()
 	peer.timersAnyAuthenticatedPacketSent()
 
-	err = peer.SendBuffer(packet)
+	err = peer.sendBuffer(packet, true)
 	if err != nil {
 		peer.device.log.Error.Println(peer, "- Failed to send handshake response", err)
 	}
@@ -219,7 +267,17 @@ func (device *Device) SendHandshakeCookie(initiatingElem *QueueHandshakeElement)
 	var buff [MessageCookieReplySize]byte
 	writer := bytes.NewBuffer(buff[:0])
 	binary.Write(writer, binary.LittleEndian, reply)
-	device.net.bind.Send(writer.Bytes(), initiatingElem.endpoint)
+	bind := device.net.bind
+	if initiatingElem.control {
+		bind = device.net.controlBind
+	}
+	switch initiatingElem.endpoint.(type) {
+	case *RelayEndpoint:
+		bind = device.net.relayBind
+	case *TURNEndpoint:
+		bind = device.net.turnBind
+	}
+	err = bind.Send(writer.Bytes(), initiatingElem.endpoint)
 	if err != nil {
 		device.log.Error.Println("Failed to send cookie reply:", err)
 	}
@@ -232,7 +290,7 @@ func (peer *Peer) keepKeyFreshSending() {
 		return
 	}
 	nonce := atomic.LoadUint64(&keypair.sendNonce)
-	if nonce > RekeyAfterMessages || (keypair.isInitiator && time.Since(keypair.created) > RekeyAfterTime) {
+	if nonce > RekeyAfterMessages || (keypair.isInitiator && time.Since(keypair.created) > keypair.rekeyAfterTime()) {
 		peer.SendHandshakeInitiation(false)
 	}
 }
@@ -259,7 +317,6 @@ func (device *Device) RoutineReadFromTUN() {
 
 	for {
 		if elem != nil {
-			device.PutMessageBuffer(elem.buffer)
 			device.PutOutboundElement(elem)
 		}
 		elem = device.NewOutboundElement()
@@ -274,7 +331,6 @@ func (device *Device) RoutineReadFromTUN() {
 				logError.Println("Failed to read packet from TUN device:", err)
 				device.Close()
 			}
-			device.PutMessageBuffer(elem.buffer)
 			device.PutOutboundElement(elem)
 			return
 		}
@@ -285,6 +341,11 @@ func (device *Device) RoutineReadFromTUN() {
 
 		elem.packet = elem.buffer[offset : offset+size]
 
+		if truncatedPacket(elem.packet) {
+			logDebug.Println("Dropped packet from TUN device larger than the read buffer")
+			continue
+		}
+
 		// lookup peer
 
 		var peer *Peer
@@ -314,6 +375,14 @@ func (device *Device) RoutineReadFromTUN() {
 		// insert into nonce/pre-handshake queue
 
 		if peer.isRunning.Get() {
+			peer.netmapOutbound(elem.packet)
+			device.clampMSS(elem.packet)
+			peer.countFlow(elem.packet, flowEgress)
+			peer.mirrorPacket(elem.packet)
+			if peer.isSelf() {
+				device.hairpin(peer, elem)
+				continue
+			}
 			if peer.queue.packetInNonceQueueIsAwaitingKey.Get() {
 				peer.SendHandshakeInitiation(false)
 			}
@@ -323,6 +392,28 @@ func (device *Device) RoutineReadFromTUN() {
 	}
 }
 
+/* Reports whether a packet read from the TUN device is shorter than its
+ * IP header claims, which is how a packet exceeding the read buffer
+ * shows, TUN devices silently truncating what does not fit
+ */
+func truncatedPacket(packet []byte) bool {
+	switch packet[0] >> 4 {
+	case ipv4.Version:
+		if len(packet) < ipv4.HeaderLen {
+			return false
+		}
+		length := binary.BigEndian.Uint16(packet[IPv4offsetTotalLength:])
+		return int(length) > len(packet)
+	case ipv6.Version:
+		if len(packet) < ipv6.HeaderLen {
+			return false
+		}
+		length := binary.BigEndian.Uint16(packet[IPv6offsetPayloadLength:])
+		return int(length)+ipv6.HeaderLen > len(packet)
+	}
+	return false
+}
+
 func (peer *Peer) FlushNonceQueue() {
 	select {
 	case peer.signals.flushNonceQueue <- struct{}{}:
@@ -346,8 +437,8 @@ func (peer *Peer) RoutineNonce() {
 		for {
 			select {
 			case elem := <-peer.queue.nonce:
-				device.PutMessageBuffer(elem.buffer)
 				device.PutOutboundElement(elem)
+				device.countDrop(QueueNonce, DropFlushed)
 			default:
 				return
 			}
@@ -414,13 +505,12 @@ func (peer *Peer) RoutineNonce() {
 					logDebug.Println(peer, "- Obtained awaited keypair")
 
 				case <-peer.signals.flushNonceQueue:
-					device.PutMessageBuffer(elem.buffer)
 					device.PutOutboundElement(elem)
+					device.countDrop(QueueNonce, DropFlushed)
 					flush()
 					goto NextPacket
 
 				case <-peer.routines.stop:
-					device.PutMessageBuffer(elem.buffer)
 					device.PutOutboundElement(elem)
 					return
 				}
@@ -436,7 +526,6 @@ func (peer *Peer) RoutineNonce() {
 
 			if elem.nonce >= RejectAfterMessages {
 				atomic.StoreUint64(&keypair.sendNonce, RejectAfterMessages)
-				device.PutMessageBuffer(elem.buffer)
 				device.PutOutboundElement(elem)
 				goto NextPacket
 			}
@@ -468,7 +557,6 @@ func (device *Device) RoutineEncryption() {
 			case elem, ok := <-device.queue.encryption:
 				if ok && !elem.IsDropped() {
 					elem.Drop()
-					device.PutMessageBuffer(elem.buffer)
 					elem.Unlock()
 				}
 			default:
@@ -515,15 +603,18 @@ func (device *Device) RoutineEncryption() {
 			binary.LittleEndian.PutUint32(fieldReceiver, elem.keypair.remoteIndex)
 			binary.LittleEndian.PutUint64(fieldNonce, elem.nonce)
 
-			// pad content to multiple of 16
+			// pad content according to the padding mode of the peer
 
 			mtu := int(atomic.LoadInt32(&device.tun.mtu))
-			lastUnit := len(elem.packet) % mtu
-			paddedSize := (lastUnit + PaddingMultiple - 1) & ^(PaddingMultiple - 1)
-			if paddedSize > mtu {
-				paddedSize = mtu
+			if mtu > device.maxMTU() {
+				mtu = device.maxMTU()
+			}
+			mode := int(atomic.LoadInt32(&elem.peer.padding))
+			size := paddedSize(mode, len(elem.packet), mtu)
+			if padding := size - len(elem.packet); padding > 0 {
+				atomic.AddUint64(&elem.peer.stats.txPaddingBytes, uint64(padding))
 			}
-			for i := len(elem.packet); i < paddedSize; i++ {
+			for i := len(elem.packet); i < size; i++ {
 				elem.packet = append(elem.packet, 0)
 			}
 
@@ -551,7 +642,6 @@ func (peer *Peer) RoutineSequentialSender() {
 	device := peer.device
 
 	logDebug := device.log.Debug
-	logError := device.log.Error
 
 	defer func() {
 		for {
@@ -559,7 +649,6 @@ func (peer *Peer) RoutineSequentialSender() {
 			case elem, ok := <-peer.queue.outbound:
 				if ok {
 					if !elem.IsDropped() {
-						device.PutMessageBuffer(elem.buffer)
 						elem.Drop()
 					}
 					device.PutOutboundElement(elem)
@@ -577,6 +666,11 @@ func (peer *Peer) RoutineSequentialSender() {
 
 	peer.routines.starting.Done()
 
+	var deadline time.Time // of the last jittered packet, see cover.go
+	jitter := time.NewTimer(time.Hour)
+	jitter.Stop()
+	defer jitter.Stop()
+
 	for {
 		select {
 
@@ -595,23 +689,58 @@ func (peer *Peer) RoutineSequentialSender() {
 				continue
 			}
 
-			peer.timersAnyAuthenticatedPacketTraversal()
-			peer.timersAnyAuthenticatedPacketSent()
+			if !device.shapeEgress(len(elem.packet)) {
+				device.PutOutboundElement(elem)
+				continue
+			}
 
-			// send message and return buffer to pool
+			// delay data packets, never before those queued earlier
 
-			err := peer.SendBuffer(elem.packet)
 			if len(elem.packet) != MessageKeepaliveSize {
-				peer.timersDataSent()
-			}
-			device.PutMessageBuffer(elem.buffer)
-			device.PutOutboundElement(elem)
-			if err != nil {
-				logError.Println(peer, "- Failed to send data packet", err)
-				continue
+				if delay := peer.transmitJitter(); delay > 0 {
+					queued := elem.queued
+					if queued.IsZero() {
+						queued = time.Now()
+					}
+					if next := queued.Add(delay); next.After(deadline) {
+						deadline = next
+					}
+				}
+				if wait := time.Until(deadline); wait > 0 {
+					jitter.Reset(wait)
+					select {
+					case <-jitter.C:
+					case <-peer.routines.stop:
+						device.PutOutboundElement(elem)
+						return
+					}
+				}
 			}
 
-			peer.keepKeyFreshSending()
+			peer.transmit(elem)
 		}
 	}
 }
+
+/* Sends an encrypted transport message and returns its buffer to the pool
+ */
+func (peer *Peer) transmit(elem *QueueOutboundElement) {
+	device := peer.device
+
+	peer.timersAnyAuthenticatedPacketTraversal()
+	peer.timersAnyAuthenticatedPacketSent()
+
+	// send message and return buffer to pool
+
+	err := peer.SendBuffer(elem.packet)
+	if len(elem.packet) != MessageKeepaliveSize {
+		peer.timersDataSent()
+	}
+	device.PutOutboundElement(elem)
+	if err != nil {
+		device.log.Error.Println(peer, "- Failed to send data packet", err)
+		return
+	}
+
+	peer.keepKeyFreshSending()
+}
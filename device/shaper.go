@@ -0,0 +1,109 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"time"
+)
+
+/* Egress traffic shaping
+ *
+ * A token bucket shared by all peers caps the rate at which transport
+ * packets leave the device, so that a tunnel on a shared uplink can be
+ * limited without tc. Up to the burst size is sent at line rate; beyond
+ * that the sequential senders are paced, each packet waiting until the
+ * bucket has refilled enough to cover it. Waits shorter than the pacing
+ * interval are skipped and accumulate as debt instead, so that small
+ * packets leave in batches rather than waking a timer each. A packet
+ * which would wait longer than EgressMaxDelay is dropped.
+ *
+ * Handshake messages are not shaped.
+ */
+
+const (
+	EgressMaxDelay         = 100 * time.Millisecond
+	EgressDefaultPacing    = time.Millisecond
+	EgressDefaultBurstTime = 10 * time.Millisecond // of traffic at the configured rate
+)
+
+/* Caps egress to rate bits per second (0 = unlimited), allowing bursts of
+ * burst bytes (0 = default) and pacing at most every pacing interval
+ * (0 = default)
+ */
+func (device *Device) SetEgressShaping(rate uint64, burst uint32, pacing time.Duration) {
+	shaper := &device.shaper
+	shaper.Lock()
+	defer shaper.Unlock()
+
+	shaper.rate = rate
+	shaper.burstConfig = burst
+	shaper.pacingConfig = pacing
+
+	shaper.burst = float64(burst)
+	if burst == 0 {
+		shaper.burst = float64(rate) / 8 * EgressDefaultBurstTime.Seconds()
+		if shaper.burst < 2*DefaultMTU {
+			shaper.burst = 2 * DefaultMTU
+		}
+	}
+	shaper.pacing = pacing
+	if pacing == 0 {
+		shaper.pacing = EgressDefaultPacing
+	}
+	shaper.tokens = shaper.burst
+	shaper.last = time.Now()
+	shaper.enabled.Set(rate != 0)
+}
+
+func (device *Device) EgressShaping() (rate uint64, burst uint32, pacing time.Duration) {
+	shaper := &device.shaper
+	shaper.Lock()
+	defer shaper.Unlock()
+	return shaper.rate, shaper.burstConfig, shaper.pacingConfig
+}
+
+/* Should be called before a transport packet is sent,
+ * returns false if the packet is to be dropped
+ */
+func (device *Device) shapeEgress(size int) bool {
+	shaper := &device.shaper
+	if !shaper.enabled.Get() {
+		return true
+	}
+
+	shaper.Lock()
+
+	// refill bucket
+
+	now := time.Now()
+	bytesPerSecond := float64(shaper.rate) / 8
+	shaper.tokens += now.Sub(shaper.last).Seconds() * bytesPerSecond
+	if shaper.tokens > shaper.burst {
+		shaper.tokens = shaper.burst
+	}
+	shaper.last = now
+
+	// reserve tokens for the packet
+
+	shaper.tokens -= float64(size)
+	var delay time.Duration
+	if shaper.tokens < 0 {
+		delay = time.Duration(-shaper.tokens / bytesPerSecond * float64(time.Second))
+	}
+	if delay > EgressMaxDelay {
+		shaper.tokens += float64(size)
+		shaper.Unlock()
+		device.countDrop(QueueOutbound, DropShaped)
+		return false
+	}
+	pacing := shaper.pacing
+	shaper.Unlock()
+
+	if delay >= pacing {
+		time.Sleep(delay)
+	}
+	return true
+}
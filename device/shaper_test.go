@@ -0,0 +1,79 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEgressShaping(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	if !device.shapeEgress(1 << 20) {
+		t.Fatal("dropped packet without shaping")
+	}
+
+	// 1 MB/s with 10 kB burst: 60 kB take 50 ms
+
+	device.SetEgressShaping(8000000, 10000, 100*time.Microsecond)
+	start := time.Now()
+	for i := 0; i < 60; i++ {
+		if !device.shapeEgress(1000) {
+			t.Fatal("dropped packet within maximum delay")
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("sending took %v, expected about 50ms", elapsed)
+	}
+
+	// 1 kB/s with default burst: the third packet would wait too long
+
+	device.SetEgressShaping(8000, 0, 0)
+	if !device.shapeEgress(1000) || !device.shapeEgress(1000) {
+		t.Fatal("dropped packet within burst")
+	}
+	if device.shapeEgress(1000) {
+		t.Fatal("sent packet exceeding maximum delay")
+	}
+	if drops := device.Stats().Queues[QueueOutbound].Drops[DropShaped]; drops != 1 {
+		t.Fatalf("counted %d shaped drops, expected 1", drops)
+	}
+	// frequent refills of less than a byte each still add up
+
+	device.SetEgressShaping(8000, 1000, 0)
+	device.shapeEgress(1000)
+	for start := time.Now(); time.Since(start) < 50*time.Millisecond; {
+		device.shapeEgress(0)
+	}
+	device.shaper.Lock()
+	tokens := device.shaper.tokens
+	device.shaper.Unlock()
+	if tokens < 40 {
+		t.Fatalf("refilled %v bytes in 50ms at 1 kB/s", tokens)
+	}
+}
+
+func TestEgressShapingConfig(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	if err := ipcSet(device, "egress_rate=100000000\negress_burst=65536\negress_pacing_us=500\n"); err != nil {
+		t.Fatal(err)
+	}
+	rate, burst, pacing := device.EgressShaping()
+	if rate != 100000000 || burst != 65536 || pacing != 500*time.Microsecond {
+		t.Fatalf("unexpected shaping %d, %d, %v", rate, burst, pacing)
+	}
+
+	if err := ipcSet(device, "egress_rate=0\n"); err != nil {
+		t.Fatal(err)
+	}
+	if device.shaper.enabled.Get() {
+		t.Fatal("shaping still enabled")
+	}
+}
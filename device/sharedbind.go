@@ -0,0 +1,382 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+/* Shared binds
+ *
+ * A multi-tenant gateway may run one isolated device per customer
+ * behind a single UDP port. A SharedBind owns the socket and
+ * demultiplexes received datagrams among the devices attached to it:
+ *
+ *  - handshake initiations go to the device whose public key
+ *    verifies their MAC1
+ *  - resume initiations go to the device which issued their ticket
+ *  - responses, resume responses, cookie replies and transport
+ *    packets go to the device which allocated their receiver index
+ *
+ * Receiver indices are kept unique across the attached devices, and
+ * the owner of each index received is cached. Datagrams claimed by no
+ * device are dropped, as are those finding the queue of their device
+ * full.
+ *
+ * An attached device uses the shared socket whenever it is up, in
+ * place of its listen port, and setting its fwmark sets that of the
+ * shared socket. The route listener of the socket, which refreshes the
+ * cached source addresses of peers on Linux, is not run for a shared
+ * socket.
+ */
+
+const (
+	SharedBindQueueSize = 1024 // per device and IP version
+	SharedBindSweepMin  = 4096 // cached receiver indices before stale ones are removed
+)
+
+var errSharedBindClosed = errors.New("shared bind closed")
+
+type SharedBind struct {
+	bind     Bind
+	port     uint16
+	stopping sync.WaitGroup
+
+	sync.RWMutex
+	closed  bool
+	members map[*Device]*sharedMember
+	indices map[uint32]*Device // owners of receiver indices seen
+	sweepAt int
+}
+
+type sharedMember struct {
+	shared *SharedBind
+	device *Device
+	ipv4   chan sharedPacket
+	ipv6   chan sharedPacket
+	closed chan struct{}
+	once   sync.Once
+}
+
+type sharedPacket struct {
+	buffer   *[MaxMessageSize]byte
+	size     int
+	endpoint Endpoint
+}
+
+var sharedBufferPool = sync.Pool{
+	New: func() interface{} {
+		return new([MaxMessageSize]byte)
+	},
+}
+
+/* Opens a socket on port, chosen randomly if zero, to be shared by devices
+ */
+func NewSharedBind(port uint16) (*SharedBind, error) {
+	bind, port, err := CreateBind(port, nil)
+	if err != nil {
+		return nil, err
+	}
+	shared := &SharedBind{
+		bind:    bind,
+		port:    port,
+		members: make(map[*Device]*sharedMember),
+		indices: make(map[uint32]*Device),
+		sweepAt: SharedBindSweepMin,
+	}
+	shared.stopping.Add(2)
+	go shared.RoutineReceive(ipv4.Version)
+	go shared.RoutineReceive(ipv6.Version)
+	return shared, nil
+}
+
+func (shared *SharedBind) Port() uint16 {
+	return shared.port
+}
+
+/* Closes the socket, leaving all attached devices without one
+ */
+func (shared *SharedBind) Close() error {
+	shared.Lock()
+	if shared.closed {
+		shared.Unlock()
+		return nil
+	}
+	shared.closed = true
+	members := make([]*sharedMember, 0, len(shared.members))
+	for _, member := range shared.members {
+		members = append(members, member)
+	}
+	shared.Unlock()
+
+	for _, member := range members {
+		member.Close()
+	}
+	err := shared.bind.Close()
+	shared.stopping.Wait()
+	return err
+}
+
+/* Uses the shared socket, or an own one on a random port if shared is
+ * nil, rebinding if the device is up
+ */
+func (device *Device) SetSharedBind(shared *SharedBind) error {
+	device.net.Lock()
+	if device.net.shared != nil {
+		device.net.port = 0
+	}
+	device.net.shared = shared
+	device.net.Unlock()
+	return device.BindUpdate()
+}
+
+func (shared *SharedBind) attach(device *Device) (Bind, uint16, error) {
+	shared.Lock()
+	defer shared.Unlock()
+
+	if shared.closed {
+		return nil, 0, errSharedBindClosed
+	}
+
+	member := &sharedMember{
+		shared: shared,
+		device: device,
+		ipv4:   make(chan sharedPacket, SharedBindQueueSize),
+		ipv6:   make(chan sharedPacket, SharedBindQueueSize),
+		closed: make(chan struct{}),
+	}
+	shared.members[device] = member
+
+	device.indexTable.Lock()
+	device.indexTable.inUse = func(index uint32) bool {
+		return shared.indexInUse(index, device)
+	}
+	device.indexTable.Unlock()
+
+	return member, shared.port, nil
+}
+
+func (shared *SharedBind) detach(member *sharedMember) {
+	shared.Lock()
+	defer shared.Unlock()
+
+	if shared.members[member.device] != member {
+		return
+	}
+	delete(shared.members, member.device)
+
+	member.device.indexTable.Lock()
+	member.device.indexTable.inUse = nil
+	member.device.indexTable.Unlock()
+}
+
+/* Checks whether a device other than self holds the receiver index
+ */
+func (shared *SharedBind) indexInUse(index uint32, self *Device) bool {
+	shared.RLock()
+	defer shared.RUnlock()
+
+	for device := range shared.members {
+		if device != self && device.indexTable.Lookup(index).peer != nil {
+			return true
+		}
+	}
+	return false
+}
+
+/* Returns the device the datagram is destined to, or nil
+ */
+func (shared *SharedBind) lookup(packet []byte) *sharedMember {
+	if len(packet) < MinMessageSize {
+		return nil
+	}
+
+	var receiver uint32
+	switch binary.LittleEndian.Uint32(packet[:4]) {
+	case MessageInitiationType:
+		if len(packet) != MessageInitiationSize {
+			return nil
+		}
+		shared.RLock()
+		defer shared.RUnlock()
+		for device, member := range shared.members {
+			if device.cookieChecker.CheckMAC1(packet) {
+				return member
+			}
+		}
+		return nil
+
+	case MessageResumeInitiationType:
+		if len(packet) != MessageResumeInitiationSize {
+			return nil
+		}
+		var ticket resumptionTicket
+		copy(ticket[:], packet[8:16])
+		shared.RLock()
+		defer shared.RUnlock()
+		for device, member := range shared.members {
+			device.resumption.Lock()
+			_, ok := device.resumption.tickets[ticket]
+			device.resumption.Unlock()
+			if ok {
+				return member
+			}
+		}
+		return nil
+
+	case MessageResponseType:
+		if len(packet) != MessageResponseSize {
+			return nil
+		}
+		receiver = binary.LittleEndian.Uint32(packet[8:12])
+
+	case MessageResumeResponseType:
+		if len(packet) != MessageResumeResponseSize {
+			return nil
+		}
+		receiver = binary.LittleEndian.Uint32(packet[8:12])
+
+	case MessageCookieReplyType:
+		if len(packet) != MessageCookieReplySize {
+			return nil
+		}
+		receiver = binary.LittleEndian.Uint32(packet[4:8])
+
+	case MessageTransportType:
+		if len(packet) < MessageTransportSize {
+			return nil
+		}
+		receiver = binary.LittleEndian.Uint32(packet[MessageTransportOffsetReceiver:MessageTransportOffsetCounter])
+
+	default:
+		return nil
+	}
+
+	// check cached owner of index
+
+	shared.RLock()
+	if device, ok := shared.indices[receiver]; ok && device.indexTable.Lookup(receiver).peer != nil {
+		member := shared.members[device]
+		shared.RUnlock()
+		return member
+	}
+	var owner *Device
+	for device := range shared.members {
+		if device.indexTable.Lookup(receiver).peer != nil {
+			owner = device
+			break
+		}
+	}
+	shared.RUnlock()
+
+	if owner == nil {
+		return nil
+	}
+
+	// cache new owner, removing stale entries as the cache grows
+
+	shared.Lock()
+	defer shared.Unlock()
+	if len(shared.indices) >= shared.sweepAt {
+		for index, device := range shared.indices {
+			if shared.members[device] == nil || device.indexTable.Lookup(index).peer == nil {
+				delete(shared.indices, index)
+			}
+		}
+		shared.sweepAt = 2 * len(shared.indices)
+		if shared.sweepAt < SharedBindSweepMin {
+			shared.sweepAt = SharedBindSweepMin
+		}
+	}
+	shared.indices[receiver] = owner
+	return shared.members[owner]
+}
+
+/* Receives datagrams from the socket and queues them for their device
+ */
+func (shared *SharedBind) RoutineReceive(IP int) {
+	defer shared.stopping.Done()
+
+	for {
+		buffer := sharedBufferPool.Get().(*[MaxMessageSize]byte)
+
+		var (
+			size     int
+			endpoint Endpoint
+			err      error
+		)
+		switch IP {
+		case ipv4.Version:
+			size, endpoint, err = shared.bind.ReceiveIPv4(buffer[:])
+		case ipv6.Version:
+			size, endpoint, err = shared.bind.ReceiveIPv6(buffer[:])
+		default:
+			panic("invalid IP version")
+		}
+		if err != nil {
+			sharedBufferPool.Put(buffer)
+			return
+		}
+
+		member := shared.lookup(buffer[:size])
+		if member == nil {
+			sharedBufferPool.Put(buffer)
+			continue
+		}
+
+		queue := member.ipv4
+		if IP == ipv6.Version {
+			queue = member.ipv6
+		}
+		select {
+		case queue <- sharedPacket{buffer: buffer, size: size, endpoint: endpoint}:
+		default:
+			sharedBufferPool.Put(buffer)
+		}
+	}
+}
+
+func (member *sharedMember) receive(queue chan sharedPacket, buff []byte) (int, Endpoint, error) {
+	select {
+	case packet := <-queue:
+		size := copy(buff, packet.buffer[:packet.size])
+		sharedBufferPool.Put(packet.buffer)
+		return size, packet.endpoint, nil
+	case <-member.closed:
+		return 0, nil, errSharedBindClosed
+	}
+}
+
+func (member *sharedMember) ReceiveIPv4(buff []byte) (int, Endpoint, error) {
+	return member.receive(member.ipv4, buff)
+}
+
+func (member *sharedMember) ReceiveIPv6(buff []byte) (int, Endpoint, error) {
+	return member.receive(member.ipv6, buff)
+}
+
+func (member *sharedMember) Send(buff []byte, end Endpoint) error {
+	return member.shared.bind.Send(buff, end)
+}
+
+func (member *sharedMember) SetMark(value uint32) error {
+	return member.shared.bind.SetMark(value)
+}
+
+/* Detaches the device, leaving the socket open for the others
+ */
+func (member *sharedMember) Close() error {
+	member.once.Do(func() {
+		member.shared.detach(member)
+		close(member.closed)
+	})
+	return nil
+}
@@ -0,0 +1,127 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSharedBind(t *testing.T) {
+	shared, err := NewSharedBind(0)
+	assertNil(t, err)
+	defer shared.Close()
+
+	publicKey := func(device *Device) NoisePublicKey {
+		device.staticIdentity.RLock()
+		defer device.staticIdentity.RUnlock()
+		return device.staticIdentity.publicKey
+	}
+	up := func(device *Device) uint16 {
+		atomic.StoreInt32(&device.tun.mtu, 1420)
+		device.Up()
+		if err := ipcSet(device, "listen_port=0\n"); err != nil {
+			t.Fatal(err)
+		}
+		device.net.RLock()
+		defer device.net.RUnlock()
+		return device.net.port
+	}
+	connect := func(device, other *Device, port uint16) *Peer {
+		config := fmt.Sprintf("public_key=%s\nendpoint=127.0.0.1:%d\n", publicKey(other).ToHex(), port)
+		if err := ipcSet(device, config); err != nil {
+			t.Fatal(err)
+		}
+		return device.LookupPeer(publicKey(other))
+	}
+
+	// two tenants on the shared port, each with one client
+
+	var tenants, clients [2]*Device
+	var tenantPeers, clientPeers [2]*Peer
+	for i := range tenants {
+		tenants[i] = randDevice(t)
+		defer tenants[i].Close()
+		assertNil(t, tenants[i].SetSharedBind(shared))
+		if port := up(tenants[i]); port != shared.Port() {
+			t.Fatalf("tenant %d listening on %d instead of shared port %d", i, port, shared.Port())
+		}
+
+		clients[i] = randDevice(t)
+		defer clients[i].Close()
+		port := up(clients[i])
+
+		tenantPeers[i] = connect(tenants[i], clients[i], port)
+		clientPeers[i] = connect(clients[i], tenants[i], shared.Port())
+	}
+
+	for i := range tenants {
+
+		// initiations are demultiplexed by MAC1, transport packets by index
+
+		result, err := clientPeers[i].Ping(time.Second)
+		assertNil(t, err)
+		if !result.Responded {
+			t.Fatalf("tenant %d did not answer client initiation", i)
+		}
+		deadline := time.Now().Add(time.Second)
+		for atomic.LoadUint64(&tenantPeers[i].stats.rxBytes) == 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("tenant %d received no transport packets", i)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if i == 0 && atomic.LoadUint64(&tenantPeers[1].stats.rxBytes) != 0 {
+			t.Fatal("transport packets delivered to the wrong tenant")
+		}
+
+		// responses are demultiplexed by index
+
+		time.Sleep(HandshakeInitationRate)
+		result, err = tenantPeers[i].Ping(time.Second)
+		assertNil(t, err)
+		if !result.Responded {
+			t.Fatalf("tenant %d received no response from client", i)
+		}
+	}
+
+	// a detached tenant falls back to its own socket
+
+	assertNil(t, tenants[0].SetSharedBind(nil))
+	tenants[0].net.RLock()
+	port := tenants[0].net.port
+	tenants[0].net.RUnlock()
+	if port == shared.Port() {
+		t.Fatal("detached tenant still on shared port")
+	}
+	if shared.lookup(make([]byte, MessageInitiationSize)) != nil {
+		t.Fatal("initiation with invalid MAC1 claimed")
+	}
+
+	// resume initiations are demultiplexed by ticket, resume responses by index
+
+	member := shared.members[tenants[1]]
+	resumeInitiation := make([]byte, MessageResumeInitiationSize)
+	binary.LittleEndian.PutUint32(resumeInitiation, MessageResumeInitiationType)
+	if shared.lookup(resumeInitiation) != nil {
+		t.Fatal("resume initiation with unknown ticket claimed")
+	}
+	tenants[1].resumption.Lock()
+	tenants[1].resumption.tickets = map[resumptionTicket]*Peer{{}: tenantPeers[1]}
+	tenants[1].resumption.Unlock()
+	if shared.lookup(resumeInitiation) != member {
+		t.Fatal("resume initiation not delivered to the tenant holding its ticket")
+	}
+	resumeResponse := make([]byte, MessageResumeResponseSize)
+	binary.LittleEndian.PutUint32(resumeResponse, MessageResumeResponseType)
+	binary.LittleEndian.PutUint32(resumeResponse[8:12], tenantPeers[1].keypairs.Current().localIndex)
+	if shared.lookup(resumeResponse) != member {
+		t.Fatal("resume response not delivered to the tenant holding its index")
+	}
+}
@@ -0,0 +1,185 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"fmt"
+	"sync/atomic"
+
+	"golang.zx2c4.com/wireguard/ipc"
+)
+
+/* Stages of the packet pipeline which are backed by a queue.
+ * The per-peer queues are aggregated over all peers.
+ */
+
+const (
+	QueueHandshake = iota
+	QueueEncryption
+	QueueDecryption
+	QueueNonce
+	QueueOutbound
+	QueueInbound
+	QueueMirror
+	queueCount
+)
+
+var queueNames = [queueCount]string{
+	QueueHandshake:  "handshake",
+	QueueEncryption: "encryption",
+	QueueDecryption: "decryption",
+	QueueNonce:      "nonce",
+	QueueOutbound:   "outbound",
+	QueueInbound:    "inbound",
+	QueueMirror:     "mirror",
+}
+
+/* Reasons for a packet being dropped by a queue
+ */
+
+const (
+	DropQueueFull   = iota // the queue was full when inserting
+	DropEvicted            // removed to make room for a newer packet
+	DropFlushed            // discarded while flushing the queue
+	DropShaped             // exceeded the egress rate, see shaper.go
+	DropSanitized          // rejected by the ip options policy, see sanitize.go
+	DropRatelimited        // handshake refused by the ratelimiter while under load
+	dropReasonCount
+)
+
+var dropReasonNames = [dropReasonCount]string{
+	DropQueueFull:   "full",
+	DropEvicted:     "evicted",
+	DropFlushed:     "flushed",
+	DropShaped:      "shaped",
+	DropSanitized:   "sanitized",
+	DropRatelimited: "ratelimited",
+}
+
+type QueueStats struct {
+	Name     string
+	Depth    int
+	Capacity int
+	Drops    [dropReasonCount]uint64 // indexed by Drop* reason
+}
+
+type DeviceStats struct {
+	Queues  [queueCount]QueueStats // indexed by Queue* stage
+	Memory  MemoryStats
+	Matches []MatchStats
+}
+
+func DropReasonName(reason int) string {
+	return dropReasonNames[reason]
+}
+
+func (device *Device) countDrop(queue, reason int) {
+	atomic.AddUint64(&device.stats.drops[queue][reason], 1)
+}
+
+func (device *Device) Stats() DeviceStats {
+	var stats DeviceStats
+
+	for i := range stats.Queues {
+		queue := &stats.Queues[i]
+		queue.Name = queueNames[i]
+		for reason := range queue.Drops {
+			queue.Drops[reason] = atomic.LoadUint64(&device.stats.drops[i][reason])
+		}
+	}
+
+	// depths of device wide queues
+
+	gauge := func(queue int, depth, capacity int) {
+		stats.Queues[queue].Depth += depth
+		stats.Queues[queue].Capacity += capacity
+	}
+
+	gauge(QueueHandshake, len(device.queue.handshake), cap(device.queue.handshake))
+	gauge(QueueEncryption, len(device.queue.encryption), cap(device.queue.encryption))
+	for _, queue := range device.queue.decryption {
+		gauge(QueueDecryption, len(queue), cap(queue))
+	}
+	if m := device.loadMirror(); m != nil {
+		gauge(QueueMirror, len(m.queue), cap(m.queue))
+	}
+
+	// depths of per peer queues
+
+	device.peers.RLock()
+	for _, peer := range device.peers.keyMap {
+		peer.routines.Lock()
+		if peer.isRunning.Get() {
+			gauge(QueueNonce, len(peer.queue.nonce), cap(peer.queue.nonce))
+			gauge(QueueOutbound, len(peer.queue.outbound), cap(peer.queue.outbound))
+			gauge(QueueInbound, len(peer.queue.inbound), cap(peer.queue.inbound))
+		}
+		peer.routines.Unlock()
+	}
+	device.peers.RUnlock()
+
+	stats.Memory = device.memoryStats(&stats.Queues)
+	stats.Matches = device.matchStats()
+
+	return stats
+}
+
+func (device *Device) IpcStatsOperation(socket *bufio.Writer) *IPCError {
+	stats := device.Stats()
+
+	lines := []string{
+		fmt.Sprintf("memory_peers=%d", stats.Memory.Peers),
+		fmt.Sprintf("memory_allowedips=%d", stats.Memory.AllowedIPs),
+		fmt.Sprintf("memory_queues=%d", stats.Memory.Queues),
+		fmt.Sprintf("memory_limit=%d", stats.Memory.Limit),
+	}
+	for _, line := range lines {
+		_, err := socket.WriteString(line + "\n")
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorIO, ipc.ReasonIO, "failed to write output: %v", err)
+		}
+	}
+
+	for _, queue := range stats.Queues {
+		lines := []string{
+			"queue=" + queue.Name,
+			fmt.Sprintf("depth=%d", queue.Depth),
+			fmt.Sprintf("capacity=%d", queue.Capacity),
+		}
+		for reason, drops := range queue.Drops {
+			lines = append(lines, fmt.Sprintf("drops_%s=%d", dropReasonNames[reason], drops))
+		}
+		for _, line := range lines {
+			_, err := socket.WriteString(line + "\n")
+			if err != nil {
+				return ipcErrorf(ipc.IpcErrorIO, ipc.ReasonIO, "failed to write output: %v", err)
+			}
+		}
+	}
+
+	for _, match := range stats.Matches {
+		lines := []string{
+			"match=" + match.Name,
+			"expression=" + match.Expression,
+		}
+		for _, peer := range match.Peers {
+			lines = append(lines,
+				"public_key="+peer.PublicKey.ToHex(),
+				fmt.Sprintf("packets=%d", peer.Packets),
+				fmt.Sprintf("bytes=%d", peer.Bytes),
+			)
+		}
+		for _, line := range lines {
+			_, err := socket.WriteString(line + "\n")
+			if err != nil {
+				return ipcErrorf(ipc.IpcErrorIO, ipc.ReasonIO, "failed to write output: %v", err)
+			}
+		}
+	}
+
+	return nil
+}
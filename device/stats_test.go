@@ -0,0 +1,65 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestQueueFullDrops(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	// a queue without room drops the element
+
+	if device.addToHandshakeQueue(make(chan QueueHandshakeElement), QueueHandshakeElement{}) {
+		t.Fatal("element added to a full handshake queue")
+	}
+	if drops := device.Stats().Queues[QueueHandshake].Drops[DropQueueFull]; drops != 1 {
+		t.Fatalf("expected 1 handshake drop, got %d", drops)
+	}
+
+	// as does the mirror queue
+
+	sk, _ := newPrivateKey()
+	peer, err := device.NewPeer(sk.publicKey())
+	assertNil(t, err)
+	device.mirror.state.Store(&mirror{
+		queue: make(chan []byte),
+		stop:  make(chan struct{}),
+	})
+	local, remote := net.IPv4(10, 0, 0, 1).To4(), net.IPv4(10, 0, 0, 2).To4()
+	peer.mirrorPacket(testPacketIPv4(17, remote, local, 53, 50000))
+
+	stats := device.Stats()
+	if drops := stats.Queues[QueueMirror].Drops[DropQueueFull]; drops != 1 {
+		t.Fatalf("expected 1 mirror drop, got %d", drops)
+	}
+	if _, dropped := device.MirrorStats(); dropped != 1 {
+		t.Fatalf("expected 1 mirrored packet dropped, got %d", dropped)
+	}
+
+	// and both are reported by the stats operation
+
+	var buf strings.Builder
+	writer := bufio.NewWriter(&buf)
+	if err := device.IpcStatsOperation(writer); err != nil {
+		t.Fatal(err)
+	}
+	writer.Flush()
+	for _, lines := range []string{
+		"queue=handshake\ndepth=0\ncapacity=",
+		"queue=mirror\ndepth=0\ncapacity=0\ndrops_full=1\n",
+		"drops_ratelimited=0\n",
+	} {
+		if !strings.Contains(buf.String(), lines) {
+			t.Errorf("missing %q in %q", lines, buf.String())
+		}
+	}
+}
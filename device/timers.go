@@ -74,10 +74,12 @@ func (timer *Timer) IsPending() bool {
 }
 
 func (peer *Peer) timersActive() bool {
-	return peer.isRunning.Get() && peer.device != nil && peer.device.isUp.Get() && len(peer.device.peers.keyMap) > 0
+	return peer.isRunning.Get() && peer.device != nil && peer.device.isUp.Get() && !peer.device.peers.empty.Get()
 }
 
 func expiredRetransmitHandshake(peer *Peer) {
+	peer.qualityRetransmit()
+
 	if atomic.LoadUint32(&peer.timers.handshakeAttempts) > MaxTimerHandshakes {
 		peer.device.log.Debug.Printf("%s - Handshake did not complete after %d attempts, giving up\n", peer, MaxTimerHandshakes+2)
 
@@ -107,6 +109,16 @@ func expiredRetransmitHandshake(peer *Peer) {
 		}
 		peer.Unlock()
 
+		/* We fall back to the relay, if there is one, in case the direct path is broken. */
+		if atomic.LoadUint32(&peer.timers.handshakeAttempts) >= RelayFallbackAttempts {
+			peer.device.net.RLock()
+			hasRelay := peer.device.hasRelay()
+			peer.device.net.RUnlock()
+			if hasRelay {
+				peer.setRelayActive(true)
+			}
+		}
+
 		peer.SendHandshakeInitiation(true)
 	}
 }
@@ -122,6 +134,7 @@ func expiredSendKeepalive(peer *Peer) {
 }
 
 func expiredNewHandshake(peer *Peer) {
+	peer.qualityAnswer(false)
 	peer.device.log.Debug.Printf("%s - Retrying handshake because we stopped hearing back after %d seconds\n", peer, int((KeepaliveTimeout + RekeyTimeout).Seconds()))
 	/* We clear the endpoint address src address, in case this is the cause of trouble. */
 	peer.Lock()
@@ -136,6 +149,7 @@ func expiredNewHandshake(peer *Peer) {
 func expiredZeroKeyMaterial(peer *Peer) {
 	peer.device.log.Debug.Printf("%s - Removing all keys, since we haven't received a new one in %d seconds\n", peer, int((RejectAfterTime * 3).Seconds()))
 	peer.ZeroAndFlushAll()
+	peer.device.emit(peer.newEvent(EventPeerExpired))
 }
 
 func expiredPersistentKeepalive(peer *Peer) {
@@ -149,6 +163,7 @@ func (peer *Peer) timersDataSent() {
 	if peer.timersActive() && !peer.timers.newHandshake.IsPending() {
 		peer.timers.newHandshake.Mod(KeepaliveTimeout + RekeyTimeout + time.Millisecond*time.Duration(rand.Int31n(RekeyTimeoutJitterMaxMs)))
 	}
+	peer.timersAwaitAnswer()
 }
 
 /* Should be called after an authenticated data packet is received. */
@@ -171,9 +186,11 @@ func (peer *Peer) timersAnyAuthenticatedPacketSent() {
 
 /* Should be called after any type of authenticated packet is received -- keepalive, data, or handshake. */
 func (peer *Peer) timersAnyAuthenticatedPacketReceived() {
-	if peer.timersActive() {
+	if peer.timersActive() && peer.timers.newHandshake.IsPending() {
 		peer.timers.newHandshake.Del()
+		peer.qualityAnswer(true)
 	}
+	peer.timersAnswerReceived()
 }
 
 /* Should be called after a handshake initiation message is sent. */
@@ -181,6 +198,7 @@ func (peer *Peer) timersHandshakeInitiated() {
 	if peer.timersActive() {
 		peer.timers.retransmitHandshake.Mod(RekeyTimeout + time.Millisecond*time.Duration(rand.Int31n(RekeyTimeoutJitterMaxMs)))
 	}
+	peer.timersAwaitAnswer()
 }
 
 /* Should be called after a handshake response message is received and processed or when getting key confirmation via the first data message. */
@@ -213,6 +231,9 @@ func (peer *Peer) timersInit() {
 	peer.timers.newHandshake = peer.NewTimer(expiredNewHandshake)
 	peer.timers.zeroKeyMaterial = peer.NewTimer(expiredZeroKeyMaterial)
 	peer.timers.persistentKeepalive = peer.NewTimer(expiredPersistentKeepalive)
+	peer.timers.coverTraffic = peer.NewTimer(expiredCoverTraffic)
+	peer.timers.gossip = peer.NewTimer(expiredGossip)
+	peer.timers.unreachable = peer.NewTimer(expiredUnreachable)
 	atomic.StoreUint32(&peer.timers.handshakeAttempts, 0)
 	peer.timers.sentLastMinuteHandshake.Set(false)
 	peer.timers.needAnotherKeepalive.Set(false)
@@ -224,4 +245,7 @@ func (peer *Peer) timersStop() {
 	peer.timers.newHandshake.DelSync()
 	peer.timers.zeroKeyMaterial.DelSync()
 	peer.timers.persistentKeepalive.DelSync()
+	peer.timers.coverTraffic.DelSync()
+	peer.timers.gossip.DelSync()
+	peer.timers.unreachable.DelSync()
 }
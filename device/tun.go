@@ -13,6 +13,13 @@ import (
 
 const DefaultMTU = 1420
 
+/* Returns the largest MTU whose packets fit in the read buffers,
+ * at most MaxMTU
+ */
+func (device *Device) maxMTU() int {
+	return device.options.ReadBufferSize - MessageTransportSize
+}
+
 func (device *Device) RoutineTUNEventReader() {
 	setUp := false
 	logDebug := device.log.Debug
@@ -29,7 +36,7 @@ func (device *Device) RoutineTUNEventReader() {
 			if err != nil {
 				logError.Println("Failed to load updated MTU of device:", err)
 			} else if int(old) != mtu {
-				if mtu+MessageTransportSize > MaxMessageSize {
+				if mtu > device.maxMTU() {
 					logInfo.Println("MTU updated:", mtu, "(too large)")
 				} else {
 					logInfo.Println("MTU updated:", mtu)
@@ -39,15 +46,13 @@ func (device *Device) RoutineTUNEventReader() {
 		}
 
 		if event&tun.EventUp != 0 && !setUp {
-			logInfo.Println("Interface set up")
 			setUp = true
-			device.Up()
+			device.handleTunUp()
 		}
 
 		if event&tun.EventDown != 0 && setUp {
-			logInfo.Println("Interface set down")
 			setUp = false
-			device.Down()
+			device.handleTunDown()
 		}
 	}
 
@@ -46,8 +46,7 @@ func (d *dummyTUN) Read(b []byte, offset int) (int, error) {
 	if !ok {
 		return 0, errors.New("device closed")
 	}
-	copy(b[offset:], buf)
-	return len(buf), nil
+	return copy(b[offset:], buf), nil
 }
 
 func (d *dummyTUN) Write(b []byte, offset int) (int, error) {
@@ -0,0 +1,134 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"time"
+)
+
+/* Behaviour when the TUN interface goes down
+ *
+ *   stop  - the sockets are closed and the sessions of all peers
+ *           discarded, as by Down (default)
+ *   grace - nothing changes for the grace period, so that sessions
+ *           survive a brief carrier flap; the device is only taken
+ *           down if the interface is still down when it ends
+ *   purge - as stop, and cookies received from peers as well as the
+ *           secret for cookies sent to them are discarded too
+ *
+ * Bringing the device down explicitly is not affected.
+ */
+
+type TunDownPolicy int32
+
+const (
+	TunDownStop TunDownPolicy = iota
+	TunDownGrace
+	TunDownPurge
+)
+
+const TunDownDefaultGrace = 30 * time.Second
+
+var tunDownPolicyNames = [...]string{
+	TunDownStop:  "stop",
+	TunDownGrace: "grace",
+	TunDownPurge: "purge",
+}
+
+func (policy TunDownPolicy) String() string {
+	if policy < 0 || int(policy) >= len(tunDownPolicyNames) {
+		return "unknown"
+	}
+	return tunDownPolicyNames[policy]
+}
+
+func ParseTunDownPolicy(s string) (TunDownPolicy, error) {
+	for policy, name := range tunDownPolicyNames {
+		if s == name {
+			return TunDownPolicy(policy), nil
+		}
+	}
+	return TunDownStop, errors.New("invalid tun down policy: " + s)
+}
+
+/* Sets the policy, where a zero grace period selects TunDownDefaultGrace
+ */
+func (device *Device) SetTunDownPolicy(policy TunDownPolicy, grace time.Duration) {
+	if grace <= 0 {
+		grace = TunDownDefaultGrace
+	}
+	device.tunDown.Lock()
+	defer device.tunDown.Unlock()
+	device.tunDown.policy = policy
+	device.tunDown.grace = grace
+}
+
+func (device *Device) TunDownPolicy() (TunDownPolicy, time.Duration) {
+	device.tunDown.Lock()
+	defer device.tunDown.Unlock()
+	return device.tunDown.policy, device.tunDown.grace
+}
+
+/* Should be called when the TUN interface goes down
+ */
+func (device *Device) handleTunDown() {
+	device.tunDown.Lock()
+	defer device.tunDown.Unlock()
+
+	switch device.tunDown.policy {
+	case TunDownGrace:
+		grace := device.tunDown.grace
+		device.log.Info.Println("Interface set down, keeping sessions for", grace)
+		var timer *time.Timer
+		timer = time.AfterFunc(grace, func() {
+			device.tunDown.Lock()
+			defer device.tunDown.Unlock()
+			if device.tunDown.timer != timer {
+				return
+			}
+			device.tunDown.timer = nil
+			device.log.Info.Println("Interface still down after", grace)
+			device.Down()
+		})
+		device.tunDown.timer = timer
+
+	case TunDownPurge:
+		device.log.Info.Println("Interface set down, purging sessions")
+		device.Down()
+		device.purgeCookies()
+
+	default:
+		device.log.Info.Println("Interface set down")
+		device.Down()
+	}
+}
+
+/* Should be called when the TUN interface goes up
+ */
+func (device *Device) handleTunUp() {
+	device.tunDown.Lock()
+	if device.tunDown.timer != nil {
+		device.tunDown.timer.Stop()
+		device.tunDown.timer = nil
+	}
+	device.tunDown.Unlock()
+
+	device.log.Info.Println("Interface set up")
+	device.Up()
+}
+
+func (device *Device) purgeCookies() {
+	device.staticIdentity.RLock()
+	device.cookieChecker.Init(device.staticIdentity.publicKey)
+	device.staticIdentity.RUnlock()
+
+	device.peers.RLock()
+	for _, peer := range device.peers.keyMap {
+		peer.cookieGenerator.Init(peer.handshake.remoteStatic)
+	}
+	device.peers.RUnlock()
+}
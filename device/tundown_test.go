@@ -0,0 +1,71 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTunDownGrace(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	if err := ipcSet(device, "tun_down=grace\ntun_down_grace=5\n"); err != nil {
+		t.Fatal(err)
+	}
+	if policy, grace := device.TunDownPolicy(); policy != TunDownGrace || grace != 5*time.Second {
+		t.Fatalf("unexpected policy %v, grace %v", policy, grace)
+	}
+	device.SetTunDownPolicy(TunDownGrace, 100*time.Millisecond)
+
+	device.handleTunUp()
+	device.handleTunDown()
+	if !device.isUp.Get() {
+		t.Fatal("device taken down within grace period")
+	}
+
+	// coming back up cancels the grace period
+
+	device.handleTunUp()
+	time.Sleep(200 * time.Millisecond)
+	if !device.isUp.Get() {
+		t.Fatal("device taken down after interface came back up")
+	}
+
+	device.handleTunDown()
+	time.Sleep(300 * time.Millisecond)
+	if device.isUp.Get() {
+		t.Fatal("device still up after grace period")
+	}
+}
+
+func TestTunDownPurge(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	peer, err := device.NewPeer(sk.publicKey())
+	assertNil(t, err)
+
+	device.SetTunDownPolicy(TunDownPurge, 0)
+	device.handleTunUp()
+	peer.cookieGenerator.Lock()
+	peer.cookieGenerator.mac2.cookieSet = time.Now()
+	peer.cookieGenerator.Unlock()
+
+	device.handleTunDown()
+	if device.isUp.Get() {
+		t.Fatal("device still up")
+	}
+	peer.cookieGenerator.Lock()
+	cookieSet := peer.cookieGenerator.mac2.cookieSet
+	peer.cookieGenerator.Unlock()
+	if !cookieSet.IsZero() {
+		t.Fatal("cookie kept after purge")
+	}
+}
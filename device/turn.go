@@ -0,0 +1,201 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/turn"
+)
+
+/* TURN relayed transport
+ *
+ * A TURN allocation is an alternative to the relay of relay.go, used
+ * for the same fallback. Peers are reached at their usual endpoint
+ * address through the allocation, and see datagrams arriving from the
+ * relayed address, to which they roam like to any other address.
+ * Hence the remote peer needs no support for TURN.
+ *
+ * Over UAPI the server is set with turn=<host:port>, after its
+ * credentials turn_username and turn_password, which may contain any
+ * character but newlines. The password is never returned.
+ */
+
+type TURNEndpoint struct {
+	addr net.UDPAddr // address of the peer, reached through the allocation
+}
+
+var _ Endpoint = (*TURNEndpoint)(nil)
+
+func (end *TURNEndpoint) ClearSrc()           {}
+func (end *TURNEndpoint) SrcToString() string { return "" }
+func (end *TURNEndpoint) DstIP() net.IP       { return end.addr.IP }
+func (end *TURNEndpoint) SrcIP() net.IP       { return nil }
+func (end *TURNEndpoint) DstToString() string { return end.addr.String() }
+
+func (end *TURNEndpoint) DstToBytes() []byte {
+	out := end.addr.IP.To4()
+	if out == nil {
+		out = end.addr.IP
+	}
+	out = append(out, byte(end.addr.Port&0xff))
+	out = append(out, byte((end.addr.Port>>8)&0xff))
+	return out
+}
+
+func newTURNEndpoint(endpoint Endpoint) *TURNEndpoint {
+	addr, err := parseEndpoint(endpoint.DstToString())
+	if err != nil {
+		return nil
+	}
+	return &TURNEndpoint{addr: *addr}
+}
+
+/* A turnBind receives from the allocation on the IPv4 routine,
+ * allocating anew whenever the allocation is lost
+ */
+type turnBind struct {
+	device   *Device
+	server   string
+	username string
+	password string
+	closed   chan struct{}
+
+	sync.RWMutex
+	client *turn.Client
+}
+
+var _ Bind = (*turnBind)(nil)
+
+func newTURNBind(device *Device, server, username, password string) *turnBind {
+	return &turnBind{
+		device:   device,
+		server:   server,
+		username: username,
+		password: password,
+		closed:   make(chan struct{}),
+	}
+}
+
+func (bind *turnBind) connect() (*turn.Client, error) {
+	for {
+		client, err := turn.Dial(bind.server, bind.username, bind.password)
+		if err == nil {
+			bind.Lock()
+			bind.client = client
+			bind.Unlock()
+			bind.device.log.Info.Println("Allocated TURN relayed address", client.RelayedAddr(), "on", bind.server)
+			return client, nil
+		}
+		bind.device.log.Error.Println("Failed to allocate on TURN server", bind.server, "-", err)
+
+		select {
+		case <-bind.closed:
+			return nil, errors.New("turn closed")
+		case <-time.After(RelayRedialTimeout):
+		}
+	}
+}
+
+func (bind *turnBind) ReceiveIPv4(buff []byte) (int, Endpoint, error) {
+	for {
+		bind.RLock()
+		client := bind.client
+		bind.RUnlock()
+
+		var err error
+		if client == nil {
+			client, err = bind.connect()
+			if err != nil {
+				return 0, nil, err
+			}
+		}
+
+		size, addr, err := client.ReadFrom(buff)
+		if err == nil {
+			return size, &TURNEndpoint{addr: *addr}, nil
+		}
+
+		client.Close()
+		bind.Lock()
+		if bind.client == client {
+			bind.client = nil
+		}
+		bind.Unlock()
+
+		select {
+		case <-bind.closed:
+			return 0, nil, err
+		default:
+		}
+	}
+}
+
+func (bind *turnBind) ReceiveIPv6(buff []byte) (int, Endpoint, error) {
+	<-bind.closed
+	return 0, nil, errors.New("turn closed")
+}
+
+func (bind *turnBind) Send(buff []byte, end Endpoint) error {
+	nend, ok := end.(*TURNEndpoint)
+	if !ok {
+		return errors.New("not a turn endpoint")
+	}
+	bind.RLock()
+	client := bind.client
+	bind.RUnlock()
+	if client == nil {
+		return errors.New("no turn allocation")
+	}
+	return client.WriteTo(buff, &nend.addr)
+}
+
+func (bind *turnBind) SetMark(mark uint32) error {
+	return nil
+}
+
+func (bind *turnBind) Close() error {
+	close(bind.closed)
+	bind.Lock()
+	defer bind.Unlock()
+	if bind.client != nil {
+		return bind.client.Close()
+	}
+	return nil
+}
+
+/* Returns the relayed address of the current allocation, if any
+ */
+func (bind *turnBind) relayedAddr() *net.UDPAddr {
+	bind.RLock()
+	defer bind.RUnlock()
+	if bind.client == nil {
+		return nil
+	}
+	return bind.client.RelayedAddr()
+}
+
+/* Returns the TURN server of the device and its credentials
+ */
+func (device *Device) TURN() (server, username, password string) {
+	device.net.RLock()
+	defer device.net.RUnlock()
+	return device.net.turnServer, device.net.turnUsername, device.net.turnPassword
+}
+
+/* Changes the TURN server of the device, takes effect on the next BindUpdate.
+ * An empty server disables TURN.
+ */
+func (device *Device) SetTURN(server, username, password string) {
+	device.net.Lock()
+	device.net.turnServer = server
+	device.net.turnUsername = username
+	device.net.turnPassword = password
+	device.net.Unlock()
+}
@@ -9,7 +9,9 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"math"
 	"net"
+	"net/url"
 	"strconv"
 	"strings"
 	"sync/atomic"
@@ -19,15 +21,39 @@ import (
 )
 
 type IPCError struct {
-	int64
+	code   int64  // negative errno, as sent to wg(8)
+	reason string // machine readable classification (see ipc.Reason*)
+	err    error  // human readable cause
 }
 
 func (s IPCError) Error() string {
-	return fmt.Sprintf("IPC error: %d", s.int64)
+	if s.err == nil {
+		return fmt.Sprintf("IPC error %d (%s)", s.code, s.reason)
+	}
+	return fmt.Sprintf("IPC error %d (%s): %v", s.code, s.reason, s.err)
 }
 
 func (s IPCError) ErrorCode() int64 {
-	return s.int64
+	return s.code
+}
+
+func (s IPCError) Reason() string {
+	return s.reason
+}
+
+func (s IPCError) Message() string {
+	if s.err == nil {
+		return ""
+	}
+	return s.err.Error()
+}
+
+func ipcErrorf(code int64, reason string, msg string, args ...interface{}) *IPCError {
+	return &IPCError{
+		code:   code,
+		reason: reason,
+		err:    fmt.Errorf(msg, args...),
+	}
 }
 
 func (device *Device) IpcGetOperation(socket *bufio.Writer) *IPCError {
@@ -51,10 +77,24 @@ func (device *Device) IpcGetOperation(socket *bufio.Writer) *IPCError {
 
 		// serialize device related values
 
+		/* Read only, reports the name of the interface,
+		 * which the kernel or tun package may have chosen
+		 */
+		if name, err := device.tun.device.Name(); err == nil && name != "" {
+			send("interface_name=" + name)
+		}
+
 		if !device.staticIdentity.privateKey.IsZero() {
 			send("private_key=" + device.staticIdentity.privateKey.ToHex())
 		}
 
+		/* Read only, identifies a key provider by its public key,
+		 * as public_key would start a peer
+		 */
+		if device.staticIdentity.provider != nil {
+			send("key_provider=" + device.staticIdentity.publicKey.ToHex())
+		}
+
 		if device.net.port != 0 {
 			send(fmt.Sprintf("listen_port=%d", device.net.port))
 		}
@@ -63,6 +103,110 @@ func (device *Device) IpcGetOperation(socket *bufio.Writer) *IPCError {
 			send(fmt.Sprintf("fwmark=%d", device.net.fwmark))
 		}
 
+		if device.net.controlPort != 0 {
+			send(fmt.Sprintf("control_port=%d", device.net.controlPort))
+		}
+
+		if device.net.relayAddress != "" {
+			send("relay=" + device.net.relayAddress)
+		}
+
+		// like the private key, the TURN password is never returned
+
+		if device.net.turnUsername != "" {
+			send("turn_username=" + device.net.turnUsername)
+		}
+
+		if device.net.turnServer != "" {
+			send("turn=" + device.net.turnServer)
+		}
+
+		if device.gossip.coordinator.Get() {
+			send("gossip_coordinator=true")
+		}
+
+		if collector, version := device.FlowExport(); collector != "" {
+			send("flow_collector=" + collector)
+			send(fmt.Sprintf("flow_version=%d", version))
+		}
+
+		if interval := device.StatsInterval(); interval != 0 {
+			send(fmt.Sprintf("stats_interval=%d", interval/time.Second))
+		}
+
+		if timeout := device.UnreachableTimeout(); timeout != 0 {
+			send(fmt.Sprintf("unreachable_timeout=%d", timeout/time.Second))
+		}
+
+		if jitter := device.RekeyJitter(); jitter != 0 {
+			send(fmt.Sprintf("rekey_jitter_ms=%d", jitter/time.Millisecond))
+		}
+
+		if rate, burst := device.HandshakePacing(); rate != 0 {
+			send(fmt.Sprintf("handshake_rate=%d", rate))
+			if burst != 0 {
+				send(fmt.Sprintf("handshake_burst=%d", burst))
+			}
+		}
+
+		if policy := device.IPOptionsPolicy(); policy != IPOptionsAllow {
+			send("ip_options=" + policy.String())
+		}
+
+		if mss := device.MSSClamp(); mss != MSSClampOff {
+			send("mss_clamp=" + formatMSSClamp(mss))
+		}
+
+		if active, deadline := device.Maintenance(); active {
+			remaining := time.Until(deadline)
+			if remaining < 0 {
+				remaining = 0
+			}
+			send(fmt.Sprintf("maintenance=%d", remaining/time.Second))
+			send(fmt.Sprintf("maintenance_sessions=%d", device.liveSessionsLocked()))
+		}
+		if refusal := device.MaintenanceRefusal(); refusal != MaintenanceSilent {
+			send("maintenance_refusal=" + refusal.String())
+		}
+
+		if policy, grace := device.TunDownPolicy(); policy != TunDownStop {
+			send("tun_down=" + policy.String())
+			if policy == TunDownGrace && grace != TunDownDefaultGrace {
+				send(fmt.Sprintf("tun_down_grace=%d", grace/time.Second))
+			}
+		}
+
+		if rate, burst, pacing := device.EgressShaping(); rate != 0 {
+			send(fmt.Sprintf("egress_rate=%d", rate))
+			if burst != 0 {
+				send(fmt.Sprintf("egress_burst=%d", burst))
+			}
+			if pacing != 0 {
+				send(fmt.Sprintf("egress_pacing_us=%d", pacing/time.Microsecond))
+			}
+		}
+
+		device.ha.Lock()
+		if device.ha.role != HARoleNone {
+			send("ha_role=" + device.ha.role.String())
+		}
+		if device.ha.address != "" {
+			send("ha_address=" + device.ha.address)
+		}
+		device.ha.Unlock()
+
+		for _, source := range device.loadHandshakeSources() {
+			send("handshake_source=" + source.String())
+		}
+
+		for _, rule := range device.loadMatches() {
+			send("match=" + rule.Name + " " + rule.Expression())
+		}
+
+		if mirror := device.Mirror(); mirror.enabled() {
+			send("mirror=" + mirror.String())
+		}
+
 		// serialize each peer state
 
 		for _, peer := range device.peers.keyMap {
@@ -75,6 +219,9 @@ func (device *Device) IpcGetOperation(socket *bufio.Writer) *IPCError {
 			if peer.endpoint != nil {
 				send("endpoint=" + peer.endpoint.DstToString())
 			}
+			if peer.control.port != 0 {
+				send(fmt.Sprintf("control_port=%d", peer.control.port))
+			}
 
 			nano := atomic.LoadInt64(&peer.stats.lastHandshakeNano)
 			secs := nano / time.Second.Nanoseconds()
@@ -84,7 +231,61 @@ func (device *Device) IpcGetOperation(socket *bufio.Writer) *IPCError {
 			send(fmt.Sprintf("last_handshake_time_nsec=%d", nano))
 			send(fmt.Sprintf("tx_bytes=%d", atomic.LoadUint64(&peer.stats.txBytes)))
 			send(fmt.Sprintf("rx_bytes=%d", atomic.LoadUint64(&peer.stats.rxBytes)))
+			send(fmt.Sprintf("tx_packets=%d", atomic.LoadUint64(&peer.stats.txPackets)))
+			send(fmt.Sprintf("rx_packets=%d", atomic.LoadUint64(&peer.stats.rxPackets)))
+			if counters, end, ok := peer.IntervalCounters(); ok {
+				send(fmt.Sprintf("interval_end_sec=%d", end.Unix()))
+				send(fmt.Sprintf("interval_tx_bytes=%d", counters.TxBytes))
+				send(fmt.Sprintf("interval_rx_bytes=%d", counters.RxBytes))
+				send(fmt.Sprintf("interval_tx_packets=%d", counters.TxPackets))
+				send(fmt.Sprintf("interval_rx_packets=%d", counters.RxPackets))
+			}
 			send(fmt.Sprintf("persistent_keepalive_interval=%d", peer.persistentKeepaliveInterval))
+			if interval := atomic.LoadUint32(&peer.cover.intervalMs); interval != 0 {
+				send(fmt.Sprintf("cover_traffic_interval_ms=%d", interval))
+			}
+			if jitter := atomic.LoadUint32(&peer.cover.jitterMs); jitter != 0 {
+				send(fmt.Sprintf("transmit_jitter_ms=%d", jitter))
+			}
+			if jitter, own := peer.RekeyJitter(); own {
+				send(fmt.Sprintf("rekey_jitter_ms=%d", jitter/time.Millisecond))
+			}
+			if padding := atomic.LoadInt32(&peer.padding); padding != PaddingDefault {
+				send("padding=" + PaddingModeName(int(padding)))
+				send(fmt.Sprintf("tx_padding_bytes=%d", atomic.LoadUint64(&peer.stats.txPaddingBytes)))
+			}
+			if peer.gossip.coordinator.Get() {
+				send("gossip_coordinator=true")
+			}
+			if peer.Resumption() {
+				send("resumption=true")
+				send(fmt.Sprintf("resumed_sessions=%d", peer.ResumedSessions()))
+			}
+			if peer.disabled.Get() {
+				send("disabled=true")
+			}
+			if peer.unreachable.Get() {
+				send("unreachable=true")
+			}
+			if quality, ok := peer.Quality(); ok {
+				send(fmt.Sprintf("quality=%d", quality.Score))
+				send(fmt.Sprintf("rtt_us=%d", quality.RTT/time.Microsecond))
+				send(fmt.Sprintf("loss_permille=%d", quality.Loss))
+				send(fmt.Sprintf("retry_permille=%d", quality.Retries))
+			}
+			allowed, window := peer.RoamingPolicy()
+			for _, prefix := range allowed {
+				send("roam_allow=" + prefix.String())
+			}
+			if window != 0 {
+				send(fmt.Sprintf("roam_handshake_window=%d", window/time.Second))
+			}
+			for _, rule := range peer.NetmapRules() {
+				send("netmap=" + rule.String())
+			}
+			for _, entry := range peer.metadataLines() {
+				send("metadata=" + entry)
+			}
 
 			for _, ip := range device.allowedips.EntriesForPeer(peer) {
 				send("allowed_ip=" + ip.String())
@@ -98,7 +299,7 @@ func (device *Device) IpcGetOperation(socket *bufio.Writer) *IPCError {
 	for _, line := range lines {
 		_, err := socket.WriteString(line + "\n")
 		if err != nil {
-			return &IPCError{ipc.IpcErrorIO}
+			return ipcErrorf(ipc.IpcErrorIO, ipc.ReasonIO, "failed to write output: %v", err)
 		}
 	}
 
@@ -106,8 +307,19 @@ func (device *Device) IpcGetOperation(socket *bufio.Writer) *IPCError {
 }
 
 func (device *Device) IpcSetOperation(socket *bufio.Reader) *IPCError {
+	device.ipcJobs.running.Lock()
+	defer device.ipcJobs.running.Unlock()
+	err := device.ipcSetOperation(socket, nil)
+	if err != nil {
+		device.log.Error.Println("Failed to set configuration:", err.Message())
+	}
+	return err
+}
+
+/* Applies the configuration, counting progress in job if not nil
+ */
+func (device *Device) ipcSetOperation(socket *bufio.Reader, job *IpcSetJob) *IPCError {
 	scanner := bufio.NewScanner(socket)
-	logError := device.log.Error
 	logDebug := device.log.Debug
 
 	var peer *Peer
@@ -123,13 +335,17 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) *IPCError {
 		if line == "" {
 			return nil
 		}
-		parts := strings.Split(line, "=")
+		parts := strings.SplitN(line, "=", 2)
 		if len(parts) != 2 {
-			return &IPCError{ipc.IpcErrorProtocol}
+			return ipcErrorf(ipc.IpcErrorProtocol, ipc.ReasonProtocol, "failed to parse line %q", line)
 		}
 		key := parts[0]
 		value := parts[1]
 
+		if job != nil {
+			job.progress(key)
+		}
+
 		/* device configuration */
 
 		if deviceConfig {
@@ -139,8 +355,7 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) *IPCError {
 				var sk NoisePrivateKey
 				err := sk.FromHex(value)
 				if err != nil {
-					logError.Println("Failed to set private_key:", err)
-					return &IPCError{ipc.IpcErrorInvalid}
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidKey, "failed to set private_key: %v", err)
 				}
 				logDebug.Println("UAPI: Updating private key")
 				device.SetPrivateKey(sk)
@@ -151,8 +366,7 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) *IPCError {
 
 				port, err := strconv.ParseUint(value, 10, 16)
 				if err != nil {
-					logError.Println("Failed to parse listen_port:", err)
-					return &IPCError{ipc.IpcErrorInvalid}
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to parse listen_port: %v", err)
 				}
 
 				// update port and rebind
@@ -164,8 +378,369 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) *IPCError {
 				device.net.Unlock()
 
 				if err := device.BindUpdate(); err != nil {
-					logError.Println("Failed to set listen_port:", err)
-					return &IPCError{ipc.IpcErrorPortInUse}
+					return ipcErrorf(ipc.IpcErrorPortInUse, ipc.ReasonPortInUse, "failed to set listen_port: %v", err)
+				}
+
+			case "control_port":
+
+				// parse port number
+
+				port, err := strconv.ParseUint(value, 10, 16)
+				if err != nil {
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to parse control_port: %v", err)
+				}
+
+				// update port and rebind
+
+				logDebug.Println("UAPI: Updating control port")
+
+				device.SetControlPort(uint16(port))
+
+				if err := device.BindUpdate(); err != nil {
+					return ipcErrorf(ipc.IpcErrorPortInUse, ipc.ReasonPortInUse, "failed to set control_port: %v", err)
+				}
+
+			case "relay", "relay_secret":
+
+				// update relay server and reconnect
+
+				logDebug.Println("UAPI: Updating relay")
+
+				device.net.RLock()
+				address, secret := device.net.relayAddress, device.net.relaySecret
+				device.net.RUnlock()
+
+				if key == "relay" {
+					address = value
+				} else if err := loadExactHex(secret[:], value); err != nil {
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidKey, "failed to set relay_secret: %v", err)
+				}
+
+				device.SetRelay(address, secret)
+
+				if err := device.BindUpdate(); err != nil {
+					return ipcErrorf(ipc.IpcErrorPortInUse, ipc.ReasonPortInUse, "failed to update relay: %v", err)
+				}
+
+			case "turn_username", "turn_password":
+
+				// update TURN credentials, used from the next turn
+
+				logDebug.Println("UAPI: Updating TURN credentials")
+
+				server, username, password := device.TURN()
+				if key == "turn_username" {
+					username = value
+				} else {
+					password = value
+				}
+				device.SetTURN(server, username, password)
+
+			case "turn":
+
+				// update TURN server (host:port), set after its credentials
+
+				logDebug.Println("UAPI: Updating TURN server")
+
+				_, username, password := device.TURN()
+				device.SetTURN(value, username, password)
+
+				if err := device.BindUpdate(); err != nil {
+					return ipcErrorf(ipc.IpcErrorPortInUse, ipc.ReasonPortInUse, "failed to update turn: %v", err)
+				}
+
+			case "flow_collector", "flow_version":
+
+				// update flow export and reconnect
+
+				logDebug.Println("UAPI: Updating flow export")
+
+				collector, version := device.FlowExport()
+				if key == "flow_collector" {
+					collector = value
+				} else {
+					v, err := strconv.Atoi(value)
+					if err != nil {
+						return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to set flow_version: %v", err)
+					}
+					version = v
+				}
+				if version == 0 {
+					version = FlowVersionIPFIX
+				}
+
+				if err := device.SetFlowExport(collector, version); err != nil {
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to update flow export: %v", err)
+				}
+
+			case "stats_interval":
+
+				// update per-interval peer counters
+
+				logDebug.Println("UAPI: Updating stats interval")
+
+				secs, err := strconv.ParseUint(value, 10, 32)
+				if err != nil {
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to set stats_interval: %v", err)
+				}
+
+				device.SetStatsInterval(time.Duration(secs) * time.Second)
+
+			case "unreachable_timeout":
+
+				// update dead peer detection
+
+				logDebug.Println("UAPI: Updating unreachable timeout")
+
+				secs, err := strconv.ParseUint(value, 10, 32)
+				if err != nil {
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to set unreachable_timeout: %v", err)
+				}
+
+				device.SetUnreachableTimeout(time.Duration(secs) * time.Second)
+
+			case "rekey_jitter_ms":
+
+				// update spreading of rekeys
+
+				logDebug.Println("UAPI: Updating rekey jitter")
+
+				ms, err := strconv.ParseUint(value, 10, 32)
+				if err != nil || time.Duration(ms)*time.Millisecond > MaxRekeyJitter {
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to set rekey_jitter_ms: %v", value)
+				}
+
+				device.SetRekeyJitter(time.Duration(ms) * time.Millisecond)
+
+			case "handshake_rate", "handshake_burst":
+
+				// update handshake initiation pacing
+
+				logDebug.Println("UAPI: Updating handshake pacing")
+
+				rate, burst := device.HandshakePacing()
+
+				n, err := strconv.ParseUint(value, 10, 32)
+				if err != nil {
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to set %s: %v", key, err)
+				}
+				if key == "handshake_rate" {
+					rate = uint32(n)
+				} else {
+					burst = uint32(n)
+				}
+
+				device.SetHandshakePacing(rate, burst)
+
+			case "ip_options":
+
+				// update ip options policy
+
+				logDebug.Println("UAPI: Updating ip options policy")
+
+				policy, err := ParseIPOptionsPolicy(value)
+				if err != nil {
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to set ip_options: %v", err)
+				}
+
+				device.SetIPOptionsPolicy(policy)
+
+			case "mss_clamp":
+
+				// update mss clamping of tcp syn segments
+
+				logDebug.Println("UAPI: Updating MSS clamping")
+
+				mss, err := parseMSSClamp(value)
+				if err != nil {
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to set mss_clamp: %v", err)
+				}
+
+				device.SetMSSClamp(mss)
+
+			case "maintenance":
+
+				// drain sessions before maintenance, or end it
+
+				if value == "off" {
+					logDebug.Println("UAPI: Ending maintenance")
+					device.EndMaintenance()
+					break
+				}
+
+				logDebug.Println("UAPI: Starting maintenance")
+
+				seconds, err := strconv.ParseUint(value, 10, 32)
+				if err != nil {
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to set maintenance: %v", err)
+				}
+
+				device.StartMaintenance(time.Duration(seconds) * time.Second)
+
+			case "maintenance_refusal":
+
+				// answer to initiations refused in maintenance
+
+				logDebug.Println("UAPI: Updating maintenance refusal")
+
+				refusal, err := ParseMaintenanceRefusal(value)
+				if err != nil {
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to set maintenance_refusal: %v", err)
+				}
+
+				device.SetMaintenanceRefusal(refusal)
+
+			case "tun_down", "tun_down_grace":
+
+				// update behaviour when the interface goes down
+
+				logDebug.Println("UAPI: Updating tun down policy")
+
+				policy, grace := device.TunDownPolicy()
+
+				if key == "tun_down" {
+					var err error
+					policy, err = ParseTunDownPolicy(value)
+					if err != nil {
+						return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to set tun_down: %v", err)
+					}
+				} else {
+					secs, err := strconv.ParseUint(value, 10, 32)
+					if err != nil {
+						return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to set tun_down_grace: %v", err)
+					}
+					grace = time.Duration(secs) * time.Second
+				}
+
+				device.SetTunDownPolicy(policy, grace)
+
+			case "egress_rate", "egress_burst", "egress_pacing_us":
+
+				// update egress shaping
+
+				logDebug.Println("UAPI: Updating egress shaping")
+
+				rate, burst, pacing := device.EgressShaping()
+
+				n, err := strconv.ParseUint(value, 10, 64)
+				if err != nil {
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to set %s: %v", key, err)
+				}
+				switch key {
+				case "egress_rate":
+					rate = n
+				case "egress_burst":
+					if n > math.MaxUint32 {
+						return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to set egress_burst, value too large: %v", value)
+					}
+					burst = uint32(n)
+				default:
+					if n > uint64(time.Minute/time.Microsecond) {
+						return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to set egress_pacing_us, value too large: %v", value)
+					}
+					pacing = time.Duration(n) * time.Microsecond
+				}
+
+				device.SetEgressShaping(rate, burst, pacing)
+
+			case "ha_role", "ha_address", "ha_secret":
+
+				// update state replication and reconnect
+
+				logDebug.Println("UAPI: Updating HA")
+
+				device.ha.Lock()
+				role, address, secret := device.ha.role, device.ha.address, device.ha.secret
+				device.ha.Unlock()
+
+				switch key {
+				case "ha_role":
+					var err error
+					if role, err = ParseHARole(value); err != nil {
+						return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to set ha_role: %v", err)
+					}
+				case "ha_address":
+					address = value
+				default:
+					if err := loadExactHex(secret[:], value); err != nil {
+						return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidKey, "failed to set ha_secret: %v", err)
+					}
+				}
+
+				if role != HARoleNone && isZero(secret[:]) {
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidKey, "failed to update ha: %v, set ha_secret before ha_role", errHANoSecret)
+				}
+				if err := device.SetHA(role, address, secret); err != nil {
+					return ipcErrorf(ipc.IpcErrorPortInUse, ipc.ReasonPortInUse, "failed to update ha: %v", err)
+				}
+
+			case "gossip_coordinator":
+
+				// announce peers to each other
+
+				logDebug.Println("UAPI: Updating gossip coordinator")
+
+				coordinator, err := strconv.ParseBool(value)
+				if err != nil {
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to set gossip_coordinator, invalid value: %v", value)
+				}
+
+				device.SetGossipCoordinator(coordinator)
+
+			case "replace_handshake_sources":
+				if value != "true" {
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to set replace_handshake_sources, invalid value: %v", value)
+				}
+				logDebug.Println("UAPI: Removing all handshake sources")
+				device.SetHandshakeSources(nil)
+
+			case "handshake_source":
+
+				// restrict sources of handshake initiations
+
+				logDebug.Println("UAPI: Adding handshake source")
+
+				_, source, err := net.ParseCIDR(value)
+				if err != nil {
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to set handshake_source: %v", err)
+				}
+				device.AddHandshakeSource(*source)
+
+			case "match":
+
+				// install or remove (without expression) a match counter
+
+				logDebug.Println("UAPI: Updating match")
+
+				fields := strings.SplitN(value, " ", 2)
+				if len(fields) == 1 || strings.TrimSpace(fields[1]) == "" {
+					device.RemoveMatch(fields[0])
+					break
+				}
+				match, err := ParseMatch(fields[0], fields[1])
+				if err != nil {
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to set match %v: %v", value, err)
+				}
+				if err := device.SetMatch(match); err != nil {
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to set match %v: %v", value, err)
+				}
+
+			case "mirror":
+
+				// mirror traffic to a monitoring peer or collector, or stop
+
+				logDebug.Println("UAPI: Updating mirror")
+
+				var config MirrorConfig
+				if value != "" {
+					var err error
+					config, err = ParseMirrorConfig(value)
+					if err != nil {
+						return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to set mirror %v: %v", value, err)
+					}
+				}
+				if err := device.SetMirror(config); err != nil {
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to set mirror %v: %v", value, err)
 				}
 
 			case "fwmark":
@@ -181,15 +756,13 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) *IPCError {
 				}()
 
 				if err != nil {
-					logError.Println("Invalid fwmark", err)
-					return &IPCError{ipc.IpcErrorInvalid}
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "invalid fwmark: %v", err)
 				}
 
 				logDebug.Println("UAPI: Updating fwmark")
 
 				if err := device.BindSetMark(uint32(fwmark)); err != nil {
-					logError.Println("Failed to update fwmark:", err)
-					return &IPCError{ipc.IpcErrorPortInUse}
+					return ipcErrorf(ipc.IpcErrorPortInUse, ipc.ReasonPortInUse, "failed to update fwmark: %v", err)
 				}
 
 			case "public_key":
@@ -199,15 +772,24 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) *IPCError {
 
 			case "replace_peers":
 				if value != "true" {
-					logError.Println("Failed to set replace_peers, invalid value:", value)
-					return &IPCError{ipc.IpcErrorInvalid}
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to set replace_peers, invalid value: %v", value)
 				}
 				logDebug.Println("UAPI: Removing all peers")
 				device.RemoveAllPeers()
 
+			case "remove_peers_by_allowed_ip":
+
+				// remove peers owning addresses within the prefix
+
+				_, prefix, err := net.ParseCIDR(value)
+				if err != nil {
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to set remove_peers_by_allowed_ip: %v", err)
+				}
+				removed := device.RemovePeersByAllowedIP(*prefix)
+				logDebug.Println("UAPI: Removed", removed, "peers with allowed IPs within", prefix)
+
 			default:
-				logError.Println("Invalid UAPI device key:", key)
-				return &IPCError{ipc.IpcErrorInvalid}
+				return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonUnknownKey, "invalid UAPI device key: %v", key)
 			}
 		}
 
@@ -221,8 +803,7 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) *IPCError {
 				var publicKey NoisePublicKey
 				err := publicKey.FromHex(value)
 				if err != nil {
-					logError.Println("Failed to get peer by public key:", err)
-					return &IPCError{ipc.IpcErrorInvalid}
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidKey, "failed to get peer by public key: %v", err)
 				}
 
 				// ignore peer with public key of device
@@ -239,9 +820,11 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) *IPCError {
 
 				if peer == nil {
 					peer, err = device.NewPeer(publicKey)
+					if err == ErrMemoryLimit {
+						return ipcErrorf(ipc.IpcErrorNoMemory, ipc.ReasonMemoryLimit, "failed to create new peer: %v", err)
+					}
 					if err != nil {
-						logError.Println("Failed to create new peer:", err)
-						return &IPCError{ipc.IpcErrorInvalid}
+						return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to create new peer: %v", err)
 					}
 					if peer == nil {
 						dummy = true
@@ -256,8 +839,7 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) *IPCError {
 				// remove currently selected peer from device
 
 				if value != "true" {
-					logError.Println("Failed to set remove, invalid value:", value)
-					return &IPCError{ipc.IpcErrorInvalid}
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to set remove, invalid value: %v", value)
 				}
 				if !dummy {
 					logDebug.Println(peer, "- UAPI: Removing")
@@ -277,8 +859,7 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) *IPCError {
 				peer.handshake.mutex.Unlock()
 
 				if err != nil {
-					logError.Println("Failed to set preshared key:", err)
-					return &IPCError{ipc.IpcErrorInvalid}
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidKey, "failed to set preshared key: %v", err)
 				}
 
 			case "endpoint":
@@ -288,21 +869,131 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) *IPCError {
 				logDebug.Println(peer, "- UAPI: Updating endpoint")
 
 				err := func() error {
-					peer.Lock()
-					defer peer.Unlock()
-					endpoint, err := CreateEndpoint(value)
+					endpoint, err := device.createEndpoint(value)
 					if err != nil {
 						return err
 					}
+					peer.Lock()
+					defer peer.Unlock()
 					peer.endpoint = endpoint
+					peer.control.endpoint = nil
 					return nil
 				}()
 
 				if err != nil {
-					logError.Println("Failed to set endpoint:", err, ":", value)
-					return &IPCError{ipc.IpcErrorInvalid}
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to set endpoint %v: %v", value, err)
+				}
+				if !dummy {
+					peer.refreshHairpin()
+				}
+
+			case "control_port":
+
+				// set control port of peer
+
+				logDebug.Println(peer, "- UAPI: Updating control port")
+
+				port, err := strconv.ParseUint(value, 10, 16)
+				if err != nil {
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to set control port: %v", err)
+				}
+
+				peer.Lock()
+				peer.control.port = uint16(port)
+				peer.control.endpoint = nil
+				peer.Unlock()
+
+			case "padding":
+
+				// set padding mode of transport packets sent to the peer, see padding.go
+
+				logDebug.Println(peer, "- UAPI: Updating padding mode")
+
+				mode, err := ParsePaddingMode(value)
+				if err != nil {
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to set padding mode %v: %v", value, err)
+				}
+
+				atomic.StoreInt32(&peer.padding, int32(mode))
+
+			case "cover_traffic_interval_ms":
+
+				// update mean interval of cover traffic
+
+				logDebug.Println(peer, "- UAPI: Updating cover traffic interval")
+
+				interval, err := strconv.ParseUint(value, 10, 32)
+				if err != nil || interval > MaxCoverTrafficInterval {
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to set cover traffic interval: %v", value)
+				}
+
+				old := atomic.SwapUint32(&peer.cover.intervalMs, uint32(interval))
+				if old == 0 && interval != 0 && device.isUp.Get() && !dummy {
+					peer.timersCoverTraffic()
+				}
+
+			case "gossip_coordinator":
+
+				// accept gossip from this peer
+
+				logDebug.Println(peer, "- UAPI: Updating gossip coordinator")
+
+				coordinator, err := strconv.ParseBool(value)
+				if err != nil {
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to set gossip_coordinator, invalid value: %v", value)
+				}
+
+				peer.gossip.coordinator.Set(coordinator)
+
+			case "resumption":
+
+				// allow abbreviated handshakes with this peer
+
+				logDebug.Println(peer, "- UAPI: Updating session resumption")
+
+				enabled, err := strconv.ParseBool(value)
+				if err != nil {
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to set resumption, invalid value: %v", value)
+				}
+
+				if dummy {
+					continue
+				}
+
+				if err := peer.SetResumption(enabled); err != nil {
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to set resumption: %v", err)
 				}
 
+			case "rekey_jitter_ms":
+
+				// update spreading of rekeys, or use that of the device
+
+				logDebug.Println(peer, "- UAPI: Updating rekey jitter")
+
+				if value == "" {
+					peer.SetRekeyJitter(-1)
+					break
+				}
+				ms, err := strconv.ParseUint(value, 10, 32)
+				if err != nil || time.Duration(ms)*time.Millisecond > MaxRekeyJitter {
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to set rekey_jitter_ms: %v", value)
+				}
+
+				peer.SetRekeyJitter(time.Duration(ms) * time.Millisecond)
+
+			case "transmit_jitter_ms":
+
+				// update maximum delay of data packets
+
+				logDebug.Println(peer, "- UAPI: Updating transmit jitter")
+
+				jitter, err := strconv.ParseUint(value, 10, 32)
+				if err != nil || jitter > MaxTransmitJitter {
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to set transmit jitter: %v", value)
+				}
+
+				atomic.StoreUint32(&peer.cover.jitterMs, uint32(jitter))
+
 			case "persistent_keepalive_interval":
 
 				// update persistent keepalive interval
@@ -311,8 +1002,7 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) *IPCError {
 
 				secs, err := strconv.ParseUint(value, 10, 16)
 				if err != nil {
-					logError.Println("Failed to set persistent keepalive interval:", err)
-					return &IPCError{ipc.IpcErrorInvalid}
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to set persistent keepalive interval: %v", err)
 				}
 
 				old := peer.persistentKeepaliveInterval
@@ -321,29 +1011,174 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) *IPCError {
 				// send immediate keepalive if we're turning it on and before it wasn't on
 
 				if old == 0 && secs != 0 {
-					if err != nil {
-						logError.Println("Failed to get tun device status:", err)
-						return &IPCError{ipc.IpcErrorIO}
-					}
 					if device.isUp.Get() && !dummy {
 						peer.SendKeepalive()
 					}
 				}
 
+			case "disabled":
+
+				// suspend or restore the peer
+
+				logDebug.Println(peer, "- UAPI: Updating disabled")
+
+				disabled, err := strconv.ParseBool(value)
+				if err != nil {
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to set disabled, invalid value: %v", value)
+				}
+
+				if dummy {
+					continue
+				}
+
+				peer.SetDisabled(disabled)
+
+			case "reset_stats":
+
+				logDebug.Println(peer, "- UAPI: Resetting counters")
+
+				if value != "true" {
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to reset stats, invalid value: %v", value)
+				}
+
+				if dummy {
+					continue
+				}
+
+				peer.ResetCounters()
+
+			case "replace_roam_allow":
+
+				logDebug.Println(peer, "- UAPI: Removing all roaming prefixes")
+
+				if value != "true" {
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to replace roaming prefixes, invalid value: %v", value)
+				}
+
+				if dummy {
+					continue
+				}
+
+				peer.ClearRoamingPrefixes()
+
+			case "roam_allow":
+
+				// restrict endpoint changes to a prefix
+
+				logDebug.Println(peer, "- UAPI: Adding roaming prefix")
+
+				_, prefix, err := net.ParseCIDR(value)
+				if err != nil {
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to set roam_allow %v: %v", value, err)
+				}
+
+				if dummy {
+					continue
+				}
+
+				peer.AddRoamingPrefix(*prefix)
+
+			case "roam_handshake_window":
+
+				// require a recent handshake for endpoint changes
+
+				logDebug.Println(peer, "- UAPI: Updating roaming handshake window")
+
+				secs, err := strconv.ParseUint(value, 10, 32)
+				if err != nil {
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to set roam_handshake_window: %v", err)
+				}
+
+				if dummy {
+					continue
+				}
+
+				peer.SetRoamingHandshakeWindow(time.Duration(secs) * time.Second)
+
+			case "replace_netmap":
+
+				logDebug.Println(peer, "- UAPI: Removing all netmap rules")
+
+				if value != "true" {
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to replace netmap, invalid value: %v", value)
+				}
+
+				if dummy {
+					continue
+				}
+
+				peer.ClearNetmap()
+
+			case "netmap":
+
+				// add an address translation rule
+
+				logDebug.Println(peer, "- UAPI: Adding netmap rule")
+
+				rule, err := ParseNetmapRule(value)
+				if err != nil {
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to set netmap %v: %v", value, err)
+				}
+
+				if dummy {
+					continue
+				}
+
+				if err := peer.AddNetmapRule(rule); err != nil {
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to set netmap %v: %v", value, err)
+				}
+
+			case "replace_metadata":
+
+				logDebug.Println(peer, "- UAPI: Removing all metadata")
+
+				if value != "true" {
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to replace metadata, invalid value: %v", value)
+				}
+
+				if dummy {
+					continue
+				}
+
+				peer.ClearMetadata()
+
+			case "metadata":
+
+				// set (or remove without value) a metadata entry
+
+				logDebug.Println(peer, "- UAPI: Updating metadata")
+
+				colon := strings.IndexByte(value, ':')
+				if colon < 0 {
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to set metadata, expected key:value: %v", value)
+				}
+
+				metadata, err := url.QueryUnescape(value[colon+1:])
+				if err != nil {
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to set metadata, invalid encoding: %v", value)
+				}
+
+				if dummy {
+					continue
+				}
+
+				if err := peer.SetMetadata(value[:colon], metadata); err != nil {
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to set metadata %v: %v", value, err)
+				}
+
 			case "replace_allowed_ips":
 
 				logDebug.Println(peer, "- UAPI: Removing all allowedips")
 
 				if value != "true" {
-					logError.Println("Failed to replace allowedips, invalid value:", value)
-					return &IPCError{ipc.IpcErrorInvalid}
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to replace allowedips, invalid value: %v", value)
 				}
 
 				if dummy {
 					continue
 				}
 
-				device.allowedips.RemoveByPeer(peer)
+				device.removeAllowedIPs(peer)
 
 			case "allowed_ip":
 
@@ -351,8 +1186,7 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) *IPCError {
 
 				_, network, err := net.ParseCIDR(value)
 				if err != nil {
-					logError.Println("Failed to set allowed ip:", err)
-					return &IPCError{ipc.IpcErrorInvalid}
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "failed to set allowed ip: %v", err)
 				}
 
 				if dummy {
@@ -360,18 +1194,18 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) *IPCError {
 				}
 
 				ones, _ := network.Mask.Size()
-				device.allowedips.Insert(network.IP, uint(ones), peer)
+				if err := device.insertAllowedIP(network.IP, uint(ones), peer); err != nil {
+					return ipcErrorf(ipc.IpcErrorNoMemory, ipc.ReasonMemoryLimit, "failed to set allowed ip: %v", err)
+				}
 
 			case "protocol_version":
 
 				if value != "1" {
-					logError.Println("Invalid protocol version:", value)
-					return &IPCError{ipc.IpcErrorInvalid}
+					return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "invalid protocol version: %v", value)
 				}
 
 			default:
-				logError.Println("Invalid UAPI peer key:", key)
-				return &IPCError{ipc.IpcErrorInvalid}
+				return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonUnknownKey, "invalid UAPI peer key: %v", key)
 			}
 		}
 	}
@@ -401,14 +1235,40 @@ func (device *Device) IpcHandle(socket net.Conn) {
 	// handle operation
 
 	var status *IPCError
+	logged := false
 
 	switch op {
 	case "set=1\n":
 		status = device.IpcSetOperation(buffered.Reader)
+		logged = true
+
+	case "set_async=1\n":
+		status = device.IpcSetAsyncOperation(buffered)
+
+	case "job=1\n":
+		status = device.IpcJobOperation(buffered)
 
 	case "get=1\n":
 		status = device.IpcGetOperation(buffered.Writer)
 
+	case "stats=1\n":
+		status = device.IpcStatsOperation(buffered.Writer)
+
+	case "dump=1\n":
+		status = device.IpcDumpOperation(buffered.Writer)
+
+	case "overlaps=1\n":
+		status = device.IpcOverlapsOperation(buffered.Writer)
+
+	case "import_allowed_ips=1\n":
+		status = device.IpcImportAllowedIPsOperation(buffered)
+
+	case "ping=1\n":
+		status = device.IpcPingOperation(buffered)
+
+	case "selftest=1\n":
+		status = device.IpcSelfTestOperation(buffered)
+
 	default:
 		device.log.Error.Println("Invalid UAPI operation:", op)
 		return
@@ -417,7 +1277,13 @@ func (device *Device) IpcHandle(socket net.Conn) {
 	// write status
 
 	if status != nil {
-		device.log.Error.Println(status)
+		if !logged {
+			device.log.Error.Println(status)
+		}
+		fmt.Fprintf(buffered, "error_reason=%s\n", status.Reason())
+		if message := status.Message(); message != "" {
+			fmt.Fprintf(buffered, "error_message=%s\n", strings.Replace(message, "\n", " ", -1))
+		}
 		fmt.Fprintf(buffered, "errno=%d\n\n", status.ErrorCode())
 	} else {
 		fmt.Fprintf(buffered, "errno=0\n\n")
@@ -0,0 +1,241 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"golang.zx2c4.com/wireguard/ipc"
+)
+
+/* Asynchronous configuration
+ *
+ * Applying tens of thousands of peers takes long enough to block the
+ * controller pushing them. An asynchronous set reads the configuration
+ * and returns at once with a job, which applies it in the background.
+ * A single routine applies jobs one after the other in the order
+ * submitted, so batches still apply in sequence, and synchronous sets
+ * wait for the job being applied.
+ *
+ * Over UAPI, set_async=1 takes the configuration like set=1 and
+ * answers with job=<id>. job=1 followed by id=<id> reports the number
+ * of lines and peers applied so far and whether the job is done, and
+ * once it is, fails with the error of the job, if any. Finished jobs
+ * are forgotten once reported, or when more than MaxFinishedIpcJobs
+ * accumulate.
+ */
+
+const (
+	MaxFinishedIpcJobs = 16
+)
+
+type IpcSetJob struct {
+	id     uint64
+	reader io.Reader // configuration, until applied
+	lines  uint64
+	peers  uint64
+	done   chan struct{}
+	err    *IPCError
+}
+
+func (job *IpcSetJob) ID() uint64 {
+	return job.id
+}
+
+/* Returns the number of lines and peers applied so far
+ */
+func (job *IpcSetJob) Progress() (lines, peers uint64) {
+	return atomic.LoadUint64(&job.lines), atomic.LoadUint64(&job.peers)
+}
+
+/* Returns a channel closed once the job is done
+ */
+func (job *IpcSetJob) Done() <-chan struct{} {
+	return job.done
+}
+
+/* Waits for the job and returns its error
+ */
+func (job *IpcSetJob) Wait() *IPCError {
+	<-job.done
+	return job.err
+}
+
+func (job *IpcSetJob) progress(key string) {
+	atomic.AddUint64(&job.lines, 1)
+	if key == "public_key" {
+		atomic.AddUint64(&job.peers, 1)
+	}
+}
+
+/* Applies the configuration read from reader in the background
+ */
+func (device *Device) IpcSetAsync(reader io.Reader) *IpcSetJob {
+	job := &IpcSetJob{reader: reader, done: make(chan struct{})}
+
+	device.ipcJobs.Lock()
+	defer device.ipcJobs.Unlock()
+	device.ipcJobs.lastID++
+	job.id = device.ipcJobs.lastID
+	if device.ipcJobs.jobs == nil {
+		device.ipcJobs.jobs = make(map[uint64]*IpcSetJob)
+	}
+	device.ipcJobs.jobs[job.id] = job
+	device.ipcJobs.queue = append(device.ipcJobs.queue, job)
+	if !device.ipcJobs.working {
+		device.ipcJobs.working = true
+		go device.RoutineIpcJobs()
+	}
+	return job
+}
+
+/* Applies queued jobs in order, exiting once the queue is empty
+ */
+func (device *Device) RoutineIpcJobs() {
+	for {
+		device.ipcJobs.Lock()
+		if len(device.ipcJobs.queue) == 0 {
+			device.ipcJobs.working = false
+			device.ipcJobs.Unlock()
+			return
+		}
+		job := device.ipcJobs.queue[0]
+		device.ipcJobs.queue[0] = nil
+		device.ipcJobs.queue = device.ipcJobs.queue[1:]
+		device.ipcJobs.Unlock()
+
+		device.ipcJobs.running.Lock()
+		job.err = device.ipcSetOperation(bufio.NewReader(job.reader), job)
+		device.ipcJobs.running.Unlock()
+		job.reader = nil
+
+		if job.err != nil {
+			device.log.Error.Println("Asynchronous set", job.id, "failed:", job.err)
+		}
+		close(job.done)
+		device.forgetFinishedIpcJobs()
+	}
+}
+
+func (device *Device) LookupIpcJob(id uint64) *IpcSetJob {
+	device.ipcJobs.Lock()
+	defer device.ipcJobs.Unlock()
+	return device.ipcJobs.jobs[id]
+}
+
+func (device *Device) forgetIpcJob(id uint64) {
+	device.ipcJobs.Lock()
+	defer device.ipcJobs.Unlock()
+	delete(device.ipcJobs.jobs, id)
+}
+
+/* Drops the oldest finished jobs beyond MaxFinishedIpcJobs
+ */
+func (device *Device) forgetFinishedIpcJobs() {
+	device.ipcJobs.Lock()
+	defer device.ipcJobs.Unlock()
+
+	var finished []uint64
+	for id, job := range device.ipcJobs.jobs {
+		select {
+		case <-job.done:
+			finished = append(finished, id)
+		default:
+		}
+	}
+	if len(finished) <= MaxFinishedIpcJobs {
+		return
+	}
+	for len(finished) > MaxFinishedIpcJobs {
+		oldest := 0
+		for i, id := range finished {
+			if id < finished[oldest] {
+				oldest = i
+			}
+		}
+		delete(device.ipcJobs.jobs, finished[oldest])
+		finished = append(finished[:oldest], finished[oldest+1:]...)
+	}
+}
+
+func (device *Device) IpcSetAsyncOperation(socket *bufio.ReadWriter) *IPCError {
+
+	// read configuration up to the terminating empty line
+
+	var config bytes.Buffer
+	for {
+		line, err := socket.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return ipcErrorf(ipc.IpcErrorIO, ipc.ReasonIO, "failed to read input: %v", err)
+		}
+		if line == "\n" || line == "" {
+			break
+		}
+		config.WriteString(line)
+		if err == io.EOF {
+			break
+		}
+	}
+	config.WriteString("\n")
+
+	job := device.IpcSetAsync(&config)
+	if _, err := fmt.Fprintf(socket, "job=%d\n", job.id); err != nil {
+		return ipcErrorf(ipc.IpcErrorIO, ipc.ReasonIO, "failed to write output: %v", err)
+	}
+	return nil
+}
+
+func (device *Device) IpcJobOperation(socket *bufio.ReadWriter) *IPCError {
+	var job *IpcSetJob
+
+	scanner := bufio.NewScanner(socket.Reader)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+		parts := strings.Split(line, "=")
+		if len(parts) != 2 || parts[0] != "id" {
+			return ipcErrorf(ipc.IpcErrorProtocol, ipc.ReasonProtocol, "failed to parse line %q", line)
+		}
+		id, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonInvalidValue, "invalid job id: %v", parts[1])
+		}
+		job = device.LookupIpcJob(id)
+		if job == nil {
+			return ipcErrorf(ipc.IpcErrorNotFound, ipc.ReasonInvalidValue, "no such job: %v", id)
+		}
+	}
+	if job == nil {
+		return ipcErrorf(ipc.IpcErrorInvalid, ipc.ReasonProtocol, "job requires id")
+	}
+
+	done := false
+	select {
+	case <-job.done:
+		done = true
+	default:
+	}
+
+	lines, peers := job.Progress()
+	_, err := fmt.Fprintf(socket, "lines=%d\npeers=%d\ndone=%v\n", lines, peers, done)
+	if err != nil {
+		return ipcErrorf(ipc.IpcErrorIO, ipc.ReasonIO, "failed to write output: %v", err)
+	}
+
+	if done {
+		device.forgetIpcJob(job.id)
+		return job.err
+	}
+	return nil
+}
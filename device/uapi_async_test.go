@@ -0,0 +1,109 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestIpcSetAsync(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	var config strings.Builder
+	for i := 0; i < 100; i++ {
+		sk, err := newPrivateKey()
+		assertNil(t, err)
+		pk := sk.publicKey()
+		config.WriteString("public_key=" + pk.ToHex() + "\n")
+	}
+
+	job := device.IpcSetAsync(strings.NewReader(config.String()))
+	if err := job.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	lines, peers := job.Progress()
+	if lines != 100 || peers != 100 || len(device.peers.keyMap) != 100 {
+		t.Fatalf("applied %d lines, %d peers, have %d peers", lines, peers, len(device.peers.keyMap))
+	}
+
+	// errors are reported on completion
+
+	job = device.IpcSetAsync(strings.NewReader("listen_port=invalid\n"))
+	if job.Wait() == nil {
+		t.Fatal("invalid configuration applied")
+	}
+
+	// jobs apply in the order submitted
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	pk := sk.publicKey()
+	var jobs []*IpcSetJob
+	for i := 1; i <= 50; i++ {
+		jobs = append(jobs, device.IpcSetAsync(strings.NewReader(fmt.Sprintf("public_key=%s\npersistent_keepalive_interval=%d\n", pk.ToHex(), i))))
+	}
+	if err := jobs[len(jobs)-1].Wait(); err != nil {
+		t.Fatal(err)
+	}
+	for i, job := range jobs {
+		select {
+		case <-job.Done():
+		default:
+			t.Fatalf("job %d pending after the last one applied", i+1)
+		}
+	}
+	if interval := device.LookupPeer(pk).persistentKeepaliveInterval; interval != 50 {
+		t.Fatalf("last job applied set keepalive interval %d, expected 50", interval)
+	}
+}
+
+func TestIpcSetAsyncOperation(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	pk := sk.publicKey()
+
+	var out strings.Builder
+	socket := bufio.NewReadWriter(
+		bufio.NewReader(strings.NewReader("public_key="+pk.ToHex()+"\nallowed_ip=10.0.0.2/32\n\n")),
+		bufio.NewWriter(&out),
+	)
+	if err := device.IpcSetAsyncOperation(socket); err != nil {
+		t.Fatal(err)
+	}
+	socket.Flush()
+	if !strings.HasPrefix(out.String(), "job=") {
+		t.Fatalf("unexpected response: %q", out.String())
+	}
+	id := strings.TrimSpace(strings.TrimPrefix(out.String(), "job="))
+
+	<-device.LookupIpcJob(1).Done()
+
+	out.Reset()
+	socket = bufio.NewReadWriter(
+		bufio.NewReader(strings.NewReader("id="+id+"\n\n")),
+		bufio.NewWriter(&out),
+	)
+	if err := device.IpcJobOperation(socket); err != nil {
+		t.Fatal(err)
+	}
+	socket.Flush()
+	if out.String() != "lines=2\npeers=1\ndone=true\n" {
+		t.Fatalf("unexpected response: %q", out.String())
+	}
+
+	// finished jobs are forgotten once reported
+
+	if device.LookupIpcJob(1) != nil {
+		t.Fatal("reported job retained")
+	}
+}
@@ -0,0 +1,278 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/ipc"
+)
+
+func ipcSet(device *Device, config string) *IPCError {
+	return device.IpcSetOperation(bufio.NewReader(strings.NewReader(config)))
+}
+
+func TestIpcSetErrorReasons(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	tests := []struct {
+		config string
+		code   int64
+		reason string
+	}{
+		{"private_key=zz\n", ipc.IpcErrorInvalid, ipc.ReasonInvalidKey},
+		{"listen_port=70000\n", ipc.IpcErrorInvalid, ipc.ReasonInvalidValue},
+		{"bogus=1\n", ipc.IpcErrorInvalid, ipc.ReasonUnknownKey},
+		{"no separator\n", ipc.IpcErrorProtocol, ipc.ReasonProtocol},
+		{"public_key=" + strings.Repeat("ab", 32) + "\nallowed_ip=10.0.0.0/33\n", ipc.IpcErrorInvalid, ipc.ReasonInvalidValue},
+	}
+
+	for _, test := range tests {
+		err := ipcSet(device, test.config)
+		if err == nil {
+			t.Fatalf("config %q: expected error", test.config)
+		}
+		if err.ErrorCode() != test.code || err.Reason() != test.reason {
+			t.Errorf("config %q: got (%d, %s), expected (%d, %s)", test.config, err.ErrorCode(), err.Reason(), test.code, test.reason)
+		}
+		if err.Message() == "" {
+			t.Errorf("config %q: missing error message", test.config)
+		}
+	}
+
+	// peers cannot be added to a closed device
+
+	device.Close()
+	err := ipcSet(device, "public_key="+strings.Repeat("cd", 32)+"\n")
+	if err == nil || err.ErrorCode() != ipc.IpcErrorInvalid || err.Reason() != ipc.ReasonInvalidValue {
+		t.Errorf("closed device: got %v, expected (%d, %s)", err, ipc.IpcErrorInvalid, ipc.ReasonInvalidValue)
+	}
+}
+
+func TestIpcRemovedPeerConfig(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	device.staticIdentity.RLock()
+	self := device.staticIdentity.publicKey.ToHex()
+	device.staticIdentity.RUnlock()
+
+	// settings following remove, or for the own key, are parsed but ignored
+
+	key := strings.Repeat("ab", 32)
+	for _, prefix := range []string{"public_key=" + key + "\nremove=true\n", "public_key=" + self + "\n"} {
+		for _, line := range []string{
+			"endpoint=192.0.2.1:51820",
+			"allowed_ip=10.0.0.1/32",
+			"control_port=51821",
+			"persistent_keepalive_interval=5",
+			"preshared_key=" + key,
+			"roam_allow=10.0.0.0/8",
+			"netmap=10.0.0.0/24,10.1.0.0/24",
+			"padding=mtu",
+			"resumption=true",
+		} {
+			if err := ipcSet(device, prefix+line+"\n"); err != nil {
+				t.Errorf("%q: %v", prefix+line, err)
+			}
+		}
+	}
+	if len(device.peers.keyMap) != 0 {
+		t.Fatalf("%d peers configured, expected none", len(device.peers.keyMap))
+	}
+}
+
+func TestIpcRemovePeersByAllowedIP(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	keys := []string{strings.Repeat("a1", 32), strings.Repeat("b2", 32), strings.Repeat("c3", 32)}
+	config := "public_key=" + keys[0] + "\nallowed_ip=10.1.0.1/32\nallowed_ip=192.168.0.0/24\n" +
+		"public_key=" + keys[1] + "\nallowed_ip=10.1.2.0/24\n" +
+		"public_key=" + keys[2] + "\nallowed_ip=10.0.0.0/8\nallowed_ip=fd00:10:1::/48\n"
+	if err := ipcSet(device, config); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ipcSet(device, "remove_peers_by_allowed_ip=10.1.0.0/16\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, key := range keys {
+		var pk NoisePublicKey
+		assertNil(t, pk.FromHex(key))
+		if exists := device.LookupPeer(pk) != nil; exists != (i == 2) {
+			t.Errorf("peer %d exists: %v", i, exists)
+		}
+	}
+
+	err := ipcSet(device, "remove_peers_by_allowed_ip=10.1.0.0\n")
+	if err == nil || err.Reason() != ipc.ReasonInvalidValue {
+		t.Fatalf("expected invalid value, got %v", err)
+	}
+}
+
+func TestIpcDisablePeer(t *testing.T) {
+	dev1 := randDevice(t)
+	dev2 := randDevice(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	dev1.Up()
+	key := dev2.staticIdentity.privateKey.publicKey()
+	if err := ipcSet(dev1, "public_key="+key.ToHex()+"\nallowed_ip=10.0.0.2/32\ndisabled=true\n"); err != nil {
+		t.Fatal(err)
+	}
+	peer := dev1.LookupPeer(key)
+	if peer.isRunning.Get() {
+		t.Fatal("disabled peer started")
+	}
+
+	// configuration is kept, but handshakes are rejected
+
+	if dev1.allowedips.LookupIPv4([]byte{10, 0, 0, 2}) != peer {
+		t.Fatal("allowed ips of disabled peer removed")
+	}
+	remote, _ := dev2.NewPeer(dev1.staticIdentity.privateKey.publicKey())
+	msg, err := dev2.CreateMessageInitiation(remote)
+	assertNil(t, err)
+	if dev1.ConsumeMessageInitiation(msg) != nil {
+		t.Fatal("disabled peer accepted handshake")
+	}
+
+	var buf strings.Builder
+	writer := bufio.NewWriter(&buf)
+	if err := dev1.IpcGetOperation(writer); err != nil {
+		t.Fatal(err)
+	}
+	writer.Flush()
+	if !strings.Contains(buf.String(), "\ndisabled=true\n") {
+		t.Fatal("get does not report disabled peer")
+	}
+
+	if err := ipcSet(dev1, "public_key="+key.ToHex()+"\ndisabled=false\n"); err != nil {
+		t.Fatal(err)
+	}
+	if !peer.isRunning.Get() {
+		t.Fatal("enabled peer not started")
+	}
+	msg, err = dev2.CreateMessageInitiation(remote)
+	assertNil(t, err)
+	if dev1.ConsumeMessageInitiation(msg) != peer {
+		t.Fatal("enabled peer rejected handshake")
+	}
+}
+
+func TestIpcPeerMetadata(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	key := strings.Repeat("a1", 32)
+	config := "public_key=" + key + "\nmetadata=owner:alice\nmetadata=id:42\nmetadata=stale:x\nmetadata=stale:\n"
+	if err := ipcSet(device, config); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf strings.Builder
+	writer := bufio.NewWriter(&buf)
+	if err := device.IpcGetOperation(writer); err != nil {
+		t.Fatal(err)
+	}
+	writer.Flush()
+	if !strings.Contains(buf.String(), "\nmetadata=id:42\nmetadata=owner:alice\n") || strings.Contains(buf.String(), "stale") {
+		t.Fatalf("unexpected metadata in %q", buf.String())
+	}
+
+	if err := ipcSet(device, "public_key="+key+"\nmetadata=owner\n"); err == nil || err.Reason() != ipc.ReasonInvalidValue {
+		t.Fatalf("expected invalid value, got %v", err)
+	}
+
+	if err := ipcSet(device, "public_key="+key+"\nreplace_metadata=true\nmetadata=owner:bob\n"); err != nil {
+		t.Fatal(err)
+	}
+	var pk NoisePublicKey
+	assertNil(t, pk.FromHex(key))
+	if metadata := device.LookupPeer(pk).Metadata(); len(metadata) != 1 || metadata["owner"] != "bob" {
+		t.Fatalf("unexpected metadata %v", metadata)
+	}
+
+	// values are percent-encoded
+
+	assertNil(t, device.LookupPeer(pk).SetMetadata("query", "a=b&c\nd"))
+	buf.Reset()
+	writer = bufio.NewWriter(&buf)
+	if err := device.IpcGetOperation(writer); err != nil {
+		t.Fatal(err)
+	}
+	writer.Flush()
+	if !strings.Contains(buf.String(), "\nmetadata=query:a%3Db%26c%0Ad\n") {
+		t.Fatalf("unexpected metadata in %q", buf.String())
+	}
+	if err := ipcSet(device, "public_key="+key+"\nmetadata=owner:carol%3D1\n"); err != nil {
+		t.Fatal(err)
+	}
+	if metadata := device.LookupPeer(pk).Metadata(); metadata["owner"] != "carol=1" {
+		t.Fatalf("unexpected metadata %v", metadata)
+	}
+	if err := ipcSet(device, "public_key="+key+"\nmetadata=owner:%zz\n"); err == nil || err.Reason() != ipc.ReasonInvalidValue {
+		t.Fatalf("expected invalid value, got %v", err)
+	}
+}
+
+func TestIpcInterfaceName(t *testing.T) {
+	device := New(newDummyTUN("tun3"), nil, WithLogger(NewLogger(LogLevelError, "")))
+	defer device.Close()
+
+	var buf bytes.Buffer
+	writer := bufio.NewWriter(&buf)
+	if err := device.IpcGetOperation(writer); err != nil {
+		t.Fatal(err)
+	}
+	writer.Flush()
+
+	if !strings.HasPrefix(buf.String(), "interface_name=tun3\n") {
+		t.Fatalf("missing interface name in %q", buf.String())
+	}
+
+	// the name is read only
+
+	err := ipcSet(device, "interface_name=tun4\n")
+	if err == nil || err.Reason() != ipc.ReasonUnknownKey {
+		t.Fatalf("expected unknown key, got %v", err)
+	}
+}
+
+func TestIpcTURN(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	// REST style credentials hold colons, base64 passwords equal signs
+
+	config := "turn_username=1700000000:alice\nturn_password=c2VjcmV0Og==\nturn=192.0.2.1:3478\n"
+	if err := ipcSet(device, config); err != nil {
+		t.Fatal(err)
+	}
+	if server, username, password := device.TURN(); server != "192.0.2.1:3478" || username != "1700000000:alice" || password != "c2VjcmV0Og==" {
+		t.Fatalf("unexpected TURN %q, %q, %q", server, username, password)
+	}
+
+	var buf bytes.Buffer
+	writer := bufio.NewWriter(&buf)
+	if err := device.IpcGetOperation(writer); err != nil {
+		t.Fatal(err)
+	}
+	writer.Flush()
+	if !strings.Contains(buf.String(), "turn_username=1700000000:alice\nturn=192.0.2.1:3478\n") {
+		t.Fatalf("missing TURN server in %q", buf.String())
+	}
+	if strings.Contains(buf.String(), "c2VjcmV0Og==") {
+		t.Fatalf("TURN password returned in %q", buf.String())
+	}
+}
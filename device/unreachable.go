@@ -0,0 +1,64 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+/* Dead peer detection
+ *
+ * Once data or a handshake initiation is sent, the peer is expected to
+ * answer: with a passive keepalive or data in response to data, and
+ * with a response to the initiation, which is retransmitted otherwise.
+ * If no authenticated packet at all arrives within the unreachable
+ * timeout, the peer is flagged unreachable and EventPeerUnreachable
+ * emitted. The next authenticated packet clears the flag and emits
+ * EventPeerRecovered.
+ */
+
+/* Sets the time after which a peer not answering is considered
+ * unreachable, zero disables detection
+ */
+func (device *Device) SetUnreachableTimeout(timeout time.Duration) {
+	atomic.StoreUint32(&device.unreachable.timeoutSec, uint32(timeout/time.Second))
+}
+
+func (device *Device) UnreachableTimeout() time.Duration {
+	return time.Duration(atomic.LoadUint32(&device.unreachable.timeoutSec)) * time.Second
+}
+
+func (peer *Peer) IsUnreachable() bool {
+	return peer.unreachable.Get()
+}
+
+/* Should be called after data or a handshake initiation is sent */
+func (peer *Peer) timersAwaitAnswer() {
+	timeout := peer.device.UnreachableTimeout()
+	if timeout > 0 && peer.timersActive() && !peer.timers.unreachable.IsPending() && !peer.unreachable.Get() {
+		peer.timers.unreachable.Mod(timeout)
+	}
+}
+
+/* Should be called after any authenticated packet is received */
+func (peer *Peer) timersAnswerReceived() {
+	if peer.timersActive() {
+		peer.timers.unreachable.Del()
+	}
+	if peer.unreachable.Swap(false) {
+		peer.device.log.Info.Println(peer, "- Recovered")
+		peer.device.emit(peer.newEvent(EventPeerRecovered))
+	}
+}
+
+func expiredUnreachable(peer *Peer) {
+	if peer.unreachable.Swap(true) {
+		return
+	}
+	peer.device.log.Info.Printf("%v - Unreachable, no answer for %v", peer, peer.device.UnreachableTimeout())
+	peer.device.emit(peer.newEvent(EventPeerUnreachable))
+}
@@ -0,0 +1,65 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUnreachableEvents(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+	device.Up()
+
+	events := make(chan Event, 10)
+	device.AddEventHandler(func(event Event) {
+		events <- event
+	})
+
+	sk, _ := newPrivateKey()
+	peer, err := device.NewPeer(sk.publicKey())
+	assertNil(t, err)
+
+	// without a timeout, detection is disabled
+
+	peer.timersAwaitAnswer()
+	if peer.timers.unreachable.IsPending() {
+		t.Fatal("detection armed without timeout")
+	}
+
+	if err := ipcSet(device, "unreachable_timeout=1\n"); err != nil {
+		t.Fatal(err)
+	}
+	peer.timersDataSent()
+
+	select {
+	case event := <-events:
+		if event.Type != EventPeerUnreachable || event.PublicKey != peer.handshake.remoteStatic {
+			t.Fatalf("unexpected event %v", event.Type)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer not flagged unreachable")
+	}
+	if !peer.IsUnreachable() {
+		t.Fatal("unreachable flag not set")
+	}
+
+	// further sends neither rearm nor repeat the event
+
+	peer.timersHandshakeInitiated()
+	if peer.timers.unreachable.IsPending() {
+		t.Fatal("detection rearmed while unreachable")
+	}
+
+	peer.timersAnyAuthenticatedPacketReceived()
+	if event := <-events; event.Type != EventPeerRecovered {
+		t.Fatalf("unexpected event %v", event.Type)
+	}
+	if peer.IsUnreachable() {
+		t.Fatal("unreachable flag not cleared")
+	}
+}
@@ -0,0 +1,185 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/* Webhook notifier POSTing events as JSON to a URL:
+ *
+ *   {"type":"handshake_complete","time":"2019-10-01T12:00:00.123456789Z",
+ *    "peer":"<base64>","endpoint":"192.0.2.1:51820","initiator":true}
+ *
+ * Events are queued and sent one at a time from a single routine, so
+ * that a slow receiver never stalls the device. Failed requests are
+ * retried with exponential backoff up to WebhookMaxAttempts times;
+ * client errors other than 429 are not retried. When the queue is full,
+ * new events are dropped.
+ *
+ * Register Notify as event handler of the device.
+ */
+
+const (
+	WebhookQueueSize      = 256
+	WebhookMaxAttempts    = 5
+	WebhookInitialBackoff = time.Second
+	WebhookMaxBackoff     = 30 * time.Second
+	WebhookTimeout        = 10 * time.Second
+)
+
+type Webhook struct {
+	url     string
+	client  *http.Client
+	log     *Logger
+	backoff time.Duration
+	queue   chan webhookEvent
+	stop    chan struct{}
+	stopped sync.WaitGroup
+	once    sync.Once
+}
+
+type webhookEvent struct {
+	Type      string `json:"type"`
+	Time      string `json:"time"`
+	Peer      string `json:"peer,omitempty"`
+	Endpoint  string `json:"endpoint,omitempty"`
+	Initiator bool   `json:"initiator,omitempty"`
+	Prefix    string `json:"prefix,omitempty"`
+	Displaced string `json:"displaced,omitempty"`
+	Quality   *int   `json:"quality,omitempty"`
+	Sessions  *int   `json:"sessions,omitempty"`
+}
+
+func NewWebhook(url string, logger *Logger) *Webhook {
+	webhook := &Webhook{
+		url:     url,
+		client:  &http.Client{Timeout: WebhookTimeout},
+		log:     logger,
+		backoff: WebhookInitialBackoff,
+		queue:   make(chan webhookEvent, WebhookQueueSize),
+		stop:    make(chan struct{}),
+	}
+	webhook.stopped.Add(1)
+	go webhook.RoutineSend()
+	return webhook
+}
+
+/* Queues the event for delivery
+ */
+func (webhook *Webhook) Notify(event Event) {
+	msg := webhookEvent{
+		Type:     event.Type.String(),
+		Time:     event.Time.UTC().Format(time.RFC3339Nano),
+		Endpoint: event.Endpoint,
+	}
+	if !event.PublicKey.IsZero() {
+		msg.Peer = base64.StdEncoding.EncodeToString(event.PublicKey[:])
+	}
+	switch event.Type {
+	case EventHandshakeComplete:
+		msg.Initiator = event.Initiator
+	case EventAllowedIPOverlap:
+		msg.Prefix = event.Prefix
+		msg.Displaced = base64.StdEncoding.EncodeToString(event.Displaced[:])
+	case EventQualityDegraded, EventQualityRestored:
+		quality := event.Quality
+		msg.Quality = &quality
+	case EventMaintenanceProgress, EventMaintenanceDrained:
+		sessions := event.Sessions
+		msg.Sessions = &sessions
+	}
+
+	select {
+	case webhook.queue <- msg:
+	default:
+		webhook.log.Error.Println("Webhook: Queue full, dropping", msg.Type, "event")
+	}
+}
+
+/* Stops delivery, discarding events not yet sent
+ */
+func (webhook *Webhook) Close() {
+	webhook.once.Do(func() {
+		close(webhook.stop)
+	})
+	webhook.stopped.Wait()
+}
+
+func (webhook *Webhook) RoutineSend() {
+	defer webhook.stopped.Done()
+
+	logDebug := webhook.log.Debug
+	logDebug.Println("Routine: webhook sender - started")
+	defer logDebug.Println("Routine: webhook sender - stopped")
+
+	for {
+		select {
+		case <-webhook.stop:
+			return
+		case msg := <-webhook.queue:
+			body, err := json.Marshal(msg)
+			if err != nil {
+				continue
+			}
+			if !webhook.deliver(body) {
+				return
+			}
+		}
+	}
+}
+
+/* Sends the body, retrying on failure,
+ * returns false if the webhook was closed meanwhile
+ */
+func (webhook *Webhook) deliver(body []byte) bool {
+	backoff := webhook.backoff
+	for attempt := 1; ; attempt++ {
+		retry, err := webhook.post(body)
+		if err == nil {
+			return true
+		}
+		if !retry || attempt == WebhookMaxAttempts {
+			webhook.log.Error.Println("Webhook: Failed to deliver event:", err)
+			return true
+		}
+		webhook.log.Debug.Println("Webhook: Retrying after", backoff, "-", err)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-webhook.stop:
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+		backoff *= 2
+		if backoff > WebhookMaxBackoff {
+			backoff = WebhookMaxBackoff
+		}
+	}
+}
+
+func (webhook *Webhook) post(body []byte) (bool, error) {
+	resp, err := webhook.client.Post(webhook.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("server responded %s", resp.Status)
+	default:
+		return false, fmt.Errorf("server responded %s", resp.Status)
+	}
+}
@@ -0,0 +1,65 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhook(t *testing.T) {
+	received := make(chan webhookEvent, 1)
+	failures := 2
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var msg webhookEvent
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- msg
+	}))
+	defer server.Close()
+
+	device := randDevice(t)
+	defer device.Close()
+
+	webhook := NewWebhook(server.URL, device.log)
+	webhook.backoff = time.Millisecond
+	defer webhook.Close()
+	device.AddEventHandler(webhook.Notify)
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	peer, err := device.NewPeer(sk.publicKey())
+	assertNil(t, err)
+	peer.endpoint, err = CreateEndpoint("192.0.2.1:51820")
+	assertNil(t, err)
+
+	// roaming to a new endpoint is reported after retries
+
+	endpoint, err := CreateEndpoint("192.0.2.2:51820")
+	assertNil(t, err)
+	peer.SetEndpointFromPacket(endpoint)
+
+	select {
+	case msg := <-received:
+		pk := peer.handshake.remoteStatic
+		if msg.Type != "peer_roamed" || msg.Endpoint != "192.0.2.2:51820" || msg.Peer != base64.StdEncoding.EncodeToString(pk[:]) {
+			t.Fatalf("unexpected event %+v", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event not delivered")
+	}
+}
@@ -0,0 +1,23 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package ipc
+
+/* Reasons accompany the errno of a failed UAPI operation,
+ * allowing tooling to distinguish failures that share an errno.
+ * They are sent as the "error_reason" key preceding "errno".
+ */
+
+const (
+	ReasonProtocol     = "protocol"       // malformed request
+	ReasonUnknownKey   = "unknown_key"    // unsupported configuration key
+	ReasonInvalidKey   = "invalid_key"    // malformed public, private or preshared key
+	ReasonInvalidValue = "invalid_value"  // value failed to parse or is out of range
+	ReasonPeerNotFound = "peer_not_found" // referenced peer does not exist
+	ReasonPortInUse    = "port_in_use"    // unable to bind or configure a socket
+	ReasonTransient    = "transient"      // temporary failure, operation may be retried
+	ReasonIO           = "io"             // failure reading or writing the socket
+	ReasonMemoryLimit  = "memory_limit"   // device memory limit would be exceeded
+)
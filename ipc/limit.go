@@ -0,0 +1,159 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package ipc
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+/* Limits on UAPI clients
+ *
+ * Every connection carries a single operation, so a misbehaving
+ * management client is contained by bounding the connections open at
+ * once, the rate at which new ones are accepted, and the time a
+ * connection may sit idle in a read or write, which would otherwise
+ * hold the configuration lock of the device for as long as a client
+ * stalls in the middle of a set operation.
+ *
+ * At the connection limit, Accept waits for a connection to close,
+ * leaving further clients in the backlog of the socket. Connections
+ * beyond the rate are closed at once.
+ */
+
+type UAPILimits struct {
+	MaxConns    int           // connections open at once, 0 = unlimited
+	Rate        int           // connections accepted per second, 0 = unlimited
+	Burst       int           // connections accepted at once, at least one
+	IdleTimeout time.Duration // per read or write, 0 = unlimited
+}
+
+var DefaultUAPILimits = UAPILimits{
+	MaxConns:    16,
+	Rate:        20,
+	Burst:       40,
+	IdleTimeout: 30 * time.Second,
+}
+
+var errListenerClosed = errors.New("listener closed")
+
+type limitListener struct {
+	net.Listener
+	limits UAPILimits
+	slots  chan struct{}
+	closed chan struct{}
+	once   sync.Once
+
+	sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+type limitConn struct {
+	net.Conn
+	listener *limitListener
+	once     sync.Once
+}
+
+/* Applies the limits to the connections accepted from listener
+ */
+func LimitListener(listener net.Listener, limits UAPILimits) net.Listener {
+	l := &limitListener{
+		Listener: listener,
+		limits:   limits,
+		closed:   make(chan struct{}),
+		last:     time.Now(),
+	}
+	if l.limits.Burst < 1 {
+		l.limits.Burst = 1
+	}
+	l.tokens = float64(l.limits.Burst)
+	if limits.MaxConns > 0 {
+		l.slots = make(chan struct{}, limits.MaxConns)
+	}
+	return l
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		if l.slots != nil {
+			select {
+			case l.slots <- struct{}{}:
+			case <-l.closed:
+				return nil, errListenerClosed
+			}
+		}
+
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.release()
+			return nil, err
+		}
+		if !l.allow() {
+			conn.Close()
+			l.release()
+			continue
+		}
+		return &limitConn{Conn: conn, listener: l}, nil
+	}
+}
+
+func (l *limitListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+	})
+	return l.Listener.Close()
+}
+
+func (l *limitListener) release() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+/* Takes a token from the bucket refilled at the rate
+ */
+func (l *limitListener) allow() bool {
+	if l.limits.Rate <= 0 {
+		return true
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.limits.Rate)
+	l.last = now
+	if max := float64(l.limits.Burst); l.tokens > max {
+		l.tokens = max
+	}
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+func (c *limitConn) Read(b []byte) (int, error) {
+	if timeout := c.listener.limits.IdleTimeout; timeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *limitConn) Write(b []byte) (int, error) {
+	if timeout := c.listener.limits.IdleTimeout; timeout > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *limitConn) Close() error {
+	c.once.Do(c.listener.release)
+	return c.Conn.Close()
+}
@@ -0,0 +1,82 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package ipc
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLimitListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := LimitListener(inner, UAPILimits{MaxConns: 2, Rate: 1, Burst: 3, IdleTimeout: 100 * time.Millisecond})
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	expect := func(ok bool) net.Conn {
+		select {
+		case conn := <-accepted:
+			if !ok {
+				t.Fatal("connection accepted beyond the limit")
+			}
+			return conn
+		case <-time.After(200 * time.Millisecond):
+			if ok {
+				t.Fatal("connection not accepted")
+			}
+			return nil
+		}
+	}
+
+	// at most two connections at once
+
+	dial()
+	dial()
+	dial()
+	first := expect(true)
+	second := expect(true)
+	expect(false)
+
+	// idle connections time out
+
+	buf := make([]byte, 1)
+	if _, err := first.Read(buf); err == nil {
+		t.Fatal("read did not time out")
+	}
+
+	// closing one admits the third, the rate then holds off a fourth
+
+	first.Close()
+	expect(true)
+	second.Close()
+	client := dial()
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(buf); err == nil {
+		t.Fatal("connection beyond the rate not closed")
+	}
+}
@@ -0,0 +1,79 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package ipc
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+/* Socket activation
+ *
+ * When started by systemd for a socket unit, the listening UAPI socket
+ * is inherited as described by LISTEN_PID, LISTEN_FDS and optionally
+ * LISTEN_FDNAMES, see sd_listen_fds(3). Systemd then owns the socket:
+ * it is created with the permissions of the unit before the daemon
+ * runs, and is neither watched for removal nor removed on exit.
+ */
+
+const listenFdsStart = 3 // SD_LISTEN_FDS_START
+
+var activatedFds = make(map[uintptr]bool)
+
+/* Returns the UAPI socket passed by systemd, or nil if the process was
+ * not socket activated. Of several sockets, the one named after the
+ * interface, as by FileDescriptorName=<name>, is used.
+ */
+func UAPIActivated(name string) (*os.File, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+	var names []string
+	if fdNames := os.Getenv("LISTEN_FDNAMES"); fdNames != "" {
+		names = strings.Split(fdNames, ":")
+	}
+
+	// keep children from taking the sockets as their own
+
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	index := -1
+	if count == 1 {
+		index = 0
+	}
+	for i := 0; i < count && i < len(names); i++ {
+		if names[i] == name || names[i] == fmt.Sprintf(socketName, name) {
+			index = i
+			break
+		}
+	}
+	for i := 0; i < count; i++ {
+		unix.CloseOnExec(listenFdsStart + i)
+	}
+	if index < 0 {
+		return nil, errors.New("no socket named " + name + " among the " + strconv.Itoa(count) + " passed by systemd")
+	}
+
+	fd := uintptr(listenFdsStart + index)
+	activatedFds[fd] = true
+	return os.NewFile(fd, "systemd:"+name), nil
+}
+
+func isActivated(file *os.File) bool {
+	return activatedFds[file.Fd()]
+}
@@ -1,4 +1,4 @@
-// +build darwin freebsd openbsd
+// +build darwin freebsd openbsd netbsd
 
 /* SPDX-License-Identifier: MIT
  *
@@ -25,6 +25,9 @@ const (
 	IpcErrorProtocol  = -int64(unix.EPROTO)
 	IpcErrorInvalid   = -int64(unix.EINVAL)
 	IpcErrorPortInUse = -int64(unix.EADDRINUSE)
+	IpcErrorNotFound  = -int64(unix.ENOENT)
+	IpcErrorBusy      = -int64(unix.EBUSY)
+	IpcErrorNoMemory  = -int64(unix.ENOMEM)
 	socketName        = "%s.sock"
 )
 
@@ -201,3 +204,9 @@ func UAPIOpen(name string) (*os.File, error) {
 
 	return listener.File()
 }
+
+/* Socket activation is specific to systemd, see uapi_activation_linux.go
+ */
+func UAPIActivated(name string) (*os.File, error) {
+	return nil, nil
+}
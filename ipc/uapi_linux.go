@@ -23,6 +23,9 @@ const (
 	IpcErrorProtocol  = -int64(unix.EPROTO)
 	IpcErrorInvalid   = -int64(unix.EINVAL)
 	IpcErrorPortInUse = -int64(unix.EADDRINUSE)
+	IpcErrorNotFound  = -int64(unix.ENOENT)
+	IpcErrorBusy      = -int64(unix.EBUSY)
+	IpcErrorNoMemory  = -int64(unix.ENOMEM)
 	socketName        = "%s.sock"
 )
 
@@ -47,8 +50,11 @@ func (l *UAPIListener) Accept() (net.Conn, error) {
 }
 
 func (l *UAPIListener) Close() error {
-	err1 := unix.Close(l.inotifyFd)
-	err2 := l.inotifyRWCancel.Cancel()
+	var err1, err2 error
+	if l.inotifyRWCancel != nil {
+		err1 = unix.Close(l.inotifyFd)
+		err2 = l.inotifyRWCancel.Cancel()
+	}
 	err3 := l.listener.Close()
 	if err1 != nil {
 		return err1
@@ -65,7 +71,9 @@ func (l *UAPIListener) Addr() net.Addr {
 
 func UAPIListen(name string, file *os.File) (net.Listener, error) {
 
-	// wrap file in listener
+	// wrap file in listener, socket activated ones belong to systemd
+
+	activated := isActivated(file)
 
 	listener, err := net.FileListener(file)
 	if err != nil {
@@ -73,7 +81,7 @@ func UAPIListen(name string, file *os.File) (net.Listener, error) {
 	}
 
 	if unixListener, ok := listener.(*net.UnixListener); ok {
-		unixListener.SetUnlinkOnClose(true)
+		unixListener.SetUnlinkOnClose(!activated)
 	}
 
 	uapi := &UAPIListener{
@@ -82,6 +90,11 @@ func UAPIListen(name string, file *os.File) (net.Listener, error) {
 		connErr:  make(chan error, 1),
 	}
 
+	if activated {
+		go uapi.routineAccept()
+		return uapi, nil
+	}
+
 	// watch for deletion of socket
 
 	socketPath := path.Join(
@@ -130,20 +143,22 @@ func UAPIListen(name string, file *os.File) (net.Listener, error) {
 
 	// watch for new connections
 
-	go func(l *UAPIListener) {
-		for {
-			conn, err := l.listener.Accept()
-			if err != nil {
-				l.connErr <- err
-				break
-			}
-			l.connNew <- conn
-		}
-	}(uapi)
+	go uapi.routineAccept()
 
 	return uapi, nil
 }
 
+func (l *UAPIListener) routineAccept() {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			l.connErr <- err
+			break
+		}
+		l.connNew <- conn
+	}
+}
+
 func UAPIOpen(name string) (*os.File, error) {
 
 	// check if path exist
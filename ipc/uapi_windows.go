@@ -19,6 +19,9 @@ const (
 	IpcErrorProtocol  = -int64(71)
 	IpcErrorInvalid   = -int64(22)
 	IpcErrorPortInUse = -int64(98)
+	IpcErrorNotFound  = -int64(2)
+	IpcErrorBusy      = -int64(16)
+	IpcErrorNoMemory  = -int64(12)
 )
 
 type UAPIListener struct {
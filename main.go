@@ -8,7 +8,10 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/signal"
 	"runtime"
@@ -29,11 +32,18 @@ const (
 	ENV_WG_TUN_FD             = "WG_TUN_FD"
 	ENV_WG_UAPI_FD            = "WG_UAPI_FD"
 	ENV_WG_PROCESS_FOREGROUND = "WG_PROCESS_FOREGROUND"
+	ENV_WG_STATE_DUMP_FILE    = "WG_STATE_DUMP_FILE"
+	ENV_WG_AUDIT_LOG_FILE     = "WG_AUDIT_LOG_FILE"
+	ENV_WG_WEBHOOK_URL        = "WG_WEBHOOK_URL"
+	ENV_WG_CONFIG_FD          = "WG_CONFIG_FD"
+	ENV_WG_KEYLOG_FILE        = "WGKEYLOGFILE"
 )
 
 func printUsage() {
 	fmt.Printf("usage:\n")
 	fmt.Printf("%s [-f/--foreground] INTERFACE-NAME\n", os.Args[0])
+	fmt.Printf("%s check [--json] CONFIG-FILE\n", os.Args[0])
+	fmt.Printf("%s encrypt CONFIG-FILE\n", os.Args[0])
 }
 
 func warning() {
@@ -55,12 +65,85 @@ func warning() {
 	fmt.Fprintln(os.Stderr, "WARNING WARNING WARNING WARNING WARNING WARNING WARNING")
 }
 
+/* Writes a diagnostic snapshot of the device to the file named by
+ * WG_STATE_DUMP_FILE, or to the log if that variable is unset
+ */
+func dumpState(dev *device.Device, logger *device.Logger) {
+	path := os.Getenv(ENV_WG_STATE_DUMP_FILE)
+	if path == "" {
+		var buf bytes.Buffer
+		dev.DumpState(&buf)
+		scanner := bufio.NewScanner(&buf)
+		for scanner.Scan() {
+			logger.Info.Println(scanner.Text())
+		}
+		return
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		logger.Error.Println("Failed to open state dump file:", err)
+		return
+	}
+	defer file.Close()
+	if err := dev.DumpState(file); err != nil {
+		logger.Error.Println("Failed to write state dump:", err)
+		return
+	}
+	logger.Info.Println("State dumped to", path)
+}
+
+/* Brings the interface up, if the TUN device supports
+ * changing its link state
+ */
+func setLinkUp(dev tun.Device) error {
+	if setter, ok := dev.(tun.LinkSetter); ok {
+		return setter.SetLinkUp(true)
+	}
+	return nil
+}
+
+/* Records completed handshakes in the file named by
+ * WG_AUDIT_LOG_FILE, if that variable is set
+ */
+func openAuditLog(dev *device.Device, logger *device.Logger) (*device.AuditLog, error) {
+	path := os.Getenv(ENV_WG_AUDIT_LOG_FILE)
+	if path == "" {
+		return nil, nil
+	}
+	audit, err := device.OpenAuditLog(path, logger)
+	if err != nil {
+		return nil, err
+	}
+	dev.AddEventHandler(audit.Record)
+	return audit, nil
+}
+
+/* Posts events to the URL in WG_WEBHOOK_URL, if that variable is set
+ */
+func startWebhook(dev *device.Device, logger *device.Logger) *device.Webhook {
+	url := os.Getenv(ENV_WG_WEBHOOK_URL)
+	if url == "" {
+		return nil
+	}
+	webhook := device.NewWebhook(url, logger)
+	dev.AddEventHandler(webhook.Notify)
+	return webhook
+}
+
 func main() {
 	if len(os.Args) == 2 && os.Args[1] == "--version" {
 		fmt.Printf("wireguard-go v%s\n\nUserspace WireGuard daemon for %s-%s.\nInformation available at https://www.wireguard.com.\nCopyright (C) Jason A. Donenfeld <Jason@zx2c4.com>.\n", device.WireGuardGoVersion, runtime.GOOS, runtime.GOARCH)
 		return
 	}
 
+	if len(os.Args) >= 2 && os.Args[1] == "check" {
+		os.Exit(checkConfig(os.Args[2:]))
+	}
+	if len(os.Args) >= 2 && os.Args[1] == "encrypt" {
+		os.Exit(encryptConfig(os.Args[2:]))
+	}
+
 	warning()
 
 	var foreground bool
@@ -109,6 +192,29 @@ func main() {
 		return device.LogLevelInfo
 	}()
 
+	// read configuration file (or take it from the parent), asking for
+	// its passphrase before daemonizing
+
+	uapiConfig, err := func() (string, error) {
+		configFdStr := os.Getenv(ENV_WG_CONFIG_FD)
+		if configFdStr == "" {
+			return loadConfig()
+		}
+
+		fd, err := strconv.ParseUint(configFdStr, 10, 32)
+		if err != nil {
+			return "", err
+		}
+		file := os.NewFile(uintptr(fd), "")
+		defer file.Close()
+		data, err := ioutil.ReadAll(file)
+		return string(data), err
+	}()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to load configuration:", err)
+		os.Exit(ExitSetupFailed)
+	}
+
 	// open TUN device (or use supplied fd)
 
 	tun, err := func() (tun.Device, error) {
@@ -154,23 +260,33 @@ func main() {
 		os.Exit(ExitSetupFailed)
 	}
 
+	// take UAPI socket from systemd, which then supervises the process
+
+	fileUAPI, err := ipc.UAPIActivated(interfaceName)
+	if fileUAPI != nil {
+		foreground = true
+		logger.Info.Println("Using UAPI socket passed by systemd")
+	}
+
 	// open UAPI file (or use supplied fd)
 
-	fileUAPI, err := func() (*os.File, error) {
-		uapiFdStr := os.Getenv(ENV_WG_UAPI_FD)
-		if uapiFdStr == "" {
-			return ipc.UAPIOpen(interfaceName)
-		}
+	if fileUAPI == nil && err == nil {
+		fileUAPI, err = func() (*os.File, error) {
+			uapiFdStr := os.Getenv(ENV_WG_UAPI_FD)
+			if uapiFdStr == "" {
+				return ipc.UAPIOpen(interfaceName)
+			}
 
-		// use supplied fd
+			// use supplied fd
 
-		fd, err := strconv.ParseUint(uapiFdStr, 10, 32)
-		if err != nil {
-			return nil, err
-		}
+			fd, err := strconv.ParseUint(uapiFdStr, 10, 32)
+			if err != nil {
+				return nil, err
+			}
 
-		return os.NewFile(uintptr(fd), ""), nil
-	}()
+			return os.NewFile(uintptr(fd), ""), nil
+		}()
+	}
 
 	if err != nil {
 		logger.Error.Println("UAPI listen error:", err)
@@ -206,6 +322,21 @@ func main() {
 			Env: env,
 		}
 
+		// pass the configuration through a pipe, never the environment
+
+		var configWriter *os.File
+		if uapiConfig != "" {
+			configReader, writer, err := os.Pipe()
+			if err != nil {
+				logger.Error.Println("Failed to pass configuration:", err)
+				os.Exit(ExitSetupFailed)
+			}
+			defer configReader.Close()
+			configWriter = writer
+			attr.Files = append(attr.Files, configReader)
+			attr.Env = append(attr.Env, fmt.Sprintf("%s=5", ENV_WG_CONFIG_FD))
+		}
+
 		path, err := os.Executable()
 		if err != nil {
 			logger.Error.Println("Failed to determine executable:", err)
@@ -222,6 +353,14 @@ func main() {
 			os.Exit(ExitSetupFailed)
 		}
 		process.Release()
+		if configWriter != nil {
+			_, err := configWriter.WriteString(uapiConfig)
+			configWriter.Close()
+			if err != nil {
+				logger.Error.Println("Failed to pass configuration:", err)
+				os.Exit(ExitSetupFailed)
+			}
+		}
 		return
 	}
 
@@ -229,6 +368,33 @@ func main() {
 
 	logger.Info.Println("Device started")
 
+	// record events before the configuration can complete handshakes
+
+	audit, err := openAuditLog(device, logger)
+	if err != nil {
+		logger.Error.Println("Failed to open audit log:", err)
+		os.Exit(ExitSetupFailed)
+	}
+
+	webhook := startWebhook(device, logger)
+
+	if path := os.Getenv(ENV_WG_KEYLOG_FILE); path != "" {
+		if err := device.OpenKeyLog(path); err != nil {
+			logger.Error.Println("Failed to open key log file:", err)
+		}
+	}
+
+	if err := applyConfig(device, uapiConfig); err != nil {
+		logger.Error.Println("Failed to apply configuration:", err)
+		os.Exit(ExitSetupFailed)
+	}
+	if uapiConfig != "" {
+		// a configured interface is ready to carry traffic
+		if err := setLinkUp(tun); err != nil {
+			logger.Error.Println("Failed to bring interface up:", err)
+		}
+	}
+
 	errs := make(chan error)
 	term := make(chan os.Signal, 1)
 
@@ -237,6 +403,7 @@ func main() {
 		logger.Error.Println("Failed to listen on uapi socket:", err)
 		os.Exit(ExitSetupFailed)
 	}
+	uapi = ipc.LimitListener(uapi, ipc.DefaultUAPILimits)
 
 	go func() {
 		for {
@@ -251,6 +418,18 @@ func main() {
 
 	logger.Info.Println("UAPI listener started")
 
+	// dump state on request
+
+	dump := make(chan os.Signal, 1)
+	signal.Notify(dump, syscall.SIGUSR1)
+	go func() {
+		for range dump {
+			dumpState(device, logger)
+		}
+	}()
+
+	debug := startDebugListener(logger)
+
 	// wait for program to terminate
 
 	signal.Notify(term, syscall.SIGTERM)
@@ -264,8 +443,17 @@ func main() {
 
 	// clean up
 
+	if debug != nil {
+		debug.Close()
+	}
 	uapi.Close()
 	device.Close()
+	if audit != nil {
+		audit.Close()
+	}
+	if webhook != nil {
+		webhook.Close()
+	}
 
 	logger.Info.Println("Shutting down")
 }
@@ -7,6 +7,7 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
 	"syscall"
@@ -23,6 +24,12 @@ const (
 )
 
 func main() {
+	if len(os.Args) >= 2 && os.Args[1] == "check" {
+		os.Exit(checkConfig(os.Args[2:]))
+	}
+	if len(os.Args) >= 2 && os.Args[1] == "encrypt" {
+		os.Exit(encryptConfig(os.Args[2:]))
+	}
 	if len(os.Args) != 2 {
 		os.Exit(ExitSetupFailed)
 	}
@@ -30,6 +37,12 @@ func main() {
 
 	fmt.Fprintln(os.Stderr, "Warning: this is a test program for Windows, mainly used for debugging this Go package. For a real WireGuard for Windows client, the repo you want is <https://git.zx2c4.com/wireguard-windows/>, which includes this code as a module.")
 
+	uapiConfig, err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to load configuration:", err)
+		os.Exit(ExitSetupFailed)
+	}
+
 	logger := device.NewLogger(
 		device.LogLevelDebug,
 		fmt.Sprintf("(%s) ", interfaceName),
@@ -48,7 +61,26 @@ func main() {
 		os.Exit(ExitSetupFailed)
 	}
 
+	etw, err := device.RegisterETWProvider()
+	if err != nil {
+		logger.Error.Println("Failed to register ETW provider:", err)
+	} else {
+		logger.Error.SetOutput(io.MultiWriter(os.Stdout, etw))
+	}
+
 	device := device.NewDevice(tun, logger)
+	if etw != nil {
+		device.AddEventHandler(etw.Record)
+	}
+	if path := os.Getenv("WGKEYLOGFILE"); path != "" {
+		if err := device.OpenKeyLog(path); err != nil {
+			logger.Error.Println("Failed to open key log file:", err)
+		}
+	}
+	if err := applyConfig(device, uapiConfig); err != nil {
+		logger.Error.Println("Failed to apply configuration:", err)
+		os.Exit(ExitSetupFailed)
+	}
 	device.Up()
 	logger.Info.Println("Device started")
 
@@ -57,6 +89,7 @@ func main() {
 		logger.Error.Println("Failed to listen on uapi socket:", err)
 		os.Exit(ExitSetupFailed)
 	}
+	uapi = ipc.LimitListener(uapi, ipc.DefaultUAPILimits)
 
 	errs := make(chan error)
 	term := make(chan os.Signal, 1)
@@ -73,6 +106,8 @@ func main() {
 	}()
 	logger.Info.Println("UAPI listener started")
 
+	debug := startDebugListener(logger)
+
 	// wait for program to terminate
 
 	signal.Notify(term, os.Interrupt)
@@ -87,8 +122,14 @@ func main() {
 
 	// clean up
 
+	if debug != nil {
+		debug.Close()
+	}
 	uapi.Close()
 	device.Close()
+	if etw != nil {
+		etw.Close()
+	}
 
 	logger.Info.Println("Shutting down")
 }
@@ -0,0 +1,24 @@
+// +build !windows
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+func stdinIsTerminal() bool {
+	return terminal.IsTerminal(int(os.Stdin.Fd()))
+}
+
+/* Reads a line from the terminal without echoing it
+ */
+func readPassphrase() ([]byte, error) {
+	return terminal.ReadPassword(int(os.Stdin.Fd()))
+}
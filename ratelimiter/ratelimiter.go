@@ -27,9 +27,34 @@ type RatelimiterEntry struct {
 
 type Ratelimiter struct {
 	sync.RWMutex
-	stopReset chan struct{}
-	tableIPv4 map[[net.IPv4len]byte]*RatelimiterEntry
-	tableIPv6 map[[net.IPv6len]byte]*RatelimiterEntry
+	stopReset  chan struct{}
+	tableIPv4  map[[net.IPv4len]byte]*RatelimiterEntry
+	tableIPv6  map[[net.IPv6len]byte]*RatelimiterEntry
+	packetCost int64 // nanoseconds of tokens per packet, 0 = default
+	maxTokens  int64
+}
+
+/* Allows each address packetsPerSecond with bursts of up to burstable
+ * packets, instead of the defaults
+ */
+func (rate *Ratelimiter) SetRate(packetsPerSecond, burstable int) {
+	rate.Lock()
+	defer rate.Unlock()
+
+	if packetsPerSecond <= 0 || burstable <= 0 {
+		rate.packetCost = 0
+		rate.maxTokens = 0
+		return
+	}
+	rate.packetCost = int64(time.Second) / int64(packetsPerSecond)
+	rate.maxTokens = rate.packetCost * int64(burstable)
+}
+
+func (rate *Ratelimiter) costs() (int64, int64) {
+	if rate.packetCost == 0 {
+		return packetCost, maxTokens
+	}
+	return rate.packetCost, rate.maxTokens
 }
 
 func (rate *Ratelimiter) Close() {
@@ -111,6 +136,8 @@ func (rate *Ratelimiter) Allow(ip net.IP) bool {
 
 	rate.RLock()
 
+	packetCost, maxTokens := rate.costs()
+
 	if IPv4 != nil {
 		copy(keyIPv4[:], IPv4)
 		entry = rate.tableIPv4[keyIPv4]
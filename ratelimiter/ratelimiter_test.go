@@ -101,3 +101,30 @@ func TestRatelimiter(t *testing.T) {
 		}
 	}
 }
+
+func TestRatelimiterSetRate(t *testing.T) {
+	var ratelimiter Ratelimiter
+	ratelimiter.Init()
+	defer ratelimiter.Close()
+
+	ip := net.ParseIP("192.0.2.1")
+	ratelimiter.SetRate(1, 2)
+	for i := 0; i < 2; i++ {
+		if !ratelimiter.Allow(ip) {
+			t.Fatalf("packet %d of burst rejected", i)
+		}
+	}
+	if ratelimiter.Allow(ip) {
+		t.Fatal("packet after burst allowed")
+	}
+
+	// resetting restores the default burst for new addresses
+
+	ratelimiter.SetRate(0, 0)
+	ip = net.ParseIP("192.0.2.2")
+	for i := 0; i < packetsBurstable; i++ {
+		if !ratelimiter.Allow(ip) {
+			t.Fatalf("packet %d of default burst rejected", i)
+		}
+	}
+}
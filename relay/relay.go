@@ -0,0 +1,211 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+/* Package relay forwards WireGuard datagrams between peers which are
+ * unable to reach each other directly, over a TCP (optionally TLS)
+ * connection to a relay server.
+ *
+ * A client opens a connection by sending a hello:
+ *
+ *   magic "WGR1" (4) | public key (32) | TAI64N timestamp (12) | mac (32)
+ *
+ * where mac is keyed BLAKE2s-256 of the preceding fields, keyed with a
+ * secret shared between the relay server and its clients. The server
+ * answers with a single zero byte if it accepts the client, otherwise
+ * it closes the connection. Hellos with a timestamp not newer than the
+ * previous one for the same public key are rejected as replays.
+ *
+ * Afterwards both directions carry frames:
+ *
+ *   type (1) | length (2, big endian) | public key (32) | payload (length)
+ *
+ * From the client the public key names the destination, from the server
+ * it names the source. Frames for unknown destinations are discarded.
+ *
+ * The relay only authenticates membership, the public key in the hello
+ * is not proven. This is acceptable as relayed datagrams are protected
+ * by WireGuard itself, but a member may disrupt relaying to others.
+ */
+package relay
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.zx2c4.com/wireguard/tai64n"
+)
+
+const (
+	KeySize       = 32
+	helloSize     = 4 + KeySize + tai64n.TimestampSize + blake2s.Size
+	frameHeader   = 1 + 2 + KeySize
+	framePacket   = 1
+	MaxPacketSize = 65535
+	DialTimeout   = 10 * time.Second
+)
+
+var magic = [4]byte{'W', 'G', 'R', '1'}
+
+var ErrRejected = errors.New("relay rejected hello")
+
+type Key [KeySize]byte
+
+func helloMAC(secret *Key, hello []byte) [blake2s.Size]byte {
+	var mac [blake2s.Size]byte
+	hash, _ := blake2s.New256(secret[:])
+	hash.Write(hello)
+	hash.Sum(mac[:0])
+	return mac
+}
+
+func writeFrame(w io.Writer, key *Key, packet []byte) error {
+	if len(packet) > MaxPacketSize {
+		return errors.New("packet too large for relay frame")
+	}
+	frame := make([]byte, frameHeader+len(packet))
+	frame[0] = framePacket
+	binary.BigEndian.PutUint16(frame[1:3], uint16(len(packet)))
+	copy(frame[3:frameHeader], key[:])
+	copy(frame[frameHeader:], packet)
+	_, err := w.Write(frame)
+	return err
+}
+
+/* Reads the next packet frame into buff,
+ * returning the size of the payload and its key
+ */
+func readFrame(r io.Reader, buff []byte) (int, Key, error) {
+	var header [frameHeader]byte
+	var key Key
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return 0, key, err
+		}
+		size := int(binary.BigEndian.Uint16(header[1:3]))
+		copy(key[:], header[3:])
+		if header[0] != framePacket || size > len(buff) {
+			if _, err := io.CopyN(ioutil.Discard, r, int64(size)); err != nil {
+				return 0, key, err
+			}
+			continue
+		}
+		if _, err := io.ReadFull(r, buff[:size]); err != nil {
+			return 0, key, err
+		}
+		return size, key, nil
+	}
+}
+
+/* A Client is a connection to a relay server
+ */
+type Client struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	writeLock sync.Mutex
+}
+
+/* Connects to the relay at address, which is "host:port" for plain TCP
+ * or "tls://host:port" for TLS, and registers the public key
+ */
+func Dial(address string, publicKey *Key, secret *Key) (*Client, error) {
+	var conn net.Conn
+	var err error
+
+	dialer := &net.Dialer{Timeout: DialTimeout}
+	if len(address) > 6 && address[:6] == "tls://" {
+		host, _, splitErr := net.SplitHostPort(address[6:])
+		if splitErr != nil {
+			return nil, splitErr
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", address[6:], &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := NewClient(conn, publicKey, secret)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+/* Performs the hello on an established connection
+ */
+func NewClient(conn net.Conn, publicKey *Key, secret *Key) (*Client, error) {
+	var hello [helloSize]byte
+	timestamp := tai64n.Now()
+	copy(hello[:4], magic[:])
+	copy(hello[4:], publicKey[:])
+	copy(hello[4+KeySize:], timestamp[:])
+	mac := helloMAC(secret, hello[:helloSize-blake2s.Size])
+	copy(hello[helloSize-blake2s.Size:], mac[:])
+
+	conn.SetDeadline(time.Now().Add(DialTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if _, err := conn.Write(hello[:]); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	status, err := reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if status != 0 {
+		return nil, ErrRejected
+	}
+
+	return &Client{conn: conn, reader: reader}, nil
+}
+
+func (client *Client) Send(dst *Key, packet []byte) error {
+	client.writeLock.Lock()
+	defer client.writeLock.Unlock()
+	return writeFrame(client.conn, dst, packet)
+}
+
+/* Receives the next packet, returning its size and the key of the sender.
+ * Must not be called concurrently.
+ */
+func (client *Client) Receive(buff []byte) (int, Key, error) {
+	return readFrame(client.reader, buff)
+}
+
+func (client *Client) Close() error {
+	return client.conn.Close()
+}
+
+/* Verifies a hello and returns the public key of the client
+ */
+func readHello(r io.Reader, secret *Key) (Key, tai64n.Timestamp, error) {
+	var hello [helloSize]byte
+	var key Key
+	var timestamp tai64n.Timestamp
+
+	if _, err := io.ReadFull(r, hello[:]); err != nil {
+		return key, timestamp, err
+	}
+	mac := helloMAC(secret, hello[:helloSize-blake2s.Size])
+	if !hmac.Equal(mac[:], hello[helloSize-blake2s.Size:]) || string(hello[:4]) != string(magic[:]) {
+		return key, timestamp, ErrRejected
+	}
+	copy(key[:], hello[4:])
+	copy(timestamp[:], hello[4+KeySize:])
+	return key, timestamp, nil
+}
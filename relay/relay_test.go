@@ -0,0 +1,69 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package relay
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestRelay(t *testing.T) {
+	secret := Key{1, 2, 3}
+	server := NewServer(&secret)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go server.Serve(listener)
+
+	address := listener.Addr().String()
+	key1, key2 := Key{1}, Key{2}
+
+	client1, err := Dial(address, &key1, &secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := Dial(address, &key2, &secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	// forward in both directions
+
+	var buff [MaxPacketSize]byte
+	for _, test := range []struct {
+		from, to *Client
+		dst, src Key
+	}{
+		{client1, client2, key2, key1},
+		{client2, client1, key1, key2},
+	} {
+		packet := []byte("datagram for " + string(test.dst[:1]))
+		if err := test.from.Send(&test.dst, packet); err != nil {
+			t.Fatal(err)
+		}
+		size, src, err := test.to.Receive(buff[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if src != test.src || !bytes.Equal(buff[:size], packet) {
+			t.Fatalf("received %q from %x", buff[:size], src[:1])
+		}
+	}
+
+	// reject clients without the secret
+
+	wrong := Key{4}
+	if _, err := Dial(address, &key1, &wrong); err == nil {
+		t.Fatal("expected hello with wrong secret to be rejected")
+	}
+}
@@ -0,0 +1,105 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package relay
+
+import (
+	"net"
+	"sync"
+
+	"golang.zx2c4.com/wireguard/tai64n"
+)
+
+/* A Server forwards frames between connected clients
+ */
+type Server struct {
+	secret Key
+
+	sync.Mutex
+	clients    map[Key]*serverConn
+	timestamps map[Key]tai64n.Timestamp
+}
+
+type serverConn struct {
+	net.Conn
+	writeLock sync.Mutex
+}
+
+func NewServer(secret *Key) *Server {
+	return &Server{
+		secret:     *secret,
+		clients:    make(map[Key]*serverConn),
+		timestamps: make(map[Key]tai64n.Timestamp),
+	}
+}
+
+/* Accepts clients until the listener is closed
+ */
+func (server *Server) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go server.handle(conn)
+	}
+}
+
+func (server *Server) handle(conn net.Conn) {
+	defer conn.Close()
+
+	key, timestamp, err := readHello(conn, &server.secret)
+	if err != nil {
+		return
+	}
+
+	client := &serverConn{Conn: conn}
+
+	server.Lock()
+	if !timestamp.After(server.timestamps[key]) {
+		server.Unlock()
+		return
+	}
+	server.timestamps[key] = timestamp
+	if old, ok := server.clients[key]; ok {
+		old.Close()
+	}
+	server.clients[key] = client
+	server.Unlock()
+
+	defer func() {
+		server.Lock()
+		if server.clients[key] == client {
+			delete(server.clients, key)
+		}
+		server.Unlock()
+	}()
+
+	if _, err := conn.Write([]byte{0}); err != nil {
+		return
+	}
+
+	var buff [MaxPacketSize]byte
+	for {
+		size, dst, err := readFrame(conn, buff[:])
+		if err != nil {
+			return
+		}
+
+		server.Lock()
+		peer := server.clients[dst]
+		server.Unlock()
+
+		if peer == nil {
+			continue
+		}
+		peer.writeLock.Lock()
+		err = writeFrame(peer, &key, buff[:size])
+		peer.writeLock.Unlock()
+		if err != nil {
+			peer.Close()
+		}
+	}
+}
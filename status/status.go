@@ -0,0 +1,349 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+/* Package status renders the state of a device in the layout of
+ * `wg show`, or as the equivalent JSON, so that embedders present
+ * the same output regardless of how they reach the device.
+ *
+ * The state is read from the output of a UAPI get operation, either
+ * taken from a device in the same process or from a UAPI socket.
+ */
+package status
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.zx2c4.com/wireguard/device"
+)
+
+type Device struct {
+	Name         string `json:"name"`
+	PublicKey    string `json:"public_key,omitempty"`
+	PrivateKey   string `json:"private_key,omitempty"`
+	ListenPort   uint16 `json:"listen_port,omitempty"`
+	FirewallMark uint32 `json:"fwmark,omitempty"`
+	Peers        []Peer `json:"peers"`
+}
+
+type Peer struct {
+	PublicKey           string            `json:"public_key"`
+	PresharedKey        string            `json:"preshared_key,omitempty"`
+	Endpoint            string            `json:"endpoint,omitempty"`
+	AllowedIPs          []string          `json:"allowed_ips"`
+	LatestHandshake     time.Time         `json:"latest_handshake"`
+	ReceiveBytes        uint64            `json:"rx_bytes"`
+	TransmitBytes       uint64            `json:"tx_bytes"`
+	ReceivePackets      uint64            `json:"rx_packets"`
+	TransmitPackets     uint64            `json:"tx_packets"`
+	PersistentKeepalive uint16            `json:"persistent_keepalive_interval,omitempty"` // seconds
+	Disabled            bool              `json:"disabled,omitempty"`
+	Unreachable         bool              `json:"unreachable,omitempty"`
+	Metadata            map[string]string `json:"metadata,omitempty"`
+}
+
+/* Returns the state of a device in the same process
+ */
+func FromDevice(name string, dev *device.Device) (*Device, error) {
+	var buf bytes.Buffer
+	writer := bufio.NewWriter(&buf)
+	if err := dev.IpcGetOperation(writer); err != nil {
+		return nil, err
+	}
+	writer.Flush()
+	return Parse(name, &buf)
+}
+
+/* Parses the output of a UAPI get operation, up to the terminating
+ * empty line or the end of the reader
+ */
+func Parse(name string, reader io.Reader) (*Device, error) {
+	dev := &Device{Name: name, Peers: []Peer{}}
+	var peer *Peer
+	var handshakeSec, handshakeNsec int64
+
+	finishPeer := func() {
+		if peer != nil && (handshakeSec != 0 || handshakeNsec != 0) {
+			peer.LatestHandshake = time.Unix(handshakeSec, handshakeNsec)
+		}
+		handshakeSec, handshakeNsec = 0, 0
+	}
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid line: %q", line)
+		}
+		key, value := parts[0], parts[1]
+
+		var err error
+		switch key {
+		case "errno":
+			if value != "0" {
+				return nil, fmt.Errorf("get operation failed with errno %s", value)
+			}
+		case "private_key":
+			dev.PrivateKey, err = hexToBase64(value)
+			if err == nil {
+				dev.PublicKey, err = publicKey(value)
+			}
+		case "key_provider":
+			dev.PublicKey, err = hexToBase64(value)
+		case "listen_port":
+			var port uint64
+			port, err = strconv.ParseUint(value, 10, 16)
+			dev.ListenPort = uint16(port)
+		case "fwmark":
+			var mark uint64
+			mark, err = strconv.ParseUint(value, 10, 32)
+			dev.FirewallMark = uint32(mark)
+		case "public_key":
+			finishPeer()
+			dev.Peers = append(dev.Peers, Peer{AllowedIPs: []string{}})
+			peer = &dev.Peers[len(dev.Peers)-1]
+			peer.PublicKey, err = hexToBase64(value)
+		default:
+			if peer == nil {
+				continue // device keys not shown
+			}
+			switch key {
+			case "preshared_key":
+				if strings.Trim(value, "0") != "" {
+					peer.PresharedKey, err = hexToBase64(value)
+				}
+			case "endpoint":
+				peer.Endpoint = value
+			case "allowed_ip":
+				peer.AllowedIPs = append(peer.AllowedIPs, value)
+			case "last_handshake_time_sec":
+				handshakeSec, err = strconv.ParseInt(value, 10, 64)
+			case "last_handshake_time_nsec":
+				handshakeNsec, err = strconv.ParseInt(value, 10, 64)
+			case "rx_bytes":
+				peer.ReceiveBytes, err = strconv.ParseUint(value, 10, 64)
+			case "tx_bytes":
+				peer.TransmitBytes, err = strconv.ParseUint(value, 10, 64)
+			case "rx_packets":
+				peer.ReceivePackets, err = strconv.ParseUint(value, 10, 64)
+			case "tx_packets":
+				peer.TransmitPackets, err = strconv.ParseUint(value, 10, 64)
+			case "persistent_keepalive_interval":
+				var interval uint64
+				interval, err = strconv.ParseUint(value, 10, 16)
+				peer.PersistentKeepalive = uint16(interval)
+			case "disabled":
+				peer.Disabled, err = strconv.ParseBool(value)
+			case "unreachable":
+				peer.Unreachable, err = strconv.ParseBool(value)
+			case "metadata":
+				colon := strings.IndexByte(value, ':')
+				if colon < 0 {
+					err = fmt.Errorf("expected key:value")
+					break
+				}
+				if peer.Metadata == nil {
+					peer.Metadata = make(map[string]string)
+				}
+				peer.Metadata[value[:colon]] = value[colon+1:]
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of %s: %v", key, err)
+		}
+	}
+	finishPeer()
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return dev, nil
+}
+
+func hexToBase64(value string) (string, error) {
+	key, err := hex.DecodeString(value)
+	if err != nil {
+		return "", err
+	}
+	if len(key) != device.NoisePublicKeySize {
+		return "", fmt.Errorf("key of %d bytes", len(key))
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+func publicKey(private string) (string, error) {
+	var sk, pk [32]byte
+	if _, err := hex.Decode(sk[:], []byte(private)); err != nil {
+		return "", err
+	}
+	curve25519.ScalarBaseMult(&pk, &sk)
+	return base64.StdEncoding.EncodeToString(pk[:]), nil
+}
+
+/* Returns a copy without private and preshared keys
+ */
+func (dev *Device) hideKeys() *Device {
+	hidden := *dev
+	hidden.PrivateKey = ""
+	hidden.Peers = make([]Peer, len(dev.Peers))
+	for i, peer := range dev.Peers {
+		peer.PresharedKey = ""
+		hidden.Peers[i] = peer
+	}
+	return &hidden
+}
+
+/* Writes the state in the layout of `wg show`, peers ordered by
+ * latest handshake, with private keys hidden unless showKeys is set
+ */
+func (dev *Device) WriteText(w io.Writer, showKeys bool) error {
+	buf := &bytes.Buffer{}
+	now := time.Now()
+
+	fmt.Fprintf(buf, "interface: %s\n", dev.Name)
+	if dev.PublicKey != "" {
+		fmt.Fprintf(buf, "  public key: %s\n", dev.PublicKey)
+	}
+	if dev.PrivateKey != "" {
+		fmt.Fprintf(buf, "  private key: %s\n", maskKey(dev.PrivateKey, showKeys))
+	}
+	if dev.ListenPort != 0 {
+		fmt.Fprintf(buf, "  listening port: %d\n", dev.ListenPort)
+	}
+	if dev.FirewallMark != 0 {
+		fmt.Fprintf(buf, "  fwmark: 0x%x\n", dev.FirewallMark)
+	}
+
+	peers := make([]Peer, len(dev.Peers))
+	copy(peers, dev.Peers)
+	sort.SliceStable(peers, func(i, j int) bool {
+		return peers[i].LatestHandshake.After(peers[j].LatestHandshake)
+	})
+
+	for _, peer := range peers {
+		fmt.Fprintf(buf, "\npeer: %s\n", peer.PublicKey)
+		if peer.Disabled {
+			fmt.Fprintf(buf, "  disabled: yes\n")
+		}
+		if peer.Unreachable {
+			fmt.Fprintf(buf, "  unreachable: yes\n")
+		}
+		if peer.PresharedKey != "" {
+			fmt.Fprintf(buf, "  preshared key: %s\n", maskKey(peer.PresharedKey, showKeys))
+		}
+		if peer.Endpoint != "" {
+			fmt.Fprintf(buf, "  endpoint: %s\n", peer.Endpoint)
+		}
+		if len(peer.AllowedIPs) == 0 {
+			fmt.Fprintf(buf, "  allowed ips: (none)\n")
+		} else {
+			fmt.Fprintf(buf, "  allowed ips: %s\n", strings.Join(peer.AllowedIPs, ", "))
+		}
+		if !peer.LatestHandshake.IsZero() {
+			fmt.Fprintf(buf, "  latest handshake: %s\n", formatAgo(now.Sub(peer.LatestHandshake)))
+		}
+		if peer.ReceiveBytes != 0 || peer.TransmitBytes != 0 {
+			fmt.Fprintf(buf, "  transfer: %s received, %s sent\n", formatBytes(peer.ReceiveBytes), formatBytes(peer.TransmitBytes))
+		}
+		if peer.PersistentKeepalive != 0 {
+			fmt.Fprintf(buf, "  persistent keepalive: every %s\n", formatDuration(time.Duration(peer.PersistentKeepalive)*time.Second))
+		}
+		if len(peer.Metadata) != 0 {
+			keys := make([]string, 0, len(peer.Metadata))
+			for key := range peer.Metadata {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			entries := make([]string, len(keys))
+			for i, key := range keys {
+				entries[i] = key + "=" + peer.Metadata[key]
+			}
+			fmt.Fprintf(buf, "  metadata: %s\n", strings.Join(entries, ", "))
+		}
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+/* Writes the state as JSON, omitting private keys unless showKeys is set
+ */
+func (dev *Device) WriteJSON(w io.Writer, showKeys bool) error {
+	if !showKeys {
+		dev = dev.hideKeys()
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(dev)
+}
+
+func maskKey(key string, show bool) string {
+	if show {
+		return key
+	}
+	return "(hidden)"
+}
+
+func formatAgo(d time.Duration) string {
+	if d < time.Second {
+		return "Now"
+	}
+	return formatDuration(d) + " ago"
+}
+
+func formatDuration(d time.Duration) string {
+	seconds := int64(d / time.Second)
+	units := []struct {
+		name    string
+		seconds int64
+	}{
+		{"year", 365 * 24 * 3600},
+		{"day", 24 * 3600},
+		{"hour", 3600},
+		{"minute", 60},
+		{"second", 1},
+	}
+
+	var parts []string
+	for _, unit := range units {
+		n := seconds / unit.seconds
+		seconds %= unit.seconds
+		if n == 1 {
+			parts = append(parts, "1 "+unit.name)
+		} else if n > 1 {
+			parts = append(parts, fmt.Sprintf("%d %ss", n, unit.name))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+func formatBytes(n uint64) string {
+	switch {
+	case n < 1024:
+		return fmt.Sprintf("%d B", n)
+	case n < 1024*1024:
+		return fmt.Sprintf("%.2f KiB", float64(n)/1024)
+	case n < 1024*1024*1024:
+		return fmt.Sprintf("%.2f MiB", float64(n)/(1024*1024))
+	case n < 1024*1024*1024*1024:
+		return fmt.Sprintf("%.2f GiB", float64(n)/(1024*1024*1024))
+	default:
+		return fmt.Sprintf("%.2f TiB", float64(n)/(1024*1024*1024*1024))
+	}
+}
@@ -0,0 +1,118 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package status
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const privateKey = "e84b5a6d2717c1003a13b431570353dbaca9146cf150c5f8575680feba52027a"
+
+func testConfig(handshake time.Time) string {
+	return strings.Join([]string{
+		"private_key=" + privateKey,
+		"listen_port=51820",
+		"fwmark=4660",
+		"public_key=c4c8e984c5322c8184c72265b92b250fdb63688705f504ba003c88f03393cf28",
+		"preshared_key=0000000000000000000000000000000000000000000000000000000000000000",
+		"protocol_version=1",
+		"endpoint=192.0.2.1:51820",
+		"last_handshake_time_sec=0",
+		"last_handshake_time_nsec=0",
+		"tx_bytes=0",
+		"rx_bytes=0",
+		"persistent_keepalive_interval=0",
+		"public_key=58402e695ba1772b1cc9309755f043251ea77fdcf10fbe63989ceb7e19321376",
+		"preshared_key=188515093e952f5f22e865cef3012e72f8b5f0b598ac0309d5dacce3b70fcf52",
+		"protocol_version=1",
+		"last_handshake_time_sec=" + strconv.FormatInt(handshake.Unix(), 10),
+		"last_handshake_time_nsec=0",
+		"tx_bytes=2048",
+		"rx_bytes=100",
+		"persistent_keepalive_interval=25",
+		"allowed_ip=10.0.0.2/32",
+		"allowed_ip=fd00::2/128",
+		"errno=0",
+		"",
+	}, "\n")
+}
+
+func TestText(t *testing.T) {
+	handshake := time.Now().Add(-(time.Minute + 2*time.Second))
+	dev, err := Parse("wg0", strings.NewReader(testConfig(handshake)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := dev.WriteText(&buf, false); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `interface: wg0
+  public key: wVMuGz01CPx+vDVPpnliDzPyhxSVQuaExnt7DYE2Kyk=
+  private key: (hidden)
+  listening port: 51820
+  fwmark: 0x1234
+
+peer: WEAuaVuhdyscyTCXVfBDJR6nf9zxD75jmJzrfhkyE3Y=
+  preshared key: (hidden)
+  allowed ips: 10.0.0.2/32, fd00::2/128
+  latest handshake: 1 minute, 2 seconds ago
+  transfer: 100 B received, 2.00 KiB sent
+  persistent keepalive: every 25 seconds
+
+peer: xMjphMUyLIGExyJluSslD9tjaIcF9QS6ADyI8DOTzyg=
+  endpoint: 192.0.2.1:51820
+  allowed ips: (none)
+`
+	if buf.String() != expected {
+		t.Fatalf("got:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	handshake := time.Unix(1500000000, 0)
+	dev, err := Parse("wg0", strings.NewReader(testConfig(handshake)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := dev.WriteJSON(&buf, false); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "private_key") || strings.Contains(buf.String(), "preshared_key") {
+		t.Fatalf("keys not hidden: %s", buf.String())
+	}
+
+	var decoded Device
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Peers) != 2 || !decoded.Peers[1].LatestHandshake.Equal(handshake) || decoded.Peers[1].TransmitBytes != 2048 {
+		t.Fatalf("unexpected state %+v", decoded)
+	}
+	if dev.PrivateKey == "" || dev.Peers[1].PresharedKey == "" {
+		t.Fatal("hiding keys modified the state")
+	}
+}
+
+func TestKeyProvider(t *testing.T) {
+	config := "key_provider=c4c8e984c5322c8184c72265b92b250fdb63688705f504ba003c88f03393cf28\nlisten_port=51820\nerrno=0\n\n"
+	dev, err := Parse("wg0", strings.NewReader(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dev.PublicKey != "xMjphMUyLIGExyJluSslD9tjaIcF9QS6ADyI8DOTzyg=" || dev.PrivateKey != "" || len(dev.Peers) != 0 {
+		t.Fatalf("unexpected state %+v", dev)
+	}
+}
@@ -0,0 +1,66 @@
+// +build linux darwin freebsd openbsd netbsd
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package tun
+
+import (
+	"errors"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// setLinkUp sets or clears IFF_UP of the named interface, leaving its
+// other flags alone.
+func setLinkUp(name string, up bool) error {
+	fd, err := unix.Socket(
+		unix.AF_INET,
+		unix.SOCK_DGRAM,
+		0,
+	)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	var ifr [unix.IFNAMSIZ + 64]byte
+	copy(ifr[:], name)
+	_, _, errno := unix.Syscall(
+		unix.SYS_IOCTL,
+		uintptr(fd),
+		uintptr(unix.SIOCGIFFLAGS),
+		uintptr(unsafe.Pointer(&ifr[0])),
+	)
+	if errno != 0 {
+		return errors.New("failed to get flags of TUN device: " + errno.Error())
+	}
+
+	flags := (*uint16)(unsafe.Pointer(&ifr[unix.IFNAMSIZ]))
+	if up {
+		*flags |= unix.IFF_UP
+	} else {
+		*flags &^= unix.IFF_UP
+	}
+	_, _, errno = unix.Syscall(
+		unix.SYS_IOCTL,
+		uintptr(fd),
+		uintptr(unix.SIOCSIFFLAGS),
+		uintptr(unsafe.Pointer(&ifr[0])),
+	)
+	if errno != 0 {
+		return errors.New("failed to set flags of TUN device: " + errno.Error())
+	}
+	return nil
+}
+
+func (tun *NativeTun) SetLinkUp(up bool) error {
+	name, err := tun.Name()
+	if err != nil {
+		return err
+	}
+	return setLinkUp(name, up)
+}
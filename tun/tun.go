@@ -27,3 +27,9 @@ type Device interface {
 	Events() chan Event             // returns a constant channel of events related to the device
 	Close() error                   // stops the device and closes the event channel
 }
+
+// LinkSetter is implemented by devices whose interface can be
+// administratively brought up or down.
+type LinkSetter interface {
+	SetLinkUp(bool) error
+}
@@ -0,0 +1,184 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package tun
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// CallbackTUN is a Device without an operating system interface behind it,
+// for hosts which hand packets to the tunnel themselves, such as VPN
+// plug-in frameworks which call into the plug-in to encapsulate and
+// decapsulate packets instead of letting it install a driver.
+//
+// Packets the host wants sent through the tunnel are passed to Inject.
+// Packets received through the tunnel are passed to the write callback.
+//
+// Only the tunnel side is handed over: the device still sends and
+// receives its encrypted datagrams on its own UDP socket, so hosts whose
+// framework also owns the transport socket are not supported.
+type CallbackTUN struct {
+	dropped uint64 // accessed atomically
+	sync.Mutex
+	name    string
+	mtu     int
+	write   func(packet []byte) error
+	packets chan []byte
+	events  chan Event
+	closed  chan struct{}
+}
+
+const (
+	callbackQueueSize = 1024
+)
+
+var errCallbackTUNClosed = errors.New("tun: callback device closed")
+
+// CreateCallbackTUN creates a CallbackTUN of the given name and MTU, calling
+// write for every packet received through the tunnel. The packet passed to
+// write is only valid for the duration of the call.
+func CreateCallbackTUN(name string, mtu int, write func(packet []byte) error) *CallbackTUN {
+	tun := &CallbackTUN{
+		name:    name,
+		mtu:     mtu,
+		write:   write,
+		packets: make(chan []byte, callbackQueueSize),
+		events:  make(chan Event, 10),
+		closed:  make(chan struct{}),
+	}
+	tun.events <- EventUp
+	return tun
+}
+
+// Inject queues a packet to be sent through the tunnel, blocking while
+// the queue is full. The packet is copied. Packets larger than the read
+// buffer of the device are dropped when read, see Dropped.
+func (tun *CallbackTUN) Inject(packet []byte) error {
+	select {
+	case <-tun.closed:
+		return errCallbackTUNClosed
+	default:
+	}
+	packet = append([]byte(nil), packet...)
+	select {
+	case <-tun.closed:
+		return errCallbackTUNClosed
+	case tun.packets <- packet:
+		return nil
+	}
+}
+
+func (tun *CallbackTUN) Read(buff []byte, offset int) (int, error) {
+	select {
+	case <-tun.closed:
+		return 0, errCallbackTUNClosed
+	default:
+	}
+	for {
+		select {
+		case <-tun.closed:
+			return 0, errCallbackTUNClosed
+		case packet := <-tun.packets:
+			if len(packet) > len(buff)-offset {
+				atomic.AddUint64(&tun.dropped, 1)
+				continue
+			}
+			return copy(buff[offset:], packet), nil
+		}
+	}
+}
+
+// Dropped returns the number of injected packets dropped for not
+// fitting the read buffer.
+func (tun *CallbackTUN) Dropped() uint64 {
+	return atomic.LoadUint64(&tun.dropped)
+}
+
+func (tun *CallbackTUN) Write(buff []byte, offset int) (int, error) {
+	select {
+	case <-tun.closed:
+		return 0, errCallbackTUNClosed
+	default:
+	}
+	if err := tun.write(buff[offset:]); err != nil {
+		return 0, err
+	}
+	return len(buff), nil
+}
+
+func (tun *CallbackTUN) Flush() error {
+	return nil
+}
+
+func (tun *CallbackTUN) File() *os.File {
+	return nil
+}
+
+func (tun *CallbackTUN) MTU() (int, error) {
+	tun.Lock()
+	defer tun.Unlock()
+	return tun.mtu, nil
+}
+
+// SetMTU changes the MTU, as when the host renegotiates it.
+func (tun *CallbackTUN) SetMTU(mtu int) {
+	tun.Lock()
+	defer tun.Unlock()
+	select {
+	case <-tun.closed:
+		return
+	default:
+	}
+	tun.mtu = mtu
+	select {
+	case tun.events <- EventMTUUpdate:
+	default:
+	}
+}
+
+// SetLinkUp reports the link going up or down, there being no
+// interface to change.
+func (tun *CallbackTUN) SetLinkUp(up bool) error {
+	tun.Lock()
+	defer tun.Unlock()
+	select {
+	case <-tun.closed:
+		return errCallbackTUNClosed
+	default:
+	}
+	var event Event = EventDown
+	if up {
+		event = EventUp
+	}
+	select {
+	case tun.events <- event:
+	default:
+	}
+	return nil
+}
+
+func (tun *CallbackTUN) Name() (string, error) {
+	return tun.name, nil
+}
+
+func (tun *CallbackTUN) Events() chan Event {
+	return tun.events
+}
+
+func (tun *CallbackTUN) Close() error {
+	tun.Lock()
+	defer tun.Unlock()
+	select {
+	case <-tun.closed:
+	default:
+		close(tun.closed)
+		close(tun.events)
+	}
+	return nil
+}
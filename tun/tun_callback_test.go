@@ -0,0 +1,105 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package tun
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestCallbackTUN(t *testing.T) {
+	var written [][]byte
+	writeErr := errors.New("host refused packet")
+	tun := CreateCallbackTUN("callback0", 1420, func(packet []byte) error {
+		if len(packet) == 0 {
+			return writeErr
+		}
+		written = append(written, append([]byte(nil), packet...))
+		return nil
+	})
+
+	if event := <-tun.Events(); event != EventUp {
+		t.Fatalf("first event %v, expected up", event)
+	}
+	if name, err := tun.Name(); err != nil || name != "callback0" {
+		t.Fatalf("name %q, %v", name, err)
+	}
+
+	// injected packets are copied and read at the offset
+
+	packet := []byte{0x45, 1, 2, 3}
+	if err := tun.Inject(packet); err != nil {
+		t.Fatal(err)
+	}
+	packet[1] = 0xff
+	var buff [64]byte
+	n, err := tun.Read(buff[:], 16)
+	if err != nil || !bytes.Equal(buff[16:16+n], []byte{0x45, 1, 2, 3}) {
+		t.Fatalf("read %x, %v", buff[16:16+n], err)
+	}
+
+	// packets not fitting the buffer are dropped rather than truncated
+
+	if err := tun.Inject(make([]byte, 60)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tun.Inject(packet); err != nil {
+		t.Fatal(err)
+	}
+	n, err = tun.Read(buff[:], 16)
+	if err != nil || n != len(packet) || tun.Dropped() != 1 {
+		t.Fatalf("read %d bytes, %v, with %d dropped", n, err, tun.Dropped())
+	}
+
+	// written packets are passed to the callback from the offset
+
+	copy(buff[16:], []byte{0x45, 4, 5, 6})
+	if _, err := tun.Write(buff[:20], 16); err != nil {
+		t.Fatal(err)
+	}
+	if len(written) != 1 || !bytes.Equal(written[0], []byte{0x45, 4, 5, 6}) {
+		t.Fatalf("callback received %x", written)
+	}
+	if _, err := tun.Write(buff[:16], 16); err != writeErr {
+		t.Fatalf("write returned %v, expected the error of the callback", err)
+	}
+
+	// MTU changes are reported
+
+	tun.SetMTU(1280)
+	if mtu, err := tun.MTU(); err != nil || mtu != 1280 {
+		t.Fatalf("MTU %d, %v", mtu, err)
+	}
+	if event := <-tun.Events(); event != EventMTUUpdate {
+		t.Fatalf("event %v, expected MTU update", event)
+	}
+
+	// a closed device fails every operation
+
+	if err := tun.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tun.Close(); err != nil {
+		t.Fatal("second close failed:", err)
+	}
+	if _, ok := <-tun.Events(); ok {
+		t.Fatal("events open after close")
+	}
+	if tun.Inject(packet) == nil {
+		t.Fatal("injected into closed device")
+	}
+	if _, err := tun.Read(buff[:], 0); err == nil {
+		t.Fatal("read from closed device")
+	}
+	if _, err := tun.Write(buff[:20], 16); err == nil {
+		t.Fatal("wrote to closed device")
+	}
+	tun.SetMTU(1420)
+	if mtu, _ := tun.MTU(); mtu != 1280 {
+		t.Fatal("MTU changed after close")
+	}
+}
@@ -34,6 +34,10 @@ const (
 	ND6_IFF_NO_DAD         = 0x100
 )
 
+// Offset of ifi_mtu in struct if_msghdr, following the 16 byte header and
+// the 8 bytes of struct if_data before it
+const ifMsghdrMTUOffset = 16 + 8
+
 // Iface status string max len
 const _IFSTATMAX = 800
 
@@ -104,7 +108,7 @@ func (tun *NativeTun) routineRouteListener(tunIfindex int) {
 			return
 		}
 
-		if n < 14 {
+		if n < ifMsghdrMTUOffset+4 {
 			continue
 		}
 
@@ -116,14 +120,13 @@ func (tun *NativeTun) routineRouteListener(tunIfindex int) {
 			continue
 		}
 
-		iface, err := net.InterfaceByIndex(ifindex)
-		if err != nil {
-			tun.errors <- err
-			return
-		}
+		// The message carries the flags and MTU of the interface, so there
+		// is no need to query them, which would take a sysctl per message.
+		flags := *(*int32)(unsafe.Pointer(&data[8 /* ifm_flags */]))
+		mtu := int(*(*uint32)(unsafe.Pointer(&data[ifMsghdrMTUOffset])))
 
 		// Up / Down event
-		up := (iface.Flags & net.FlagUp) != 0
+		up := flags&unix.IFF_UP != 0
 		if up != statusUp && up {
 			tun.events <- EventUp
 		}
@@ -133,10 +136,10 @@ func (tun *NativeTun) routineRouteListener(tunIfindex int) {
 		statusUp = up
 
 		// MTU changes
-		if iface.MTU != statusMTU {
+		if mtu != statusMTU {
 			tun.events <- EventMTUUpdate
 		}
-		statusMTU = iface.MTU
+		statusMTU = mtu
 	}
 }
 
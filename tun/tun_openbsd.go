@@ -109,6 +109,26 @@ func errorIsEBUSY(err error) bool {
 	return false
 }
 
+/* Opens the first unused /dev/tunN, in the same spirit as the
+ * kernel picking a unit for "utun" on macOS. The search ends at
+ * the first missing device node, as created by MAKEDEV(8).
+ */
+func openFreeTUN() (*os.File, error) {
+	for ifIndex := 0; ; ifIndex += 1 {
+		tunfile, err := os.OpenFile(fmt.Sprintf("/dev/tun%d", ifIndex), unix.O_RDWR, 0)
+		if err == nil {
+			return tunfile, nil
+		}
+		if errorIsEBUSY(err) {
+			continue
+		}
+		if os.IsNotExist(err) && ifIndex > 0 {
+			return nil, fmt.Errorf("no free tun device among /dev/tun0-%d", ifIndex-1)
+		}
+		return nil, err
+	}
+}
+
 func CreateTUN(name string, mtu int) (Device, error) {
 	ifIndex := -1
 	if name != "tun" {
@@ -124,12 +144,7 @@ func CreateTUN(name string, mtu int) (Device, error) {
 	if ifIndex != -1 {
 		tunfile, err = os.OpenFile(fmt.Sprintf("/dev/tun%d", ifIndex), unix.O_RDWR, 0)
 	} else {
-		for ifIndex = 0; ifIndex < 256; ifIndex += 1 {
-			tunfile, err = os.OpenFile(fmt.Sprintf("/dev/tun%d", ifIndex), unix.O_RDWR, 0)
-			if err == nil || !errorIsEBUSY(err) {
-				break
-			}
-		}
+		tunfile, err = openFreeTUN()
 	}
 
 	if err != nil {
@@ -131,6 +131,15 @@ func (tun *NativeTun) Close() error {
 	return err
 }
 
+// SetLinkUp only accepts bringing the link up: Wintun adapters are up
+// while the device is open, and disabling one would tear down its rings.
+func (tun *NativeTun) SetLinkUp(up bool) error {
+	if up {
+		return nil
+	}
+	return errors.New("bringing Wintun adapters down is not supported")
+}
+
 func (tun *NativeTun) MTU() (int, error) {
 	return tun.forcedMTU, nil
 }
@@ -194,11 +203,12 @@ retry:
 		return 0, errors.New("incomplete packet in send ring")
 	}
 
-	copy(buff[offset:], packet.Data[:packet.Size])
+	// like other TUN devices, truncate packets exceeding the buffer
+	n := copy(buff[offset:], packet.Data[:packet.Size])
 	buffHead = tun.rings.Send.Ring.Wrap(buffHead + alignedPacketSize)
 	atomic.StoreUint32(&tun.rings.Send.Ring.Head, buffHead)
 	tun.rate.update(uint64(packet.Size))
-	return int(packet.Size), nil
+	return n, nil
 }
 
 func (tun *NativeTun) Flush() error {
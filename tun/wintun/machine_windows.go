@@ -0,0 +1,65 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package wintun
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	modkernel32         = windows.NewLazySystemDLL("kernel32.dll")
+	procIsWow64Process2 = modkernel32.NewProc("IsWow64Process2")
+)
+
+const (
+	imageFileMachineUnknown = 0
+	imageFileMachineI386    = 0x014c
+	imageFileMachineAMD64   = 0x8664
+	imageFileMachineARMNT   = 0x01c4
+	imageFileMachineARM64   = 0xaa64
+)
+
+func machineName(machine uint16) string {
+	switch machine {
+	case imageFileMachineI386:
+		return "x86"
+	case imageFileMachineAMD64:
+		return "amd64"
+	case imageFileMachineARMNT:
+		return "arm"
+	case imageFileMachineARM64:
+		return "arm64"
+	}
+	return fmt.Sprintf("0x%04x", machine)
+}
+
+// checkNativeMachine returns an error if the process runs emulated, for
+// example as amd64 or x86 on Windows on ARM64. SetupAPI refuses to install
+// devices from emulated processes, and the driver store only holds the Wintun
+// driver of the native architecture, so the process must match it.
+// Windows versions predating IsWow64Process2 lack ARM64 support, so the check
+// is skipped there.
+func checkNativeMachine() error {
+	if procIsWow64Process2.Find() != nil {
+		return nil
+	}
+	process, err := windows.GetCurrentProcess()
+	if err != nil {
+		return err
+	}
+	var processMachine, nativeMachine uint16
+	r1, _, e1 := procIsWow64Process2.Call(uintptr(process), uintptr(unsafe.Pointer(&processMachine)), uintptr(unsafe.Pointer(&nativeMachine)))
+	if r1 == 0 {
+		return fmt.Errorf("IsWow64Process2 failed: %v", e1)
+	}
+	if processMachine != imageFileMachineUnknown {
+		return fmt.Errorf("process runs emulated as %s on %s, use the native %s build", machineName(processMachine), machineName(nativeMachine), machineName(nativeMachine))
+	}
+	return nil
+}
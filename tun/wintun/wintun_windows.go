@@ -196,6 +196,11 @@ func (pool Pool) GetInterface(ifname string) (*Interface, error) {
 // interesting complications with its usage. This function returns the network
 // interface ID and a flag if reboot is required.
 func (pool Pool) CreateInterface(ifname string, requestedGUID *windows.GUID) (wintun *Interface, rebootRequired bool, err error) {
+	err = checkNativeMachine()
+	if err != nil {
+		return
+	}
+
 	mutex, err := pool.takeNameMutex()
 	if err != nil {
 		return
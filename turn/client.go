@@ -0,0 +1,406 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+/* Package turn implements a minimal TURN client (RFC 5766) over UDP,
+ * sufficient to allocate a relayed transport address and exchange
+ * datagrams with peers through it using Send and Data indications.
+ *
+ * Only messages from the server are accepted, and responses to
+ * authenticated requests must carry a valid MESSAGE-INTEGRITY, except
+ * for the challenges renewing the nonce. Permissions are created in the
+ * background, so sending never waits for the server: the last datagram
+ * to an address without permission is held until it is installed.
+ */
+package turn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultLifetime    = 10 * time.Minute
+	PermissionLifetime = 5 * time.Minute
+	requestTimeout     = 500 * time.Millisecond
+	requestAttempts    = 5
+	dataQueueSize      = 256
+)
+
+var ErrClosed = errors.New("turn client closed")
+
+type datagram struct {
+	data []byte
+	addr *net.UDPAddr
+}
+
+type permission struct {
+	expiry   time.Time // on the server
+	creating bool
+	pending  *datagram // held until the permission is installed
+}
+
+/* A Client holds an allocation on a TURN server
+ */
+type Client struct {
+	conn     *net.UDPConn
+	server   *net.UDPAddr
+	username string
+	password string
+	relayed  *net.UDPAddr
+	mapped   *net.UDPAddr
+	data     chan datagram
+	closed   chan struct{}
+	closing  sync.Once
+
+	sync.Mutex
+	realm        string
+	nonce        []byte
+	key          []byte
+	transactions map[transactionID]chan *message
+	permissions  map[string]*permission
+}
+
+/* Allocates a relayed address on the server at address ("host:port"),
+ * authenticating with the long-term credentials
+ */
+func Dial(address, username, password string) (*Client, error) {
+	server, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &Client{
+		conn:         conn,
+		server:       server,
+		username:     username,
+		password:     password,
+		data:         make(chan datagram, dataQueueSize),
+		closed:       make(chan struct{}),
+		transactions: make(map[transactionID]chan *message),
+		permissions:  make(map[string]*permission),
+	}
+	go client.routineRead()
+
+	lifetime, err := client.allocate()
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	go client.routineRefresh(lifetime)
+
+	return client, nil
+}
+
+/* The relayed transport address, at which peers reach the client
+ */
+func (client *Client) RelayedAddr() *net.UDPAddr {
+	client.Lock()
+	defer client.Unlock()
+	return client.relayed
+}
+
+/* The server reflexive address of the client, as seen by the server
+ */
+func (client *Client) MappedAddr() *net.UDPAddr {
+	client.Lock()
+	defer client.Unlock()
+	return client.mapped
+}
+
+func (client *Client) fromServer(addr *net.UDPAddr) bool {
+	return addr.Port == client.server.Port && addr.IP.Equal(client.server.IP)
+}
+
+func (client *Client) routineRead() {
+	buff := make([]byte, 65536)
+	for {
+		size, addr, err := client.conn.ReadFromUDP(buff)
+		if err != nil {
+			select {
+			case <-client.closed:
+				close(client.data)
+				return
+			default:
+				continue
+			}
+		}
+
+		if !client.fromServer(addr) {
+			continue
+		}
+
+		msg, err := decodeMessage(append([]byte(nil), buff[:size]...))
+		if err != nil {
+			continue
+		}
+
+		// data indication from a peer
+
+		if msg.typ == methodData|classIndication {
+			addr, err := decodeXorAddress(msg.get(attrXorPeerAddress), msg.id)
+			data := msg.get(attrData)
+			if err != nil || data == nil {
+				continue
+			}
+			select {
+			case client.data <- datagram{data, addr}:
+			default:
+			}
+			continue
+		}
+
+		// response to a pending request
+
+		client.Lock()
+		pending, ok := client.transactions[msg.id]
+		client.Unlock()
+		if ok {
+			select {
+			case pending <- msg:
+			default:
+			}
+		}
+	}
+}
+
+/* Sends an authenticated request, retransmitting until a response arrives.
+ * Challenges for (new) credentials are answered once.
+ */
+func (client *Client) request(method uint16, build func(msg *message)) (*message, error) {
+	for challenge := 0; challenge < 2; challenge++ {
+		msg := newMessage(method, classRequest)
+		if build != nil {
+			build(msg)
+		}
+
+		client.Lock()
+		var packet []byte
+		key := client.key
+		if key != nil {
+			msg.add(attrUsername, []byte(client.username))
+			msg.add(attrRealm, []byte(client.realm))
+			msg.add(attrNonce, client.nonce)
+			packet = msg.encodeWithIntegrity(client.key)
+		} else {
+			packet = msg.encode()
+		}
+		pending := make(chan *message, 1)
+		client.transactions[msg.id] = pending
+		client.Unlock()
+
+		resp, err := client.roundTrip(packet, pending)
+
+		client.Lock()
+		delete(client.transactions, msg.id)
+		client.Unlock()
+
+		if err != nil {
+			return nil, err
+		}
+
+		// 401 unauthorized or 438 stale nonce carry a new challenge,
+		// any other response to an authenticated request is signed
+
+		code := decodeErrorCode(resp.get(attrErrorCode))
+		challenged := resp.class() == classError && (code == 401 || code == 438)
+		if key != nil && !challenged && !resp.verifyIntegrity(key) {
+			return nil, errors.New("turn response failed authentication")
+		}
+		if resp.class() == classSuccess {
+			return resp, nil
+		}
+		if !challenged {
+			return nil, fmt.Errorf("turn request failed with error %d", code)
+		}
+		client.Lock()
+		if realm := resp.get(attrRealm); realm != nil {
+			client.realm = string(realm)
+		}
+		client.nonce = append([]byte(nil), resp.get(attrNonce)...)
+		client.key = longTermKey(client.username, client.realm, client.password)
+		client.Unlock()
+	}
+	return nil, errors.New("turn authentication failed")
+}
+
+func (client *Client) roundTrip(packet []byte, pending chan *message) (*message, error) {
+	timeout := requestTimeout
+	for attempt := 0; attempt < requestAttempts; attempt++ {
+		if _, err := client.conn.WriteToUDP(packet, client.server); err != nil {
+			return nil, err
+		}
+		select {
+		case resp := <-pending:
+			return resp, nil
+		case <-client.closed:
+			return nil, ErrClosed
+		case <-time.After(timeout):
+			timeout *= 2
+		}
+	}
+	return nil, errors.New("turn request timed out")
+}
+
+func lifetimeValue(lifetime time.Duration) []byte {
+	value := make([]byte, 4)
+	binary.BigEndian.PutUint32(value, uint32(lifetime/time.Second))
+	return value
+}
+
+func lifetimeOf(resp *message) time.Duration {
+	if value := resp.get(attrLifetime); len(value) == 4 {
+		return time.Duration(binary.BigEndian.Uint32(value)) * time.Second
+	}
+	return DefaultLifetime
+}
+
+func (client *Client) allocate() (time.Duration, error) {
+	resp, err := client.request(methodAllocate, func(msg *message) {
+		msg.add(attrRequestedTransport, []byte{transportUDP, 0, 0, 0})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	relayed, err := decodeXorAddress(resp.get(attrXorRelayedAddress), resp.id)
+	if err != nil {
+		return 0, err
+	}
+	mapped, _ := decodeXorAddress(resp.get(attrXorMappedAddress), resp.id)
+
+	client.Lock()
+	client.relayed, client.mapped = relayed, mapped
+	client.Unlock()
+
+	return lifetimeOf(resp), nil
+}
+
+func (client *Client) routineRefresh(lifetime time.Duration) {
+	for {
+		wait := lifetime - time.Minute
+		if wait < lifetime/2 {
+			wait = lifetime / 2
+		}
+		select {
+		case <-client.closed:
+			return
+		case <-time.After(wait):
+		}
+
+		resp, err := client.request(methodRefresh, func(msg *message) {
+			msg.add(attrLifetime, lifetimeValue(DefaultLifetime))
+		})
+		if err != nil {
+			continue
+		}
+		lifetime = lifetimeOf(resp)
+	}
+}
+
+/* Creates or refreshes the permission for the IP address of addr,
+ * then sends the datagram held for it, if any
+ */
+func (client *Client) routinePermit(key string, addr *net.UDPAddr) {
+	_, err := client.request(methodCreatePermission, func(msg *message) {
+		msg.add(attrXorPeerAddress, encodeXorAddress(addr, msg.id))
+	})
+
+	client.Lock()
+	perm := client.permissions[key]
+	perm.creating = false
+	if err == nil {
+		perm.expiry = time.Now().Add(PermissionLifetime)
+	}
+	pending := perm.pending
+	perm.pending = nil
+	client.Unlock()
+
+	if err == nil && pending != nil {
+		client.send(pending.data, pending.addr)
+	}
+}
+
+func (client *Client) send(buff []byte, addr *net.UDPAddr) error {
+	msg := newMessage(methodSend, classIndication)
+	msg.add(attrXorPeerAddress, encodeXorAddress(addr, msg.id))
+	msg.add(attrData, buff)
+	_, err := client.conn.WriteToUDP(msg.encode(), client.server)
+	return err
+}
+
+/* Sends a datagram to addr through the relayed address. Without a
+ * permission for addr, the datagram is held until one is created.
+ */
+func (client *Client) WriteTo(buff []byte, addr *net.UDPAddr) error {
+	key := addr.IP.String()
+	now := time.Now()
+
+	client.Lock()
+	perm, ok := client.permissions[key]
+	if !ok {
+		perm = &permission{}
+		client.permissions[key] = perm
+	}
+	valid := now.Before(perm.expiry)
+	if !perm.creating && now.After(perm.expiry.Add(-time.Minute)) {
+		perm.creating = true
+		go client.routinePermit(key, addr)
+	}
+	if !valid {
+		perm.pending = &datagram{append([]byte(nil), buff...), addr}
+	}
+	client.Unlock()
+
+	if !valid {
+		return nil
+	}
+	return client.send(buff, addr)
+}
+
+/* Receives the next datagram sent to the relayed address
+ */
+func (client *Client) ReadFrom(buff []byte) (int, *net.UDPAddr, error) {
+	packet, ok := <-client.data
+	if !ok {
+		return 0, nil, ErrClosed
+	}
+	return copy(buff, packet.data), packet.addr, nil
+}
+
+/* Releases the allocation and closes the client
+ */
+func (client *Client) Close() error {
+	var err error
+	client.closing.Do(func() {
+		client.release()
+		close(client.closed)
+		err = client.conn.Close()
+	})
+	return err
+}
+
+/* Releases the allocation on a best effort basis,
+ * without awaiting the response
+ */
+func (client *Client) release() {
+	client.Lock()
+	if client.relayed != nil && client.key != nil {
+		msg := newMessage(methodRefresh, classRequest)
+		msg.add(attrLifetime, lifetimeValue(0))
+		msg.add(attrUsername, []byte(client.username))
+		msg.add(attrRealm, []byte(client.realm))
+		msg.add(attrNonce, client.nonce)
+		client.conn.WriteToUDP(msg.encodeWithIntegrity(client.key), client.server)
+	}
+	client.Unlock()
+}
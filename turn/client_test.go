@@ -0,0 +1,175 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package turn
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestXorAddress(t *testing.T) {
+	id := newMessage(0, 0).id
+	for _, addr := range []*net.UDPAddr{
+		{IP: net.IPv4(192, 0, 2, 1).To4(), Port: 51820},
+		{IP: net.ParseIP("2001:db8::1"), Port: 3478},
+	} {
+		decoded, err := decodeXorAddress(encodeXorAddress(addr, id), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !decoded.IP.Equal(addr.IP) || decoded.Port != addr.Port {
+			t.Errorf("round trip of %v: got %v", addr, decoded)
+		}
+	}
+}
+
+/* A fake TURN server which challenges once, then relays
+ * Send indications back to the client as Data indications.
+ * Responses are signed with the password given.
+ */
+func fakeServer(t *testing.T, conn *net.UDPConn, relayed *net.UDPAddr, password string) {
+	key := longTermKey("user", "example.org", "pass")
+	signKey := longTermKey("user", "example.org", password)
+	buff := make([]byte, 65536)
+	for {
+		size, addr, err := conn.ReadFromUDP(buff)
+		if err != nil {
+			return
+		}
+		req, err := decodeMessage(buff[:size])
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if req.class() == classIndication {
+			peer, _ := decodeXorAddress(req.get(attrXorPeerAddress), req.id)
+			data := newMessage(methodData, classIndication)
+			data.add(attrXorPeerAddress, encodeXorAddress(peer, data.id))
+			data.add(attrData, req.get(attrData))
+			conn.WriteToUDP(data.encode(), addr)
+			continue
+		}
+
+		var resp []byte
+		if integrity := req.get(attrMessageIntegrity); integrity == nil {
+			challenge := &message{typ: req.method() | classError, id: req.id}
+			challenge.add(attrErrorCode, []byte{0, 0, 4, 1})
+			challenge.add(attrRealm, []byte("example.org"))
+			challenge.add(attrNonce, []byte("nonce"))
+			resp = challenge.encode()
+		} else {
+			// verify integrity over the message preceding the attribute
+
+			signed := append([]byte(nil), buff[:size-4-sha1.Size]...)
+			binary.BigEndian.PutUint16(signed[2:4], uint16(size-headerSize))
+			mac := hmac.New(sha1.New, key)
+			mac.Write(signed)
+			if !hmac.Equal(mac.Sum(nil), integrity) {
+				t.Error("invalid message integrity")
+				return
+			}
+			success := &message{typ: req.method() | classSuccess, id: req.id}
+			if req.method() == methodAllocate {
+				success.add(attrXorRelayedAddress, encodeXorAddress(relayed, req.id))
+				success.add(attrXorMappedAddress, encodeXorAddress(addr, req.id))
+			}
+			resp = success.encodeWithIntegrity(signKey)
+		}
+		conn.WriteToUDP(resp, addr)
+	}
+}
+
+func TestClient(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	relayed := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 7).To4(), Port: 49152}
+	go fakeServer(t, conn, relayed, "pass")
+
+	client, err := Dial(conn.LocalAddr().String(), "user", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if !client.RelayedAddr().IP.Equal(relayed.IP) || client.RelayedAddr().Port != relayed.Port {
+		t.Fatalf("unexpected relayed address %v", client.RelayedAddr())
+	}
+
+	peer := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 5).To4(), Port: 51820}
+	packet := []byte("datagram through turn")
+	if err := client.WriteTo(packet, peer); err != nil {
+		t.Fatal(err)
+	}
+
+	// data indications from others than the server are ignored
+
+	other, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	forged := newMessage(methodData, classIndication)
+	forged.add(attrXorPeerAddress, encodeXorAddress(peer, forged.id))
+	forged.add(attrData, []byte("forged"))
+	other.WriteToUDP(forged.encode(), client.conn.LocalAddr().(*net.UDPAddr))
+
+	var buff [1500]byte
+	size, from, err := client.ReadFrom(buff[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buff[:size], packet) || !from.IP.Equal(peer.IP) || from.Port != peer.Port {
+		t.Fatalf("received %q from %v", buff[:size], from)
+	}
+}
+
+func TestClientIntegrity(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	relayed := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 7).To4(), Port: 49152}
+	go fakeServer(t, conn, relayed, "wrong")
+
+	if client, err := Dial(conn.LocalAddr().String(), "user", "pass"); err == nil {
+		client.Close()
+		t.Fatal("accepted allocation without valid message integrity")
+	}
+}
+
+func TestBinding(t *testing.T) {
+	id, packet := NewBindingRequest()
+	if !IsMessage(packet) {
+		t.Fatal("binding request not recognized as STUN message")
+	}
+
+	req, err := decodeMessage(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapped := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 9).To4(), Port: 40000}
+	resp := &message{typ: methodBinding | classSuccess, id: req.id}
+	resp.add(attrXorMappedAddress, encodeXorAddress(mapped, req.id))
+
+	respID, addr, err := ParseBindingResponse(resp.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if respID != id || !addr.IP.Equal(mapped.IP) || addr.Port != mapped.Port {
+		t.Fatalf("unexpected binding response %x %v", respID, addr)
+	}
+}
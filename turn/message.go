@@ -0,0 +1,235 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package turn
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+/* STUN message encoding (RFC 5389), limited to what TURN requires
+ */
+
+const (
+	headerSize  = 20
+	magicCookie = 0x2112A442
+
+	classRequest    = 0x0000
+	classIndication = 0x0010
+	classSuccess    = 0x0100
+	classError      = 0x0110
+	classMask       = 0x0110
+
+	methodBinding          = 0x001
+	methodAllocate         = 0x003
+	methodRefresh          = 0x004
+	methodSend             = 0x006
+	methodData             = 0x007
+	methodCreatePermission = 0x008
+
+	attrUsername           = 0x0006
+	attrMessageIntegrity   = 0x0008
+	attrErrorCode          = 0x0009
+	attrLifetime           = 0x000D
+	attrXorPeerAddress     = 0x0012
+	attrData               = 0x0013
+	attrRealm              = 0x0014
+	attrNonce              = 0x0015
+	attrXorRelayedAddress  = 0x0016
+	attrRequestedTransport = 0x0019
+	attrXorMappedAddress   = 0x0020
+
+	transportUDP = 17
+)
+
+var errMalformed = errors.New("malformed STUN message")
+
+type transactionID [12]byte
+
+type attribute struct {
+	typ   uint16
+	value []byte
+}
+
+type message struct {
+	typ        uint16 // method and class
+	id         transactionID
+	attributes []attribute
+	raw        []byte // when decoded
+	integrity  int    // offset of MESSAGE-INTEGRITY in raw, if present
+}
+
+func newMessage(method, class uint16) *message {
+	msg := &message{typ: method | class}
+	rand.Read(msg.id[:])
+	return msg
+}
+
+func (msg *message) method() uint16 {
+	return msg.typ &^ classMask
+}
+
+func (msg *message) class() uint16 {
+	return msg.typ & classMask
+}
+
+func (msg *message) add(typ uint16, value []byte) {
+	msg.attributes = append(msg.attributes, attribute{typ, value})
+}
+
+func (msg *message) get(typ uint16) []byte {
+	for _, attr := range msg.attributes {
+		if attr.typ == typ {
+			return attr.value
+		}
+	}
+	return nil
+}
+
+func (msg *message) encode() []byte {
+	buff := make([]byte, headerSize, 128)
+	binary.BigEndian.PutUint16(buff[0:2], msg.typ)
+	binary.BigEndian.PutUint32(buff[4:8], magicCookie)
+	copy(buff[8:20], msg.id[:])
+	for _, attr := range msg.attributes {
+		buff = appendAttribute(buff, attr.typ, attr.value)
+	}
+	binary.BigEndian.PutUint16(buff[2:4], uint16(len(buff)-headerSize))
+	return buff
+}
+
+func appendAttribute(buff []byte, typ uint16, value []byte) []byte {
+	var header [4]byte
+	binary.BigEndian.PutUint16(header[0:2], typ)
+	binary.BigEndian.PutUint16(header[2:4], uint16(len(value)))
+	buff = append(buff, header[:]...)
+	buff = append(buff, value...)
+	for len(buff)%4 != 0 {
+		buff = append(buff, 0)
+	}
+	return buff
+}
+
+/* Encodes the message with a MESSAGE-INTEGRITY attribute appended
+ */
+func (msg *message) encodeWithIntegrity(key []byte) []byte {
+	buff := msg.encode()
+
+	// length covers the integrity attribute while computing the mac
+
+	binary.BigEndian.PutUint16(buff[2:4], uint16(len(buff)-headerSize+4+sha1.Size))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(buff)
+	return appendAttribute(buff, attrMessageIntegrity, mac.Sum(nil))
+}
+
+func isMessage(buff []byte) bool {
+	return len(buff) >= headerSize && buff[0]&0xc0 == 0 && binary.BigEndian.Uint32(buff[4:8]) == magicCookie
+}
+
+func decodeMessage(buff []byte) (*message, error) {
+	if !isMessage(buff) {
+		return nil, errMalformed
+	}
+	size := int(binary.BigEndian.Uint16(buff[2:4]))
+	if headerSize+size > len(buff) {
+		return nil, errMalformed
+	}
+	msg := &message{typ: binary.BigEndian.Uint16(buff[0:2]), raw: buff}
+	copy(msg.id[:], buff[8:20])
+
+	attrs := buff[headerSize : headerSize+size]
+	for len(attrs) >= 4 {
+		typ := binary.BigEndian.Uint16(attrs[0:2])
+		length := int(binary.BigEndian.Uint16(attrs[2:4]))
+		if 4+length > len(attrs) {
+			return nil, errMalformed
+		}
+		if typ == attrMessageIntegrity && msg.integrity == 0 {
+			msg.integrity = headerSize + size - len(attrs)
+		}
+		msg.add(typ, attrs[4:4+length])
+		padded := (4 + length + 3) &^ 3
+		if padded > len(attrs) {
+			break
+		}
+		attrs = attrs[padded:]
+	}
+	return msg, nil
+}
+
+/* Checks the MESSAGE-INTEGRITY of a decoded message, which covers
+ * everything preceding it with the length including the attribute
+ */
+func (msg *message) verifyIntegrity(key []byte) bool {
+	if msg.integrity == 0 || msg.integrity+4+sha1.Size > len(msg.raw) {
+		return false
+	}
+	signed := append([]byte(nil), msg.raw[:msg.integrity]...)
+	binary.BigEndian.PutUint16(signed[2:4], uint16(msg.integrity-headerSize+4+sha1.Size))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(signed)
+	return hmac.Equal(mac.Sum(nil), msg.raw[msg.integrity+4:msg.integrity+4+sha1.Size])
+}
+
+/* Long-term credential key (RFC 5389, section 15.4)
+ */
+func longTermKey(username, realm, password string) []byte {
+	sum := md5.Sum([]byte(username + ":" + realm + ":" + password))
+	return sum[:]
+}
+
+func encodeXorAddress(addr *net.UDPAddr, id transactionID) []byte {
+	ip := addr.IP.To4()
+	family := byte(0x01)
+	if ip == nil {
+		ip = addr.IP.To16()
+		family = 0x02
+	}
+	value := make([]byte, 4+len(ip))
+	value[1] = family
+	binary.BigEndian.PutUint16(value[2:4], uint16(addr.Port)^(magicCookie>>16))
+	xorAddress(value[4:], ip, id)
+	return value
+}
+
+func decodeXorAddress(value []byte, id transactionID) (*net.UDPAddr, error) {
+	if len(value) < 8 {
+		return nil, errMalformed
+	}
+	size := net.IPv4len
+	if value[1] == 0x02 {
+		size = net.IPv6len
+	}
+	if len(value) < 4+size {
+		return nil, errMalformed
+	}
+	ip := make(net.IP, size)
+	xorAddress(ip, value[4:4+size], id)
+	port := binary.BigEndian.Uint16(value[2:4]) ^ (magicCookie >> 16)
+	return &net.UDPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func xorAddress(dst, src []byte, id transactionID) {
+	var mask [16]byte
+	binary.BigEndian.PutUint32(mask[0:4], magicCookie)
+	copy(mask[4:], id[:])
+	for i := range src {
+		dst[i] = src[i] ^ mask[i]
+	}
+}
+
+func decodeErrorCode(value []byte) int {
+	if len(value) < 4 {
+		return 0
+	}
+	return int(value[2]&0x7)*100 + int(value[3])
+}
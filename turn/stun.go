@@ -0,0 +1,45 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package turn
+
+import (
+	"errors"
+	"net"
+)
+
+/* STUN binding (RFC 5389), for discovering the server reflexive
+ * address of a socket owned by the caller. Requests need no
+ * credentials and are sent and received by the caller, so that
+ * the mapping discovered is the one of its own socket.
+ */
+
+type TransactionID transactionID
+
+/* Reports whether packet looks like a STUN message
+ */
+func IsMessage(packet []byte) bool {
+	return isMessage(packet)
+}
+
+func NewBindingRequest() (TransactionID, []byte) {
+	msg := newMessage(methodBinding, classRequest)
+	return TransactionID(msg.id), msg.encode()
+}
+
+/* Returns the transaction and the server reflexive address
+ * from a successful binding response
+ */
+func ParseBindingResponse(packet []byte) (TransactionID, *net.UDPAddr, error) {
+	msg, err := decodeMessage(packet)
+	if err != nil {
+		return TransactionID{}, nil, err
+	}
+	if msg.typ != methodBinding|classSuccess {
+		return TransactionID(msg.id), nil, errors.New("not a binding success response")
+	}
+	addr, err := decodeXorAddress(msg.get(attrXorMappedAddress), msg.id)
+	return TransactionID(msg.id), addr, err
+}